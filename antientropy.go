@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Keys are spread over the leaves of the Merkle tree by the first
+// merkleDepth hex digits of their hash, so every node has 16 children and
+// the tree has 16^merkleDepth leaves
+const merkleDepth = 3
+const merkleFanout = 16
+
+var ErrWrongShard = errors.New("node is on a different shard")
+var ErrAntiEntropyOff = errors.New("anti-entropy only runs with causal replication")
+
+// The state of one key on a replica, as anti-entropy compares it: the entry
+// if the key exists, otherwise the delete that removed it (Entry is nil).
+// Hash covers all of it, so equal hashes mean equal copies
+type SyncItem struct {
+	Entry   *KeyEntry `json:"entry,omitempty"`
+	Version int64     `json:"version"`
+	Hash    string    `json:"hash"`
+}
+
+// The body of every /rep/anti-entropy request
+type AntiEntropyRequest struct {
+	ShardId  int                 `json:"shard-id"`
+	Prefixes []string            `json:"prefixes,omitempty"` // of the tree nodes wanted
+	Items    map[string]SyncItem `json:"items,omitempty"`    // repairs, by key
+	From     string              `json:"from,omitempty"`     // the replica the repairs were copied from
+	Metadata map[string]int      `json:"causal-metadata,omitempty"`
+
+	// repairs sent by a read that found the replica behind
+	ReadRepair bool `json:"read-repair,omitempty"`
+}
+
+// Digests of a shard's keys by hash range. Each node is named by the hash
+// prefix its keys share, "" being the root
+type MerkleTree struct {
+	hashes map[string]string
+	leaves map[string]map[string]string // item hashes by key
+}
+
+// The Merkle tree of this node's shard, kept from one exchange to the next.
+// Keys that change are only noted, and hashed again the next time the tree
+// is read, along with the tree nodes above them
+type merkleCache struct {
+	tree    *MerkleTree
+	ring    *Ring
+	shardId int
+	dirty   map[string]struct{}
+}
+
+func newSyncItem(key string, entry *KeyEntry, version int64) SyncItem {
+	h := sha256.New()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	if entry != nil {
+		encoded, _ := json.Marshal(entry)
+		h.Write(encoded)
+	} else {
+		h.Write([]byte("deleted " + strconv.FormatInt(version, 10)))
+	}
+	return SyncItem{Entry: entry, Version: version, Hash: hex.EncodeToString(h.Sum(nil))}
+}
+
+// Returns true if item should replace other: the later version, with ties
+// between concurrent writes broken the same way on every replica
+func (item SyncItem) newerThan(other SyncItem) bool {
+	return item.Version > other.Version || (item.Version == other.Version && item.Hash > other.Hash)
+}
+
+// Returns true if both items hold the same type of crdt, which merge
+// instead of one replacing the other
+func sameCrdt(a, b SyncItem) bool {
+	return a.Entry != nil && b.Entry != nil && a.Entry.CrdtType() != "" && a.Entry.CrdtType() == b.Entry.CrdtType()
+}
+
+// Returns the leaf of the tree key falls in
+func merkleLeaf(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:merkleDepth]
+}
+
+func merkleChildren(prefix string) []string {
+	children := make([]string, merkleFanout)
+	for i := range children {
+		children[i] = prefix + strconv.FormatInt(int64(i), merkleFanout)
+	}
+	return children
+}
+
+func buildMerkleTree(items map[string]SyncItem) *MerkleTree {
+	tree := &MerkleTree{hashes: make(map[string]string), leaves: make(map[string]map[string]string)}
+	for key, item := range items {
+		tree.set(key, item.Hash)
+	}
+	tree.hash("")
+	return tree
+}
+
+// Sets the hash of key's item, or removes key if hash is empty. Its leaf
+// and the nodes above it have to be hashed again after
+func (tree *MerkleTree) set(key string, hash string) {
+	leaf := merkleLeaf(key)
+	if hash == "" {
+		delete(tree.leaves[leaf], key)
+		return
+	}
+	if tree.leaves[leaf] == nil {
+		tree.leaves[leaf] = make(map[string]string)
+	}
+	tree.leaves[leaf][key] = hash
+}
+
+// Fills in the hashes of prefix and everything below it
+func (tree *MerkleTree) hash(prefix string) {
+	if len(prefix) < merkleDepth {
+		for _, child := range merkleChildren(prefix) {
+			tree.hash(child)
+		}
+	}
+	tree.hashNode(prefix)
+}
+
+// Hashes the given leaves again, and every node above them
+func (tree *MerkleTree) rehash(leaves map[string]struct{}) {
+	prefixes := leaves
+	for depth := merkleDepth; depth >= 0; depth-- {
+		parents := make(map[string]struct{})
+		for prefix := range prefixes {
+			tree.hashNode(prefix)
+			if depth > 0 {
+				parents[prefix[:depth-1]] = struct{}{}
+			}
+		}
+		prefixes = parents
+	}
+}
+
+// Works out the hash of prefix alone. A leaf hashes its items in key
+// order, every other node the hashes of its children
+func (tree *MerkleTree) hashNode(prefix string) {
+	h := sha256.New()
+	if len(prefix) == merkleDepth {
+		items := tree.leaves[prefix]
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h.Write([]byte(items[key]))
+		}
+	} else {
+		for _, child := range merkleChildren(prefix) {
+			h.Write([]byte(tree.hashes[child]))
+		}
+	}
+	tree.hashes[prefix] = hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the hashes of the children of each prefix, in order
+func childHashes(hashes map[string]string, prefixes []string) (map[string][]string, error) {
+	children := make(map[string][]string, len(prefixes))
+	for _, prefix := range prefixes {
+		if _, exists := hashes[prefix]; !exists || len(prefix) == merkleDepth {
+			return nil, fmt.Errorf("no inner tree node %q", prefix)
+		}
+		for _, child := range merkleChildren(prefix) {
+			children[prefix] = append(children[prefix], hashes[child])
+		}
+	}
+	return children, nil
+}
+
+/// --- kvs ---
+
+// Returns the digests of every node of this node's Merkle tree, and the
+// clock they were taken at
+func (kvs *KeyValStoreDatabase) MerkleHashes() (hashes map[string]string, metadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	tree, err := kvs.merkleTree()
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes = make(map[string]string, len(tree.hashes))
+	for prefix, hash := range tree.hashes {
+		hashes[prefix] = hash
+	}
+	return hashes, kvs.copyMetadata(), nil
+}
+
+// Returns the state of every key in the given leaves of this node's
+// Merkle tree
+func (kvs *KeyValStoreDatabase) LeafItems(leaves []string) (map[string]SyncItem, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	tree, err := kvs.merkleTree()
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string]SyncItem)
+	for _, leaf := range leaves {
+		for key := range tree.leaves[leaf] {
+			item, exists, err := kvs.syncItem(key)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				items[key] = item
+			}
+		}
+	}
+	return items, nil
+}
+
+// Returns the Merkle tree of this node's shard, hashing again whatever
+// changed since it was last read. It's built from scratch the first time,
+// and whenever the keys of the shard move. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) merkleTree() (*MerkleTree, error) {
+	cache := &kvs.merkle
+	if cache.tree == nil || cache.ring != ring || cache.shardId != localShardId {
+		items, err := kvs.syncItems()
+		if err != nil {
+			return nil, err
+		}
+		*cache = merkleCache{tree: buildMerkleTree(items), ring: ring, shardId: localShardId, dirty: make(map[string]struct{})}
+		return cache.tree, nil
+	}
+
+	leaves := make(map[string]struct{})
+	for key := range cache.dirty {
+		// a key that's gone has no hash, and leaves the tree
+		item, _, err := kvs.syncItem(key)
+		if err != nil {
+			return nil, err
+		}
+		cache.tree.set(key, item.Hash)
+		leaves[merkleLeaf(key)] = struct{}{}
+	}
+	cache.dirty = make(map[string]struct{})
+	cache.tree.rehash(leaves)
+	return cache.tree, nil
+}
+
+// Notes that key changed, so its hash in the Merkle tree has to be worked
+// out again. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) touchMerkle(key string) {
+	if kvs.merkle.tree != nil {
+		kvs.merkle.dirty[key] = struct{}{}
+	}
+}
+
+// Returns the state of every key of this node's shard. Caller must hold
+// the lock
+func (kvs *KeyValStoreDatabase) syncItems() (map[string]SyncItem, error) {
+	items := make(map[string]SyncItem, kvs.engine.Len())
+	err := kvs.rangeData(func(key string, entry KeyEntry) bool {
+		if ring.GetShardId(key) == localShardId {
+			items[key] = newSyncItem(key, &entry, entry.Version)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for key := range kvs.history {
+		if _, exists := items[key]; exists || ring.GetShardId(key) != localShardId {
+			continue
+		}
+		if item, exists := kvs.tombstone(key); exists {
+			items[key] = item
+		}
+	}
+	return items, nil
+}
+
+// Returns the state of key, if it's on this node's shard and this node has
+// its entry or tombstone. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) syncItem(key string) (SyncItem, bool, error) {
+	if ring.GetShardId(key) != localShardId {
+		return SyncItem{}, false, nil
+	}
+	entry, exists, err := kvs.engine.Get(key)
+	if err != nil {
+		return SyncItem{}, false, err
+	}
+	if exists {
+		return newSyncItem(key, &entry, entry.Version), true, nil
+	}
+	item, exists := kvs.tombstone(key)
+	return item, exists, nil
+}
+
+// Returns the item of a key that's been deleted, if its history still has
+// the delete. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) tombstone(key string) (SyncItem, bool) {
+	history := kvs.history[key]
+	if len(history) == 0 || !history[len(history)-1].Deleted {
+		return SyncItem{}, false
+	}
+	return newSyncItem(key, nil, history[len(history)-1].Version), true
+}
+
+// Returns true if a deleted key leaves a tombstone behind for long enough
+// that a key only one replica has must be a write the other one missed.
+// Tombstones last as long as HistoryRetention, so it has to cover many
+// anti-entropy rounds; a replica out of touch for longer than that can
+// still bring a deleted key back
+func (kvs *KeyValStoreDatabase) KeepsTombstones() bool {
+	retention := kvs.config.HistoryRetention
+	return kvs.config.HistoryVersions > 0 && (retention == 0 || retention >= tombstoneRounds*ANTI_ENTROPY_INTERVAL)
+}
+
+// Anti-entropy rounds a tombstone has to outlast
+const tombstoneRounds = 100
+
+// Replaces this node's copy of key with a replica's copy if that one is
+// newer, or merges the two if they're the same crdt. Repairs don't move
+// any clock, but watchers and the change log see them as coming from the
+// replica from. Returns true if the key changed
+func (kvs *KeyValStoreDatabase) RepairKey(key string, item SyncItem, from string) (bool, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	if kvs.isLocked(key) {
+		return false, ErrKeyLocked
+	}
+	// the hash isn't taken on trust, it decides ties
+	item = newSyncItem(key, item.Entry, item.Version)
+
+	var current SyncItem
+	entry, exists, err := kvs.engine.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		current = newSyncItem(key, &entry, entry.Version)
+	} else {
+		current, exists = kvs.tombstone(key)
+	}
+
+	if exists && sameCrdt(current, item) {
+		// everything but the crdt itself comes from the newer copy, so both
+		// replicas end up with the same entry
+		merged := mergeCrdtEntries(*current.Entry, *item.Entry)
+		if current.newerThan(item) {
+			merged = mergeCrdtEntries(*item.Entry, *current.Entry)
+		}
+		if newSyncItem(key, &merged, merged.Version).Hash == current.Hash {
+			return false, nil
+		}
+		return true, kvs.commit(WalRecord{Op: WalOpPut, Key: key, Entry: &merged, From: from})
+	}
+	if exists && !item.newerThan(current) {
+		return false, nil
+	}
+	if item.Entry == nil {
+		return true, kvs.commit(WalRecord{Op: WalOpDelete, Key: key, Version: item.Version, From: from})
+	}
+	return true, kvs.commit(WalRecord{Op: WalOpPut, Key: key, Entry: item.Entry, From: from})
+}
+
+// Moves this node's clock up to a replica's, once this node holds every
+// write the replica held at that clock. Writes of that replica that are
+// still being retried are then taken as already applied. Watchers see the
+// clock move as a catch-up from the replica from
+func (kvs *KeyValStoreDatabase) CatchUpMetadata(metadata map[string]int, from string) error {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	if !metadataBehind(kvs.Metadata, metadata) {
+		return nil
+	}
+	return kvs.commit(WalRecord{Op: WalOpCatchUp, Metadata: metadata, From: from})
+}
+
+// Returns true if metadata is missing anything other has seen
+func metadataBehind(metadata map[string]int, other map[string]int) bool {
+	for replica, time := range other {
+		if time > metadata[replica] {
+			return true
+		}
+	}
+	return false
+}
+
+/// --- exchanges ---
+
+// Every ANTI_ENTROPY_INTERVAL, compares this node's copy of its shard with
+// a random other replica's and repairs whatever differs on either side. In
+// raft mode the log already keeps the replicas the same
+func runAntiEntropy() {
+	ticker := time.NewTicker(ANTI_ENTROPY_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if kvsDb.Raft() != nil || localShardId < 0 || localShardId >= len(ring.Shards) {
+			continue
+		}
+		replicas := make([]string, 0)
+		for node := range removeLocalAddressFromMap(ring.Shards[localShardId].Replicas) {
+			replicas = append(replicas, node)
+		}
+		if len(replicas) == 0 {
+			continue
+		}
+
+		peer := replicas[rand.Intn(len(replicas))]
+		err := syncWithReplica(peer)
+		if err != nil {
+			log.Printf("anti-entropy with %s failed: %v", peer, err)
+			metrics.Lock()
+			metrics.AntiEntropy.FailedRounds++
+			metrics.Unlock()
+		}
+	}
+}
+
+// One anti-entropy exchange with peer. The trees are compared a level at a
+// time, following only the ranges whose digests differ, down to the keys of
+// the differing leaves. Each differing key is copied from the replica with
+// the newer version (crdts are merged both ways). If every key could be
+// settled, each side ends up with every write the other had when the
+// exchange started, so both clocks catch up to each other
+func syncWithReplica(peer string) error {
+	hashes, metadata, err := kvsDb.MerkleHashes()
+	if err != nil {
+		return err
+	}
+
+	var peerMetadata map[string]int
+	prefixes := []string{""}
+	divergentRanges := 0
+	for depth := 0; depth < merkleDepth && len(prefixes) > 0; depth++ {
+		var res struct {
+			Hashes   map[string][]string `json:"hashes"`
+			Metadata map[string]int      `json:"causal-metadata"`
+		}
+		err = antiEntropyCall(peer, "/rep/anti-entropy/tree", AntiEntropyRequest{ShardId: localShardId, Prefixes: prefixes}, &res)
+		if err != nil {
+			return err
+		}
+		if depth == 0 {
+			peerMetadata = res.Metadata
+		}
+
+		var divergent []string
+		for _, prefix := range prefixes {
+			theirHashes := res.Hashes[prefix]
+			if len(theirHashes) != merkleFanout {
+				return fmt.Errorf("%s sent no digests for %q", peer, prefix)
+			}
+			for i, child := range merkleChildren(prefix) {
+				if hashes[child] != theirHashes[i] {
+					divergent = append(divergent, child)
+				}
+			}
+		}
+		prefixes = divergent
+	}
+	divergentRanges = len(prefixes)
+
+	var theirs map[string]SyncItem
+	if len(prefixes) > 0 {
+		var res struct {
+			Items map[string]SyncItem `json:"items"`
+		}
+		err = antiEntropyCall(peer, "/rep/anti-entropy/keys", AntiEntropyRequest{ShardId: localShardId, Prefixes: prefixes}, &res)
+		if err != nil {
+			return err
+		}
+		theirs = res.Items
+	}
+	ours, err := kvsDb.LeafItems(prefixes)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]struct{}, len(ours)+len(theirs))
+	for key := range ours {
+		keys[key] = struct{}{}
+	}
+	for key := range theirs {
+		keys[key] = struct{}{}
+	}
+
+	divergentKeys, repaired, unresolved := 0, 0, 0
+	pushes := make(map[string]SyncItem)
+	for key := range keys {
+		ourItem, haveOurs := ours[key]
+		theirItem, haveTheirs := theirs[key]
+		if haveOurs && haveTheirs && ourItem.Hash == theirItem.Hash {
+			continue
+		}
+		divergentKeys++
+
+		pull, push := resolveDivergence(ourItem, haveOurs, theirItem, haveTheirs)
+		if !pull && !push {
+			unresolved++
+			continue
+		}
+		if pull {
+			changed, err := kvsDb.RepairKey(key, theirItem, peer)
+			if err == ErrKeyLocked {
+				unresolved++
+				continue
+			} else if err != nil {
+				return err
+			}
+			if changed {
+				repaired++
+			}
+		}
+		if push {
+			pushes[key] = ourItem
+		}
+	}
+
+	// the clocks only catch up once nothing was left unsettled
+	complete := unresolved == 0
+	var catchUp map[string]int
+	if complete && metadataBehind(peerMetadata, metadata) {
+		catchUp = metadata
+	}
+	pushed, err := pushRepairs(peer, AntiEntropyRequest{ShardId: localShardId, Items: pushes, From: localAddress, Metadata: catchUp})
+	if err != nil {
+		return err
+	}
+	if complete {
+		err = kvsDb.CatchUpMetadata(peerMetadata, peer)
+		if err != nil {
+			return err
+		}
+	}
+
+	metrics.Lock()
+	metrics.AntiEntropy.Rounds++
+	metrics.AntiEntropy.DivergentRanges += int64(divergentRanges)
+	metrics.AntiEntropy.DivergentKeys += int64(divergentKeys)
+	metrics.AntiEntropy.KeysRepaired += int64(repaired)
+	metrics.AntiEntropy.KeysPushed += int64(pushed)
+	metrics.AntiEntropy.UnresolvedKeys += int64(unresolved)
+	metrics.Unlock()
+	return nil
+}
+
+// Works out which way a key that differs between two replicas is copied.
+// A key only one replica has is copied over if the other would have kept a
+// tombstone for it; otherwise it could as well be a delete the other saw
+// whose tombstone is gone, and neither way is taken
+func resolveDivergence(ours SyncItem, haveOurs bool, theirs SyncItem, haveTheirs bool) (pull bool, push bool) {
+	switch {
+	case !haveOurs:
+		return theirs.Entry == nil || kvsDb.KeepsTombstones(), false
+	case !haveTheirs:
+		return false, ours.Entry == nil || kvsDb.KeepsTombstones()
+	case sameCrdt(ours, theirs):
+		return true, true
+	case theirs.newerThan(ours):
+		return true, false
+	}
+	return false, true
+}
+
+// Applies repairs a replica sent, and catches this node's clock up to the
+// replica's if it sent one and every repair went through. Returns how many
+// keys changed
+func applyRepairs(req AntiEntropyRequest) (repaired int, complete bool, err error) {
+	complete = true
+	for key, item := range req.Items {
+		if ring.GetShardId(key) != localShardId {
+			complete = false
+			continue
+		}
+		var changed bool
+		changed, err = kvsDb.RepairKey(key, item, req.From)
+		if err == ErrKeyLocked {
+			complete, err = false, nil
+			continue
+		} else if err != nil {
+			break
+		}
+		if changed {
+			repaired++
+		}
+	}
+
+	metrics.Lock()
+	if req.ReadRepair {
+		metrics.ReadRepair.KeysRepaired += int64(repaired)
+	} else {
+		metrics.AntiEntropy.KeysRepaired += int64(repaired)
+	}
+	metrics.Unlock()
+
+	if err != nil {
+		return repaired, false, err
+	}
+	if complete && req.Metadata != nil {
+		err = kvsDb.CatchUpMetadata(req.Metadata, req.From)
+	}
+	return repaired, complete, err
+}
+
+// Sends peer the repairs of req, in requests that each stay within the /rep
+// body limit. The clock of req, if any, goes with the last one, for peer to
+// catch up to if every repair before it went through. Returns how many keys
+// peer changed
+func pushRepairs(peer string, req AntiEntropyRequest) (repaired int, err error) {
+	chunks := chunkRepairs(req.Items)
+	if len(chunks) == 0 && req.Metadata != nil {
+		chunks = append(chunks, nil)
+	}
+
+	complete := true
+	for i, chunk := range chunks {
+		chunkReq := req
+		chunkReq.Items = chunk
+		if i < len(chunks)-1 || !complete {
+			chunkReq.Metadata = nil
+		}
+		var res struct {
+			Repaired int  `json:"repaired"`
+			Complete bool `json:"complete"`
+		}
+		err = antiEntropyCall(peer, "/rep/anti-entropy/repair", chunkReq, &res)
+		if err != nil {
+			return repaired, err
+		}
+		repaired += res.Repaired
+		complete = complete && res.Complete
+	}
+	return repaired, nil
+}
+
+// Splits items into groups of up to limits.MaxBodySize bytes of JSON, like
+// raft appends, which leaves room in a /rep request for a raw value's
+// base64. An item bigger than that goes in a group of its own
+func chunkRepairs(items map[string]SyncItem) []map[string]SyncItem {
+	var chunks []map[string]SyncItem
+	size := 0
+	for key, item := range items {
+		jsonData, _ := json.Marshal(item)
+		itemSize := len(key) + len(jsonData)
+		if len(chunks) == 0 || (size > 0 && int64(size+itemSize) > limits.MaxBodySize) {
+			chunks = append(chunks, make(map[string]SyncItem))
+			size = 0
+		}
+		chunks[len(chunks)-1][key] = item
+		size += itemSize
+	}
+	return chunks
+}
+
+// Sends an anti-entropy request to peer and decodes the answer into res.
+// Like raftCall, this never drops peer from the view: a replica that
+// doesn't answer is left to the regular failure detection
+func antiEntropyCall(peer string, endpoint string, req AntiEntropyRequest, res interface{}) error {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer+endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body bytes.Buffer
+		body.ReadFrom(resp.Body)
+		return fmt.Errorf("%s answered %d: %s", endpoint, resp.StatusCode, body.String())
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Points the globals at a single shard holding this node and replicas,
+// keeping tombstones for an hour
+func antiEntropyTestShard(t *testing.T, replicas ...string) {
+	quorumTestShard(t, replicas...)
+	kvsDb.config.HistoryVersions = 10
+	kvsDb.config.HistoryRetention = time.Hour
+}
+
+func TestMerkleTreeKeptCurrent(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(kvs *KeyValStoreDatabase) error
+	}{
+		{"put", func(kvs *KeyValStoreDatabase) error {
+			_, _, _, err := kvs.PutData("c", KeyEntry{Value: "z"}, WriteCondition{}, map[string]int{}, "n0")
+			return err
+		}},
+		{"overwrite", func(kvs *KeyValStoreDatabase) error {
+			_, _, _, err := kvs.PutData("a", KeyEntry{Value: "z"}, WriteCondition{}, map[string]int{}, "n0")
+			return err
+		}},
+		{"delete", func(kvs *KeyValStoreDatabase) error {
+			_, err := kvs.DeleteData("a", WriteCondition{}, 0, map[string]int{}, "n0")
+			return err
+		}},
+		{"tombstone pruned", func(kvs *KeyValStoreDatabase) error {
+			_, err := kvs.DeleteData("a", WriteCondition{}, 0, map[string]int{}, "n0")
+			kvs.PruneHistory(time.Now().Add(2 * time.Hour).UnixMilli())
+			return err
+		}},
+		{"repair", func(kvs *KeyValStoreDatabase) error {
+			_, err := kvs.RepairKey("b", SyncItem{Entry: &KeyEntry{Value: "z", Version: 1 << 30}, Version: 1 << 30}, "n1")
+			return err
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			antiEntropyTestShard(t)
+			for _, key := range []string{"a", "b"} {
+				_, _, _, err := kvsDb.PutData(key, KeyEntry{Value: "x"}, WriteCondition{}, map[string]int{}, "n0")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, _, err := kvsDb.MerkleHashes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = test.change(kvsDb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := kvsDb.MerkleHashes()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			items, err := kvsDb.syncItems()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := buildMerkleTree(items).hashes
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("kept tree has root %s, built from scratch %s", got[""], want[""])
+			}
+			if got[""] == before[""] {
+				t.Errorf("root didn't change")
+			}
+		})
+	}
+}
+
+// Repairs and catch-ups reach watchers and the change log
+func TestRepairChanges(t *testing.T) {
+	antiEntropyTestShard(t)
+	kvsDb.Metadata["n1"] = 1
+
+	_, err := kvsDb.RepairKey("a", SyncItem{Entry: &KeyEntry{Value: "x", Version: 5}, Version: 5}, "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kvsDb.RepairKey("b", SyncItem{Version: 6}, "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kvsDb.CatchUpMetadata(map[string]int{"n1": 3}, "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []WatchEvent{
+		{Type: "put", Key: "a", Value: "x", Version: 5, Metadata: map[string]int{"n1": 1}, Sender: "n1", Repair: true},
+		{Type: "delete", Key: "b", Version: 6, Metadata: map[string]int{"n1": 1}, Sender: "n1", Repair: true},
+		{Type: "catch-up", Metadata: map[string]int{"n1": 3}, Sender: "n1"},
+	}
+	if len(kvsDb.feed.changes) != len(want) {
+		t.Fatalf("got %d changes, want %d", len(kvsDb.feed.changes), len(want))
+	}
+	for i, change := range kvsDb.feed.changes {
+		if !reflect.DeepEqual(change, Change{want[i]}) {
+			t.Errorf("got change %+v, want %+v", change, want[i])
+		}
+	}
+}
+
+func TestChangeAfter(t *testing.T) {
+	write := Change{{Type: "put", Metadata: map[string]int{"n0": 2, "n1": 4}, Sender: "n1"}}
+	repair := Change{{Type: "put", Metadata: map[string]int{"n0": 2, "n1": 4}, Sender: "n1", Repair: true}}
+	catchUp := Change{{Type: "catch-up", Metadata: map[string]int{"n0": 2, "n1": 4}, Sender: "n1"}}
+
+	tests := []struct {
+		name   string
+		change Change
+		clock  map[string]int
+		want   bool
+	}{
+		{"write not seen", write, map[string]int{"n1": 3}, true},
+		{"write seen", write, map[string]int{"n1": 4}, false},
+		{"repair before the clock it was made at", repair, map[string]int{"n0": 1, "n1": 4}, true},
+		{"repair at the clock it was made at", repair, map[string]int{"n0": 2, "n1": 4}, true},
+		{"repair after", repair, map[string]int{"n0": 3, "n1": 4}, false},
+		{"catch-up not seen", catchUp, map[string]int{"n0": 2, "n1": 3}, true},
+		{"catch-up seen", catchUp, map[string]int{"n0": 2, "n1": 4}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.change.after(test.clock); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPushRepairs(t *testing.T) {
+	item := SyncItem{Entry: &KeyEntry{Value: strings.Repeat("x", 100)}, Version: 1}
+	// every key is one byte
+	jsonData, _ := json.Marshal(item)
+	itemSize := int64(1 + len(jsonData))
+
+	tests := []struct {
+		name         string
+		items        int
+		bodySize     int64
+		metadata     map[string]int
+		wantRequests int
+	}{
+		{"nothing to send", 0, DefaultMaxBodySize, nil, 0},
+		{"only the clock", 0, DefaultMaxBodySize, map[string]int{"n0": 1}, 1},
+		{"one request", 10, DefaultMaxBodySize, map[string]int{"n0": 1}, 1},
+		{"two per request", 10, 2 * itemSize, map[string]int{"n0": 1}, 5},
+		{"items bigger than a request", 3, 1, nil, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var reqs []AntiEntropyRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req AntiEntropyRequest
+				json.NewDecoder(r.Body).Decode(&req)
+				reqs = append(reqs, req)
+				json.NewEncoder(w).Encode(map[string]interface{}{"repaired": len(req.Items), "complete": true})
+			}))
+			defer server.Close()
+			antiEntropyTestShard(t)
+			defaults := limits
+			limits.MaxBodySize = test.bodySize
+			defer func() { limits = defaults }()
+
+			items := make(map[string]SyncItem)
+			for i := 0; i < test.items; i++ {
+				items[string(rune('a'+i))] = item
+			}
+			req := AntiEntropyRequest{ShardId: localShardId, Items: items, From: localAddress, Metadata: test.metadata}
+			repaired, err := pushRepairs(strings.TrimPrefix(server.URL, "http://"), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(reqs) != test.wantRequests {
+				t.Fatalf("got %d requests, want %d", len(reqs), test.wantRequests)
+			}
+			if repaired != test.items {
+				t.Errorf("got %d repaired, want %d", repaired, test.items)
+			}
+			for i, req := range reqs {
+				if size := int64(len(req.Items)) * itemSize; len(req.Items) > 1 && size > test.bodySize {
+					t.Errorf("request %d has %d bytes of items", i, size)
+				}
+				last := i == len(reqs)-1
+				if (req.Metadata != nil) != (last && test.metadata != nil) {
+					t.Errorf("request %d of %d has clock %v", i+1, len(reqs), req.Metadata)
+				}
+			}
+		})
+	}
+}
+
+func TestAntiEntropyCallKeepsView(t *testing.T) {
+	peer := "127.0.0.1:1"
+	antiEntropyTestShard(t, peer)
+
+	var res struct{}
+	err := antiEntropyCall(peer, "/rep/anti-entropy/tree", AntiEntropyRequest{Prefixes: []string{""}}, &res)
+	if err == nil {
+		t.Fatal("got no error from a peer that isn't there")
+	}
+	if !view.Contains(peer) {
+		t.Errorf("%s was dropped from the view", peer)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Most keys a single batch request can name
+const MaxBatchSize = 1000
+
+// The outcome of one key in a batch, with the status code the single key
+// endpoint would have answered with
+type BatchResult struct {
+	Status  int         `json:"status"`
+	Result  string      `json:"result,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+	Version int64       `json:"version,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// Runs the part of a batch that falls on the local shard
+type localBatchFunc func(keys []string, values map[string]interface{}, metadata map[string]int) (map[string]BatchResult, map[string]int)
+
+// Groups keys by shard and runs each group at once: locally for our own
+// shard, and by sending the same batch endpoint just that shard's keys
+// otherwise. values is nil for batches that don't write. A shard that
+// can't be reached fails only its own keys
+func runBatch(endpoint string, keys []string, values map[string]interface{}, metadata map[string]int, local localBatchFunc) (map[string]BatchResult, map[string]int) {
+	shardKeys := make(map[int][]string)
+	for _, key := range keys {
+		shardId := ring.GetShardId(key)
+		shardKeys[shardId] = append(shardKeys[shardId], key)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]BatchResult, len(keys))
+	mergedMetadata := make(map[string]int)
+
+	for shardId, keys := range shardKeys {
+		wg.Add(1)
+		go func(shardId int, keys []string) {
+			defer wg.Done()
+
+			var shardResults map[string]BatchResult
+			var currMetadata map[string]int
+			if shardId == localShardId && shardPrimary(shardId) != localAddress && kvsDb.Raft() != nil {
+				// in raft mode the leader runs the shard's part
+				shardResults, currMetadata = sendBatchToLeader(endpoint, shardId, keys, values, metadata)
+			} else if shardId == localShardId {
+				shardResults, currMetadata = local(keys, values, metadata)
+			} else {
+				shardResults, currMetadata = sendBatchToShard(endpoint, shardId, keys, values, metadata)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			for key, result := range shardResults {
+				results[key] = result
+			}
+			mergeMetadata(mergedMetadata, currMetadata)
+		}(shardId, keys)
+	}
+	wg.Wait()
+
+	return results, mergedMetadata
+}
+
+// Sends one shard its part of a batch
+func sendBatchToShard(endpoint string, shardId int, keys []string, values map[string]interface{}, metadata map[string]int) (map[string]BatchResult, map[string]int) {
+	return sendBatchToNodes(endpoint, removeLocalAddressFromMap(ring.Shards[shardId].Replicas), keys, values, metadata)
+}
+
+// Sends this node's shard's part of a batch to the shard's raft leader
+func sendBatchToLeader(endpoint string, shardId int, keys []string, values map[string]interface{}, metadata map[string]int) (map[string]BatchResult, map[string]int) {
+	leader := shardPrimary(shardId)
+	if leader == "" {
+		return failBatchKeys(keys, http.StatusServiceUnavailable, ErrNotLeader), nil
+	}
+	return sendBatchToNodes(endpoint, map[string]struct{}{leader: {}}, keys, values, metadata)
+}
+
+func sendBatchToNodes(endpoint string, nodes map[string]struct{}, keys []string, values map[string]interface{}, metadata map[string]int) (map[string]BatchResult, map[string]int) {
+	dataMap := make(map[string]interface{})
+	dataMap["causal-metadata"] = metadata
+	if values == nil {
+		dataMap["keys"] = keys
+	} else {
+		shardValues := make(map[string]interface{}, len(keys))
+		for _, key := range keys {
+			shardValues[key] = values[key]
+		}
+		dataMap["values"] = shardValues
+	}
+	jsonData, _ := json.Marshal(dataMap)
+
+	res, err := sendMsgToGroup(
+		nodes,
+		endpoint,
+		http.MethodPost,
+		"application/json",
+		jsonData,
+		false)
+	if err != nil {
+		return failBatchKeys(keys, http.StatusServiceUnavailable, err), nil
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Results  map[string]BatchResult `json:"results"`
+		Metadata map[string]int         `json:"causal-metadata"`
+		Error    string                 `json:"error"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return failBatchKeys(keys, http.StatusBadGateway, err), nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return failBatchKeys(keys, res.StatusCode, errors.New(body.Error)), nil
+	}
+	return body.Results, body.Metadata
+}
+
+func failBatchKeys(keys []string, status int, err error) map[string]BatchResult {
+	results := make(map[string]BatchResult, len(keys))
+	for _, key := range keys {
+		results[key] = BatchResult{Status: status, Error: err.Error()}
+	}
+	return results
+}
+
+/// --- local halves of the batch operations ---
+// Each returns the node's clock after the whole batch
+
+func localMget(keys []string, values map[string]interface{}, metadata map[string]int) (map[string]BatchResult, map[string]int) {
+	results := make(map[string]BatchResult, len(keys))
+	for _, key := range keys {
+		entry, _, err := kvsDb.GetData(key, metadata)
+		if err == ErrInvalidMetadata {
+			results[key] = BatchResult{Status: http.StatusServiceUnavailable, Error: "Causal dependencies not satisfied; try again later"}
+		} else if err == ErrKeyNotFound {
+			results[key] = BatchResult{Status: http.StatusNotFound, Error: "Key does not exist"}
+		} else if err == ErrNotLeader || err == ErrRaftNotReady || err == ErrRaftTimeout {
+			results[key] = BatchResult{Status: http.StatusServiceUnavailable, Error: "Couldn't make sure the read is up to date; try again later"}
+		} else if err != nil {
+			results[key] = BatchResult{Status: http.StatusInternalServerError, Error: err.Error()}
+		} else {
+			results[key] = BatchResult{Status: http.StatusOK, Result: "found", Value: entry.ClientValue(), Version: entry.Version}
+		}
+	}
+
+	return results, kvsDb.CurrentMetadata()
+}
+
+func localMput(keys []string, values map[string]interface{}, metadata map[string]int) (map[string]BatchResult, map[string]int) {
+	results := make(map[string]BatchResult, len(keys))
+	writes := make([]TxnWrite, 0, len(keys))
+	for _, key := range keys {
+		// same checks as a single put
+		if limits.checkKey(key) != nil {
+			results[key] = BatchResult{Status: http.StatusBadRequest, Error: "Key is too long"}
+			continue
+		}
+		if values[key] == nil {
+			results[key] = BatchResult{Status: http.StatusBadRequest, Error: "PUT request does not specify a value"}
+			continue
+		}
+		if limits.checkValue(values[key]) != nil {
+			results[key] = BatchResult{Status: http.StatusRequestEntityTooLarge, Error: valueTooLargeMessage()}
+			continue
+		}
+		writes = append(writes, TxnWrite{Key: key, Value: values[key]})
+	}
+
+	return localMulti(writes, results, metadata)
+}
+
+func localMdelete(keys []string, values map[string]interface{}, metadata map[string]int) (map[string]BatchResult, map[string]int) {
+	writes := make([]TxnWrite, 0, len(keys))
+	for _, key := range keys {
+		writes = append(writes, TxnWrite{Key: key, Delete: true})
+	}
+	return localMulti(writes, make(map[string]BatchResult, len(keys)), metadata)
+}
+
+// Applies the writes of a multi-put or multi-delete that passed the
+// request checks as one batch, and sends the replicas that one batch
+// instead of a message per key. Fills in results for every write
+func localMulti(txnWrites []TxnWrite, results map[string]BatchResult, metadata map[string]int) (map[string]BatchResult, map[string]int) {
+	writes, created, failed, currMetadata, err := kvsDb.PutMulti(txnWrites, metadata)
+
+	// every write in the batch has the same version
+	var version int64
+	if len(writes) > 0 && writes[0].Entry != nil {
+		version = writes[0].Entry.Version
+	}
+
+	for _, write := range txnWrites {
+		keyErr := err
+		if keyErr == nil {
+			keyErr = failed[write.Key]
+		}
+		switch {
+		case keyErr != nil:
+			results[write.Key] = batchErrorResult(keyErr)
+		case write.Delete:
+			results[write.Key] = BatchResult{Status: http.StatusOK, Result: "deleted"}
+		case created[write.Key]:
+			results[write.Key] = BatchResult{Status: http.StatusCreated, Result: "created", Version: version}
+		default:
+			results[write.Key] = BatchResult{Status: http.StatusOK, Result: "updated", Version: version}
+		}
+	}
+
+	// broadcast. The messages go out in the background, but who they go to
+	// is settled before returning
+	if len(writes) > 0 {
+		broadcastKvsBatch(writes, "", currMetadata, localAddress)
+	}
+
+	return results, currMetadata
+}
+
+// The result of a key in a batch whose write failed with err
+func batchErrorResult(err error) BatchResult {
+	switch err {
+	case ErrInvalidMetadata:
+		return BatchResult{Status: http.StatusServiceUnavailable, Error: "Causal dependencies not satisfied; try again later"}
+	case ErrKeyNotFound:
+		return BatchResult{Status: http.StatusNotFound, Error: "Key does not exist"}
+	case ErrKeyLocked:
+		return BatchResult{Status: http.StatusConflict, Error: "Key is locked by a transaction"}
+	case ErrOutOfMemory:
+		return BatchResult{Status: http.StatusInsufficientStorage, Error: "Node is over its memory limit"}
+	case ErrNotLeader, ErrRaftNotReady:
+		return BatchResult{Status: http.StatusServiceUnavailable, Error: "Shard has no leader ready to serve this; try again later"}
+	case ErrRaftTimeout:
+		return BatchResult{Status: http.StatusGatewayTimeout, Error: "Write wasn't committed in time; it may or may not have been applied"}
+	}
+	return BatchResult{Status: http.StatusInternalServerError, Error: err.Error()}
+}
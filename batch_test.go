@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPutMulti(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   []string
+		locked     []string
+		writes     []TxnWrite
+		wantStatus map[string]int
+	}{
+		{
+			name:       "puts",
+			existing:   []string{"a"},
+			writes:     []TxnWrite{{Key: "a", Value: 1}, {Key: "b", Value: 2}},
+			wantStatus: map[string]int{"a": http.StatusOK, "b": http.StatusCreated},
+		},
+		{
+			name:       "deletes",
+			existing:   []string{"a"},
+			writes:     []TxnWrite{{Key: "a", Delete: true}, {Key: "b", Delete: true}},
+			wantStatus: map[string]int{"a": http.StatusOK, "b": http.StatusNotFound},
+		},
+		{
+			name:       "locked key fails on its own",
+			existing:   []string{"a", "b"},
+			locked:     []string{"a"},
+			writes:     []TxnWrite{{Key: "a", Value: 1}, {Key: "b", Value: 2}},
+			wantStatus: map[string]int{"a": http.StatusConflict, "b": http.StatusOK},
+		},
+		{
+			name:       "nothing goes through",
+			locked:     []string{"a"},
+			writes:     []TxnWrite{{Key: "a", Value: 1}, {Key: "b", Delete: true}},
+			wantStatus: map[string]int{"a": http.StatusConflict, "b": http.StatusNotFound},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kvsDb = NewKeyValStoreDatabase("n0")
+			localAddress = "n0"
+			view = NewView() // no replicas to send the batch to
+			for _, key := range test.existing {
+				kvsDb.putEntry(key, KeyEntry{Value: 0})
+			}
+			for _, key := range test.locked {
+				kvsDb.locks[key] = "txn"
+			}
+
+			results, metadata := localMulti(test.writes, make(map[string]BatchResult), map[string]int{})
+
+			applied := 0
+			var version int64
+			for key, want := range test.wantStatus {
+				result := results[key]
+				if result.Status != want {
+					t.Errorf("%s: got status %d, want %d", key, result.Status, want)
+				}
+				if result.Status < 300 {
+					applied++
+				}
+				isPut := result.Result == "created" || result.Result == "updated"
+				if isPut != (result.Version != 0) {
+					t.Errorf("%s: got version %d for a %q", key, result.Version, result.Result)
+				}
+				if result.Version != 0 {
+					if version != 0 && result.Version != version {
+						t.Errorf("%s: got version %d, want the batch's version %d", key, result.Version, version)
+					}
+					version = result.Version
+				}
+			}
+
+			// the keys that went through are one write with one tick
+			wantTicks := 0
+			if applied > 0 {
+				wantTicks = 1
+			}
+			if metadata["n0"] != wantTicks {
+				t.Errorf("clock ticked %d times, want %d", metadata["n0"], wantTicks)
+			}
+		})
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	l := Limits{MaxKeyLength: 4}
+	tests := []struct {
+		key  string
+		want error
+	}{
+		{"", nil},
+		{"abcd", nil},
+		{"abcde", ErrKeyTooLong},
+		{strings.Repeat("x", 100), ErrKeyTooLong},
+	}
+
+	for _, test := range tests {
+		if got := l.checkKey(test.key); got != test.want {
+			t.Errorf("checkKey(%q) = %v, want %v", test.key, got, test.want)
+		}
+	}
+}
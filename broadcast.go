@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -14,10 +15,33 @@ func sendServiceUnavailable(c *gin.Context) {
 	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Causal dependencies not satisfied; try again later"})
 }
 
+func sendPreconditionFailed(c *gin.Context, metadata map[string]int) {
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Precondition failed", "causal-metadata": metadata})
+}
+
+func sendInsufficientStorage(c *gin.Context, metadata map[string]int) {
+	c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Node is over its memory limit", "causal-metadata": metadata})
+}
+
+func sendNoLeader(c *gin.Context) {
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Shard has no leader ready to serve this; try again later"})
+}
+
+func sendRaftTimeout(c *gin.Context) {
+	c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Write wasn't committed in time; it may or may not have been applied"})
+}
+
 // sends a single message to the node specified and returns the response
 // If the response code is 503 (Service Unavailable) is retries until
 // a different status code is returned or timeout
 func sendSingleMsg(node string, endpoint string, method string, contentType string, data []byte, shouldRetry bool) (*http.Response, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return sendSingleMsgWithHeaders(node, endpoint, method, header, data, shouldRetry)
+}
+
+// Same as sendSingleMsg, but sends the given headers with the request
+func sendSingleMsgWithHeaders(node string, endpoint string, method string, header http.Header, data []byte, shouldRetry bool) (*http.Response, error) {
 	nodeUrl := "http://" + node + endpoint
 
 	// Loop on doing request until response or timeout
@@ -27,7 +51,7 @@ func sendSingleMsg(node string, endpoint string, method string, contentType stri
 		if err != nil {
 			return &http.Response{}, err
 		}
-		req.Header.Set("Content-Type", "application/json")
+		req.Header = header.Clone()
 
 		// Create netClient with timeout set at 1 second
 		var netClient = &http.Client{
@@ -53,9 +77,16 @@ func sendSingleMsg(node string, endpoint string, method string, contentType stri
 // In other words, it picks a node, and if that node doesn't respond it moves to the
 // next node on the list
 func sendMsgToGroup(nodes map[string]struct{}, endpoint string, method string, contentType string, data []byte, shouldRetry bool) (*http.Response, error) {
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	return sendMsgToGroupWithHeaders(nodes, endpoint, method, header, data, shouldRetry)
+}
+
+// Same as sendMsgToGroup, but sends the given headers with the request
+func sendMsgToGroupWithHeaders(nodes map[string]struct{}, endpoint string, method string, header http.Header, data []byte, shouldRetry bool) (*http.Response, error) {
 	// Send msg to each node in list until response
 	for node := range nodes {
-		res, err := sendSingleMsg(node, endpoint, method, contentType, data, shouldRetry)
+		res, err := sendSingleMsgWithHeaders(node, endpoint, method, header, data, shouldRetry)
 		if err == nil {
 			return res, nil
 		}
@@ -74,42 +105,183 @@ func sendBroadcastMsg(nodes map[string]struct{}, endpoint string, method string,
 }
 
 // Wrapper for sendBroadcastMsg for put kvs
-func broadcastKvsPut(key string, value interface{}, metadata map[string]int, sender string) {
+func broadcastKvsPut(key string, entry KeyEntry, metadata map[string]int, sender string) {
+	// the raft log already carries the write to the rest of the shard
+	if kvsDb.Raft() != nil {
+		return
+	}
+
+	// send broadcast messages on new thread
+	sendBroadcastMsg(
+		removeLocalAddressFromMap(view.Nodes),
+		"/rep/kvs",
+		http.MethodPut,
+		"application/json",
+		kvsPutMessage(key, entry, metadata))
+}
+
+// Returns the body of the /rep/kvs message replicating a put
+func kvsPutMessage(key string, entry KeyEntry, metadata map[string]int) []byte {
 	dataMap := make(map[string]interface{})
 	dataMap["key"] = key
-	dataMap["value"] = value
+	dataMap["entry"] = entry
 	dataMap["causal-metadata"] = metadata
 	dataMap["sender"] = localAddress
 
 	// turn body data into string JSON
 	jsonData, _ := json.Marshal(dataMap)
+	return jsonData
+}
+
+// Wrapper for sendBroadcastMsg for delete kvs
+func broadcastKvsDelete(key string, metadata map[string]int, sender string) {
+	// the raft log already carries the write to the rest of the shard
+	if kvsDb.Raft() != nil {
+		return
+	}
 
 	// send broadcast messages on new thread
 	sendBroadcastMsg(
 		removeLocalAddressFromMap(view.Nodes),
 		"/rep/kvs",
-		http.MethodPut,
+		http.MethodDelete,
 		"application/json",
-		jsonData)
+		kvsDeleteMessage(key, versionFromMetadata(metadata, sender), metadata))
 }
 
-// Wrapper for sendBroadcastMsg for delete kvs
-func broadcastKvsDelete(key string, metadata map[string]int, sender string) {
+// Returns the body of the /rep/kvs message replicating a delete
+func kvsDeleteMessage(key string, version int64, metadata map[string]int) []byte {
 	dataMap := make(map[string]interface{})
 	dataMap["key"] = key
+	dataMap["version"] = version
 	dataMap["causal-metadata"] = metadata
 	dataMap["sender"] = localAddress
 
 	// turn body data into string JSON
 	jsonData, _ := json.Marshal(dataMap)
+	return jsonData
+}
+
+// Wrapper for sendBroadcastMsg for a batch of writes applied as one unit,
+// optionally the commit of transaction txnId
+func broadcastKvsBatch(writes []BatchWrite, txnId string, metadata map[string]int, sender string) {
+	// the raft log already carries the write to the rest of the shard
+	if kvsDb.Raft() != nil {
+		return
+	}
 
 	// send broadcast messages on new thread
 	sendBroadcastMsg(
 		removeLocalAddressFromMap(view.Nodes),
 		"/rep/kvs",
-		http.MethodDelete,
+		http.MethodPut,
 		"application/json",
-		jsonData)
+		kvsBatchMessage(writes, txnId, metadata))
+}
+
+// Returns the body of the /rep/kvs message replicating a batch
+func kvsBatchMessage(writes []BatchWrite, txnId string, metadata map[string]int) []byte {
+	dataMap := make(map[string]interface{})
+	dataMap["writes"] = writes
+	dataMap["txn-id"] = txnId
+	dataMap["causal-metadata"] = metadata
+	dataMap["sender"] = localAddress
+
+	// turn body data into string JSON
+	jsonData, _ := json.Marshal(dataMap)
+	return jsonData
+}
+
+// Copies a transaction prepared on this node to the rest of its shard,
+// waiting for each replica so they all hold it before the shard votes.
+// Returns ErrTxnNotReplicated unless every replica acknowledged it
+func broadcastPreparedTxn(txn PreparedTxn) error {
+	// the raft log already carries the transaction to the rest of the shard
+	if kvsDb.Raft() != nil {
+		return nil
+	}
+
+	jsonData, _ := json.Marshal(map[string]interface{}{"txn": txn})
+
+	replicas := removeLocalAddressFromMap(ring.Shards[localShardId].Replicas)
+	acks := 0
+	for node := range replicas {
+		res, err := sendSingleMsg(node, "/rep/shard/txn", http.MethodPut, "application/json", jsonData, false)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			acks++
+		} else {
+			log.Printf("%s didn't take prepared transaction %s: %s", node, txn.Id, res.Status)
+		}
+	}
+
+	if acks < len(replicas) {
+		return ErrTxnNotReplicated
+	}
+	return nil
+}
+
+// Tells the rest of this node's shard to drop a prepared transaction, in
+// the background. Replicas that don't answer are left in the view
+func broadcastAbortTxn(txnId string) {
+	// the raft log already carries the transaction to the rest of the shard
+	if kvsDb.Raft() != nil {
+		return
+	}
+
+	jsonData, _ := json.Marshal(map[string]interface{}{"txn-id": txnId})
+
+	for node := range removeLocalAddressFromMap(ring.Shards[localShardId].Replicas) {
+		go func(node string) {
+			res, err := txnCall(node, "/rep/shard/txn", http.MethodDelete, jsonData)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			res.Body.Close()
+		}(node)
+	}
+}
+
+// Tells the rest of this node's shard to drop a transaction, waiting for
+// each replica. Returns ErrAbortNotReplicated unless every replica
+// acknowledged it. Replicas that don't answer are left in the view
+func replicateAbortTxn(txnId string) error {
+	// the raft log already carries the abort to the rest of the shard
+	if kvsDb.Raft() != nil {
+		return nil
+	}
+
+	jsonData, _ := json.Marshal(map[string]interface{}{"txn-id": txnId})
+
+	replicas := removeLocalAddressFromMap(ring.Shards[localShardId].Replicas)
+	acks := make(chan bool, len(replicas))
+	for node := range replicas {
+		go func(node string) {
+			res, err := txnCall(node, "/rep/shard/txn", http.MethodDelete, jsonData)
+			if err != nil {
+				log.Println(err)
+				acks <- false
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				log.Printf("%s didn't drop transaction %s: %s", node, txnId, res.Status)
+			}
+			acks <- res.StatusCode == http.StatusOK
+		}(node)
+	}
+
+	for range replicas {
+		if !<-acks {
+			return ErrAbortNotReplicated
+		}
+	}
+	return nil
 }
 
 // Wrapper for sendBroadcastMsg for adding node to shard
@@ -183,11 +355,11 @@ func broadcastDeleteView(node string) {
 		jsonData)
 }
 
-func sendKeyValNoChecks(key string, val interface{}, node string) {
+func sendKeyValNoChecks(key string, entry KeyEntry, node string) {
 	// build response to broadcast
 	dataMap := make(map[string]interface{})
 	dataMap["key"] = key
-	dataMap["value"] = val
+	dataMap["entry"] = entry
 
 	// turn body data into string JSON
 	jsonData, _ := json.Marshal(dataMap)
@@ -201,8 +373,29 @@ func sendKeyValNoChecks(key string, val interface{}, node string) {
 		true)
 }
 
-func broadcastKeyValNoChecks(key string, val interface{}, nodes map[string]struct{}) {
+func broadcastKeyValNoChecks(key string, entry KeyEntry, nodes map[string]struct{}) {
 	for node := range nodes {
-		sendKeyValNoChecks(key, val, node)
+		sendKeyValNoChecks(key, entry, node)
 	}
 }
+
+// Sends a consumer's committed progress to the rest of its shard
+func broadcastConsumer(consumer ChangeConsumer, shardId int) {
+	jsonData, _ := json.Marshal(consumer)
+
+	sendBroadcastMsg(
+		removeLocalAddressFromMap(ring.Shards[shardId].Replicas),
+		"/rep/changes/consumers/"+consumer.Name,
+		http.MethodPut,
+		"application/json",
+		jsonData)
+}
+
+func broadcastDeleteConsumer(name string, shardId int) {
+	sendBroadcastMsg(
+		removeLocalAddressFromMap(ring.Shards[shardId].Replicas),
+		"/rep/changes/consumers/"+name,
+		http.MethodDelete,
+		"application/json",
+		make([]byte, 0))
+}
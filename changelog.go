@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Changes per log segment. Segments are only dropped whole, so at most
+// this many past the retention are kept
+const changeLogSegmentSize = 10000
+
+// Segments are named after the offset of their first change so they sort in order
+const changeLogSegmentPattern = "changes-*.log"
+const changeLogSegmentFormat = "changes-%020d.log"
+
+// Page sizes for reading the change log
+const (
+	DefaultChangesLimit = 100
+	MaxChangesLimit     = 1000
+)
+
+var ErrOffsetTooOld = errors.New("offset is older than the retained changes")
+var ErrInvalidOffset = errors.New("offset is past the end of the change log")
+var ErrConsumerNotFound = errors.New("consumer not found")
+var ErrInvalidConsumerName = errors.New("consumer names are 1 to 64 letters, digits, '.', '-' or '_', and can't start with '.'")
+
+var consumerNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,63}$`)
+
+// One change in the log: a write, or every write of a batch, as watchers
+// see it
+type ChangeLogEntry struct {
+	Offset uint64 `json:"offset"`
+	LSN    uint64 `json:"lsn"`  // of the write-ahead log record that made it
+	Time   int64  `json:"time"` // unix milliseconds this node applied it
+	Events Change `json:"events"`
+}
+
+// Returns the clock of the node just before it applied the change. A
+// repair doesn't move it, and a catch-up only counts writes already
+// repaired or applied, so for those it's the clock after
+func (entry ChangeLogEntry) clockBefore() map[string]int {
+	clock := make(map[string]int, len(entry.Events[0].Metadata))
+	for replica, time := range entry.Events[0].Metadata {
+		clock[replica] = time
+	}
+	if entry.Events.counted() {
+		clock[entry.Events.sender()]--
+	}
+	return clock
+}
+
+// Every change applied to this node, in the order it applied them, each
+// with an offset one past the last. Every node keeps its own, and the
+// shard's primary is the one read from. The log is regenerated from the
+// write-ahead log on startup, so it only needs to be synced before the
+// write-ahead log segments behind it are removed.
+//
+// A change that can't be written is kept and written ahead of the next
+// one, so the log never skips a change and the last lsn in it is always
+// where regenerating it has to start
+type ChangeLog struct {
+	sync.Mutex
+	dir       string
+	retention int
+	file      *os.File
+	size      int64 // of the newest segment
+
+	segments       []uint64 // first offset of each segment, oldest first
+	segmentEntries int      // changes in the newest segment
+	nextOffset     uint64
+	lastLSN        uint64
+	unsynced       bool
+	pending        []ChangeLogEntry // not yet written, offsets aren't given out yet
+}
+
+// A reader of the change log and how far it got. Offsets only mean
+// something in one node's log, so the clock the offset starts at is kept
+// too: any replica can find where the reader is in its own log from it
+type ChangeConsumer struct {
+	Name     string         `json:"name"`
+	Offset   uint64         `json:"offset"` // the next change to read
+	Node     string         `json:"node"`   // whose log the offset is in
+	Position map[string]int `json:"position"`
+	Time     int64          `json:"time"`
+}
+
+// One page of the change log
+type ChangePage struct {
+	Changes     []ChangeLogEntry `json:"changes"`
+	NextOffset  uint64           `json:"next-offset"`  // read from here for the next page
+	FirstOffset uint64           `json:"first-offset"` // the oldest change retained
+	EndOffset   uint64           `json:"end-offset"`   // one past the newest change
+	Node        string           `json:"node"`
+}
+
+// Opens the log in dir, dropping a partially written change at the end of
+// the newest segment (from a crash mid-write)
+func OpenChangeLog(dir string, retention int) (*ChangeLog, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, changeLogSegmentPattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	changes := &ChangeLog{dir: dir, retention: retention}
+	for _, name := range names {
+		var start uint64
+		fmt.Sscanf(filepath.Base(name), changeLogSegmentFormat, &start)
+		changes.segments = append(changes.segments, start)
+	}
+	if len(changes.segments) == 0 {
+		return changes, nil
+	}
+
+	// pick up after the last complete change of the newest segment
+	err = changes.openNewest()
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Opens the newest segment for appending, truncating anything after its
+// last complete change. Caller must hold the lock
+func (changes *ChangeLog) openNewest() error {
+	start := changes.segments[len(changes.segments)-1]
+	file, err := os.OpenFile(changes.segmentName(start), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	changes.nextOffset = start
+	changes.segmentEntries = 0
+	validLen, err := readChanges(file, func(entry ChangeLogEntry) bool {
+		changes.nextOffset = entry.Offset + 1
+		changes.lastLSN = entry.LSN
+		changes.segmentEntries++
+		return true
+	})
+	if err == nil {
+		err = file.Truncate(validLen)
+	}
+	if err == nil {
+		_, err = file.Seek(validLen, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	changes.file = file
+	changes.size = validLen
+	return nil
+}
+
+func (changes *ChangeLog) segmentName(start uint64) string {
+	return filepath.Join(changes.dir, fmt.Sprintf(changeLogSegmentFormat, start))
+}
+
+// Reads changes from r until the end or the first one that can't be
+// decoded, or fn returns false. Returns the number of bytes read up to there
+func readChanges(r io.Reader, fn func(ChangeLogEntry) bool) (int64, error) {
+	reader := bufio.NewReader(r)
+	var validLen int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return validLen, nil
+		} else if err != nil {
+			return validLen, err
+		}
+
+		var entry ChangeLogEntry
+		if json.Unmarshal(line, &entry) != nil || len(entry.Events) == 0 {
+			return validLen, nil
+		}
+		if !fn(entry) {
+			return validLen, nil
+		}
+		validLen += int64(len(line))
+	}
+}
+
+// Returns the lsn of the last write-ahead log record with a change in the log
+func (changes *ChangeLog) LastLSN() uint64 {
+	changes.Lock()
+	defer changes.Unlock()
+	return changes.lastLSN
+}
+
+// Returns the offsets of the oldest change retained and one past the newest
+func (changes *ChangeLog) Bounds() (first uint64, end uint64) {
+	changes.Lock()
+	defer changes.Unlock()
+	return changes.firstOffset(), changes.nextOffset
+}
+
+// Caller must hold the lock
+func (changes *ChangeLog) firstOffset() uint64 {
+	if len(changes.segments) == 0 {
+		return changes.nextOffset
+	}
+	return changes.segments[0]
+}
+
+// Adds the change a write-ahead log record made to the end of the log. If
+// it can't be written it's kept, and written before the next change is
+func (changes *ChangeLog) Append(lsn uint64, time int64, change Change) error {
+	if len(change) == 0 {
+		return nil
+	}
+	changes.Lock()
+	defer changes.Unlock()
+
+	changes.pending = append(changes.pending, ChangeLogEntry{LSN: lsn, Time: time, Events: change})
+	return changes.writePending()
+}
+
+// Writes the changes not written yet, in order, stopping at the first that
+// fails. A partly written change is cut off again. Caller must hold the lock
+func (changes *ChangeLog) writePending() error {
+	for len(changes.pending) > 0 {
+		if changes.file == nil || changes.segmentEntries >= changeLogSegmentSize {
+			err := changes.openSegment()
+			if err != nil {
+				return err
+			}
+		}
+
+		entry := changes.pending[0]
+		entry.Offset = changes.nextOffset
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		n, err := changes.file.Write(append(line, '\n'))
+		if err != nil {
+			if n > 0 {
+				changes.file.Truncate(changes.size)
+			}
+			return err
+		}
+		changes.pending = changes.pending[1:]
+		changes.size += int64(n)
+		changes.nextOffset++
+		changes.lastLSN = entry.LSN
+		changes.segmentEntries++
+		changes.unsynced = true
+	}
+
+	return changes.dropOldSegments()
+}
+
+// Starts a new segment at the next offset. Caller must hold the lock
+func (changes *ChangeLog) openSegment() error {
+	if changes.file != nil {
+		err := changes.file.Sync()
+		if err != nil {
+			return err
+		}
+		changes.file.Close()
+		changes.unsynced = false
+	}
+
+	file, err := os.OpenFile(changes.segmentName(changes.nextOffset), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	changes.file = file
+	changes.size = 0
+	changes.segments = append(changes.segments, changes.nextOffset)
+	changes.segmentEntries = 0
+	return nil
+}
+
+// Removes the oldest segments for as long as at least retention changes
+// are left without them. Caller must hold the lock
+func (changes *ChangeLog) dropOldSegments() error {
+	for len(changes.segments) > 1 && changes.nextOffset-changes.segments[1] >= uint64(changes.retention) {
+		err := os.Remove(changes.segmentName(changes.segments[0]))
+		if err != nil {
+			return err
+		}
+		changes.segments = changes.segments[1:]
+	}
+	return nil
+}
+
+// Drops every change made by a write-ahead log record past lsn. The log is
+// written after the write-ahead log, but with a sync policy other than
+// always the write-ahead log can lose records on a crash that the change
+// log kept, and those lsns will be used again
+func (changes *ChangeLog) TruncateAfter(lsn uint64) error {
+	changes.Lock()
+	defer changes.Unlock()
+
+	for changes.lastLSN > lsn && len(changes.segments) > 0 {
+		start := changes.segments[len(changes.segments)-1]
+		changes.file.Close()
+		changes.file = nil
+
+		file, err := os.OpenFile(changes.segmentName(start), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		validLen, err := readChanges(file, func(entry ChangeLogEntry) bool {
+			return entry.LSN <= lsn
+		})
+		if err == nil && validLen == 0 {
+			// nothing in this segment survives
+			file.Close()
+			err = os.Remove(changes.segmentName(start))
+			changes.segments = changes.segments[:len(changes.segments)-1]
+			changes.lastLSN = 0
+			changes.nextOffset = start
+			if err == nil && len(changes.segments) > 0 {
+				err = changes.openNewest()
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err == nil {
+			err = file.Truncate(validLen)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+		return changes.openNewest()
+	}
+	return nil
+}
+
+// Writes any changes still pending and flushes the log to disk
+func (changes *ChangeLog) Sync() error {
+	changes.Lock()
+	defer changes.Unlock()
+
+	err := changes.writePending()
+	if err != nil {
+		return err
+	}
+	if !changes.unsynced || changes.file == nil {
+		return nil
+	}
+	err = changes.file.Sync()
+	if err == nil {
+		changes.unsynced = false
+	}
+	return err
+}
+
+// Calls fn on every change from offset on, until fn returns false. Changes
+// appended while it runs may or may not be included
+func (changes *ChangeLog) Range(offset uint64, fn func(ChangeLogEntry) bool) error {
+	changes.Lock()
+	segments := append([]uint64(nil), changes.segments...)
+	end := changes.nextOffset
+	first := changes.firstOffset()
+	changes.Unlock()
+
+	if offset < first {
+		return ErrOffsetTooOld
+	}
+
+	// start from the last segment starting at or before offset
+	i := sort.Search(len(segments), func(i int) bool { return segments[i] > offset }) - 1
+	if i < 0 {
+		return nil
+	}
+
+	for ; i < len(segments); i++ {
+		file, err := os.Open(changes.segmentName(segments[i]))
+		if os.IsNotExist(err) {
+			// dropped by retention since we looked
+			return ErrOffsetTooOld
+		} else if err != nil {
+			return err
+		}
+
+		more := true
+		_, err = readChanges(file, func(entry ChangeLogEntry) bool {
+			if entry.Offset >= end {
+				more = false
+				return false
+			}
+			if entry.Offset < offset {
+				return true
+			}
+			more = fn(entry)
+			return more
+		})
+		file.Close()
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the change at offset
+func (changes *ChangeLog) Get(offset uint64) (ChangeLogEntry, error) {
+	var found ChangeLogEntry
+	var exists bool
+	err := changes.Range(offset, func(entry ChangeLogEntry) bool {
+		found, exists = entry, entry.Offset == offset
+		return false
+	})
+	if err == nil && !exists {
+		err = ErrInvalidOffset
+	}
+	return found, err
+}
+
+/// --- consumers ---
+
+func (changes *ChangeLog) consumerDir() string {
+	return filepath.Join(changes.dir, "consumers")
+}
+
+// Writes a consumer to a temporary file, syncs it and moves it into place
+func (changes *ChangeLog) SaveConsumer(consumer ChangeConsumer) error {
+	dir := changes.consumerDir()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(consumer)
+	if err != nil {
+		return err
+	}
+
+	tmpName := filepath.Join(dir, consumer.Name+".tmp")
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	_, err = file.Write(jsonData)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpName, filepath.Join(dir, consumer.Name+".json"))
+	if err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+func (changes *ChangeLog) LoadConsumer(name string) (ChangeConsumer, error) {
+	var consumer ChangeConsumer
+	jsonData, err := os.ReadFile(filepath.Join(changes.consumerDir(), name+".json"))
+	if os.IsNotExist(err) {
+		return consumer, ErrConsumerNotFound
+	} else if err != nil {
+		return consumer, err
+	}
+	err = json.Unmarshal(jsonData, &consumer)
+	return consumer, err
+}
+
+func (changes *ChangeLog) RemoveConsumer(name string) error {
+	err := os.Remove(filepath.Join(changes.consumerDir(), name+".json"))
+	if os.IsNotExist(err) {
+		return ErrConsumerNotFound
+	}
+	return err
+}
+
+/// --- kvs ---
+
+// Returns up to limit changes from offset on. Changes covered by skip (a
+// clock) are left out
+func (kvs *KeyValStoreDatabase) ReadChanges(offset uint64, limit int, skip map[string]int) (ChangePage, error) {
+	first, end := kvs.changes.Bounds()
+	page := ChangePage{
+		Changes:     make([]ChangeLogEntry, 0),
+		NextOffset:  offset,
+		FirstOffset: first,
+		EndOffset:   end,
+		Node:        kvs.LocalAddress,
+	}
+	if offset > end {
+		return page, ErrInvalidOffset
+	}
+
+	err := kvs.changes.Range(offset, func(entry ChangeLogEntry) bool {
+		page.NextOffset = entry.Offset + 1
+		if entry.Events.after(skip) {
+			page.Changes = append(page.Changes, entry)
+		}
+		return len(page.Changes) < limit
+	})
+	return page, err
+}
+
+// Returns the clock this node's log starts from at offset: everything
+// before offset is counted in it, and nothing after
+func (kvs *KeyValStoreDatabase) positionAt(offset uint64) (map[string]int, error) {
+	// the log only grows under the kvs lock, so the clock matches its end
+	kvs.Lock()
+	first, end := kvs.changes.Bounds()
+	current := kvs.copyMetadata()
+	kvs.Unlock()
+
+	switch {
+	case offset > end:
+		return nil, ErrInvalidOffset
+	case offset == end:
+		return current, nil
+	case offset < first:
+		return nil, ErrOffsetTooOld
+	}
+	entry, err := kvs.changes.Get(offset)
+	if err != nil {
+		return nil, err
+	}
+	return entry.clockBefore(), nil
+}
+
+// Returns the first offset in this node's log that position doesn't
+// count, for a consumer whose offset is in another node's log. The
+// changes of senders don't all have to come before it in this log too, so
+// position is also what to skip after it. Returns ErrOffsetTooOld if this
+// log doesn't go back far enough for position
+func (kvs *KeyValStoreDatabase) offsetOf(position map[string]int, senders map[string]struct{}) (uint64, error) {
+	kvs.Lock()
+	first, end := kvs.changes.Bounds()
+	start := kvs.copyMetadata()
+	kvs.Unlock()
+
+	var offset uint64 = end
+	found := false
+	err := kvs.changes.Range(first, func(entry ChangeLogEntry) bool {
+		if !found {
+			start = entry.clockBefore()
+			found = true
+		}
+		if entry.Events.after(position) {
+			offset = entry.Offset
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// anything this log starts after, position has to have seen already
+	for sender := range senders {
+		if start[sender] > position[sender] {
+			return 0, ErrOffsetTooOld
+		}
+	}
+	return offset, nil
+}
+
+// Records that consumer has read every change before offset in this
+// node's log
+func (kvs *KeyValStoreDatabase) CommitConsumer(name string, offset uint64) (ChangeConsumer, error) {
+	position, err := kvs.positionAt(offset)
+	if err != nil {
+		return ChangeConsumer{}, err
+	}
+	consumer := ChangeConsumer{
+		Name:     name,
+		Offset:   offset,
+		Node:     kvs.LocalAddress,
+		Position: position,
+		Time:     time.Now().UnixMilli(),
+	}
+	return consumer, kvs.changes.SaveConsumer(consumer)
+}
+
+// Returns the next changes for a consumer, from the oldest change retained
+// if it hasn't committed anything yet
+func (kvs *KeyValStoreDatabase) ConsumerChanges(name string, limit int, senders map[string]struct{}) (ChangePage, error) {
+	consumer, err := kvs.changes.LoadConsumer(name)
+	if err == ErrConsumerNotFound {
+		first, _ := kvs.changes.Bounds()
+		return kvs.ReadChanges(first, limit, nil)
+	} else if err != nil {
+		return ChangePage{}, err
+	}
+
+	if consumer.Node == kvs.LocalAddress {
+		return kvs.ReadChanges(consumer.Offset, limit, nil)
+	}
+
+	// the offset is in the log of a node that was primary before
+	offset, err := kvs.offsetOf(consumer.Position, senders)
+	if err != nil {
+		return ChangePage{}, err
+	}
+	return kvs.ReadChanges(offset, limit, consumer.Position)
+}
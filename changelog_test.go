@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Returns the key of the first event of every change on the page
+func changePageKeys(page ChangePage) []string {
+	keys := make([]string, 0)
+	for _, entry := range page.Changes {
+		keys = append(keys, entry.Events[0].Key)
+	}
+	return keys
+}
+
+// A consumer picks up where it committed after the node restarts, including
+// changes the change log hadn't written yet when it went down
+func TestChangeLogResumesAcrossRestart(t *testing.T) {
+	config := walTestConfig(t)
+	kvs := NewKeyValStoreDatabase("n0")
+	err := kvs.OpenStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(kvs *KeyValStoreDatabase, key string) {
+		if _, _, _, err := kvs.PutData(key, KeyEntry{Value: key}, WriteCondition{}, nil, "n0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put(kvs, "a")
+	put(kvs, "b")
+	if _, err = kvs.CommitConsumer("reader", 1); err != nil {
+		t.Fatal(err)
+	}
+	put(kvs, "c")
+
+	// the node goes down before the change log gets the last write
+	if err = kvs.changes.TruncateAfter(kvs.wal.LastLSN() - 1); err != nil {
+		t.Fatal(err)
+	}
+	kvs.wal.file.Close()
+	kvs.changes.file.Close()
+
+	reopened := NewKeyValStoreDatabase("n0")
+	err = reopened.OpenStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.wal.file.Close()
+	put(reopened, "d")
+
+	page, err := reopened.ConsumerChanges("reader", DefaultChangesLimit, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "c", "d"}; !reflect.DeepEqual(changePageKeys(page), want) {
+		t.Errorf("got changes to %v, want %v", changePageKeys(page), want)
+	}
+	if page.NextOffset != 4 || page.EndOffset != 4 {
+		t.Errorf("got next offset %d and end %d, want 4", page.NextOffset, page.EndOffset)
+	}
+}
+
+// A change that can't be written holds back the ones after it, so none are
+// skipped: they're written with the next change, or after a restart
+func TestChangeLogKeepsFailedChanges(t *testing.T) {
+	config := walTestConfig(t)
+	kvs := NewKeyValStoreDatabase("n0")
+	err := kvs.OpenStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(kvs *KeyValStoreDatabase, key string) {
+		if _, _, _, err := kvs.PutData(key, KeyEntry{Value: key}, WriteCondition{}, nil, "n0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logged := func(kvs *KeyValStoreDatabase) []string {
+		keys := make([]string, 0)
+		err := kvs.changes.Range(0, func(entry ChangeLogEntry) bool {
+			keys = append(keys, entry.Events[0].Key)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	breakFile := func(kvs *KeyValStoreDatabase) {
+		kvs.changes.file.Close()
+	}
+
+	put(kvs, "a")
+	breakFile(kvs)
+	put(kvs, "b")
+	put(kvs, "c")
+	if lsn := kvs.changes.LastLSN(); lsn != 1 {
+		t.Errorf("got last lsn %d with changes unwritten, want 1", lsn)
+	}
+
+	// the log can be written again
+	start := kvs.changes.segments[len(kvs.changes.segments)-1]
+	kvs.changes.file, err = os.OpenFile(kvs.changes.segmentName(start), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(kvs, "d")
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(logged(kvs), want) {
+		t.Errorf("got changes to %v, want %v", logged(kvs), want)
+	}
+
+	// or the node goes down first
+	breakFile(kvs)
+	put(kvs, "e")
+	kvs.wal.file.Close()
+
+	reopened := NewKeyValStoreDatabase("n0")
+	err = reopened.OpenStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.wal.file.Close()
+	defer reopened.changes.file.Close()
+	put(reopened, "f")
+	if want := []string{"a", "b", "c", "d", "e", "f"}; !reflect.DeepEqual(logged(reopened), want) {
+		t.Errorf("got changes to %v after restarting, want %v", logged(reopened), want)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Preconditions for a conditional put or delete. They're evaluated by the
+// node that accepts the write, while it holds the kvs lock; replicas just
+// apply the outcome.
+type WriteCondition struct {
+	IfAbsent   bool
+	IfPresent  bool
+	IfVersion  *int64
+	IfValue    interface{}
+	HasIfValue bool
+
+	// versions from the If-Match and If-None-Match headers
+	IfMatch     []int64
+	IfNoneMatch []int64
+}
+
+// Returns true if no precondition was given
+func (cond WriteCondition) IsEmpty() bool {
+	return !cond.IfAbsent && !cond.IfPresent && cond.IfVersion == nil && !cond.HasIfValue &&
+		len(cond.IfMatch) == 0 && len(cond.IfNoneMatch) == 0
+}
+
+// Returns true if the current state of the key satisfies every precondition.
+// Expired keys should be passed in as not existing
+func (cond WriteCondition) Check(entry KeyEntry, exists bool) bool {
+	if cond.IfAbsent && exists {
+		return false
+	}
+	if cond.IfPresent && !exists {
+		return false
+	}
+	if cond.IfVersion != nil && (!exists || entry.Version != *cond.IfVersion) {
+		return false
+	}
+	if cond.HasIfValue && (!exists || !reflect.DeepEqual(entry.Value, cond.IfValue)) {
+		return false
+	}
+	if len(cond.IfMatch) > 0 && (!exists || !containsVersion(cond.IfMatch, entry.Version)) {
+		return false
+	}
+	if len(cond.IfNoneMatch) > 0 && exists && containsVersion(cond.IfNoneMatch, entry.Version) {
+		return false
+	}
+	return true
+}
+
+func containsVersion(versions []int64, version int64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds a WriteCondition from the optional if-* fields of a request body
+func parseWriteCondition(data map[string]interface{}) (WriteCondition, error) {
+	var cond WriteCondition
+	var ok bool
+
+	if val, exists := data["if-absent"]; exists {
+		if cond.IfAbsent, ok = val.(bool); !ok {
+			return cond, errors.New("if-absent must be a boolean")
+		}
+	}
+	if val, exists := data["if-present"]; exists {
+		if cond.IfPresent, ok = val.(bool); !ok {
+			return cond, errors.New("if-present must be a boolean")
+		}
+	}
+	if val, exists := data["if-version"]; exists {
+		version, ok := val.(float64)
+		if !ok {
+			return cond, errors.New("if-version must be a number")
+		}
+		v := int64(version)
+		cond.IfVersion = &v
+	}
+	if val, exists := data["if-value"]; exists {
+		cond.IfValue = val
+		cond.HasIfValue = true
+	}
+
+	return cond, nil
+}
+
+// The optional fields parseWriteCondition looks for
+var writeConditionKeys = []string{"if-absent", "if-present", "if-version", "if-value"}
+
+/// --- ETags ---
+
+// ETags are just the key's version in quotes
+func formatEtag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// Parses an If-Match or If-None-Match header into the versions it lists.
+// Returns any as true for "*". Tags that aren't ours never match anything,
+// and neither do weak tags under strong comparison (If-Match), since our
+// tags are all strong
+func parseEtagList(value string, strong bool) (versions []int64, any bool) {
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil, true
+		}
+		weak := strings.HasPrefix(tag, "W/")
+		tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+		version, err := strconv.ParseInt(tag, 10, 64)
+		if err != nil || (weak && strong) {
+			version = -1
+		}
+		versions = append(versions, version)
+	}
+	return versions, false
+}
+
+// Adds the If-Match and If-None-Match headers of a write to cond
+func parseEtagConditions(header http.Header, cond *WriteCondition) {
+	if value := header.Get("If-Match"); value != "" {
+		versions, any := parseEtagList(value, true)
+		if any {
+			cond.IfPresent = true
+		} else {
+			cond.IfMatch = versions
+		}
+	}
+	if value := header.Get("If-None-Match"); value != "" {
+		versions, any := parseEtagList(value, false)
+		if any {
+			cond.IfAbsent = true
+		} else {
+			cond.IfNoneMatch = versions
+		}
+	}
+}
+
+// Returns the status a read of entry should respond with given the
+// request's headers: 412 if If-Match doesn't match, 304 if If-None-Match
+// does, and 200 otherwise
+func checkReadPreconditions(header http.Header, entry KeyEntry) int {
+	if value := header.Get("If-Match"); value != "" {
+		versions, any := parseEtagList(value, true)
+		if !any && !containsVersion(versions, entry.Version) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if value := header.Get("If-None-Match"); value != "" {
+		versions, any := parseEtagList(value, false)
+		if any || containsVersion(versions, entry.Version) {
+			return http.StatusNotModified
+		}
+	}
+	return http.StatusOK
+}
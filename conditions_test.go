@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckReadPreconditions(t *testing.T) {
+	entry := KeyEntry{Value: "x", Version: 7}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"no conditions", nil, http.StatusOK},
+		{"if-match same version", map[string]string{"If-Match": `"7"`}, http.StatusOK},
+		{"if-match in a list", map[string]string{"If-Match": `"3", "7"`}, http.StatusOK},
+		{"if-match other version", map[string]string{"If-Match": `"3"`}, http.StatusPreconditionFailed},
+		{"if-match any", map[string]string{"If-Match": `*`}, http.StatusOK},
+		{"if-match weak tag", map[string]string{"If-Match": `W/"7"`}, http.StatusPreconditionFailed},
+		{"if-match weak and strong tags", map[string]string{"If-Match": `W/"7", "7"`}, http.StatusOK},
+		{"if-match not our tag", map[string]string{"If-Match": `"abc"`}, http.StatusPreconditionFailed},
+		{"if-none-match same version", map[string]string{"If-None-Match": `"7"`}, http.StatusNotModified},
+		{"if-none-match weak tag", map[string]string{"If-None-Match": `W/"7"`}, http.StatusNotModified},
+		{"if-none-match other version", map[string]string{"If-None-Match": `"3"`}, http.StatusOK},
+		{"if-none-match any", map[string]string{"If-None-Match": `*`}, http.StatusNotModified},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := make(http.Header)
+			for name, value := range test.header {
+				header.Set(name, value)
+			}
+			if got := checkReadPreconditions(header, entry); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseEtagConditions(t *testing.T) {
+	tests := []struct {
+		name      string
+		ifMatch   string
+		wantMatch []int64
+	}{
+		{"strong tag", `"7"`, []int64{7}},
+		{"weak tag", `W/"7"`, []int64{-1}},
+		{"any", `*`, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := make(http.Header)
+			header.Set("If-Match", test.ifMatch)
+			var cond WriteCondition
+			parseEtagConditions(header, &cond)
+
+			if len(cond.IfMatch) != len(test.wantMatch) {
+				t.Fatalf("got if-match %v, want %v", cond.IfMatch, test.wantMatch)
+			}
+			for i := range cond.IfMatch {
+				if cond.IfMatch[i] != test.wantMatch[i] {
+					t.Errorf("got if-match %v, want %v", cond.IfMatch, test.wantMatch)
+				}
+			}
+			if cond.IfPresent != (test.ifMatch == "*") {
+				t.Errorf("got if-present %v", cond.IfPresent)
+			}
+		})
+	}
+}
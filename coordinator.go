@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// States of a transaction in its coordinator's record
+const (
+	TxnPreparing = "preparing"
+	TxnCommitted = "committed"
+	TxnAborted   = "aborted"
+)
+
+// The coordinator's durable record of a transaction. It's written before
+// any shard is asked to prepare and again once the outcome is decided, and
+// removed once every shard has heard the outcome. The decided record is
+// also copied to the rest of the coordinator's shard, so the outcome can be
+// found without the coordinator
+type TxnRecord struct {
+	Id     string `json:"id"`
+	State  string `json:"state"`
+	Shards []int  `json:"shards"`
+}
+
+// A client's transaction
+type TxnRequest struct {
+	Reads      []string
+	Conditions map[string]map[string]interface{} // the if-* fields for each key
+	Writes     []TxnWrite
+}
+
+// What a single shard is asked to prepare
+type txnPart struct {
+	reads      []string
+	conditions map[string]interface{}
+	writes     []TxnWrite
+	keys       map[string]struct{}
+}
+
+// A shard couldn't be reached, or couldn't prepare its part for now
+var ErrShardUnavailable = errors.New("shard is unavailable")
+
+// Runs a transaction with two-phase commit, coordinated by this node. Every
+// shard with a key in the transaction prepares it on its primary, and it
+// only commits if they all do. Returns the values of the keys in req.Reads,
+// or the first shard's reason for not preparing
+func runTransaction(req TxnRequest, metadata map[string]int) (map[string]interface{}, map[string]int, error) {
+	// split the transaction up by shard
+	parts := make(map[int]*txnPart)
+	partFor := func(key string) *txnPart {
+		shardId := ring.GetShardId(key)
+		if parts[shardId] == nil {
+			parts[shardId] = &txnPart{conditions: make(map[string]interface{}), keys: make(map[string]struct{})}
+		}
+		parts[shardId].keys[key] = struct{}{}
+		return parts[shardId]
+	}
+	for _, key := range req.Reads {
+		part := partFor(key)
+		part.reads = append(part.reads, key)
+	}
+	for key, cond := range req.Conditions {
+		partFor(key).conditions[key] = cond
+	}
+	for _, write := range req.Writes {
+		part := partFor(write.Key)
+		part.writes = append(part.writes, write)
+	}
+
+	record := TxnRecord{Id: newTxnId(), State: TxnPreparing}
+	for shardId := range parts {
+		record.Shards = append(record.Shards, shardId)
+	}
+	sort.Ints(record.Shards)
+
+	err := writeTxnRecord(txnDir(), record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// phase one: every shard prepares at once
+	reads := make(map[string]interface{}, len(req.Reads))
+	mergedMetadata := make(map[string]int)
+	errs := make([]error, len(record.Shards))
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i, shardId := range record.Shards {
+		wg.Add(1)
+		go func(i int, shardId int) {
+			defer wg.Done()
+			values, currMetadata, err := prepareOnShard(shardId, record, parts[shardId], metadata)
+
+			lock.Lock()
+			defer lock.Unlock()
+			errs[i] = err
+			for key, value := range values {
+				reads[key] = value
+			}
+			mergeMetadata(mergedMetadata, currMetadata)
+		}(i, shardId)
+	}
+	wg.Wait()
+
+	var prepareErr error
+	for _, err := range errs {
+		if err != nil {
+			prepareErr = err
+			break
+		}
+	}
+
+	// the outcome is decided the moment it's on disk
+	record.State = TxnCommitted
+	if prepareErr != nil {
+		record.State = TxnAborted
+	}
+	err = writeTxnRecord(txnDir(), record)
+	if err != nil && record.State == TxnCommitted {
+		// couldn't save the commit, so abort instead. If this write fails
+		// too the record stays preparing, which recovery also aborts
+		record.State = TxnAborted
+		prepareErr = err
+		err = writeTxnRecord(txnDir(), record)
+	}
+	if err == nil {
+		copyTxnRecord(record)
+	}
+
+	// phase two: tell every shard. Shards that can't be reached now are
+	// retried by resolveTransactions
+	currMetadata, _ := finishTxn(record)
+	mergeMetadata(mergedMetadata, currMetadata)
+
+	if record.State == TxnAborted {
+		return nil, mergedMetadata, prepareErr
+	}
+	return reads, mergedMetadata, nil
+}
+
+// Asks a shard's primary to prepare its part of a transaction
+func prepareOnShard(shardId int, record TxnRecord, part *txnPart, metadata map[string]int) (map[string]interface{}, map[string]int, error) {
+	txn := PreparedTxn{
+		Id:               record.Id,
+		Coordinator:      localAddress,
+		CoordinatorShard: localShardId,
+		Shards:           record.Shards,
+		Writes:           part.writes,
+	}
+	for key := range part.keys {
+		txn.Keys = append(txn.Keys, key)
+	}
+
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"txn":             txn,
+		"reads":           part.reads,
+		"conditions":      part.conditions,
+		"causal-metadata": metadata,
+	})
+
+	res, err := sendToShardPrimary(shardId, "/rep/txn/prepare", jsonData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrShardUnavailable, err)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Reads    map[string]interface{} `json:"reads"`
+		Metadata map[string]int         `json:"causal-metadata"`
+		Error    string                 `json:"error"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return body.Reads, body.Metadata, nil
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return nil, body.Metadata, fmt.Errorf("%w: %s", ErrShardUnavailable, body.Error)
+	case http.StatusPreconditionFailed:
+		return nil, body.Metadata, ErrPreconditionFailed
+	case http.StatusConflict:
+		return nil, body.Metadata, ErrKeyLocked
+	case http.StatusInsufficientStorage:
+		return nil, body.Metadata, ErrOutOfMemory
+	case http.StatusGone:
+		return nil, body.Metadata, ErrTxnAborted
+	default:
+		return nil, body.Metadata, errors.New(body.Error)
+	}
+}
+
+// Sends the outcome in record to every shard in it, and removes the record
+// once they've all got it. Returns the merged metadata of the shards that
+// answered, and whether they all did
+func finishTxn(record TxnRecord) (map[string]int, bool) {
+	endpoint := "/rep/txn/commit"
+	if record.State != TxnCommitted {
+		endpoint = "/rep/txn/abort"
+	}
+	jsonData, _ := json.Marshal(map[string]interface{}{"txn-id": record.Id})
+
+	mergedMetadata := make(map[string]int)
+	done := true
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, shardId := range record.Shards {
+		wg.Add(1)
+		go func(shardId int) {
+			defer wg.Done()
+
+			// shards that no longer have the transaction already finished it
+			res, err := sendToShardPrimary(shardId, endpoint, jsonData)
+			ok := err == nil && (res.StatusCode == http.StatusOK || res.StatusCode == http.StatusNotFound)
+
+			// a shard that already finished it the other way has nothing
+			// more to hear, and asking again won't change its answer
+			if err == nil && res.StatusCode == http.StatusConflict {
+				log.Printf("shard %d already finished transaction %s the other way", shardId, record.Id)
+				ok = true
+			}
+
+			var body struct {
+				Metadata map[string]int `json:"causal-metadata"`
+			}
+			if err == nil {
+				json.NewDecoder(res.Body).Decode(&body)
+				res.Body.Close()
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			done = done && ok
+			mergeMetadata(mergedMetadata, body.Metadata)
+		}(shardId)
+	}
+	wg.Wait()
+
+	if done {
+		err := removeTxnRecord(txnDir(), record.Id)
+		if err != nil {
+			log.Println(err)
+		}
+		dropTxnRecordCopies(record.Id)
+	}
+	return mergedMetadata, done
+}
+
+// Sends a message to a shard's primary, or to any other replica if the
+// primary doesn't answer. A replica that doesn't answer is left in the
+// view: it's only down as far as this one message can tell
+func sendToShardPrimary(shardId int, endpoint string, data []byte) (*http.Response, error) {
+	if shardId < 0 || shardId >= len(ring.Shards) {
+		return nil, errors.New("no such shard")
+	}
+
+	primary := shardPrimary(shardId)
+	nodes := make([]string, 0, len(ring.Shards[shardId].Replicas))
+	if primary != "" {
+		nodes = append(nodes, primary)
+	}
+	for node := range ring.Shards[shardId].Replicas {
+		if node != primary {
+			nodes = append(nodes, node)
+		}
+	}
+
+	for _, node := range nodes {
+		res, err := txnCall(node, endpoint, http.MethodPost, data)
+		if err == nil {
+			return res, nil
+		}
+	}
+	return nil, errors.New("all nodes specified are down or unresponsive")
+}
+
+// Sends a transaction message to node, giving up after DEFAULT_TIMEOUT.
+// The body of the answer is read before returning
+func txnCall(node string, endpoint string, method string, data []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_TIMEOUT)
+	defer cancel()
+
+	res, err := replicaCall(ctx, node, endpoint, method, data, false)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+// Run once on startup, before serving anything: transactions that were
+// still preparing when the node went down can never commit now
+func recoverTransactions() {
+	records, err := listTxnRecords(txnDir())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, record := range records {
+		if record.State == TxnPreparing {
+			record.State = TxnAborted
+			err = writeTxnRecord(txnDir(), record)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// Background loop that finishes transactions left hanging by a failure.
+// As a coordinator it keeps sending decided outcomes to shards that didn't
+// get them. As a shard primary it finds out how any transaction prepared
+// for longer than TXN_TIMEOUT ended
+func resolveTransactions() {
+	ticker := time.NewTicker(TXN_RESOLVE_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		records, err := listTxnRecords(txnDir())
+		if err != nil {
+			log.Println(err)
+		}
+		for _, record := range records {
+			if record.State != TxnPreparing {
+				finishTxn(record)
+			}
+		}
+		forgetBefore := time.Now().Add(-TXN_FINISHED_RETENTION)
+		kvsDb.PruneFinishedTxns(forgetBefore.UnixMilli())
+		err = pruneTxnRecordCopies(forgetBefore)
+		if err != nil {
+			log.Println(err)
+		}
+
+		// only the shard's primary resolves prepared transactions
+		if localShardId < 0 || localShardId >= len(ring.Shards) {
+			continue
+		}
+		if shardPrimary(localShardId) != localAddress {
+			continue
+		}
+
+		cutoff := time.Now().Add(-TXN_TIMEOUT).UnixMilli()
+		for _, txn := range kvsDb.PreparedTxns() {
+			if txn.Time > cutoff {
+				continue
+			}
+			resolvePreparedTxn(txn)
+		}
+	}
+}
+
+// Finds out how a transaction prepared here ended and finishes it the same
+// way. Whoever doesn't answer is left in the view. It asks, until one of
+// them knows:
+//   - the rest of this shard, one of which committed it if this node
+//     couldn't be reached at the time
+//   - the coordinator. If it's still preparing, it's left to finish
+//   - the rest of the coordinator's shard, which hold copies of its record
+//   - the other shards in the transaction. One that hasn't prepared it
+//     never will, so it can abort
+//
+// If every shard has it prepared and none of them know the outcome, it
+// stays prepared until the coordinator or a copy of its record is back
+func resolvePreparedTxn(txn PreparedTxn) {
+	var err error
+	state, version := finishedOnShard(txn.Id)
+	if state == TxnCommitted {
+		// with the same version, so this replica stores the same writes
+		err = kvsDb.SettleTxn(txn.Id, version)
+	} else {
+		if state == "" {
+			state = coordinatorOutcome(txn)
+			if state == TxnPreparing {
+				return
+			}
+		}
+		if state == "" {
+			state = terminateOnShards(txn)
+		}
+
+		switch state {
+		case TxnAborted:
+			err = abortPreparedTxn(txn.Id)
+		case TxnCommitted:
+			_, err = commitPreparedTxn(txn.Id)
+		default:
+			log.Printf("no one knows how prepared transaction %s ended yet", txn.Id)
+		}
+	}
+	if err != nil && err != ErrTxnNotFound {
+		log.Println(err)
+	}
+}
+
+// Returns how the rest of this node's shard finished a transaction, and the
+// version it was committed with, or "" if none of them have
+func finishedOnShard(id string) (string, int64) {
+	for node := range removeLocalAddressFromMap(ring.Shards[localShardId].Replicas) {
+		var finished FinishedTxn
+		if txnAnswer(node, "/rep/shard/txn/"+id, http.MethodGet, nil, &finished) {
+			return finished.State, finished.Version
+		}
+	}
+	return "", 0
+}
+
+// Returns the state of a transaction's record on its coordinator, or on
+// the rest of the coordinator's shard if the coordinator doesn't have it,
+// or "" if none of them do
+func coordinatorOutcome(txn PreparedTxn) string {
+	var record TxnRecord
+	if txnAnswer(txn.Coordinator, "/rep/txn/"+txn.Id, http.MethodGet, nil, &record) {
+		return record.State
+	}
+
+	if txn.CoordinatorShard < 0 || txn.CoordinatorShard >= len(ring.Shards) {
+		return ""
+	}
+	for node := range ring.Shards[txn.CoordinatorShard].Replicas {
+		if node == txn.Coordinator || node == localAddress {
+			continue
+		}
+		if txnAnswer(node, "/rep/txn/"+txn.Id, http.MethodGet, nil, &record) {
+			return record.State
+		}
+	}
+	return ""
+}
+
+// Asks every other shard in a transaction how it ended, aborting it on any
+// that hasn't prepared it. Returns the first outcome one of them knows, or
+// "" if they all have it prepared or can't be reached
+func terminateOnShards(txn PreparedTxn) string {
+	jsonData, _ := json.Marshal(map[string]interface{}{"txn-id": txn.Id})
+
+	for _, shardId := range txn.Shards {
+		if shardId == localShardId {
+			continue
+		}
+		res, err := sendToShardPrimary(shardId, "/rep/txn/terminate", jsonData)
+		if err != nil {
+			continue
+		}
+		var answer struct {
+			State string `json:"state"`
+		}
+		ok := res.StatusCode == http.StatusOK && json.NewDecoder(res.Body).Decode(&answer) == nil
+		res.Body.Close()
+		if ok && answer.State != TxnPreparing {
+			return answer.State
+		}
+	}
+	return ""
+}
+
+// Sends a transaction message to node with txnCall, and decodes a 200
+// answer into resp. Returns false for anything else
+func txnAnswer(node string, endpoint string, method string, data []byte, resp interface{}) bool {
+	res, err := txnCall(node, endpoint, method, data)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	return res.StatusCode == http.StatusOK && json.NewDecoder(res.Body).Decode(resp) == nil
+}
+
+// Answers a shard that can't find out from the coordinator how a
+// transaction ended. If this shard hasn't prepared it, it's aborted here
+// first, so the shard can't vote for it later. Returns TxnPreparing if the
+// shard has it prepared, since then only the coordinator's record knows.
+// An abort is only answered once every replica of the shard has it
+func terminateTxn(id string) (string, error) {
+	state, err := kvsDb.RefuseTxn(id)
+	if err != nil || state != TxnAborted {
+		return state, err
+	}
+	return state, replicateAbortTxn(id)
+}
+
+// Commits a transaction prepared on this node and sends its writes to every
+// replica. Committing it again does nothing
+func commitPreparedTxn(id string) (map[string]int, error) {
+	writes, currMetadata, err := kvsDb.CommitTxn(id)
+	if err == ErrTxnCommitted {
+		return currMetadata, nil
+	} else if err != nil {
+		return currMetadata, err
+	}
+	// the messages go out in the background, but who they go to is settled
+	// before returning
+	broadcastKvsBatch(writes, id, currMetadata, localAddress)
+	return currMetadata, nil
+}
+
+// Aborts a transaction prepared on this node and on the rest of its shard.
+// Aborting it again, or before it was ever prepared, just records the abort
+func abortPreparedTxn(id string) error {
+	err := kvsDb.AbortTxn(id)
+	if err != nil {
+		return err
+	}
+	broadcastAbortTxn(id)
+	return nil
+}
+
+/// --- coordinator records ---
+
+// Records are kept next to the write-ahead log
+func txnDir() string {
+	return filepath.Join(kvsDb.config.Dir, "txn")
+}
+
+// Copies of the records of coordinators on this node's shard
+func txnCopyDir() string {
+	return filepath.Join(txnDir(), "copies")
+}
+
+// Copies a decided record to the rest of this node's shard. A replica that
+// doesn't take it in time just can't answer for the coordinator later
+func copyTxnRecord(record TxnRecord) {
+	if localShardId < 0 || localShardId >= len(ring.Shards) {
+		return
+	}
+	jsonData, _ := json.Marshal(map[string]interface{}{"record": record})
+
+	var wg sync.WaitGroup
+	for node := range removeLocalAddressFromMap(ring.Shards[localShardId].Replicas) {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			res, err := txnCall(node, "/rep/txn/record", http.MethodPut, jsonData)
+			if err != nil {
+				log.Printf("couldn't copy the record of transaction %s to %s: %v", record.Id, node, err)
+				return
+			}
+			res.Body.Close()
+		}(node)
+	}
+	wg.Wait()
+}
+
+// Tells the rest of this node's shard they can drop their copies of a
+// record, once every shard has heard its outcome. Copies that are missed
+// are pruned after TXN_FINISHED_RETENTION
+func dropTxnRecordCopies(id string) {
+	if localShardId < 0 || localShardId >= len(ring.Shards) {
+		return
+	}
+	jsonData, _ := json.Marshal(map[string]interface{}{"txn-id": id})
+
+	for node := range removeLocalAddressFromMap(ring.Shards[localShardId].Replicas) {
+		go func(node string) {
+			res, err := txnCall(node, "/rep/txn/record", http.MethodDelete, jsonData)
+			if err == nil {
+				res.Body.Close()
+			}
+		}(node)
+	}
+}
+
+// Stores a copy of a coordinator's decided record. The first outcome
+// copied stands
+func storeTxnRecordCopy(record TxnRecord) error {
+	if record.State != TxnCommitted && record.State != TxnAborted {
+		return errors.New("only decided records are copied")
+	}
+	_, err := readTxnRecord(txnCopyDir(), record.Id)
+	if err != ErrTxnNotFound {
+		return err
+	}
+	return writeTxnRecord(txnCopyDir(), record)
+}
+
+// Removes the copies of records last written before cutoff
+func pruneTxnRecordCopies(cutoff time.Time) error {
+	names, err := filepath.Glob(filepath.Join(txnCopyDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err == nil && info.ModTime().Before(cutoff) {
+			err = os.Remove(name)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTxnId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Ids come from URLs too, so only allow ones newTxnId could have made
+func isValidTxnId(id string) bool {
+	b, err := hex.DecodeString(id)
+	return err == nil && len(b) == 8
+}
+
+// Writes a record to a temporary file in dir, syncs it and moves it into place
+func writeTxnRecord(dir string, record TxnRecord) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	tmpName := filepath.Join(dir, record.Id+".tmp")
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	_, err = file.Write(jsonData)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpName, filepath.Join(dir, record.Id+".json"))
+	if err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+func readTxnRecord(dir string, id string) (TxnRecord, error) {
+	var record TxnRecord
+	jsonData, err := os.ReadFile(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return record, ErrTxnNotFound
+	} else if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(jsonData, &record)
+	return record, err
+}
+
+func listTxnRecords(dir string) ([]TxnRecord, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]TxnRecord, 0, len(names))
+	for _, name := range names {
+		record, err := readTxnRecord(dir, filepath.Base(name[:len(name)-len(".json")]))
+		if err == ErrTxnNotFound {
+			// finished since we listed the directory
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func removeTxnRecord(dir string, id string) error {
+	err := os.Remove(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
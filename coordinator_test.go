@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Points the globals at a single shard holding this node and replicas
+func txnTestShard(t *testing.T, replicas ...string) {
+	kvsDb = NewKeyValStoreDatabase("n0")
+	kvsDb.config.Dir = t.TempDir()
+	localAddress = "n0"
+	localShardId = 0
+	view = NewView() // no nodes to send commits to
+	ring = NewRing(1, map[string]struct{}{"n0": {}})
+	for _, replica := range replicas {
+		ring.Shards[0].Replicas[replica] = struct{}{}
+	}
+}
+
+// Starts a server answering every request with status and body, and
+// returns its address
+func txnTestServer(t *testing.T, status int, body interface{}) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestBroadcastPreparedTxn(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     error
+	}{
+		{"no other replicas", nil, nil},
+		{"every replica acknowledged", []int{http.StatusOK, http.StatusOK}, nil},
+		{"one replica refused", []int{http.StatusOK, http.StatusInternalServerError}, ErrTxnNotReplicated},
+		{"one replica too big", []int{http.StatusRequestEntityTooLarge, http.StatusOK}, ErrTxnNotReplicated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var replicas []string
+			for _, status := range test.statuses {
+				replicas = append(replicas, txnTestServer(t, status, map[string]string{}))
+			}
+			txnTestShard(t, replicas...)
+
+			err := broadcastPreparedTxn(PreparedTxn{Id: "txn", Keys: []string{"a"}})
+			if err != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// How a node in TestResolvePreparedTxn answers; a zero status is a node
+// that's down
+type txnTestAnswer struct {
+	status int
+	body   interface{}
+}
+
+func (answer txnTestAnswer) address(t *testing.T) string {
+	if answer.status == 0 {
+		return "127.0.0.1:1"
+	}
+	return txnTestServer(t, answer.status, answer.body)
+}
+
+// This node is the primary of shard 0, with another replica (peer). The
+// coordinator is on shard 1 with another replica holding a copy of its
+// record, and shard 2 is the other shard in the transaction
+func TestResolvePreparedTxn(t *testing.T) {
+	committed := txnTestAnswer{http.StatusOK, TxnRecord{Id: "txn", State: TxnCommitted}}
+	aborted := txnTestAnswer{http.StatusOK, TxnRecord{Id: "txn", State: TxnAborted}}
+	noRecord := txnTestAnswer{http.StatusNotFound, map[string]string{}}
+
+	tests := []struct {
+		name         string
+		peer         txnTestAnswer
+		coordinator  txnTestAnswer
+		copy         txnTestAnswer
+		other        txnTestAnswer
+		wantPrepared bool
+		wantValue    interface{}
+		wantVersion  int64
+	}{
+		{name: "committed", coordinator: committed, wantValue: "x", wantVersion: makeVersion(1, "n0")},
+		{name: "aborted", coordinator: aborted},
+		{
+			name:         "still preparing",
+			coordinator:  txnTestAnswer{http.StatusOK, TxnRecord{Id: "txn", State: TxnPreparing}},
+			other:        txnTestAnswer{http.StatusOK, map[string]string{"state": TxnAborted}},
+			wantPrepared: true,
+		},
+		{name: "no record anywhere", coordinator: noRecord, copy: noRecord, wantPrepared: true},
+		{name: "coordinator failing", coordinator: txnTestAnswer{http.StatusInternalServerError, map[string]string{}}, wantPrepared: true},
+		{name: "committed in the copy", copy: committed, wantValue: "x", wantVersion: makeVersion(1, "n0")},
+		{name: "aborted in the copy", coordinator: noRecord, copy: aborted},
+		{
+			name:        "committed on the other shard",
+			other:       txnTestAnswer{http.StatusOK, map[string]string{"state": TxnCommitted}},
+			wantValue:   "x",
+			wantVersion: makeVersion(1, "n0"),
+		},
+		{name: "aborted on the other shard", other: txnTestAnswer{http.StatusOK, map[string]string{"state": TxnAborted}}},
+		{
+			name:         "prepared on the other shard",
+			other:        txnTestAnswer{http.StatusOK, map[string]string{"state": TxnPreparing}},
+			wantPrepared: true,
+		},
+		{
+			name:        "committed on another replica of the shard",
+			peer:        txnTestAnswer{http.StatusOK, FinishedTxn{State: TxnCommitted, Version: makeVersion(5, "n1")}},
+			coordinator: aborted, // never asked
+			wantValue:   "x",
+			wantVersion: makeVersion(5, "n1"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			txnTestShard(t, test.peer.address(t))
+			txn := PreparedTxn{
+				Id:               "txn",
+				Coordinator:      test.coordinator.address(t),
+				CoordinatorShard: 1,
+				Shards:           []int{0, 1, 2},
+				Keys:             []string{"a"},
+				Writes:           []TxnWrite{{Key: "a", Value: "x"}},
+			}
+			ring.Shards = append(ring.Shards,
+				Shard{Replicas: map[string]struct{}{txn.Coordinator: {}, test.copy.address(t): {}}},
+				Shard{Replicas: map[string]struct{}{test.other.address(t): {}}})
+			err := kvsDb.AcceptPreparedTxn(txn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resolvePreparedTxn(txn)
+
+			if _, prepared := kvsDb.prepared["txn"]; prepared != test.wantPrepared {
+				t.Errorf("got prepared %v, want %v", prepared, test.wantPrepared)
+			}
+			if kvsDb.isLocked("a") != test.wantPrepared {
+				t.Errorf("got locked %v, want %v", kvsDb.isLocked("a"), test.wantPrepared)
+			}
+			entry, exists, _ := kvsDb.engine.Get("a")
+			if exists != (test.wantValue != nil) || (exists && entry.Value != test.wantValue) {
+				t.Errorf("got %v (exists %v), want %v", entry.Value, exists, test.wantValue)
+			}
+			if exists && entry.Version != test.wantVersion {
+				t.Errorf("got version %d, want %d", entry.Version, test.wantVersion)
+			}
+		})
+	}
+}
+
+// Nodes that don't answer while a prepared transaction is resolved stay in
+// the view
+func TestResolvePreparedTxnKeepsView(t *testing.T) {
+	other := txnTestServer(t, http.StatusOK, map[string]string{"state": TxnPreparing})
+	coordinator := "127.0.0.1:1"
+	txnTestShard(t)
+	ring.Shards = append(ring.Shards, Shard{Replicas: map[string]struct{}{other: {}, coordinator: {}}})
+	view.PutView(coordinator)
+	view.PutView(other)
+
+	txn := PreparedTxn{Id: "txn", Coordinator: coordinator, CoordinatorShard: 1, Shards: []int{0, 1}, Keys: []string{"a"}}
+	err := kvsDb.AcceptPreparedTxn(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolvePreparedTxn(txn)
+
+	if _, prepared := kvsDb.prepared["txn"]; !prepared {
+		t.Error("no longer prepared")
+	}
+	for _, node := range []string{coordinator, other} {
+		if _, exists := view.Nodes[node]; !exists {
+			t.Errorf("%s was dropped from the view", node)
+		}
+	}
+}
+
+// A shard asked how a transaction ended by another that can't reach the
+// coordinator only answers aborted once the abort can't be undone
+func TestTerminateTxn(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(kvs *KeyValStoreDatabase) error
+		replica   int // status the other replica answers with
+		wantState string
+		wantErr   error
+	}{
+		{"never prepared", func(kvs *KeyValStoreDatabase) error { return nil }, http.StatusOK, TxnAborted, nil},
+		{"never prepared, replica refusing", func(kvs *KeyValStoreDatabase) error { return nil }, http.StatusInternalServerError, TxnAborted, ErrAbortNotReplicated},
+		{"prepared", func(kvs *KeyValStoreDatabase) error {
+			return kvs.AcceptPreparedTxn(PreparedTxn{Id: "txn", Keys: []string{"a"}})
+		}, http.StatusOK, TxnPreparing, nil},
+		{"committed", func(kvs *KeyValStoreDatabase) error {
+			err := kvs.AcceptPreparedTxn(PreparedTxn{Id: "txn", Keys: []string{"a"}})
+			if err == nil {
+				_, _, err = kvs.CommitTxn("txn")
+			}
+			return err
+		}, http.StatusOK, TxnCommitted, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			txnTestShard(t, txnTestServer(t, test.replica, map[string]string{}))
+			err := test.setup(kvsDb)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := terminateTxn("txn")
+			if state != test.wantState || err != test.wantErr {
+				t.Errorf("got %s, %v, want %s, %v", state, err, test.wantState, test.wantErr)
+			}
+
+			// once aborted here it can't be prepared
+			if test.wantState == TxnAborted {
+				err = kvsDb.AcceptPreparedTxn(PreparedTxn{Id: "txn", Keys: []string{"a"}})
+				if err != ErrTxnAborted {
+					t.Errorf("got %v preparing it, want %v", err, ErrTxnAborted)
+				}
+			}
+		})
+	}
+}
+
+// A coordinator's decided record is kept by the rest of its shard, where
+// it's served like the coordinator's own, until the coordinator is done
+func TestTxnRecordCopies(t *testing.T) {
+	txnTestShard(t)
+	router := gin.New()
+	router.GET("/rep/txn/:id", repGetTxn)
+
+	get := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rep/txn/0123456789abcdef", nil))
+		return w.Code
+	}
+
+	record := TxnRecord{Id: "0123456789abcdef", State: TxnCommitted, Shards: []int{0}}
+	err := storeTxnRecordCopy(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first outcome stands
+	err = storeTxnRecordCopy(TxnRecord{Id: record.Id, State: TxnAborted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := readTxnRecord(txnCopyDir(), record.Id)
+	if err != nil || copied.State != TxnCommitted {
+		t.Errorf("got %v, %v, want the committed record", copied, err)
+	}
+	if code := get(); code != http.StatusOK {
+		t.Errorf("got %d, want the copy served", code)
+	}
+
+	// copies aren't finished by this node
+	records, err := listTxnRecords(txnDir())
+	if err != nil || len(records) != 0 {
+		t.Errorf("got records %v, %v, want none of this node's own", records, err)
+	}
+
+	err = pruneTxnRecordCopies(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(); code != http.StatusNotFound {
+		t.Errorf("got %d after pruning, want 404", code)
+	}
+}
+
+func TestRecoverTransactions(t *testing.T) {
+	tests := []struct {
+		state string
+		want  string
+	}{
+		{TxnPreparing, TxnAborted},
+		{TxnCommitted, TxnCommitted},
+		{TxnAborted, TxnAborted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			txnTestShard(t)
+			err := writeTxnRecord(txnDir(), TxnRecord{Id: "txn", State: test.state, Shards: []int{0}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recoverTransactions()
+
+			records, err := listTxnRecords(txnDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 || records[0].State != test.want {
+				t.Errorf("got records %v, want one %s", records, test.want)
+			}
+		})
+	}
+}
+
+// A prepared transaction keeps its keys locked across a restart until
+// its outcome is logged
+func TestPreparedTxnReplay(t *testing.T) {
+	tests := []struct {
+		name         string
+		finish       func(kvs *KeyValStoreDatabase) error
+		wantPrepared bool
+		wantValue    interface{}
+	}{
+		{"prepared", func(kvs *KeyValStoreDatabase) error { return nil }, true, nil},
+		{"committed", func(kvs *KeyValStoreDatabase) error {
+			_, _, err := kvs.CommitTxn("txn")
+			return err
+		}, false, "x"},
+		{"aborted", func(kvs *KeyValStoreDatabase) error { return kvs.AbortTxn("txn") }, false, nil},
+		{"committed before a snapshot", func(kvs *KeyValStoreDatabase) error {
+			_, _, err := kvs.CommitTxn("txn")
+			if err != nil {
+				return err
+			}
+			return kvs.Snapshot()
+		}, false, "x"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := walTestConfig(t)
+			kvs := NewKeyValStoreDatabase("n0")
+			err := kvs.OpenStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = kvs.AcceptPreparedTxn(PreparedTxn{Id: "txn", Keys: []string{"a"}, Writes: []TxnWrite{{Key: "a", Value: "x"}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = test.finish(kvs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kvs.wal.file.Close()
+
+			reopened := NewKeyValStoreDatabase("n0")
+			err = reopened.OpenStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.wal.file.Close()
+
+			if _, prepared := reopened.prepared["txn"]; prepared != test.wantPrepared {
+				t.Errorf("got prepared %v, want %v", prepared, test.wantPrepared)
+			}
+			if reopened.isLocked("a") != test.wantPrepared {
+				t.Errorf("got locked %v, want %v", reopened.isLocked("a"), test.wantPrepared)
+			}
+			entry, exists, _ := reopened.engine.Get("a")
+			if exists != (test.wantValue != nil) || (exists && entry.Value != test.wantValue) {
+				t.Errorf("got %v (exists %v), want %v", entry.Value, exists, test.wantValue)
+			}
+			// a finished transaction can't be prepared again after the restart
+			if !test.wantPrepared {
+				err = reopened.AcceptPreparedTxn(PreparedTxn{Id: "txn", Keys: []string{"a"}})
+				if err != ErrTxnCommitted && err != ErrTxnAborted {
+					t.Errorf("got %v preparing it again, want it refused", err)
+				}
+			}
+		})
+	}
+}
+
+// Each replica commits or aborts a transaction at most once, however many
+// times, and from however many replicas, it hears about it
+func TestTxnFinishesOnce(t *testing.T) {
+	txn := PreparedTxn{Id: "txn", Keys: []string{"a"}, Writes: []TxnWrite{{Key: "a", Value: "x"}}}
+	commit := func(kvs *KeyValStoreDatabase) error {
+		_, _, err := kvs.CommitTxn("txn")
+		return err
+	}
+	// the same transaction committed by replica n1 with its own version
+	batchFromReplica := func(kvs *KeyValStoreDatabase) error {
+		writes := []BatchWrite{{Key: "a", Entry: &KeyEntry{Value: "x", Version: makeVersion(1, "n1")}}}
+		return kvs.ApplyBatch(writes, "txn", map[string]int{"n1": 1}, "n1")
+	}
+
+	tests := []struct {
+		name        string
+		steps       []func(kvs *KeyValStoreDatabase) error
+		wantErr     error // of the last step
+		wantVersion int64 // of key a, 0 if it shouldn't exist
+		wantClock   int   // of n1
+	}{
+		{
+			name:        "committed twice",
+			steps:       []func(kvs *KeyValStoreDatabase) error{commit, commit},
+			wantErr:     ErrTxnCommitted,
+			wantVersion: makeVersion(1, "n0"),
+		},
+		{
+			name:        "batch from another replica after the commit",
+			steps:       []func(kvs *KeyValStoreDatabase) error{commit, batchFromReplica},
+			wantVersion: makeVersion(1, "n0"),
+			wantClock:   1,
+		},
+		{
+			name:        "commit after the batch from another replica",
+			steps:       []func(kvs *KeyValStoreDatabase) error{batchFromReplica, commit},
+			wantErr:     ErrTxnCommitted,
+			wantVersion: makeVersion(1, "n1"),
+			wantClock:   1,
+		},
+		{
+			name: "settled with another replica's version",
+			steps: []func(kvs *KeyValStoreDatabase) error{
+				func(kvs *KeyValStoreDatabase) error { return kvs.SettleTxn("txn", makeVersion(1, "n1")) },
+				batchFromReplica,
+			},
+			wantVersion: makeVersion(1, "n1"),
+			wantClock:   1,
+		},
+		{
+			name:    "aborted after the commit",
+			steps:   []func(kvs *KeyValStoreDatabase) error{commit, func(kvs *KeyValStoreDatabase) error { return kvs.AbortTxn("txn") }},
+			wantErr: ErrTxnCommitted,
+			// the commit stands
+			wantVersion: makeVersion(1, "n0"),
+		},
+		{
+			name:    "committed after the abort",
+			steps:   []func(kvs *KeyValStoreDatabase) error{func(kvs *KeyValStoreDatabase) error { return kvs.AbortTxn("txn") }, commit},
+			wantErr: ErrTxnAborted,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kvs := NewKeyValStoreDatabase("n0")
+			err := kvs.AcceptPreparedTxn(txn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range test.steps {
+				err = step(kvs)
+			}
+			if err != test.wantErr {
+				t.Errorf("got %v, want %v", err, test.wantErr)
+			}
+
+			entry, exists, _ := kvs.engine.Get("a")
+			if exists != (test.wantVersion != 0) || (exists && entry.Version != test.wantVersion) {
+				t.Errorf("got version %d (exists %v), want %d", entry.Version, exists, test.wantVersion)
+			}
+			if kvs.Metadata["n1"] != test.wantClock {
+				t.Errorf("got n1's clock %d, want %d", kvs.Metadata["n1"], test.wantClock)
+			}
+			if kvs.isLocked("a") {
+				t.Error("key is still locked")
+			}
+		})
+	}
+}
+
+// An abort that gets to a replica before the prepare does keeps the
+// transaction from ever being prepared there
+func TestPrepareAfterAbort(t *testing.T) {
+	kvs := NewKeyValStoreDatabase("n0")
+	err := kvs.AbortTxn("txn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txn := PreparedTxn{Id: "txn", Keys: []string{"a"}, Writes: []TxnWrite{{Key: "a", Value: "x"}}}
+	err = kvs.AcceptPreparedTxn(txn)
+	if err != ErrTxnAborted {
+		t.Errorf("accepting got %v, want %v", err, ErrTxnAborted)
+	}
+	_, _, err = kvs.PrepareTxn(txn, nil, nil, nil)
+	if err != ErrTxnAborted {
+		t.Errorf("preparing got %v, want %v", err, ErrTxnAborted)
+	}
+	if kvs.isLocked("a") {
+		t.Error("key is locked")
+	}
+
+	// forgotten once it's old enough
+	kvs.PruneFinishedTxns(time.Now().Add(time.Minute).UnixMilli())
+	if _, finished := kvs.FinishedTxn("txn"); finished {
+		t.Error("still remembered after pruning")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrNotANumber = errors.New("value is not a number")
+var ErrCounterOutOfBounds = errors.New("counter would go out of bounds")
+var ErrNotACounter = errors.New("value is not a conflict-free counter")
+var ErrCounterBounds = errors.New("conflict-free counters can't have bounds")
+
+// An increment of a numeric key. A key that doesn't exist yet is taken to
+// hold Initial, so the first increment stores Initial+Delta
+type IncrOp struct {
+	Delta   float64
+	Initial float64
+	Min     *float64 // the result can't go below Min
+	Max     *float64 // or above Max
+
+	// store the key as a conflict-free counter if it doesn't exist yet
+	ConflictFree bool
+}
+
+// A counter every replica of a shard can increment at once. Each node only
+// ever adds to its own totals, so merging two copies by taking the bigger
+// total of every node converges no matter what order increments arrive in
+type PNCounter struct {
+	P        map[string]float64 `json:"p"` // increments made on each node
+	N        map[string]float64 `json:"n"` // decrements made on each node
+	GrowOnly bool               `json:"grow-only,omitempty"`
+}
+
+func NewPNCounter() *PNCounter {
+	return &PNCounter{P: make(map[string]float64), N: make(map[string]float64)}
+}
+
+// Adds delta to node's totals
+func (counter *PNCounter) Add(node string, delta float64) {
+	if delta >= 0 {
+		counter.P[node] += delta
+	} else {
+		counter.N[node] -= delta
+	}
+}
+
+func (counter *PNCounter) Value() float64 {
+	var value float64
+	for _, p := range counter.P {
+		value += p
+	}
+	for _, n := range counter.N {
+		value -= n
+	}
+	return value
+}
+
+// Returns a counter holding every increment in either counter
+func (counter *PNCounter) Merge(other *PNCounter) *PNCounter {
+	merged := NewPNCounter()
+	merged.GrowOnly = counter.GrowOnly || other.GrowOnly
+	for _, c := range []*PNCounter{counter, other} {
+		for node, p := range c.P {
+			if p > merged.P[node] {
+				merged.P[node] = p
+			}
+		}
+		for node, n := range c.N {
+			if n > merged.N[node] {
+				merged.N[node] = n
+			}
+		}
+	}
+	return merged
+}
+
+func (counter *PNCounter) Copy() *PNCounter {
+	return counter.Merge(NewPNCounter())
+}
+
+// Adds delta to node's totals in a copy of the entry's counter, so the
+// stored entry isn't changed. Grow-only counters can't go down
+func addToCounter(entry KeyEntry, node string, delta float64) (KeyEntry, error) {
+	if entry.Counter.GrowOnly && delta < 0 {
+		return entry, ErrInvalidCrdtOp
+	}
+	entry.Counter = entry.Counter.Copy()
+	entry.Counter.Add(node, delta)
+	entry.Value = entry.Counter.Value()
+	return entry, nil
+}
+
+// Adds op.Delta to the number stored at key in one step, so concurrent
+// increments sent to this node never lose each other. Conflict-free
+// counters only add to this node's own total. Returns the entry as it was stored
+func (kvs *KeyValStoreDatabase) IncrData(key string, op IncrOp, metadata map[string]int) (wasCreated bool, stored KeyEntry, currentMetadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	// Check metadata
+	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
+	if !metadataValid {
+		return false, KeyEntry{}, kvs.copyMetadata(), ErrInvalidMetadata
+	}
+
+	// clients can't write keys a transaction is about to write
+	if kvs.isLocked(key) {
+		return false, KeyEntry{}, kvs.copyMetadata(), ErrKeyLocked
+	}
+
+	// missing and expired keys start over
+	var entry KeyEntry
+	exists := kvs.hasLiveKey(key)
+	if exists {
+		entry, _, err = kvs.engine.Get(key)
+		if err != nil {
+			return false, KeyEntry{}, kvs.copyMetadata(), err
+		}
+	} else {
+		entry = KeyEntry{Value: op.Initial}
+		if op.ConflictFree {
+			entry = newCrdtEntry(CrdtPNCounter)
+		}
+	}
+
+	if entry.Counter != nil {
+		// every replica can take increments, so no one replica can hold a bound
+		if op.Min != nil || op.Max != nil {
+			return false, KeyEntry{}, kvs.copyMetadata(), ErrCounterBounds
+		}
+		entry, err = addToCounter(entry, kvs.LocalAddress, op.Delta)
+		if err != nil {
+			return false, KeyEntry{}, kvs.copyMetadata(), err
+		}
+	} else {
+		if op.ConflictFree {
+			return false, KeyEntry{}, kvs.copyMetadata(), ErrNotACounter
+		}
+		current, ok := entry.Value.(float64)
+		if !ok || entry.CrdtType() != "" {
+			return false, KeyEntry{}, kvs.copyMetadata(), ErrNotANumber
+		}
+		value := current + op.Delta
+		if (op.Min != nil && value < *op.Min) || (op.Max != nil && value > *op.Max) {
+			return false, KeyEntry{}, kvs.copyMetadata(), ErrCounterOutOfBounds
+		}
+		entry.Value = value
+	}
+	entry.Version = kvs.nextVersion()
+
+	err = kvs.checkQuota(key, entry)
+	if err != nil {
+		return false, KeyEntry{}, kvs.copyMetadata(), err
+	}
+
+	// an increment keeps the key's ttl
+	err = kvs.propose(WalRecord{Op: WalOpPut, Key: key, Entry: &entry, Sender: kvs.LocalAddress})
+	if err != nil {
+		return false, KeyEntry{}, kvs.copyMetadata(), err
+	}
+	return !exists, entry, kvs.copyMetadata(), nil
+}
+
+// A replica's copy of a conflict-free counter is merged into ours instead
+// of replacing it, so increments taken here at the same time aren't lost.
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) mergeCounter(key string, entry KeyEntry) (KeyEntry, error) {
+	if entry.Counter == nil {
+		return entry, nil
+	}
+	current, existed, err := kvs.engine.Get(key)
+	if err != nil || !existed || current.CrdtType() != entry.CrdtType() || current.Expired(time.Now().UnixMilli()) {
+		return entry, err
+	}
+
+	entry.Counter = current.Counter.Merge(entry.Counter)
+	entry.Value = entry.Counter.Value()
+	if current.Version > entry.Version {
+		entry.Version = current.Version
+	}
+	return entry, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testCounter(growOnly bool, p map[string]float64, n map[string]float64) *PNCounter {
+	counter := NewPNCounter()
+	counter.GrowOnly = growOnly
+	for node, v := range p {
+		counter.P[node] = v
+	}
+	for node, v := range n {
+		counter.N[node] = v
+	}
+	return counter
+}
+
+func TestAddToCounter(t *testing.T) {
+	tests := []struct {
+		name      string
+		counter   *PNCounter
+		delta     float64
+		wantValue float64
+		err       error
+	}{
+		{"increment", testCounter(false, map[string]float64{"n0": 1, "n1": 2}, nil), 2, 5, nil},
+		{"decrement", testCounter(false, map[string]float64{"n1": 2}, nil), -3, -1, nil},
+		{"grow-only increment", testCounter(true, map[string]float64{"n1": 2}, nil), 1, 3, nil},
+		{"grow-only decrement", testCounter(true, map[string]float64{"n1": 2}, nil), -1, 2, ErrInvalidCrdtOp},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored := KeyEntry{Counter: test.counter, Value: test.counter.Value()}
+			before := test.counter.Copy()
+
+			entry, err := addToCounter(stored, "n0", test.delta)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if entry.Value != test.wantValue || entry.Counter.Value() != test.wantValue {
+				t.Errorf("got value %v, want %v", entry.Value, test.wantValue)
+			}
+			if entry.Counter.GrowOnly != test.counter.GrowOnly {
+				t.Errorf("lost grow-only: %v", entry.Counter.GrowOnly)
+			}
+			// the stored counter is never changed in place
+			if !reflect.DeepEqual(stored.Counter, before) {
+				t.Errorf("stored counter changed to %+v", stored.Counter)
+			}
+		})
+	}
+}
+
+func TestMergeCounter(t *testing.T) {
+	incoming := KeyEntry{Counter: testCounter(false, map[string]float64{"n1": 3}, map[string]float64{"n1": 1}), Value: 2.0, Version: 5}
+
+	tests := []struct {
+		name        string
+		current     *KeyEntry
+		incoming    KeyEntry
+		wantValue   float64
+		wantVersion int64
+	}{
+		{"no key here", nil, incoming, 2, 5},
+		{"plain value here", &KeyEntry{Value: 10.0, Version: 7}, incoming, 2, 5},
+		{"grow-only counter here", &KeyEntry{Counter: testCounter(true, map[string]float64{"n0": 4}, nil), Value: 4.0, Version: 7}, incoming, 2, 5},
+		{"counter here", &KeyEntry{Counter: testCounter(false, map[string]float64{"n0": 4, "n1": 1}, nil), Value: 5.0, Version: 7}, incoming, 6, 7},
+		{"expired counter here", &KeyEntry{Counter: testCounter(false, map[string]float64{"n0": 4}, nil), Value: 4.0, Version: 7, ExpiresAt: 1}, incoming, 2, 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kvs := NewKeyValStoreDatabase("n0")
+			if test.current != nil {
+				kvs.putEntry("key", *test.current)
+			}
+
+			merged, err := kvs.mergeCounter("key", test.incoming)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if merged.Value != test.wantValue || merged.Counter.Value() != test.wantValue {
+				t.Errorf("got value %v, want %v", merged.Value, test.wantValue)
+			}
+			if merged.Version != test.wantVersion {
+				t.Errorf("got version %d, want %d", merged.Version, test.wantVersion)
+			}
+		})
+	}
+}
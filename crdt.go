@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Value types that merge instead of overwriting, so every replica of a
+// shard can take writes at once (even cut off from the others) and still
+// end up with the same value once they've seen each other's writes
+const (
+	CrdtGCounter  = "gcounter"  // a counter that only goes up
+	CrdtPNCounter = "pncounter" // a counter that goes up and down
+	CrdtORSet     = "orset"     // a set where an add beats a concurrent remove
+	CrdtRegister  = "register"  // a single value, the last write wins
+	CrdtMap       = "map"       // an object of fields, the last write of each field wins
+)
+
+var ErrCrdtTypeMismatch = errors.New("key holds a different type")
+var ErrInvalidCrdtOp = errors.New("invalid operation for the type")
+
+// One operation on a crdt value
+type CrdtOp struct {
+	Type  string
+	Op    string // incr, add, remove or set
+	Value interface{}
+	Field string // of a map
+	Delta float64
+}
+
+// An observed-remove set. Every add is tagged with a tag no other add has;
+// a remove only removes the tags it has seen, so an add the remover hadn't
+// seen yet survives. Removed tags are kept forever so a merge with an older
+// copy can't bring them back
+type ORSet struct {
+	Elements map[string]*ORSetElement `json:"elements"` // by the JSON encoding of the value
+	Removed  map[string]bool          `json:"removed"`
+}
+
+type ORSetElement struct {
+	Value interface{}     `json:"value"`
+	Tags  map[string]bool `json:"tags"`
+}
+
+// A value stamped with the version and node of the write that set it. The
+// write with the biggest version wins, with ties broken by node, which
+// always picks a write that causally follows another over it
+type LWWRegister struct {
+	Value   interface{} `json:"value,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"` // a removed map field
+	Version int64       `json:"version"`
+	Node    string      `json:"node"`
+}
+
+// An object with a register per field
+type LWWMap struct {
+	Fields map[string]*LWWRegister `json:"fields"`
+}
+
+// Returns which crdt the entry holds, or "" for a plain value
+func (entry KeyEntry) CrdtType() string {
+	switch {
+	case entry.Counter != nil && entry.Counter.GrowOnly:
+		return CrdtGCounter
+	case entry.Counter != nil:
+		return CrdtPNCounter
+	case entry.Set != nil:
+		return CrdtORSet
+	case entry.Register != nil:
+		return CrdtRegister
+	case entry.Map != nil:
+		return CrdtMap
+	}
+	return ""
+}
+
+// Returns an empty entry of the given type
+func newCrdtEntry(crdtType string) KeyEntry {
+	var entry KeyEntry
+	switch crdtType {
+	case CrdtGCounter:
+		entry.Counter = NewPNCounter()
+		entry.Counter.GrowOnly = true
+	case CrdtPNCounter:
+		entry.Counter = NewPNCounter()
+	case CrdtORSet:
+		entry.Set = &ORSet{Elements: make(map[string]*ORSetElement), Removed: make(map[string]bool)}
+	case CrdtRegister:
+		entry.Register = &LWWRegister{}
+	case CrdtMap:
+		entry.Map = &LWWMap{Fields: make(map[string]*LWWRegister)}
+	}
+	entry.Value = crdtValue(entry)
+	return entry
+}
+
+// Returns an entry holding every write in either entry. Both have to hold
+// the same type; the merged entry keeps the bigger version and ttl of
+// incoming, and Value is the merged value
+func mergeCrdtEntries(current, incoming KeyEntry) KeyEntry {
+	merged := incoming
+	switch incoming.CrdtType() {
+	case CrdtGCounter, CrdtPNCounter:
+		merged.Counter = current.Counter.Merge(incoming.Counter)
+	case CrdtORSet:
+		merged.Set = current.Set.Merge(incoming.Set)
+	case CrdtRegister:
+		merged.Register = current.Register.Merge(incoming.Register)
+	case CrdtMap:
+		merged.Map = current.Map.Merge(incoming.Map)
+	}
+	merged.Value = crdtValue(merged)
+	if current.Version > merged.Version {
+		merged.Version = current.Version
+	}
+	return merged
+}
+
+// Applies op to a copy of the entry's crdt, as a write made by node with
+// the given version. The entry must already hold op.Type
+func applyCrdtOp(entry KeyEntry, op CrdtOp, node string, version int64) (KeyEntry, error) {
+	// counters are the conflict-free counters of /incr
+	if op.Type == CrdtGCounter || op.Type == CrdtPNCounter {
+		if op.Op != "incr" {
+			return entry, ErrInvalidCrdtOp
+		}
+		entry, err := addToCounter(entry, node, op.Delta)
+		entry.Version = version
+		return entry, err
+	}
+
+	// copy, so the stored entry isn't changed if anything fails
+	entry = mergeCrdtEntries(newCrdtEntry(op.Type), entry)
+	tag := node + ":" + strconv.FormatInt(version, 10)
+
+	switch op.Type + "." + op.Op {
+	case CrdtORSet + ".add":
+		entry.Set.Add(op.Value, tag)
+	case CrdtORSet + ".remove":
+		entry.Set.Remove(op.Value)
+	case CrdtRegister + ".set":
+		entry.Register = &LWWRegister{Value: op.Value, Version: version, Node: node}
+	case CrdtMap + ".set":
+		entry.Map.Fields[op.Field] = &LWWRegister{Value: op.Value, Version: version, Node: node}
+	case CrdtMap + ".remove":
+		entry.Map.Fields[op.Field] = &LWWRegister{Deleted: true, Version: version, Node: node}
+	default:
+		return entry, ErrInvalidCrdtOp
+	}
+
+	entry.Value = crdtValue(entry)
+	entry.Version = version
+	return entry, nil
+}
+
+// Returns what a client reads for the entry's crdt
+func crdtValue(entry KeyEntry) interface{} {
+	switch entry.CrdtType() {
+	case CrdtGCounter, CrdtPNCounter:
+		return entry.Counter.Value()
+	case CrdtORSet:
+		return entry.Set.Value()
+	case CrdtRegister:
+		return entry.Register.Value
+	case CrdtMap:
+		return entry.Map.Value()
+	}
+	return entry.Value
+}
+
+/// --- OR-Set ---
+
+func (set *ORSet) Add(value interface{}, tag string) {
+	id := orSetId(value)
+	element, exists := set.Elements[id]
+	if !exists {
+		element = &ORSetElement{Value: value, Tags: make(map[string]bool)}
+		set.Elements[id] = element
+	}
+	element.Tags[tag] = true
+}
+
+// Removes every add of value this copy has seen
+func (set *ORSet) Remove(value interface{}) {
+	id := orSetId(value)
+	element, exists := set.Elements[id]
+	if !exists {
+		return
+	}
+	for tag := range element.Tags {
+		set.Removed[tag] = true
+	}
+	delete(set.Elements, id)
+}
+
+// Returns the elements in order of their JSON encoding
+func (set *ORSet) Value() []interface{} {
+	ids := make([]string, 0, len(set.Elements))
+	for id := range set.Elements {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	values := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, set.Elements[id].Value)
+	}
+	return values
+}
+
+// Returns a set holding every add and remove in either set
+func (set *ORSet) Merge(other *ORSet) *ORSet {
+	merged := &ORSet{Elements: make(map[string]*ORSetElement), Removed: make(map[string]bool)}
+	for _, s := range []*ORSet{set, other} {
+		for tag := range s.Removed {
+			merged.Removed[tag] = true
+		}
+	}
+	for _, s := range []*ORSet{set, other} {
+		for id, element := range s.Elements {
+			for tag := range element.Tags {
+				if merged.Removed[tag] {
+					continue
+				}
+				if merged.Elements[id] == nil {
+					merged.Elements[id] = &ORSetElement{Value: element.Value, Tags: make(map[string]bool)}
+				}
+				merged.Elements[id].Tags[tag] = true
+			}
+		}
+	}
+	return merged
+}
+
+// Equal values have equal encodings, since maps encode with sorted keys
+func orSetId(value interface{}) string {
+	id, _ := json.Marshal(value)
+	return string(id)
+}
+
+/// --- registers ---
+
+// Returns the register with the later write
+func (reg *LWWRegister) Merge(other *LWWRegister) *LWWRegister {
+	if other.Version > reg.Version || (other.Version == reg.Version && other.Node > reg.Node) {
+		return other
+	}
+	return reg
+}
+
+// Returns the fields that haven't been removed
+func (m *LWWMap) Value() map[string]interface{} {
+	values := make(map[string]interface{}, len(m.Fields))
+	for field, reg := range m.Fields {
+		if !reg.Deleted {
+			values[field] = reg.Value
+		}
+	}
+	return values
+}
+
+// Returns a map with the later write of every field
+func (m *LWWMap) Merge(other *LWWMap) *LWWMap {
+	merged := &LWWMap{Fields: make(map[string]*LWWRegister)}
+	for _, mm := range []*LWWMap{m, other} {
+		for field, reg := range mm.Fields {
+			if current, exists := merged.Fields[field]; exists {
+				reg = current.Merge(reg)
+			}
+			merged.Fields[field] = reg
+		}
+	}
+	return merged
+}
+
+// Applies op to the crdt stored at key, creating it if the key doesn't
+// exist yet. Returns the entry as it was stored
+func (kvs *KeyValStoreDatabase) UpdateCrdt(key string, op CrdtOp, metadata map[string]int) (wasCreated bool, stored KeyEntry, currentMetadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	// Check metadata
+	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
+	if !metadataValid {
+		return false, KeyEntry{}, kvs.copyMetadata(), ErrInvalidMetadata
+	}
+
+	// clients can't write keys a transaction is about to write
+	if kvs.isLocked(key) {
+		return false, KeyEntry{}, kvs.copyMetadata(), ErrKeyLocked
+	}
+
+	// missing and expired keys start over
+	entry := newCrdtEntry(op.Type)
+	exists := kvs.hasLiveKey(key)
+	if exists {
+		entry, _, err = kvs.engine.Get(key)
+		if err != nil {
+			return false, KeyEntry{}, kvs.copyMetadata(), err
+		}
+		if entry.CrdtType() != op.Type {
+			return false, KeyEntry{}, kvs.copyMetadata(), ErrCrdtTypeMismatch
+		}
+	}
+
+	entry, err = applyCrdtOp(entry, op, kvs.LocalAddress, kvs.nextVersion())
+	if err != nil {
+		return false, KeyEntry{}, kvs.copyMetadata(), err
+	}
+	err = kvs.checkQuota(key, entry)
+	if err != nil {
+		return false, KeyEntry{}, kvs.copyMetadata(), err
+	}
+
+	err = kvs.propose(WalRecord{Op: WalOpPut, Key: key, Entry: &entry, Sender: kvs.LocalAddress})
+	if err != nil {
+		return false, KeyEntry{}, kvs.copyMetadata(), err
+	}
+	return !exists, entry, kvs.copyMetadata(), nil
+}
+
+// A copy of a crdt from somewhere else is merged into ours instead of
+// replacing it, so writes taken here at the same time aren't lost. Plain
+// values, and crdts of another type, still replace what's here.
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) mergeCrdt(key string, entry KeyEntry) (KeyEntry, error) {
+	if entry.Counter != nil {
+		return kvs.mergeCounter(key, entry)
+	}
+	if entry.CrdtType() == "" {
+		return entry, nil
+	}
+	current, existed, err := kvs.engine.Get(key)
+	if err != nil || !existed || current.CrdtType() != entry.CrdtType() || current.Expired(time.Now().UnixMilli()) {
+		return entry, err
+	}
+	return mergeCrdtEntries(current, entry), nil
+}
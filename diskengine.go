@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Data files are rolled over once they reach this size
+const DiskEngineFileSize = 64 << 20
+
+// Live data is rewritten into fresh files once there is at least this much
+// garbage and it makes up more than half of what's on disk
+var DiskEngineMergeSize int64 = 64 << 20
+
+const diskFileFormat = "data-%06d.dat"
+const diskFilePattern = "data-*.dat"
+const diskCheckpointFileName = "checkpoint"
+
+// Kinds of records in the data files
+const (
+	diskRecordPut     = ""        // a key's entry
+	diskRecordDelete  = "delete"  // the key is gone
+	diskRecordVersion = "version" // an older version of a key, kept for its history
+	diskRecordShared  = "shared"  // a version whose entry is in a put record
+	diskRecordDrop    = "drop"    // the version is no longer kept
+)
+
+// DiskEngine is a log structured engine in the style of Bitcask: values are
+// appended to data files in a single directory and only an index of where
+// each key's latest value lives is kept in memory, so the data set can be
+// larger than RAM.
+//
+// The write-ahead log and snapshots are what make the data durable. When
+// the kvs takes a snapshot the engine checkpoints the files it's made of,
+// and on open it cuts them back to that checkpoint and rebuilds its index
+// from them, so the kvs only has to replay the log after the snapshot.
+type DiskEngine struct {
+	sync.Mutex
+	dir        string
+	index      map[string]diskLocation
+	keys       *KeyIndex
+	versions   map[versionKey]diskLocation
+	files      map[int]*os.File
+	sizes      map[int]int64
+	active     *os.File
+	activeId   int
+	activeSize int64
+	nextId     int64 // taken atomically, merges name their files too
+	seq        uint64
+	liveBytes  int64
+	totalBytes int64
+
+	// the lsn and files of the last checkpoint. Files it names are kept
+	// even once they're retired, since reopening goes back to them
+	checkpointLSN   uint64
+	checkpointFiles map[int]bool
+
+	// files replaced by a merge or clear are kept open until no snapshot
+	// (or running merge) needs them
+	views   int
+	retired map[int]*os.File
+
+	// a merge runs in the background and leaves its result to be swapped
+	// in by the next write. Clears bump the epoch so stale results are dropped
+	merging bool
+	merged  *diskMerge
+	epoch   int
+	merges  sync.WaitGroup
+}
+
+type diskLocation struct {
+	fileId  int
+	offset  int64
+	size    int
+	version int64 // of the entry stored there
+}
+
+// Records are JSON lines. Every record gets the next sequence number, so
+// the newest record for a key or version wins however the files are read
+type diskRecord struct {
+	Seq     uint64        `json:"seq"`
+	Kind    string        `json:"kind,omitempty"`
+	Key     string        `json:"key"`
+	Entry   *KeyEntry     `json:"entry,omitempty"`
+	Version int64         `json:"version,omitempty"` // shared and drop records
+	Shared  *diskLocation `json:"-"`
+	At      []int64       `json:"at,omitempty"` // file, offset and size of a shared record
+}
+
+// What the last checkpoint covers: the lsn of the kvs snapshot it was
+// taken with, and the size of every data file at the time
+type diskCheckpoint struct {
+	LSN   uint64        `json:"lsn"`
+	Seq   uint64        `json:"seq"`
+	Files map[int]int64 `json:"files"`
+}
+
+// Opens the engine in dir, going back to its last checkpoint. Without a
+// usable checkpoint the directory is wiped and the engine starts out empty
+func OpenDiskEngine(dir string) (*DiskEngine, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	e := newDiskEngine(dir)
+	err = e.reopen()
+	if err != nil {
+		log.Printf("starting the disk engine over: %v", err)
+		e.closeFiles()
+		e = newDiskEngine(dir)
+		err = os.RemoveAll(dir)
+		if err == nil {
+			err = os.MkdirAll(dir, 0755)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = e.openFile()
+	if err != nil {
+		e.closeFiles()
+		return nil, err
+	}
+	return e, nil
+}
+
+func newDiskEngine(dir string) *DiskEngine {
+	return &DiskEngine{
+		dir:             dir,
+		index:           make(map[string]diskLocation),
+		keys:            NewKeyIndex(),
+		versions:        make(map[versionKey]diskLocation),
+		files:           make(map[int]*os.File),
+		sizes:           make(map[int]int64),
+		checkpointFiles: make(map[int]bool),
+		retired:         make(map[int]*os.File),
+	}
+}
+
+// Cuts the data files back to the last checkpoint, removes files made
+// since, and rebuilds the index from what's left
+func (e *DiskEngine) reopen() error {
+	jsonData, err := os.ReadFile(filepath.Join(e.dir, diskCheckpointFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var checkpoint diskCheckpoint
+	err = json.Unmarshal(jsonData, &checkpoint)
+	if err != nil {
+		return err
+	}
+
+	names, err := filepath.Glob(filepath.Join(e.dir, diskFilePattern))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var id int
+		fmt.Sscanf(filepath.Base(name), diskFileFormat, &id)
+		if int64(id) > e.nextId {
+			e.nextId = int64(id)
+		}
+		if _, checkpointed := checkpoint.Files[id]; !checkpointed {
+			err = os.Remove(name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for id, size := range checkpoint.Files {
+		file, err := os.OpenFile(filepath.Join(e.dir, fmt.Sprintf(diskFileFormat, id)), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		e.files[id] = file
+		info, err := file.Stat()
+		if err == nil && info.Size() < size {
+			err = fmt.Errorf("%s is shorter than its checkpoint", file.Name())
+		}
+		if err == nil {
+			err = file.Truncate(size)
+		}
+		if err != nil {
+			return err
+		}
+		e.sizes[id] = size
+		e.totalBytes += size
+		e.checkpointFiles[id] = true
+	}
+
+	// replay every record, newest sequence number first per key or version
+	keySeqs := make(map[string]uint64)
+	versionSeqs := make(map[versionKey]uint64)
+	newer := func(key string, seq uint64) bool {
+		last, exists := keySeqs[key]
+		if exists && last >= seq {
+			return false
+		}
+		keySeqs[key] = seq
+		return true
+	}
+	newerVersion := func(vkey versionKey, seq uint64) bool {
+		last, exists := versionSeqs[vkey]
+		if exists && last >= seq {
+			return false
+		}
+		versionSeqs[vkey] = seq
+		return true
+	}
+	for id, file := range e.files {
+		err = readDiskRecords(file, func(rec diskRecord, loc diskLocation) {
+			loc.fileId = id
+			if rec.Seq > e.seq {
+				e.seq = rec.Seq
+			}
+			switch rec.Kind {
+			case diskRecordPut:
+				if newer(rec.Key, rec.Seq) {
+					loc.version = rec.Entry.Version
+					e.index[rec.Key] = loc
+				}
+			case diskRecordDelete:
+				if newer(rec.Key, rec.Seq) {
+					delete(e.index, rec.Key)
+				}
+			case diskRecordVersion:
+				vkey := versionKey{rec.Key, rec.Entry.Version}
+				if newerVersion(vkey, rec.Seq) {
+					loc.version = rec.Entry.Version
+					e.versions[vkey] = loc
+				}
+			case diskRecordShared:
+				vkey := versionKey{rec.Key, rec.Version}
+				if newerVersion(vkey, rec.Seq) {
+					e.versions[vkey] = *rec.Shared
+				}
+			case diskRecordDrop:
+				vkey := versionKey{rec.Key, rec.Version}
+				if newerVersion(vkey, rec.Seq) {
+					delete(e.versions, vkey)
+				}
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name(), err)
+		}
+	}
+	if checkpoint.Seq > e.seq {
+		e.seq = checkpoint.Seq
+	}
+
+	for _, loc := range e.versions {
+		if e.files[loc.fileId] == nil {
+			return fmt.Errorf("a version points at missing file %d", loc.fileId)
+		}
+	}
+
+	// count each record the index or the versions point at once
+	live := make(map[diskLocation]bool)
+	for key, loc := range e.index {
+		e.keys.Insert(key)
+		live[loc] = true
+	}
+	for _, loc := range e.versions {
+		live[loc] = true
+	}
+	for loc := range live {
+		e.liveBytes += int64(loc.size)
+	}
+	e.checkpointLSN = checkpoint.LSN
+	return nil
+}
+
+// Calls fn on every record in file with where it is
+func readDiskRecords(file *os.File, fn func(rec diskRecord, loc diskLocation)) error {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, 1<<62))
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		rec, err := decodeDiskRecord(line)
+		if err != nil {
+			return fmt.Errorf("bad record at byte %d: %w", offset, err)
+		}
+		fn(rec, diskLocation{offset: offset, size: len(line)})
+		offset += int64(len(line))
+	}
+}
+
+func decodeDiskRecord(line []byte) (diskRecord, error) {
+	var rec diskRecord
+	err := json.Unmarshal(line, &rec)
+	if err != nil {
+		return rec, err
+	}
+	switch rec.Kind {
+	case diskRecordPut, diskRecordVersion:
+		if rec.Entry == nil {
+			return rec, fmt.Errorf("%s record without an entry", rec.Kind)
+		}
+	case diskRecordShared:
+		if len(rec.At) != 3 {
+			return rec, fmt.Errorf("shared record without a location")
+		}
+		rec.Shared = &diskLocation{fileId: int(rec.At[0]), offset: rec.At[1], size: int(rec.At[2]), version: rec.Version}
+	}
+	return rec, nil
+}
+
+// Closes every open file. Used when opening fails
+func (e *DiskEngine) closeFiles() {
+	for _, file := range e.files {
+		file.Close()
+	}
+}
+
+// Returns the lsn of the snapshot the engine's files were last
+// checkpointed with, 0 if it started out empty
+func (e *DiskEngine) CheckpointLSN() uint64 {
+	e.Lock()
+	defer e.Unlock()
+	return e.checkpointLSN
+}
+
+func (e *DiskEngine) Get(key string) (KeyEntry, bool, error) {
+	loc, exists := e.index[key]
+	if !exists {
+		return KeyEntry{}, false, nil
+	}
+
+	entry, err := readDiskEntry(e.files[loc.fileId], loc)
+	if err != nil {
+		return KeyEntry{}, true, err
+	}
+	return entry, true, nil
+}
+
+func (e *DiskEngine) Has(key string) bool {
+	_, exists := e.index[key]
+	return exists
+}
+
+func (e *DiskEngine) Put(key string, entry KeyEntry) error {
+	e.installMerge()
+
+	loc, err := e.writeRecord(diskRecord{Key: key, Entry: &entry})
+	if err != nil {
+		return err
+	}
+	loc.version = entry.Version
+
+	// the old value (if any) is now garbage, unless the history still has it
+	old, exists := e.index[key]
+	e.index[key] = loc
+	e.liveBytes += int64(loc.size)
+	if exists {
+		e.release(key, old)
+	} else {
+		e.keys.Insert(key)
+	}
+
+	e.maybeMerge()
+	return nil
+}
+
+// Deleted keys drop out of the index, and a record of the delete is written
+// so they stay deleted when the files are read back
+func (e *DiskEngine) Delete(key string) error {
+	e.installMerge()
+
+	old, exists := e.index[key]
+	if !exists {
+		return nil
+	}
+	_, err := e.writeRecord(diskRecord{Kind: diskRecordDelete, Key: key})
+	if err != nil {
+		return err
+	}
+	delete(e.index, key)
+	e.release(key, old)
+	e.keys.Remove(key)
+
+	e.maybeMerge()
+	return nil
+}
+
+// The version a key has now shares the record of its entry, so keeping it
+// only writes a pointer to it; older ones get a record of their own
+func (e *DiskEngine) PutVersion(key string, entry KeyEntry) error {
+	e.installMerge()
+
+	vkey := versionKey{key, entry.Version}
+	if _, exists := e.versions[vkey]; exists {
+		return nil
+	}
+	if loc, exists := e.index[key]; exists && loc.version == entry.Version {
+		_, err := e.writeRecord(sharedRecord(key, loc))
+		if err != nil {
+			return err
+		}
+		e.versions[vkey] = loc
+		return nil
+	}
+
+	loc, err := e.writeRecord(diskRecord{Kind: diskRecordVersion, Key: key, Entry: &entry})
+	if err != nil {
+		return err
+	}
+	loc.version = entry.Version
+	e.versions[vkey] = loc
+	e.liveBytes += int64(loc.size)
+
+	e.maybeMerge()
+	return nil
+}
+
+func sharedRecord(key string, loc diskLocation) diskRecord {
+	return diskRecord{
+		Kind:    diskRecordShared,
+		Key:     key,
+		Version: loc.version,
+		At:      []int64{int64(loc.fileId), loc.offset, int64(loc.size)},
+	}
+}
+
+func (e *DiskEngine) GetVersion(key string, version int64) (KeyEntry, bool, error) {
+	return getDiskVersion(e.versions, e.files, key, version)
+}
+
+// A version that can't be marked dropped on disk is still dropped here; it
+// would only come back if the node restarted before the next checkpoint
+func (e *DiskEngine) DropVersion(key string, version int64) {
+	e.installMerge()
+
+	vkey := versionKey{key, version}
+	loc, exists := e.versions[vkey]
+	if !exists {
+		return
+	}
+	_, err := e.writeRecord(diskRecord{Kind: diskRecordDrop, Key: key, Version: version})
+	if err != nil {
+		log.Println(err)
+	}
+	delete(e.versions, vkey)
+	e.release(key, loc)
+}
+
+// Counts a record no longer pointed at by the index or the versions as
+// garbage, once neither of them does
+func (e *DiskEngine) release(key string, loc diskLocation) {
+	if e.index[key] == loc || e.versions[versionKey{key, loc.version}] == loc {
+		return
+	}
+	e.liveBytes -= int64(loc.size)
+}
+
+func (e *DiskEngine) Clear() error {
+	e.Lock()
+	defer e.Unlock()
+
+	// a merge still running is of data that's gone
+	e.epoch++
+	e.retireFiles()
+	e.index = make(map[string]diskLocation)
+	e.keys = NewKeyIndex()
+	e.versions = make(map[versionKey]diskLocation)
+	e.liveBytes = 0
+	e.totalBytes = 0
+	return e.openFile()
+}
+
+func (e *DiskEngine) Len() int {
+	return len(e.index)
+}
+
+func (e *DiskEngine) Range(fn func(key string, entry KeyEntry) bool) error {
+	return rangeDisk(e.index, e.files, fn)
+}
+
+// Merges never change which keys exist, so the key index is left alone by them
+func (e *DiskEngine) Scan(start, end string, fn func(key string, entry KeyEntry) bool) error {
+	var err error
+	e.keys.Ascend(start, func(key string) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		var entry KeyEntry
+		entry, _, err = e.Get(key)
+		if err != nil {
+			return false
+		}
+		return fn(key, entry)
+	})
+	return err
+}
+
+// Copies the index; the data files it points at are append only and are
+// kept around until the snapshot is closed
+func (e *DiskEngine) Snapshot() EngineSnapshot {
+	e.Lock()
+	defer e.Unlock()
+
+	view := &diskSnapshot{
+		engine:   e,
+		index:    make(map[string]diskLocation, len(e.index)),
+		versions: make(map[versionKey]diskLocation, len(e.versions)),
+		files:    make(map[int]*os.File, len(e.files)),
+		sizes:    make(map[int]int64, len(e.sizes)),
+		seq:      e.seq,
+	}
+	for key, loc := range e.index {
+		view.index[key] = loc
+	}
+	for vkey, loc := range e.versions {
+		view.versions[vkey] = loc
+	}
+	for id, file := range e.files {
+		view.files[id] = file
+		view.sizes[id] = e.sizes[id]
+	}
+	e.views++
+
+	return view
+}
+
+type diskSnapshot struct {
+	engine   *DiskEngine
+	index    map[string]diskLocation
+	versions map[versionKey]diskLocation
+	files    map[int]*os.File
+	sizes    map[int]int64
+	seq      uint64
+}
+
+func (s *diskSnapshot) Range(fn func(key string, entry KeyEntry) bool) error {
+	return rangeDisk(s.index, s.files, fn)
+}
+
+func (s *diskSnapshot) GetVersion(key string, version int64) (KeyEntry, bool, error) {
+	return getDiskVersion(s.versions, s.files, key, version)
+}
+
+// Syncs the files as they were when the snapshot was taken and records
+// them as the state to reopen at, as of the kvs snapshot at lsn
+func (s *diskSnapshot) Checkpoint(lsn uint64) error {
+	for _, file := range s.files {
+		err := file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	jsonData, err := json.Marshal(diskCheckpoint{LSN: lsn, Seq: s.seq, Files: s.sizes})
+	if err != nil {
+		return err
+	}
+	e := s.engine
+	err = writeFileSynced(e.dir, diskCheckpointFileName, jsonData)
+	if err != nil {
+		return err
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.checkpointLSN = lsn
+	e.checkpointFiles = make(map[int]bool, len(s.sizes))
+	for id := range s.sizes {
+		e.checkpointFiles[id] = true
+	}
+	return nil
+}
+
+func (s *diskSnapshot) Close() {
+	e := s.engine
+	e.Lock()
+	defer e.Unlock()
+
+	e.views--
+	if e.views == 0 {
+		e.removeRetired()
+	}
+}
+
+func rangeDisk(index map[string]diskLocation, files map[int]*os.File, fn func(key string, entry KeyEntry) bool) error {
+	for key, loc := range index {
+		entry, err := readDiskEntry(files[loc.fileId], loc)
+		if err != nil {
+			return err
+		}
+		if !fn(key, entry) {
+			break
+		}
+	}
+	return nil
+}
+
+func getDiskVersion(versions map[versionKey]diskLocation, files map[int]*os.File, key string, version int64) (KeyEntry, bool, error) {
+	loc, exists := versions[versionKey{key, version}]
+	if !exists {
+		return KeyEntry{}, false, nil
+	}
+	entry, err := readDiskEntry(files[loc.fileId], loc)
+	return entry, true, err
+}
+
+func readDiskEntry(file *os.File, loc diskLocation) (KeyEntry, error) {
+	buf := make([]byte, loc.size)
+	_, err := file.ReadAt(buf, loc.offset)
+	if err != nil {
+		return KeyEntry{}, err
+	}
+
+	rec, err := decodeDiskRecord(buf)
+	if err != nil {
+		return KeyEntry{}, err
+	}
+	if rec.Entry == nil {
+		return KeyEntry{}, fmt.Errorf("no entry at byte %d of %s", loc.offset, file.Name())
+	}
+	return *rec.Entry, nil
+}
+
+// Appends a record to the active file with the next sequence number,
+// rolling over to a new file when full
+func (e *DiskEngine) writeRecord(rec diskRecord) (diskLocation, error) {
+	e.seq++
+	rec.Seq = e.seq
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return diskLocation{}, err
+	}
+	line = append(line, '\n')
+
+	if e.activeSize >= DiskEngineFileSize {
+		err := e.openFile()
+		if err != nil {
+			return diskLocation{}, err
+		}
+	}
+
+	loc := diskLocation{
+		fileId: e.activeId,
+		offset: e.activeSize,
+		size:   len(line),
+	}
+	_, err = e.active.WriteAt(line, loc.offset)
+	if err != nil {
+		return diskLocation{}, err
+	}
+	e.activeSize += int64(len(line))
+	e.sizes[e.activeId] = e.activeSize
+	e.totalBytes += int64(len(line))
+
+	return loc, nil
+}
+
+// Starts a new, empty active file
+func (e *DiskEngine) openFile() error {
+	id, file, err := e.createFile()
+	if err != nil {
+		return err
+	}
+	e.activeId = id
+	e.files[id] = file
+	e.sizes[id] = 0
+	e.active = file
+	e.activeSize = 0
+	return nil
+}
+
+// Creates a data file with the next id
+func (e *DiskEngine) createFile() (int, *os.File, error) {
+	id := int(atomic.AddInt64(&e.nextId, 1))
+	name := filepath.Join(e.dir, fmt.Sprintf(diskFileFormat, id))
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	return id, file, err
+}
+
+/// --- merges ---
+
+// What a merge read from and wrote
+type diskMerge struct {
+	epoch  int
+	seq    uint64                        // the last one written to the sealed files
+	sealed map[int]bool                  // the files it rewrote
+	moved  map[diskLocation]diskLocation // where each record it copied went
+	copied map[versionKey]diskLocation   // the versions it wrote records for
+	files  map[int]*os.File
+	sizes  map[int]int64
+	err    error
+}
+
+// Starts rewriting every live value into new files in the background, once
+// enough of the old ones is garbage. Writes go to a fresh active file in
+// the meantime, and the result is swapped in by the first write after
+func (e *DiskEngine) maybeMerge() {
+	garbage := e.totalBytes - e.liveBytes
+	if e.merging || garbage < DiskEngineMergeSize || garbage < e.liveBytes {
+		return
+	}
+
+	// seal the files to merge by moving writes to a new one
+	err := e.openFile()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	merge := &diskMerge{
+		epoch:  e.epoch,
+		seq:    e.seq,
+		sealed: make(map[int]bool, len(e.files)),
+		moved:  make(map[diskLocation]diskLocation),
+		files:  make(map[int]*os.File),
+		sizes:  make(map[int]int64),
+	}
+	files := make(map[int]*os.File, len(e.files))
+	for id, file := range e.files {
+		if id != e.activeId {
+			merge.sealed[id] = true
+			files[id] = file
+		}
+	}
+	index := make(map[string]diskLocation, len(e.index))
+	for key, loc := range e.index {
+		index[key] = loc
+	}
+	versions := make(map[versionKey]diskLocation, len(e.versions))
+	for vkey, loc := range e.versions {
+		versions[vkey] = loc
+	}
+
+	// the sealed files can't be removed while the merge reads them
+	e.merging = true
+	e.views++
+	e.merges.Add(1)
+	go func() {
+		defer e.merges.Done()
+		merge.copied = versions
+		merge.err = e.merge(merge, files, index, versions)
+
+		e.Lock()
+		defer e.Unlock()
+		e.merged = merge
+	}()
+}
+
+// Copies the records index and versions point at into new files, keeping
+// their sequence numbers. Runs without any lock: the sealed files are never
+// written again, and nothing but the merge touches the new ones
+func (e *DiskEngine) merge(merge *diskMerge, files map[int]*os.File, index map[string]diskLocation, versions map[versionKey]diskLocation) error {
+	var out *os.File
+	var outId int
+	write := func(rec diskRecord) (diskLocation, error) {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return diskLocation{}, err
+		}
+		line = append(line, '\n')
+		if out == nil || merge.sizes[outId] >= DiskEngineFileSize {
+			outId, out, err = e.createFile()
+			if err != nil {
+				return diskLocation{}, err
+			}
+			merge.files[outId] = out
+			merge.sizes[outId] = 0
+		}
+		loc := diskLocation{fileId: outId, offset: merge.sizes[outId], size: len(line)}
+		_, err = out.WriteAt(line, loc.offset)
+		merge.sizes[outId] += int64(len(line))
+		return loc, err
+	}
+	copyRecord := func(old diskLocation) (diskLocation, error) {
+		buf := make([]byte, old.size)
+		_, err := files[old.fileId].ReadAt(buf, old.offset)
+		if err != nil {
+			return diskLocation{}, err
+		}
+		rec, err := decodeDiskRecord(buf)
+		if err != nil {
+			return diskLocation{}, err
+		}
+		loc, err := write(rec)
+		loc.version = old.version
+		merge.moved[old] = loc
+		return loc, err
+	}
+
+	err := func() error {
+		// the entries first, so the versions sharing them can point at them
+		for _, old := range index {
+			_, err := copyRecord(old)
+			if err != nil {
+				return err
+			}
+		}
+		for vkey, old := range versions {
+			if loc, shared := merge.moved[old]; shared {
+				rec := sharedRecord(vkey.key, loc)
+				rec.Seq = merge.seq // older than anything written after the merge started
+				_, err := write(rec)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			_, err := copyRecord(old)
+			if err != nil {
+				return err
+			}
+		}
+		for _, file := range merge.files {
+			err := file.Sync()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		for _, file := range merge.files {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
+	return err
+}
+
+// Swaps in the result of a merge that's finished: the index and versions
+// are copied with every moved record pointing at its new place, and the
+// files it rewrote are retired. A merge of data cleared since is thrown away
+func (e *DiskEngine) installMerge() {
+	e.Lock()
+	defer e.Unlock()
+
+	merge := e.merged
+	if merge == nil {
+		return
+	}
+	e.merged = nil
+	e.merging = false
+	e.views--
+	defer func() {
+		if e.views == 0 {
+			e.removeRetired()
+		}
+	}()
+
+	if merge.err != nil {
+		log.Printf("merging the disk engine's files: %v", merge.err)
+		return
+	}
+	if merge.epoch != e.epoch {
+		for _, file := range merge.files {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		return
+	}
+
+	// records overwritten or deleted since the merge started stay where
+	// they are, and their copies are garbage
+	index := make(map[string]diskLocation, len(e.index))
+	versions := make(map[versionKey]diskLocation, len(e.versions))
+	live := make(map[diskLocation]bool)
+	for key, loc := range e.index {
+		if moved, exists := merge.moved[loc]; exists {
+			loc = moved
+		}
+		index[key] = loc
+		live[loc] = true
+	}
+	var repointed []versionKey
+	for vkey, loc := range e.versions {
+		if moved, exists := merge.moved[loc]; exists {
+			// versions kept since the merge started can share entries it
+			// moved, and their records point at the old place
+			if merge.copied[vkey] != loc {
+				repointed = append(repointed, vkey)
+			}
+			loc = moved
+		}
+		versions[vkey] = loc
+		live[loc] = true
+	}
+	e.index = index
+	e.versions = versions
+
+	e.liveBytes = 0
+	for loc := range live {
+		e.liveBytes += int64(loc.size)
+	}
+	for id := range merge.sealed {
+		e.totalBytes -= e.sizes[id]
+		e.retired[id] = e.files[id]
+		delete(e.files, id)
+		delete(e.sizes, id)
+	}
+	for id, file := range merge.files {
+		e.files[id] = file
+		e.sizes[id] = merge.sizes[id]
+		e.totalBytes += merge.sizes[id]
+	}
+	for _, vkey := range repointed {
+		_, err := e.writeRecord(sharedRecord(vkey.key, e.versions[vkey]))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Waits for a merge that's running to finish. Its result is swapped in by
+// the next write
+func (e *DiskEngine) waitForMerge() {
+	e.merges.Wait()
+}
+
+// Moves every current file to the retired list. Caller must hold the lock
+func (e *DiskEngine) retireFiles() {
+	for id, file := range e.files {
+		e.retired[id] = file
+	}
+	e.files = make(map[int]*os.File)
+	e.sizes = make(map[int]int64)
+	if e.views == 0 {
+		e.removeRetired()
+	}
+}
+
+// Closes and deletes retired files, except ones the last checkpoint still
+// needs. Caller must hold the lock
+func (e *DiskEngine) removeRetired() {
+	for id, file := range e.retired {
+		if e.checkpointFiles[id] {
+			continue
+		}
+		file.Close()
+		os.Remove(file.Name())
+		delete(e.retired, id)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func diskEngineContents(t *testing.T, e *DiskEngine) map[string]interface{} {
+	got := make(map[string]interface{})
+	err := e.Range(func(key string, entry KeyEntry) bool {
+		got[key] = entry.Value
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func diskEnginePut(t *testing.T, e *DiskEngine, key string, value string, version int64) {
+	err := e.Put(key, KeyEntry{Value: value, Version: version})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reopening goes back to the last checkpoint, dropping what was written
+// after it, and starts over empty without one
+func TestDiskEngineReopen(t *testing.T) {
+	dir := t.TempDir()
+	e, err := OpenDiskEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskEnginePut(t, e, "a", "1", 1)
+	diskEnginePut(t, e, "b", "2", 1)
+	diskEnginePut(t, e, "c", "3", 1)
+	err = e.PutVersion("b", KeyEntry{Value: "2", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskEnginePut(t, e, "b", "4", 2)
+	err = e.Delete("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := e.Snapshot()
+	err = snapshot.Checkpoint(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Close()
+
+	// not checkpointed
+	diskEnginePut(t, e, "a", "5", 2)
+	diskEnginePut(t, e, "d", "6", 1)
+
+	reopened, err := OpenDiskEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.CheckpointLSN() != 7 {
+		t.Errorf("got checkpoint lsn %d, want 7", reopened.CheckpointLSN())
+	}
+	want := map[string]interface{}{"a": "1", "b": "4"}
+	if got := diskEngineContents(t, reopened); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	entry, exists, err := reopened.GetVersion("b", 1)
+	if err != nil || !exists || entry.Value != "2" {
+		t.Errorf("got version 1 of b %v (exists %v, err %v), want 2", entry.Value, exists, err)
+	}
+	if reopened.liveBytes != e.liveBytes-int64(e.index["a"].size+e.index["d"].size)+int64(reopened.index["a"].size) {
+		t.Errorf("got %d live bytes after reopening", reopened.liveBytes)
+	}
+
+	// writes carry on after the records that are left
+	diskEnginePut(t, reopened, "e", "7", 1)
+	if entry, _, _ := reopened.Get("e"); entry.Value != "7" {
+		t.Errorf("got e %v, want 7", entry.Value)
+	}
+
+	err = os.Remove(filepath.Join(dir, diskCheckpointFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := OpenDiskEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.Len() != 0 || empty.CheckpointLSN() != 0 {
+		t.Errorf("got %d keys at checkpoint lsn %d without a checkpoint, want none", empty.Len(), empty.CheckpointLSN())
+	}
+}
+
+// Merges run in the background and are swapped in by the next write,
+// keeping writes made in the meantime and versions kept for history
+func TestDiskEngineBackgroundMerge(t *testing.T) {
+	defaultMergeSize := DiskEngineMergeSize
+	DiskEngineMergeSize = 1
+	defer func() { DiskEngineMergeSize = defaultMergeSize }()
+
+	dir := t.TempDir()
+	e, err := OpenDiskEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Put("kept", KeyEntry{Value: "k", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.PutVersion("kept", KeyEntry{Value: "k", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskEnginePut(t, e, "a", "1", 1)
+	diskEnginePut(t, e, "a", "2", 2)
+	if !e.merging {
+		t.Fatal("no merge was started")
+	}
+	var sealed []int
+	for id := range e.files {
+		if id != e.activeId {
+			sealed = append(sealed, id)
+		}
+	}
+
+	e.waitForMerge()
+	merged := e.merged
+	if merged == nil {
+		t.Fatal("the merge didn't leave a result")
+	}
+
+	// written while the merge ran, so held back from being swapped in
+	e.merged = nil
+	diskEnginePut(t, e, "b", "3", 1)
+	err = e.PutVersion("a", KeyEntry{Value: "2", Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.merged = merged
+
+	diskEnginePut(t, e, "c", "4", 1)
+	if e.merged != nil || e.merging {
+		t.Fatal("the merge wasn't swapped in by the next write")
+	}
+	for _, id := range sealed {
+		if e.files[id] != nil {
+			t.Errorf("file %d is still in use after being merged", id)
+		}
+	}
+	var total int64
+	for _, file := range e.files {
+		info, err := file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	if e.totalBytes != total {
+		t.Errorf("got %d bytes in total, want the files' %d", e.totalBytes, total)
+	}
+	if e.liveBytes > e.totalBytes {
+		t.Errorf("got %d live of %d bytes", e.liveBytes, e.totalBytes)
+	}
+
+	want := map[string]interface{}{"kept": "k", "a": "2", "b": "3", "c": "4"}
+	if got := diskEngineContents(t, e); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	check := func(e *DiskEngine) {
+		for _, version := range []versionKey{{"kept", 1}, {"a", 2}} {
+			entry, exists, err := e.GetVersion(version.key, version.version)
+			if err != nil || !exists {
+				t.Errorf("version %d of %s is gone (err %v)", version.version, version.key, err)
+			} else if want := map[string]string{"kept": "k", "a": "2"}[version.key]; entry.Value != want {
+				t.Errorf("got version %d of %s %v, want %s", version.version, version.key, entry.Value, want)
+			}
+		}
+	}
+	check(e)
+
+	// the files the merge replaced go once nothing needs them
+	names, err := filepath.Glob(filepath.Join(dir, diskFilePattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != len(e.files) {
+		t.Errorf("got %d data files, want the engine's %d", len(names), len(e.files))
+	}
+
+	// and the merged files reopen as they are
+	snapshot := e.Snapshot()
+	err = snapshot.Checkpoint(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Close()
+	reopened, err := OpenDiskEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := diskEngineContents(t, reopened); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v after reopening, want %v", got, want)
+	}
+	check(reopened)
+}
+
+// A kvs on a disk engine reopens its files instead of loading the snapshot
+// into it again, and one whose checkpoint doesn't match the snapshot starts over
+func TestDiskEngineReopenedByKvs(t *testing.T) {
+	config := walTestConfig(t)
+	config.Engine = EngineDisk
+	kvs := NewKeyValStoreDatabase("n0")
+	err := kvs.OpenStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		_, _, _, err := kvs.PutData(key, KeyEntry{Value: key}, WriteCondition{}, nil, "n0")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = kvs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = kvs.PutData("c", KeyEntry{Value: "c"}, WriteCondition{}, nil, "n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs.wal.file.Close()
+	kvs.changes.file.Close()
+
+	reopened := NewKeyValStoreDatabase("n0")
+	err = reopened.OpenStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsn := reopened.engine.CheckpointLSN(); lsn != kvs.lastSnapshotLSN {
+		t.Errorf("got checkpoint lsn %d, want the snapshot's %d", lsn, kvs.lastSnapshotLSN)
+	}
+	want := []string{"a", "b", "c"}
+	got := []string{}
+	reopened.engine.Scan("", "", func(key string, entry KeyEntry) bool {
+		got = append(got, key)
+		return true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	if reopened.memoryUsed != kvs.memoryUsed {
+		t.Errorf("got %d bytes of memory used after reopening, want %d", reopened.memoryUsed, kvs.memoryUsed)
+	}
+	reopened.wal.file.Close()
+	reopened.changes.file.Close()
+
+	// a checkpoint from some other snapshot can't be trusted
+	err = os.WriteFile(filepath.Join(config.Dir, "engine", diskCheckpointFileName), []byte(`{"lsn":1,"files":{}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewKeyValStoreDatabase("n0")
+	err = restarted.OpenStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.file.Close()
+	defer restarted.changes.file.Close()
+	got = []string{}
+	restarted.engine.Scan("", "", func(key string, entry KeyEntry) bool {
+		got = append(got, key)
+		return true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v after starting over from the snapshot, want %v", got, want)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+)
+
+// Storage engines selectable with STORAGE_ENGINE
+const (
+	EngineMemory = "memory"
+	EngineDisk   = "disk"
+)
+
+var ErrUnknownEngine = errors.New("unknown storage engine")
+
+// StorageEngine holds the key value pairs for a KeyValStoreDatabase.
+// Engines don't need their own locking against each other's methods;
+// the kvs only calls them while holding its lock. Snapshots returned by
+// Snapshot are the exception and must stay readable while the engine keeps
+// changing.
+type StorageEngine interface {
+	Get(key string) (entry KeyEntry, exists bool, err error)
+	Has(key string) bool
+	Put(key string, entry KeyEntry) error
+	Delete(key string) error
+	Clear() error
+	Len() int
+
+	// Calls fn on every key value pair until fn returns false
+	Range(fn func(key string, entry KeyEntry) bool) error
+
+	// Like Range but in key order, over the keys in [start, end). An empty
+	// end means no upper bound
+	Scan(start, end string, fn func(key string, entry KeyEntry) bool) error
+
+	// Returns a point in time, read only view of the engine
+	Snapshot() EngineSnapshot
+
+	// Keep the entries of older versions of keys for their history. The
+	// kvs only keeps which versions there are, so the engine decides where
+	// their values live. Putting a version that's already kept does nothing
+	PutVersion(key string, entry KeyEntry) error
+	GetVersion(key string, version int64) (entry KeyEntry, exists bool, err error)
+	DropVersion(key string, version int64)
+
+	// The lsn of the kvs snapshot the engine came back as it was at when
+	// opened, 0 if it didn't keep anything
+	CheckpointLSN() uint64
+}
+
+type EngineSnapshot interface {
+	Range(fn func(key string, entry KeyEntry) bool) error
+	GetVersion(key string, version int64) (entry KeyEntry, exists bool, err error)
+
+	// Called once the kvs snapshot at lsn is written, so engines that keep
+	// their data on disk can reopen as of it
+	Checkpoint(lsn uint64) error
+	Close()
+}
+
+// A version of a key kept for its history
+type versionKey struct {
+	key     string
+	version int64
+}
+
+// Creates the engine named by config.Engine. Engines that store on disk
+// keep their files in a subdirectory of config.Dir
+func OpenStorageEngine(config StorageConfig) (StorageEngine, error) {
+	switch config.Engine {
+	case EngineMemory:
+		return NewMemoryEngine(), nil
+	case EngineDisk:
+		return OpenDiskEngine(filepath.Join(config.Dir, "engine"))
+	default:
+		return nil, ErrUnknownEngine
+	}
+}
+
+/// --- memory engine ---
+
+// Keeps everything in a map, with the keys also in an ordered index for scans
+type MemoryEngine struct {
+	data     map[string]KeyEntry
+	keys     *KeyIndex
+	versions map[versionKey]KeyEntry
+}
+
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{
+		data:     make(map[string]KeyEntry),
+		keys:     NewKeyIndex(),
+		versions: make(map[versionKey]KeyEntry),
+	}
+}
+
+func (e *MemoryEngine) Get(key string) (KeyEntry, bool, error) {
+	entry, exists := e.data[key]
+	return entry, exists, nil
+}
+
+func (e *MemoryEngine) Has(key string) bool {
+	_, exists := e.data[key]
+	return exists
+}
+
+func (e *MemoryEngine) Put(key string, entry KeyEntry) error {
+	if _, exists := e.data[key]; !exists {
+		e.keys.Insert(key)
+	}
+	e.data[key] = entry
+	return nil
+}
+
+func (e *MemoryEngine) Delete(key string) error {
+	delete(e.data, key)
+	e.keys.Remove(key)
+	return nil
+}
+
+func (e *MemoryEngine) Clear() error {
+	e.data = make(map[string]KeyEntry)
+	e.keys = NewKeyIndex()
+	e.versions = make(map[versionKey]KeyEntry)
+	return nil
+}
+
+func (e *MemoryEngine) Len() int {
+	return len(e.data)
+}
+
+func (e *MemoryEngine) Range(fn func(key string, entry KeyEntry) bool) error {
+	for key, entry := range e.data {
+		if !fn(key, entry) {
+			break
+		}
+	}
+	return nil
+}
+
+func (e *MemoryEngine) Scan(start, end string, fn func(key string, entry KeyEntry) bool) error {
+	e.keys.Ascend(start, func(key string) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		return fn(key, e.data[key])
+	})
+	return nil
+}
+
+// Snapshots are only ever ranged over, so they go without a key index.
+// Values are never modified in place, so shallow copies of the maps are enough
+func (e *MemoryEngine) Snapshot() EngineSnapshot {
+	copy := make(map[string]KeyEntry, len(e.data))
+	for key, entry := range e.data {
+		copy[key] = entry
+	}
+	versions := make(map[versionKey]KeyEntry, len(e.versions))
+	for version, entry := range e.versions {
+		versions[version] = entry
+	}
+	return &MemoryEngine{data: copy, versions: versions}
+}
+
+// Everything's in memory anyway, so versions are kept as they are
+func (e *MemoryEngine) PutVersion(key string, entry KeyEntry) error {
+	e.versions[versionKey{key, entry.Version}] = entry
+	return nil
+}
+
+func (e *MemoryEngine) GetVersion(key string, version int64) (KeyEntry, bool, error) {
+	entry, exists := e.versions[versionKey{key, version}]
+	return entry, exists, nil
+}
+
+func (e *MemoryEngine) DropVersion(key string, version int64) {
+	delete(e.versions, versionKey{key, version})
+}
+
+// Nothing outlives a restart, so there's never a checkpoint to go back to
+func (e *MemoryEngine) CheckpointLSN() uint64 {
+	return 0
+}
+
+func (e *MemoryEngine) Checkpoint(lsn uint64) error {
+	return nil
+}
+
+func (e *MemoryEngine) Close() {}
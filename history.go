@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// One version of a key, kept after it has been overwritten or deleted. The
+// history held by the kvs leaves out Value: the engine keeps the entry of
+// each version, so a disk engine doesn't hold old values in memory
+type HistoryVersion struct {
+	Version int64       `json:"version"`
+	Value   interface{} `json:"value,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+	Time    int64       `json:"time"` // unix milliseconds this node applied it
+
+	// the node that took the write from a client, if it's known. Keys copied
+	// over by a reshard or a repair don't say who wrote them
+	Writer string `json:"writer,omitempty"`
+}
+
+// Returns every version of key that's still retained, oldest first
+func (kvs *KeyValStoreDatabase) GetHistory(key string, metadata map[string]int) (history []HistoryVersion, currentMetadata map[string]int, err error) {
+	// Lock Data
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	// Check metadata
+	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
+	if !metadataValid {
+		return nil, nil, ErrInvalidMetadata
+	}
+
+	versions := kvs.pruneHistory(kvs.history[key], time.Now().UnixMilli())
+	if len(versions) == 0 {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	history, err = withValues(key, versions, kvs.engine.GetVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	return history, kvs.copyMetadata(), nil
+}
+
+// Returns a single retained version of key
+func (kvs *KeyValStoreDatabase) GetVersion(key string, version int64, metadata map[string]int) (HistoryVersion, map[string]int, error) {
+	history, currentMetadata, err := kvs.GetHistory(key, metadata)
+	if err != nil {
+		return HistoryVersion{}, nil, err
+	}
+
+	for _, v := range history {
+		if v.Version == version {
+			return v, currentMetadata, nil
+		}
+	}
+	return HistoryVersion{}, nil, ErrVersionNotFound
+}
+
+// Adds a version to the end of key's history, dropping versions that are
+// past the limits. entry is the entry a put stored, nil for a delete; the
+// engine keeps it for as long as the version is in the history. Caller must
+// hold the lock
+func (kvs *KeyValStoreDatabase) recordHistory(key string, version HistoryVersion, entry *KeyEntry) error {
+	if kvs.config.HistoryVersions <= 0 {
+		return nil
+	}
+	if entry != nil {
+		err := kvs.engine.PutVersion(key, *entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	versions := append(kvs.history[key], version)
+	history := kvs.pruneHistory(versions, version.Time)
+	kvs.dropVersions(key, versions[:len(versions)-len(history)], history)
+	kvs.touchMerkle(key)
+	if len(history) == 0 {
+		delete(kvs.history, key)
+	} else {
+		kvs.history[key] = history
+	}
+	return nil
+}
+
+// Replaces key's history with versions, which carry their values, handing
+// the values to the engine. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) loadHistory(key string, versions []HistoryVersion) error {
+	history := make([]HistoryVersion, len(versions))
+	for i, version := range versions {
+		if !version.Deleted {
+			err := kvs.engine.PutVersion(key, KeyEntry{Value: version.Value, Version: version.Version})
+			if err != nil {
+				return err
+			}
+		}
+		version.Value = nil
+		history[i] = version
+	}
+	kvs.history[key] = history
+	return nil
+}
+
+// Forgets key's history. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) dropHistory(key string) {
+	kvs.dropVersions(key, kvs.history[key], nil)
+	delete(kvs.history, key)
+}
+
+// Lets the engine drop the entries of versions pruned from key's history,
+// unless kept has the same version too. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) dropVersions(key string, dropped []HistoryVersion, kept []HistoryVersion) {
+	for _, version := range dropped {
+		if version.Deleted {
+			continue
+		}
+		stillKept := false
+		for _, other := range kept {
+			stillKept = stillKept || (!other.Deleted && other.Version == version.Version)
+		}
+		if !stillKept {
+			kvs.engine.DropVersion(key, version.Version)
+		}
+	}
+}
+
+// Returns a copy of versions with the value of every put filled in from
+// get, which reads from the engine or a snapshot of it
+func withValues(key string, versions []HistoryVersion, get func(key string, version int64) (KeyEntry, bool, error)) ([]HistoryVersion, error) {
+	history := make([]HistoryVersion, len(versions))
+	for i, version := range versions {
+		if !version.Deleted && version.Value == nil {
+			entry, exists, err := get(key, version.Version)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				version.Value = entry.ClientValue()
+			}
+		}
+		history[i] = version
+	}
+	return history, nil
+}
+
+// Returns a copy of the history of every key, with the values filled in.
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) historyWithValues() (map[string][]HistoryVersion, error) {
+	history := make(map[string][]HistoryVersion, len(kvs.history))
+	for key, versions := range kvs.history {
+		var err error
+		history[key], err = withValues(key, versions, kvs.engine.GetVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// Every HISTORY_PRUNE_INTERVAL, drops the versions of every key that are
+// past HistoryRetention. Keys that aren't written again, deleted ones in
+// particular, would otherwise keep their history forever
+func pruneOldHistory() {
+	ticker := time.NewTicker(HISTORY_PRUNE_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		kvsDb.PruneHistory(time.Now().UnixMilli())
+	}
+}
+
+// Applies pruneHistory to the history of every key
+func (kvs *KeyValStoreDatabase) PruneHistory(now int64) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	if kvs.config.HistoryRetention <= 0 {
+		return
+	}
+	for key, versions := range kvs.history {
+		history := kvs.pruneHistory(versions, now)
+		kvs.dropVersions(key, versions[:len(versions)-len(history)], history)
+		if len(history) == 0 {
+			// a tombstone may have gone with it
+			kvs.touchMerkle(key)
+			delete(kvs.history, key)
+		} else {
+			kvs.history[key] = history
+		}
+	}
+}
+
+// Keeps the newest HistoryVersions versions, and of those only the ones
+// younger than HistoryRetention (if set). The newest version is kept no
+// matter how old it is, unless it's a delete
+func (kvs *KeyValStoreDatabase) pruneHistory(history []HistoryVersion, now int64) []HistoryVersion {
+	if len(history) > kvs.config.HistoryVersions {
+		history = history[len(history)-kvs.config.HistoryVersions:]
+	}
+
+	if kvs.config.HistoryRetention > 0 {
+		cutoff := now - kvs.config.HistoryRetention.Milliseconds()
+		i := 0
+		for i < len(history)-1 && history[i].Time < cutoff {
+			i++
+		}
+		history = history[i:]
+
+		if len(history) == 1 && history[0].Deleted && history[0].Time < cutoff {
+			return nil
+		}
+	}
+
+	return history
+}
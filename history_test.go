@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPruneHistory(t *testing.T) {
+	const now = 1000 * 60 * 60 * 24 * 30
+	const hour = 1000 * 60 * 60
+	put := func(version int64, age int64) HistoryVersion {
+		return HistoryVersion{Version: version, Value: version, Time: now - age}
+	}
+	del := func(version int64, age int64) HistoryVersion {
+		return HistoryVersion{Version: version, Deleted: true, Time: now - age}
+	}
+
+	tests := []struct {
+		name      string
+		versions  int
+		retention time.Duration
+		history   []HistoryVersion
+		want      []HistoryVersion
+	}{
+		{"within limits", 10, 24 * time.Hour, []HistoryVersion{put(1, 2*hour), put(2, hour)}, []HistoryVersion{put(1, 2*hour), put(2, hour)}},
+		{"too many versions", 2, 24 * time.Hour, []HistoryVersion{put(1, 3), put(2, 2), put(3, 1)}, []HistoryVersion{put(2, 2), put(3, 1)}},
+		{"old versions", 10, 24 * time.Hour, []HistoryVersion{put(1, 48*hour), put(2, 25*hour), put(3, hour)}, []HistoryVersion{put(3, hour)}},
+		{"old live key keeps its newest version", 10, 24 * time.Hour, []HistoryVersion{put(1, 48*hour), put(2, 25*hour)}, []HistoryVersion{put(2, 25*hour)}},
+		{"recent delete keeps its tombstone", 10, 24 * time.Hour, []HistoryVersion{put(1, 48*hour), del(2, hour)}, []HistoryVersion{del(2, hour)}},
+		{"old delete is dropped", 10, 24 * time.Hour, []HistoryVersion{put(1, 48*hour), del(2, 25*hour)}, nil},
+		{"no retention keeps old deletes", 10, 0, []HistoryVersion{put(1, 48*hour), del(2, 25*hour)}, []HistoryVersion{put(1, 48*hour), del(2, 25*hour)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kvs := NewKeyValStoreDatabase("n0")
+			kvs.config.HistoryVersions = test.versions
+			kvs.config.HistoryRetention = test.retention
+			kvs.history["key"] = test.history
+
+			kvs.PruneHistory(now)
+			got, exists := kvs.history["key"]
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			if exists != (test.want != nil) {
+				t.Errorf("key still has history: %v", exists)
+			}
+		})
+	}
+}
+
+func TestHistoryRecordsWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		rec  WalRecord
+		want HistoryVersion
+	}{
+		{"client put", WalRecord{Op: WalOpPut, Key: "key", Entry: &KeyEntry{Value: "x", Version: 3}, Sender: "n1", Time: 5}, HistoryVersion{Version: 3, Value: "x", Time: 5, Writer: "n1"}},
+		{"client delete", WalRecord{Op: WalOpDelete, Key: "key", Version: 4, Sender: "n2", Time: 6}, HistoryVersion{Version: 4, Deleted: true, Time: 6, Writer: "n2"}},
+		{"batch", WalRecord{Op: WalOpBatch, Writes: []BatchWrite{{Key: "key", Entry: &KeyEntry{Value: "y", Version: 5}}}, Sender: "n1", Time: 7}, HistoryVersion{Version: 5, Value: "y", Time: 7, Writer: "n1"}},
+		{"repair", WalRecord{Op: WalOpPut, Key: "key", Entry: &KeyEntry{Value: "z", Version: 6}, Time: 8}, HistoryVersion{Version: 6, Value: "z", Time: 8}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kvs := NewKeyValStoreDatabase("n0")
+			kvs.config.HistoryVersions = DefaultHistoryVersions
+
+			err := kvs.applyRecord(test.rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			history, _, err := kvs.GetHistory("key", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 1 || !reflect.DeepEqual(history[0], test.want) {
+				t.Errorf("got history %v, want %v", history, test.want)
+			}
+		})
+	}
+}
+
+// The kvs only keeps which versions a key had; the engine keeps their
+// values, and a disk engine keeps them on disk, through a snapshot and
+// restart too
+func TestHistoryValuesInEngine(t *testing.T) {
+	for _, engine := range []string{EngineMemory, EngineDisk} {
+		t.Run(engine, func(t *testing.T) {
+			config := walTestConfig(t)
+			config.Engine = engine
+			config.HistoryVersions = 2
+			config.HistoryRetention = 0
+			kvs := NewKeyValStoreDatabase("n0")
+			err := kvs.OpenStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, value := range []string{"a", "b", "c"} {
+				err = kvs.commit(WalRecord{Op: WalOpPut, Key: "key", Entry: &KeyEntry{Value: value, Version: int64(i + 1)}})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, version := range kvs.history["key"] {
+				if version.Value != nil {
+					t.Errorf("version %d holds its value in memory", version.Version)
+				}
+			}
+			if _, exists, _ := kvs.engine.GetVersion("key", 1); exists {
+				t.Error("the engine still keeps the pruned version")
+			}
+			if disk, ok := kvs.engine.(*DiskEngine); ok {
+				newest, older := disk.versions[versionKey{"key", 3}], disk.versions[versionKey{"key", 2}]
+				if newest != disk.index["key"] {
+					t.Errorf("got version 3 at %v, want it sharing its entry's record at %v", newest, disk.index["key"])
+				}
+				if want := int64(newest.size + older.size); disk.liveBytes != want {
+					t.Errorf("got %d live bytes, want %d", disk.liveBytes, want)
+				}
+			}
+
+			want := []HistoryVersion{{Version: 2, Value: "b"}, {Version: 3, Value: "c"}}
+			check := func(kvs *KeyValStoreDatabase) {
+				history, _, err := kvs.GetHistory("key", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range history {
+					history[i].Time = 0
+				}
+				if !reflect.DeepEqual(history, want) {
+					t.Errorf("got history %v, want %v", history, want)
+				}
+			}
+			check(kvs)
+
+			err = kvs.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			kvs.wal.file.Close()
+			reopened := NewKeyValStoreDatabase("n0")
+			err = reopened.OpenStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.wal.file.Close()
+			check(reopened)
+		})
+	}
+}
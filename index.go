@@ -0,0 +1,102 @@
+package main
+
+import "math/rand"
+
+const keyIndexMaxLevel = 24
+
+// KeyIndex is an ordered set of keys, kept as a skip list so inserts,
+// removes and seeks are all O(log n)
+type KeyIndex struct {
+	head   *keyIndexNode
+	level  int
+	length int
+}
+
+type keyIndexNode struct {
+	key  string
+	next []*keyIndexNode
+}
+
+func NewKeyIndex() *KeyIndex {
+	return &KeyIndex{
+		head:  &keyIndexNode{next: make([]*keyIndexNode, keyIndexMaxLevel)},
+		level: 1,
+	}
+}
+
+func (idx *KeyIndex) Len() int {
+	return idx.length
+}
+
+func (idx *KeyIndex) Insert(key string) {
+	// find the last node before key on every level
+	update := idx.findPredecessors(key)
+	if next := update[0].next[0]; next != nil && next.key == key {
+		return
+	}
+
+	level := randomKeyIndexLevel()
+	if level > idx.level {
+		for i := idx.level; i < level; i++ {
+			update[i] = idx.head
+		}
+		idx.level = level
+	}
+
+	// link the new node in after its predecessors
+	node := &keyIndexNode{key: key, next: make([]*keyIndexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	idx.length++
+}
+
+func (idx *KeyIndex) Remove(key string) {
+	update := idx.findPredecessors(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+
+	// unlink the node on every level it's on
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+	idx.length--
+}
+
+// Calls fn on every key >= start, in order, until fn returns false
+func (idx *KeyIndex) Ascend(start string, fn func(key string) bool) {
+	node := idx.findPredecessors(start)[0].next[0]
+	for ; node != nil; node = node.next[0] {
+		if !fn(node.key) {
+			return
+		}
+	}
+}
+
+// Returns the last node with a key less than key on each level
+func (idx *KeyIndex) findPredecessors(key string) []*keyIndexNode {
+	update := make([]*keyIndexNode, keyIndexMaxLevel)
+	node := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+	return update
+}
+
+// Each level up holds about a quarter of the keys of the one below it
+func randomKeyIndexLevel() int {
+	level := 1
+	for level < keyIndexMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
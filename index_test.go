@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// The index stays in order through inserts and removes in any order
+func TestKeyIndex(t *testing.T) {
+	idx := NewKeyIndex()
+	want := make(map[string]bool)
+	for _, i := range rand.Perm(500) {
+		key := strconv.Itoa(i)
+		idx.Insert(key)
+		want[key] = true
+		if i%3 == 0 {
+			idx.Remove(key)
+			delete(want, key)
+		}
+	}
+	idx.Insert("1") // already there
+	idx.Remove("missing")
+
+	sorted := make([]string, 0, len(want))
+	for key := range want {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	if idx.Len() != len(sorted) {
+		t.Errorf("got %d keys, want %d", idx.Len(), len(sorted))
+	}
+
+	for _, start := range []string{"", "250", "99", "zzz"} {
+		got := make([]string, 0)
+		idx.Ascend(start, func(key string) bool {
+			got = append(got, key)
+			return true
+		})
+		from := sort.SearchStrings(sorted, start)
+		if !reflect.DeepEqual(got, sorted[from:]) {
+			t.Errorf("ascending from %q got %d keys, want %d", start, len(got), len(sorted)-from)
+		}
+	}
+}
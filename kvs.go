@@ -1,16 +1,106 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"hash/crc32"
+	"log"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 // Structures
 type KeyValStoreDatabase struct {
 	sync.Mutex
-	Data         map[string]interface{} `json:"data"`
-	Metadata     map[string]int         `json:"metadata"`
-	LocalAddress string                 `json:"localAddress"`
+	Metadata     map[string]int `json:"metadata"`
+	LocalAddress string         `json:"localAddress"`
+	engine       StorageEngine
+	wal          *WriteAheadLog
+
+	// expiry time of every key that has one, so the reaper doesn't need to scan the engine
+	expiries map[string]int64
+
+	// recent versions of every key, oldest first
+	history map[string][]HistoryVersion
+
+	// transactions prepared on this shard by id, and the id of the one
+	// holding each locked key
+	prepared map[string]PreparedTxn
+	locks    map[string]string
+
+	// how recently finished transactions ended, by id
+	finished map[string]FinishedTxn
+
+	// estimated bytes of every key and their total, and how recently and
+	// often each key was used, for the memory limit and eviction
+	memoryUsed  int64
+	sizes       map[string]int64
+	access      map[string]*keyAccess
+	accessClock uint64
+
+	config StorageConfig
+
+	// this node's part in its shard's raft group, nil in causal mode, and
+	// the index of the last raft entry applied
+	raft      *RaftNode
+	raftIndex uint64
+
+	// closed once the raft proposal in flight, if any, is applied or given up on
+	proposal chan struct{}
+
+	// the Merkle tree of this node's shard, for anti-entropy
+	merkle merkleCache
+
+	// recent changes, for watchers, and every change, for consumers
+	feed    *ChangeFeed
+	changes *ChangeLog
+
+	// guards the fields below, so only one snapshot runs at a time
+	snapshotLock     sync.Mutex
+	lastSnapshotLSN  uint64
+	lastSnapshotTime time.Time
+}
+
+// A value and everything stored alongside it
+type KeyEntry struct {
+	Value     interface{} `json:"value"`
+	Version   int64       `json:"version"`
+	ExpiresAt int64       `json:"expires-at,omitempty"` // unix milliseconds, 0 means never
+
+	// a raw value, stored byte for byte instead of Value
+	Data        []byte `json:"data,omitempty"`
+	ContentType string `json:"content-type,omitempty"`
+
+	// at most one is set, if the value is a crdt. Value is then what the
+	// crdt reads as
+	Counter  *PNCounter   `json:"counter,omitempty"`
+	Set      *ORSet       `json:"set,omitempty"`
+	Register *LWWRegister `json:"register,omitempty"`
+	Map      *LWWMap      `json:"map,omitempty"`
+}
+
+// Returns true if the entry holds a raw value rather than JSON
+func (entry KeyEntry) IsRaw() bool {
+	return entry.ContentType != ""
+}
+
+// Returns the value as it's shown inside a JSON response. Raw values are
+// shown as their content type and base64 encoded bytes
+func (entry KeyEntry) ClientValue() interface{} {
+	if entry.IsRaw() {
+		return map[string]interface{}{
+			"content-type": entry.ContentType,
+			"base64":       base64.StdEncoding.EncodeToString(entry.Data),
+		}
+	}
+	return entry.Value
+}
+
+// Returns true if the entry has a ttl and it ran out before now (unix milliseconds)
+func (entry KeyEntry) Expired(now int64) bool {
+	return entry.ExpiresAt != 0 && entry.ExpiresAt <= now
 }
 
 // Errors
@@ -20,14 +110,30 @@ var ErrInvalidMetadata = errors.New("cannot accept metadata")
 // Constructor
 func NewKeyValStoreDatabase(localAdd string) *KeyValStoreDatabase {
 	return &KeyValStoreDatabase{
-		Data:         make(map[string]interface{}),
+		engine:       NewMemoryEngine(),
+		expiries:     make(map[string]int64),
+		history:      make(map[string][]HistoryVersion),
+		prepared:     make(map[string]PreparedTxn),
+		locks:        make(map[string]string),
+		finished:     make(map[string]FinishedTxn),
+		sizes:        make(map[string]int64),
+		access:       make(map[string]*keyAccess),
 		Metadata:     make(map[string]int),
 		LocalAddress: localAdd,
+		feed:         NewChangeFeed(),
 	}
 }
 
 // Gets a key from the kvs
-func (kvs *KeyValStoreDatabase) GetData(key string, metadata map[string]int) (value interface{}, currentMetadata map[string]int, err error) {
+func (kvs *KeyValStoreDatabase) GetData(key string, metadata map[string]int) (entry KeyEntry, currentMetadata map[string]int, err error) {
+	// In raft mode only the leader reads, once it knows it's seen every committed write
+	if raft := kvs.Raft(); raft != nil {
+		err = raft.LinearizableRead()
+		if err != nil {
+			return KeyEntry{}, nil, err
+		}
+	}
+
 	// Lock Data
 	kvs.Lock()
 	defer kvs.Unlock()
@@ -35,47 +141,79 @@ func (kvs *KeyValStoreDatabase) GetData(key string, metadata map[string]int) (va
 	// Check metadata
 	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
 	if !metadataValid {
-		return nil, nil, ErrInvalidMetadata
+		return KeyEntry{}, nil, ErrInvalidMetadata
 	}
 
-	// Check if key exists in map
-	value, existed := kvs.Data[key]
+	// Check if key exists in map. Expired keys are served until the
+	// primary's delete of them gets here (see hasLiveKey)
+	entry, existed, err := kvs.engine.Get(key)
+	if err != nil {
+		return KeyEntry{}, nil, err
+	}
 	if !existed {
-		return nil, nil, ErrKeyNotFound
+		return KeyEntry{}, nil, ErrKeyNotFound
 	}
+	kvs.touch(key)
 
 	// Make copy of metadata before unlocking
 	currentMetadata = kvs.copyMetadata()
 
-	// return value and metadata
-	return value, currentMetadata, nil
+	// return entry and metadata
+	return entry, currentMetadata, nil
 }
 
-// Adds Data to the kvs
-func (kvs *KeyValStoreDatabase) PutData(key string, value interface{}, metadata map[string]int, sender string) (wasCreated bool, currentMetadata map[string]int, err error) {
+// Adds Data to the kvs if cond holds. When the write comes from this node
+// the entry is given a new version; replicas keep the version they're sent.
+// Returns the entry as it was stored
+func (kvs *KeyValStoreDatabase) PutData(key string, entry KeyEntry, cond WriteCondition, metadata map[string]int, sender string) (wasCreated bool, stored KeyEntry, currentMetadata map[string]int, err error) {
 	// Lock Database
 	kvs.Lock()
 	defer kvs.Unlock()
+	kvs.awaitProposal()
 
+	if kvs.alreadyApplied(metadata, sender) {
+		return false, entry, kvs.copyMetadata(), nil
+	}
 	metadataValid := kvs.IsMetadataValid(metadata, sender)
 	if !metadataValid {
-		return false, kvs.copyMetadata(), ErrInvalidMetadata
+		return false, entry, kvs.copyMetadata(), ErrInvalidMetadata
 	}
 
-	// Check if key already exists in map
-	_, wasCreated = kvs.Data[key]
+	// clients can't write keys a transaction is about to write
+	if sender == kvs.LocalAddress && kvs.isLocked(key) {
+		return false, entry, kvs.copyMetadata(), ErrKeyLocked
+	}
 
-	// Add data to map
-	kvs.Data[key] = value
+	// Check if key already exists in map and if the preconditions hold
+	wasCreated, err = kvs.checkCondition(key, cond)
+	if err != nil {
+		return false, entry, kvs.copyMetadata(), err
+	}
 
-	// Update metadata
-	kvs.incrementMetadata(sender)
+	if sender == kvs.LocalAddress {
+		err = kvs.checkQuota(key, entry)
+		if err != nil {
+			return false, entry, kvs.copyMetadata(), err
+		}
+		entry.Version = kvs.nextVersion()
+	} else {
+		entry, err = kvs.mergeCrdt(key, entry)
+		if err != nil {
+			return false, entry, kvs.copyMetadata(), err
+		}
+	}
+
+	// Add data to map and update metadata
+	err = kvs.propose(WalRecord{Op: WalOpPut, Key: key, Entry: &entry, Sender: sender})
+	if err != nil {
+		return false, entry, kvs.copyMetadata(), err
+	}
 
 	// Make copy of metadata before unlocking
 	currentMetadata = kvs.copyMetadata()
 
 	// return success and wasCreated
-	return !wasCreated, currentMetadata, nil
+	return !wasCreated, entry, currentMetadata, nil
 }
 
 // exactly the same as PutData, but it doesn't actually stor the data
@@ -85,44 +223,76 @@ func (kvs *KeyValStoreDatabase) putJustMetadata(metadata map[string]int, sender
 	defer kvs.Unlock()
 
 	// check if metadata valid
+	if kvs.alreadyApplied(metadata, sender) {
+		return nil
+	}
 	metadataValid := kvs.IsMetadataValid(metadata, sender)
 	if !metadataValid {
 		return ErrInvalidMetadata
 	}
 
-	kvs.incrementMetadata(sender)
-	return nil
+	return kvs.commit(WalRecord{Op: WalOpMetadata, Sender: sender})
 }
 
-func (kvs *KeyValStoreDatabase) PutDataNoChecks(key string, value interface{}) {
+// Stores a key moved here by a reshard. A crdt is merged with any writes
+// this shard already took for it
+func (kvs *KeyValStoreDatabase) PutDataNoChecks(key string, entry KeyEntry) error {
 	kvs.Lock()
 	defer kvs.Unlock()
-	kvs.Data[key] = value
+
+	entry, err := kvs.mergeCrdt(key, entry)
+	if err != nil {
+		return err
+	}
+	return kvs.commit(WalRecord{Op: WalOpPut, Key: key, Entry: &entry})
 }
 
-// Deletes Data from kvs
-func (kvs *KeyValStoreDatabase) DeleteData(key string, metadata map[string]int, sender string) (currentMetadata map[string]int, err error) {
+// Deletes Data from kvs if cond holds. A delete replicated from another node
+// carries the version it was given there, if the sender sent one
+func (kvs *KeyValStoreDatabase) DeleteData(key string, cond WriteCondition, version int64, metadata map[string]int, sender string) (currentMetadata map[string]int, err error) {
 	// Lock Data
 	kvs.Lock()
 	defer kvs.Unlock()
+	kvs.awaitProposal()
 
 	// Check metadata
+	if kvs.alreadyApplied(metadata, sender) {
+		return kvs.copyMetadata(), nil
+	}
 	metadataValid := kvs.IsMetadataValid(metadata, sender)
 	if !metadataValid {
 		return kvs.copyMetadata(), ErrInvalidMetadata
 	}
 
 	// Check if key exists in map
-	_, existed := kvs.Data[key]
-	if !existed {
+	if !kvs.hasLiveKey(key) {
 		return kvs.copyMetadata(), ErrKeyNotFound
 	}
 
-	// Delete data from map
-	delete(kvs.Data, key)
+	// clients can't delete keys a transaction is about to write
+	if sender == kvs.LocalAddress && kvs.isLocked(key) {
+		return kvs.copyMetadata(), ErrKeyLocked
+	}
+
+	// Check preconditions
+	_, err = kvs.checkCondition(key, cond)
+	if err != nil {
+		return kvs.copyMetadata(), err
+	}
+
+	// The delete gets a version like a put would. Replicas are sent it, or
+	// work it out from the sender's clock, which then counts the delete
+	if sender == kvs.LocalAddress {
+		version = kvs.nextVersion()
+	} else if version == 0 {
+		version = versionFromMetadata(metadata, sender)
+	}
 
-	// Update metadata in senders position
-	kvs.incrementMetadata(sender)
+	// Delete data from map and update metadata in senders position
+	err = kvs.propose(WalRecord{Op: WalOpDelete, Key: key, Version: version, Sender: sender})
+	if err != nil {
+		return kvs.copyMetadata(), err
+	}
 
 	// Make copy of metadata before unlocking
 	currentMetadata = kvs.copyMetadata()
@@ -132,8 +302,425 @@ func (kvs *KeyValStoreDatabase) DeleteData(key string, metadata map[string]int,
 
 }
 
+// Deletes a key whose ttl has run out, as if it was deleted by sender.
+// Returns ErrKeyNotFound if the key is gone or was given a new ttl since,
+// or is locked by a transaction (it's reaped once that finishes)
+func (kvs *KeyValStoreDatabase) ExpireData(key string, sender string) (currentMetadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	expiresAt, exists := kvs.expiries[key]
+	if !exists || expiresAt > time.Now().UnixMilli() || kvs.isLocked(key) {
+		return nil, ErrKeyNotFound
+	}
+
+	err = kvs.propose(WalRecord{Op: WalOpDelete, Key: key, Version: kvs.nextVersion(), Sender: sender})
+	if err != nil {
+		return nil, err
+	}
+	return kvs.copyMetadata(), nil
+}
+
+// Returns every key whose ttl ran out before now (unix milliseconds)
+func (kvs *KeyValStoreDatabase) ExpiredKeys(now int64) []string {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	keys := make([]string, 0)
+	for key, expiresAt := range kvs.expiries {
+		if expiresAt <= now {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Replaces all data, history and metadata in the kvs, used when cloning a shard.
+// Crdts this node already holds are merged into the cloned ones
+func (kvs *KeyValStoreDatabase) ResetData(data map[string]KeyEntry, history map[string][]HistoryVersion, metadata map[string]int) error {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	for key, entry := range data {
+		merged, err := kvs.mergeCrdt(key, entry)
+		if err != nil {
+			return err
+		}
+		data[key] = merged
+	}
+	return kvs.commit(WalRecord{Op: WalOpReset, Data: data, History: history, Metadata: metadata})
+}
+
+// Returns the number of keys stored
+func (kvs *KeyValStoreDatabase) KeyCount() int {
+	kvs.Lock()
+	defer kvs.Unlock()
+	return kvs.engine.Len()
+}
+
+// Returns a copy of the kvs's vector clock
+func (kvs *KeyValStoreDatabase) CurrentMetadata() map[string]int {
+	kvs.Lock()
+	defer kvs.Unlock()
+	return kvs.copyMetadata()
+}
+
+// Calls fn on every key value pair. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) rangeData(fn func(key string, entry KeyEntry) bool) error {
+	return kvs.engine.Range(fn)
+}
+
+// Returns whether key currently exists, or ErrPreconditionFailed if cond
+// doesn't hold. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) checkCondition(key string, cond WriteCondition) (exists bool, err error) {
+	exists = kvs.hasLiveKey(key)
+	if cond.IsEmpty() {
+		return exists, nil
+	}
+
+	var entry KeyEntry
+	if exists {
+		entry, _, err = kvs.engine.Get(key)
+		if err != nil {
+			return exists, err
+		}
+	}
+
+	if !cond.Check(entry, exists) {
+		return exists, ErrPreconditionFailed
+	}
+	return exists, nil
+}
+
+// Versions are the sum of the vector clock once the write is counted in it,
+// with the id of the node that took the write in the low bits. Every write
+// that causally follows another sees a bigger sum, so versions of a key only
+// go up, even across deletes, and concurrent writes on different nodes with
+// the same sum still get different versions. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) nextVersion() int64 {
+	return makeVersion(clockSum(kvs.Metadata)+1, kvs.LocalAddress)
+}
+
+// Bits of a version that hold the writer's node id
+const versionNodeBits = 20
+
+// Returns the version of a write taken by writer, given its clock once the
+// write is counted in it
+func versionFromMetadata(metadata map[string]int, writer string) int64 {
+	return makeVersion(clockSum(metadata), writer)
+}
+
+func makeVersion(clockSum int64, writer string) int64 {
+	return clockSum<<versionNodeBits | int64(nodeVersionId(writer))
+}
+
+// A node's id within versions, taken from a hash of its address
+func nodeVersionId(node string) uint32 {
+	return crc32.ChecksumIEEE([]byte(node)) & (1<<versionNodeBits - 1)
+}
+
+func clockSum(metadata map[string]int) int64 {
+	var sum int64
+	for _, time := range metadata {
+		sum += int64(time)
+	}
+	return sum
+}
+
+// Returns true if key is stored. A key whose ttl has run out still counts
+// until the delete the shard's primary sends for it is applied, so every
+// replica stops serving it at the same causal point rather than when its
+// own clock says so. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) hasLiveKey(key string) bool {
+	return kvs.engine.Has(key)
+}
+
+// Removes a key and its history without touching metadata. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) dropData(key string) error {
+	return kvs.commit(WalRecord{Op: WalOpDelete, Key: key})
+}
+
+// Loads the latest snapshot and replays the write-ahead log after it into
+// the kvs, then starts logging every change and taking periodic snapshots
+func (kvs *KeyValStoreDatabase) OpenStorage(config StorageConfig) error {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	switch config.EvictionPolicy {
+	case EvictNone, EvictLRU, EvictLFU, EvictTTL:
+	default:
+		return ErrInvalidEvictionPolicy
+	}
+	switch config.Replication {
+	case ReplicationCausal, ReplicationRaft:
+	default:
+		return ErrInvalidReplication
+	}
+
+	engine, err := OpenStorageEngine(config)
+	if err != nil {
+		return err
+	}
+	kvs.engine = engine
+
+	kvs.config = config
+
+	// Load snapshot. An engine that reopened as of it already has its
+	// entries, anything else starts over from the snapshot
+	reopened := false
+	header, err := readSnapshot(config.Dir, func(header SnapshotHeader) error {
+		reopened = header.LSN != 0 && engine.CheckpointLSN() == header.LSN
+		if reopened {
+			return nil
+		}
+		return engine.Clear()
+	}, func(entry SnapshotEntry) error {
+		// the entry first, so the engine can keep its version in the same place
+		if entry.Entry != nil && reopened {
+			kvs.trackEntry(entry.Key, *entry.Entry)
+		} else if entry.Entry != nil {
+			err := kvs.putEntry(entry.Key, *entry.Entry)
+			if err != nil {
+				return err
+			}
+		}
+		if entry.History == nil {
+			return nil
+		}
+		return kvs.loadHistory(entry.Key, entry.History)
+	})
+	if err != nil {
+		return err
+	}
+	for replica, time := range header.Metadata {
+		kvs.Metadata[replica] = time
+	}
+	for _, txn := range header.Prepared {
+		kvs.lockTxn(txn)
+	}
+	for id, finished := range header.Finished {
+		kvs.finished[id] = finished
+	}
+	kvs.raftIndex = header.RaftIndex
+
+	// Replay everything logged since the snapshot, logging the changes the
+	// change log didn't get to before the node went down
+	changes, err := OpenChangeLog(filepath.Join(config.Dir, "changes"), config.ChangeLogRetention)
+	if err != nil {
+		return err
+	}
+	kvs.changes = changes
+	wal, err := OpenWriteAheadLog(config, header.LSN, func(rec WalRecord) error {
+		err := kvs.applyRecord(rec)
+		if err != nil || rec.LSN <= changes.LastLSN() {
+			return err
+		}
+		return changes.Append(rec.LSN, rec.Time, kvs.recordChange(rec))
+	})
+	if err != nil {
+		return err
+	}
+	kvs.wal = wal
+	err = changes.TruncateAfter(wal.LastLSN())
+	if err != nil {
+		return err
+	}
+	kvs.lastSnapshotLSN = header.LSN
+
+	// nothing from before the restart can be replayed to watchers
+	kvs.feed.reset(kvs.Metadata)
+	kvs.lastSnapshotTime = time.Now()
+
+	go kvs.snapshotLoop()
+	return nil
+}
+
+// Writes the record to the log (if there is one) and then applies it.
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) commit(rec WalRecord) error {
+	rec.Time = time.Now().UnixMilli()
+	if kvs.wal != nil {
+		err := kvs.wal.Append(rec)
+		if err != nil {
+			return err
+		}
+		rec.LSN = kvs.wal.LastLSN()
+	}
+	err := kvs.applyRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	// watchers resuming from before a reset would miss what it replaced
+	if rec.Op == WalOpReset {
+		kvs.feed.reset(kvs.Metadata)
+		return nil
+	}
+	change := kvs.recordChange(rec)
+	kvs.feed.publish(change)
+	if kvs.changes != nil {
+		// the write is already applied. A change that fails is written
+		// with the next one, or logged again from the write-ahead log on
+		// startup
+		err = kvs.changes.Append(rec.LSN, rec.Time, change)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// Applies a single record to the engine and metadata. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) applyRecord(rec WalRecord) error {
+	var err error
+	switch rec.Op {
+	case WalOpPut:
+		err = kvs.putEntry(rec.Key, *rec.Entry)
+		if err == nil {
+			err = kvs.recordHistory(rec.Key, HistoryVersion{Version: rec.Entry.Version, Time: rec.Time, Writer: rec.Sender}, rec.Entry)
+		}
+	case WalOpDelete:
+		err = kvs.deleteEntry(rec.Key)
+		// deletes without a version are keys moving to another shard
+		if err == nil && rec.Version != 0 {
+			err = kvs.recordHistory(rec.Key, HistoryVersion{Version: rec.Version, Deleted: true, Time: rec.Time, Writer: rec.Sender}, nil)
+		} else if err == nil {
+			kvs.dropHistory(rec.Key)
+		}
+	case WalOpBatch:
+		for _, write := range rec.Writes {
+			if err != nil {
+				break
+			}
+			if write.Entry != nil {
+				err = kvs.putEntry(write.Key, *write.Entry)
+				if err == nil {
+					err = kvs.recordHistory(write.Key, HistoryVersion{Version: write.Entry.Version, Time: rec.Time, Writer: rec.Sender}, write.Entry)
+				}
+			} else {
+				err = kvs.deleteEntry(write.Key)
+				if err == nil {
+					err = kvs.recordHistory(write.Key, HistoryVersion{Version: write.Version, Deleted: true, Time: rec.Time, Writer: rec.Sender}, nil)
+				}
+			}
+		}
+		if rec.TxnId != "" {
+			kvs.releaseTxn(rec.TxnId)
+			kvs.recordFinishedTxn(rec.TxnId, TxnCommitted, rec.Writes, rec.Time)
+		}
+	case WalOpPrepare:
+		kvs.lockTxn(*rec.Txn)
+	case WalOpAbort:
+		kvs.releaseTxn(rec.TxnId)
+		kvs.recordFinishedTxn(rec.TxnId, TxnAborted, nil, rec.Time)
+	case WalOpCatchUp:
+		mergeMetadata(kvs.Metadata, rec.Metadata)
+	case WalOpReset:
+		err = kvs.engine.Clear()
+		kvs.expiries = make(map[string]int64)
+		kvs.trackClear()
+		kvs.merkle = merkleCache{}
+		kvs.history = make(map[string][]HistoryVersion)
+		for key, entry := range rec.Data {
+			if err != nil {
+				break
+			}
+			err = kvs.putEntry(key, entry)
+		}
+		for key, history := range rec.History {
+			if err != nil {
+				break
+			}
+			err = kvs.loadHistory(key, history)
+		}
+		kvs.Metadata = make(map[string]int)
+		for key, val := range rec.Metadata {
+			kvs.Metadata[key] = val
+		}
+		// resets that don't carry the finished transactions keep the ones here
+		if rec.Finished != nil {
+			kvs.finished = make(map[string]FinishedTxn, len(rec.Finished))
+			for id, finished := range rec.Finished {
+				kvs.finished[id] = finished
+			}
+		}
+	}
+
+	// puts, deletes, batches and metadata records sent by a replica move its clock forward
+	if rec.Sender != "" {
+		kvs.incrementMetadata(rec.Sender)
+	}
+	if rec.RaftIndex > kvs.raftIndex {
+		kvs.raftIndex = rec.RaftIndex
+	}
+	return err
+}
+
+// Stores an entry in the engine and keeps the expiry index up to date.
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) putEntry(key string, entry KeyEntry) error {
+	err := kvs.engine.Put(key, entry)
+	if err != nil {
+		return err
+	}
+	kvs.trackEntry(key, entry)
+	return nil
+}
+
+// Keeps the expiry index, memory accounting and merkle tree up to date
+// with an entry the engine has. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) trackEntry(key string, entry KeyEntry) {
+	if entry.ExpiresAt != 0 {
+		kvs.expiries[key] = entry.ExpiresAt
+	} else {
+		delete(kvs.expiries, key)
+	}
+	kvs.trackPut(key, entry)
+	kvs.touchMerkle(key)
+}
+
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) deleteEntry(key string) error {
+	delete(kvs.expiries, key)
+	kvs.trackDelete(key)
+	kvs.touchMerkle(key)
+	return kvs.engine.Delete(key)
+}
+
+// The engine isn't a plain field, so build the data map for it by hand
+func (kvs *KeyValStoreDatabase) MarshalJSON() ([]byte, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	data := make(map[string]KeyEntry, kvs.engine.Len())
+	err := kvs.rangeData(func(key string, entry KeyEntry) bool {
+		data[key] = entry
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	history, err := kvs.historyWithValues()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"format":       WalFormat,
+		"data":         data,
+		"history":      history,
+		"metadata":     kvs.Metadata,
+		"localAddress": kvs.LocalAddress,
+	})
+}
+
 // TODO: refactor this to make non-existant values = 0 when comparing
 func (kvs *KeyValStoreDatabase) IsMetadataValid(incomingMetadata map[string]int, sender string) bool {
+	// the raft log orders writes, so clocks don't need to be waited on
+	if kvs.raft != nil {
+		return true
+	}
 	if sender == kvs.LocalAddress {
 		for replica, time := range incomingMetadata {
 			if time > kvs.Metadata[replica] {
@@ -154,6 +741,13 @@ func (kvs *KeyValStoreDatabase) IsMetadataValid(incomingMetadata map[string]int,
 	}
 }
 
+// Returns true if a write from another node is already counted by this
+// node's clock. That happens when anti-entropy caught this node up past a
+// write the sender is still retrying; the write's effect is already here
+func (kvs *KeyValStoreDatabase) alreadyApplied(metadata map[string]int, sender string) bool {
+	return kvs.raft == nil && sender != kvs.LocalAddress && metadata[sender] <= kvs.Metadata[sender]
+}
+
 func (kvs *KeyValStoreDatabase) incrementMetadata(sender string) {
 	kvs.Metadata[sender] = kvs.Metadata[sender] + 1
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Nodes upgraded in place have to start from whatever older versions of
+// the code left on disk
+func TestOpenStorageReplaysOlderFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+		segments map[uint64]string
+		want     map[string]KeyEntry
+	}{
+		{
+			name: "format 1 puts and deletes",
+			segments: map[uint64]string{1: `{"lsn":1,"op":"put","key":"a","value":"x","sender":"n1"}` + "\n" +
+				`{"lsn":2,"op":"put","key":"b","value":{"value":1}}` + "\n" +
+				`{"lsn":3,"op":"delete","key":"a","sender":"n1"}` + "\n" +
+				`{"lsn":4,"op":"put","key":"c","value":[1,2]}` + "\n"},
+			want: map[string]KeyEntry{
+				"b": {Value: map[string]interface{}{"value": 1.0}},
+				"c": {Value: []interface{}{1.0, 2.0}},
+			},
+		},
+		{
+			name: "format 1 reset",
+			segments: map[uint64]string{1: `{"lsn":1,"op":"put","key":"a","value":"x"}` + "\n" +
+				`{"lsn":2,"op":"reset","data":{"b":"y","c":{"value":"z"}},"metadata":{"n1":3}}` + "\n"},
+			want: map[string]KeyEntry{
+				"b": {Value: "y"},
+				"c": {Value: map[string]interface{}{"value": "z"}},
+			},
+		},
+		{
+			name: "format 2 after format 1",
+			segments: map[uint64]string{1: `{"lsn":1,"op":"put","key":"a","value":"x"}` + "\n" +
+				`{"format":2,"lsn":2,"op":"put","key":"b","entry":{"value":"y","version":4}}` + "\n" +
+				`{"format":2,"lsn":3,"op":"reset","data":{"c":{"value":"z","version":2}},"metadata":{}}` + "\n" +
+				`{"format":2,"lsn":4,"op":"put","key":"a","entry":{"value":"w","version":3}}` + "\n"},
+			want: map[string]KeyEntry{
+				"a": {Value: "w", Version: 3},
+				"c": {Value: "z", Version: 2},
+			},
+		},
+		{
+			name:     "version 1 snapshot",
+			snapshot: `{"version":1,"lsn":2,"metadata":{"n1":2}}` + "\n" + `{"key":"a","value":"x"}` + "\n" + `{"key":"b","value":{"value":2}}` + "\n",
+			segments: map[uint64]string{3: `{"lsn":3,"op":"put","key":"c","value":"z","sender":"n1"}` + "\n"},
+			want: map[string]KeyEntry{
+				"a": {Value: "x"},
+				"b": {Value: map[string]interface{}{"value": 2.0}},
+				"c": {Value: "z"},
+			},
+		},
+		{
+			name:     "version 2 snapshot",
+			snapshot: `{"version":2,"lsn":1,"metadata":{}}` + "\n" + `{"key":"a","entry":{"value":"x","expires-at":32503680000000}}` + "\n",
+			segments: map[uint64]string{2: `{"lsn":2,"op":"put","key":"b","value":"y"}` + "\n"},
+			want: map[string]KeyEntry{
+				"a": {Value: "x", ExpiresAt: 32503680000000},
+				"b": {Value: "y"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := walTestConfig(t)
+			writeWalSegments(t, config.Dir, test.segments)
+			if test.snapshot != "" {
+				err := os.WriteFile(filepath.Join(config.Dir, snapshotFileName), []byte(test.snapshot), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			kvs := NewKeyValStoreDatabase("n0")
+			err := kvs.OpenStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer kvs.wal.file.Close()
+
+			got := make(map[string]KeyEntry)
+			kvs.rangeData(func(key string, entry KeyEntry) bool {
+				got[key] = entry
+				return true
+			})
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWalRecordFormats(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want WalRecord
+	}{
+		{
+			name: "format 1 put",
+			line: `{"lsn":1,"op":"put","key":"a","value":"x"}`,
+			want: WalRecord{Format: 1, LSN: 1, Op: WalOpPut, Key: "a", Value: "x", Entry: &KeyEntry{Value: "x"}},
+		},
+		{
+			name: "format 1 reset",
+			line: `{"lsn":1,"op":"reset","data":{"a":{"value":"x"}}}`,
+			want: WalRecord{Format: 1, LSN: 1, Op: WalOpReset, Data: map[string]KeyEntry{"a": {Value: map[string]interface{}{"value": "x"}}}},
+		},
+		{
+			name: "format 2 put",
+			line: `{"format":2,"lsn":1,"op":"put","key":"a","entry":{"value":"x","version":2}}`,
+			want: WalRecord{Format: 2, LSN: 1, Op: WalOpPut, Key: "a", Entry: &KeyEntry{Value: "x", Version: 2}},
+		},
+		{
+			name: "format 2 reset",
+			line: `{"format":2,"lsn":1,"op":"reset","data":{"a":{"value":"x","version":2}}}`,
+			want: WalRecord{Format: 2, LSN: 1, Op: WalOpReset, Data: map[string]KeyEntry{"a": {Value: "x", Version: 2}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rec WalRecord
+			err := json.Unmarshal([]byte(test.line), &rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rec, test.want) {
+				t.Errorf("got %+v, want %+v", rec, test.want)
+			}
+
+			// records are always written in the current format
+			line, err := json.Marshal(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var reread WalRecord
+			err = json.Unmarshal(line, &reread)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reread.Format != WalFormat || !reflect.DeepEqual(reread.Entry, rec.Entry) || !reflect.DeepEqual(reread.Data, rec.Data) {
+				t.Errorf("%s reads back as %+v", line, reread)
+			}
+		})
+	}
+}
+
+func TestVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		a, b         map[string]int
+		writerA      string
+		writerB      string
+		wantAIsNewer bool
+	}{
+		{"later write on the same node", map[string]int{"n1": 2}, map[string]int{"n1": 1}, "n1", "n1", true},
+		{"write that saw another", map[string]int{"n1": 1, "n2": 1}, map[string]int{"n1": 1}, "n2", "n1", true},
+		{"concurrent writes on different nodes", map[string]int{"n1": 2}, map[string]int{"n1": 1, "n2": 1}, "n1", "n2", nodeVersionId("n1") > nodeVersionId("n2")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := versionFromMetadata(test.a, test.writerA)
+			b := versionFromMetadata(test.b, test.writerB)
+			if a == b {
+				t.Fatalf("both writes got version %d", a)
+			}
+			if (a > b) != test.wantAIsNewer {
+				t.Errorf("got versions %d and %d", a, b)
+			}
+		})
+	}
+}
+
+// Replicas keep serving an expired key until the primary's delete of it
+// arrives, whatever their own clocks say
+func TestExpiredKeyServedUntilReaped(t *testing.T) {
+	txnTestShard(t)
+	if err := kvsDb.PutDataNoChecks("a", KeyEntry{Value: "x", ExpiresAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := kvsDb.GetData("a", nil); err != nil {
+		t.Errorf("got %v reading the expired key before it was reaped", err)
+	}
+	page, err := kvsDb.ScanKeys(ScanQuery{Limit: DefaultScanLimit}, nil)
+	if err != nil || !reflect.DeepEqual(page.Keys, []string{"a"}) {
+		t.Errorf("scan got keys %v, error %v", page.Keys, err)
+	}
+
+	if _, err := kvsDb.ExpireData("a", "n0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := kvsDb.GetData("a", nil); err != ErrKeyNotFound {
+		t.Errorf("got %v reading the key after it was reaped", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrLinearizableUnsupported = errors.New("linearizable reads need raft replication")
+
+// Records that peer answered a request the leader sent at sent. Caller
+// must hold the lock
+func (r *RaftNode) recordAck(peer string, sent time.Time) {
+	if sent.After(r.ackSent[peer]) {
+		r.ackSent[peer] = sent
+	}
+}
+
+// Returns when the leader's lease runs out: RAFT_LEASE_TIMEOUT after the
+// newest request a majority has answered went out. Followers that answered
+// it won't vote anyone else in for an election timeout after getting it, so
+// no other leader can be elected before then. Caller must hold the lock
+func (r *RaftNode) leaseExpiry() time.Time {
+	// this node makes up the rest of the majority
+	needed := r.majority() - 1
+	if needed == 0 {
+		return time.Now().Add(RAFT_LEASE_TIMEOUT)
+	}
+
+	sent := make([]time.Time, 0, len(r.peers))
+	for peer := range r.peers {
+		sent = append(sent, r.ackSent[peer])
+	}
+	sort.Slice(sent, func(i, j int) bool { return sent[i].After(sent[j]) })
+	return sent[needed-1].Add(RAFT_LEASE_TIMEOUT)
+}
+
+// Makes sure a read served now sees every write acknowledged before it
+// started. While the leader holds its lease that's just a matter of
+// applying everything committed; otherwise it falls back to confirming
+// its leadership with a round of heartbeats
+func (r *RaftNode) LinearizableRead() error {
+	r.Lock()
+	if r.role != RaftLeader {
+		r.Unlock()
+		return ErrNotLeader
+	}
+	// until an entry of its own term is committed, a new leader doesn't
+	// know how far the log is committed
+	if r.termAt(r.commitIndex) != r.term {
+		r.Unlock()
+		return ErrRaftNotReady
+	}
+	if time.Now().Before(r.leaseExpiry()) {
+		readIndex := r.commitIndex
+		r.Unlock()
+		return r.waitApplied(readIndex)
+	}
+	r.Unlock()
+
+	return r.ReadIndex()
+}
+
+// Like GetData, but refuses to read unless the value read reflects every
+// write acknowledged before the read started. Only a raft leader can
+// promise that; GetData makes sure of it in raft mode
+func (kvs *KeyValStoreDatabase) GetLinearizable(key string, metadata map[string]int) (entry KeyEntry, currentMetadata map[string]int, err error) {
+	if kvs.Raft() == nil {
+		return KeyEntry{}, nil, ErrLinearizableUnsupported
+	}
+	return kvs.GetData(key, metadata)
+}
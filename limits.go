@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Default limits, used when the matching environment variable isn't set
+const DefaultMaxKeyLength = 50
+const DefaultMaxValueSize = 1 << 20 // 1 MiB
+const DefaultMaxBodySize = 8 << 20  // 8 MiB
+
+var ErrValueTooLarge = errors.New("value too large")
+var ErrKeyTooLong = errors.New("key too long")
+
+type Limits struct {
+	MaxKeyLength int   // bytes in a key
+	MaxValueSize int   // bytes in a value: the raw bytes, or its JSON encoding
+	MaxBodySize  int64 // bytes in a client request body
+}
+
+// Replication messages can carry a raw value as base64 plus everything
+// around it, so the nodes allow each other twice the client body size
+func (l Limits) maxBodySize(path string) int64 {
+	if strings.HasPrefix(path, "/rep/") {
+		return 2 * l.MaxBodySize
+	}
+	return l.MaxBodySize
+}
+
+// Returns ErrKeyTooLong if key is over the key length limit. Every path
+// that stores a key checks it here
+func (l Limits) checkKey(key string) error {
+	if len(key) > l.MaxKeyLength {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// Returns ErrValueTooLarge if value is over the value size limit
+func (l Limits) checkValue(value interface{}) error {
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if len(jsonData) > l.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// Checks an entry sent by another node. Crdts aren't checked, since every
+// operation that built them up was
+func (l Limits) checkEntry(entry KeyEntry) error {
+	if entry.IsRaw() {
+		if len(entry.Data) > l.MaxValueSize {
+			return ErrValueTooLarge
+		}
+		return nil
+	}
+	if entry.CrdtType() != "" {
+		return nil
+	}
+	return l.checkValue(entry.Value)
+}
+
+// Checks the value of every write of a transaction or batch
+func (l Limits) checkWrites(writes []TxnWrite) error {
+	for _, write := range writes {
+		if !write.Delete {
+			if err := l.checkValue(write.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Rejects request bodies over the size limit with 413 before any handler
+// reads them, and never holds more than the limit in memory doing so
+func limitRequestBody(c *gin.Context) {
+	max := limits.maxBodySize(c.Request.URL.Path)
+	if c.Request.ContentLength > max {
+		sendBodyTooLarge(c, max)
+		return
+	}
+	if c.Request.Body == nil || c.Request.ContentLength == 0 {
+		return
+	}
+
+	// bodies without a length (or lying about it) are read up to one byte past the limit
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, max+1))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if int64(len(body)) > max {
+		sendBodyTooLarge(c, max)
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+func sendBodyTooLarge(c *gin.Context, max int64) {
+	c.Header("Connection", "close")
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is larger than the " + strconv.FormatInt(max, 10) + " byte limit"})
+}
+
+func sendValueTooLarge(c *gin.Context) {
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": valueTooLargeMessage()})
+}
+
+func valueTooLargeMessage() string {
+	return "Value is larger than the " + strconv.Itoa(limits.MaxValueSize) + " byte limit"
+}
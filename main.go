@@ -7,18 +7,47 @@ import (
 )
 
 var DEFAULT_TIMEOUT = time.Second * 3
+var REAP_INTERVAL = time.Second
+var EVICT_INTERVAL = time.Second
+var TXN_RESOLVE_INTERVAL = time.Second
+var TXN_TIMEOUT = time.Second * 10
+var TXN_FINISHED_RETENTION = time.Hour
+var WATCH_HEARTBEAT_INTERVAL = time.Second * 15
+var ANTI_ENTROPY_INTERVAL = time.Second * 5
+var HISTORY_PRUNE_INTERVAL = time.Minute
+
+// how long a node moving keys placed by an older shard hash waits for the
+// rest of the view to come up, and how long it waits between tries
+var MIGRATE_WAIT_TIMEOUT = time.Second * 30
+var MIGRATE_RETRY_INTERVAL = time.Second * 5
+
+// shorter than DEFAULT_TIMEOUT, so a node proxying a request to the
+// coordinator doesn't give up on it while it waits for the other replicas
+var QUORUM_TIMEOUT = time.Second * 2
+
+// raft timing: followers wait between one and two election timeouts
+// without hearing from the leader before standing for election
+var RAFT_HEARTBEAT_INTERVAL = time.Millisecond * 100
+var RAFT_ELECTION_TIMEOUT = time.Second
+var RAFT_COMMIT_TIMEOUT = time.Second * 2
+
+// how long a leader's lease lasts after a heartbeat a majority answers.
+// Shorter than RAFT_ELECTION_TIMEOUT by more than clocks drift apart over it
+var RAFT_LEASE_TIMEOUT = time.Millisecond * 800
 
 var kvsDb *KeyValStoreDatabase
 var view *View
 var ring *Ring
 var localShardId int
 var localAddress string
+var limits Limits
 
 func main() {
 
 	// Parse Environment Variables
 	localAdd, initialView, initialShardCount, shardCountExists := parseEnvironmentVariables()
 	localAddress = localAdd
+	limits = parseLimits()
 
 	// --- For Testing ---
 	testing := false
@@ -38,8 +67,22 @@ func main() {
 		initTertiaryNode(initialView)
 	}
 
+	// Abort transactions that were mid prepare when the node went down
+	recoverTransactions()
+
+	// Move keys an older shard hash put on the wrong shard
+	go migrateShardHash()
+
+	// Start background work
+	go reapExpiredKeys()
+	go evictKeys()
+	go resolveTransactions()
+	go runAntiEntropy()
+	go pruneOldHistory()
+
 	// Set Up Router
 	router := gin.Default()
+	router.Use(limitRequestBody)
 
 	// View Routes
 	router.GET("/view", getView)
@@ -47,9 +90,19 @@ func main() {
 	router.DELETE("/view", deleteView)
 
 	// kvs Routes
+	router.GET("/kvs", getKeys)
 	router.GET("/kvs/:key", getKey)
+	router.GET("/kvs/:key/history", getKeyHistory)
+	router.GET("/kvs/_watch", watchKeys)
 	router.PUT("/kvs/:key", putKey)
+	router.POST("/kvs/:key/incr", incrKey)
+	router.POST("/kvs/:key/crdt", updateCrdt)
 	router.DELETE("/kvs/:key", deleteKey)
+	router.POST("/kvs/_mget", mgetKeys)
+	router.POST("/kvs/_mput", mputKeys)
+	router.POST("/kvs/_mdelete", mdeleteKeys)
+	router.POST("/kvs/_batch", putBatch)
+	router.POST("/kvs/_txn", runTxn)
 
 	// shard routes
 	router.GET("/shard/ids", getShardIds)
@@ -59,13 +112,43 @@ func main() {
 	router.PUT("/shard/add-member/:id", addNodeToShard)
 	router.PUT("/shard/reshard", putReshard)
 
+	// change log routes
+	router.GET("/changes/:id", getChanges)
+	router.GET("/changes/:id/consumers/:name", getConsumer)
+	router.PUT("/changes/:id/consumers/:name", commitConsumer)
+	router.DELETE("/changes/:id/consumers/:name", deleteConsumer)
+
+	router.GET("/metrics", getMetrics)
+
 	// kvs Routes
+	router.GET("/rep/kvs", repGetKey)
 	router.PUT("/rep/kvs", repPutKey)
 	router.DELETE("/rep/kvs", repDeleteKey)
+	router.GET("/rep/scan", repScanKeys)
+	router.GET("/rep/watch", repWatchKeys)
+	router.POST("/rep/txn/prepare", repPrepareTxn)
+	router.POST("/rep/txn/commit", repCommitTxn)
+	router.POST("/rep/txn/abort", repAbortTxn)
+	router.POST("/rep/txn/terminate", repTerminateTxn)
+	router.GET("/rep/txn/:id", repGetTxn)
+	router.PUT("/rep/txn/record", repPutTxnRecord)
+	router.DELETE("/rep/txn/record", repDropTxnRecord)
+	router.POST("/rep/raft/vote", repRaftVote)
+	router.POST("/rep/raft/append", repRaftAppend)
+	router.POST("/rep/raft/snapshot", repRaftSnapshot)
+	router.POST("/rep/anti-entropy/tree", repAntiEntropyTree)
+	router.POST("/rep/anti-entropy/keys", repAntiEntropyKeys)
+	router.POST("/rep/anti-entropy/repair", repAntiEntropyRepair)
 
 	router.PUT("/rep/shard/add-member", repAddNodeToShard)
 	router.PUT("/rep/shard/reshard", repReshard)
 	router.PUT("/rep/shard/kvs", repPutKeyNoChecks)
+	router.GET("/rep/shard/unmigrated/:key", repGetUnmigratedKey)
+	router.PUT("/rep/shard/txn", repAcceptTxn)
+	router.DELETE("/rep/shard/txn", repDropTxn)
+	router.GET("/rep/shard/txn/:id", repGetFinishedTxn)
+	router.PUT("/rep/changes/consumers/:name", repSaveConsumer)
+	router.DELETE("/rep/changes/consumers/:name", repDeleteConsumer)
 	router.GET("/rep/shard", repCloneRing)
 	router.GET("/rep/clone-shard-data", repCloneShardData)
 
@@ -73,6 +156,7 @@ func main() {
 	router.GET("/test/view", testViewDump)
 	router.GET("/test/kvs", testKvsDump)
 	router.GET("/test/ring", testRingDump)
+	router.GET("/test/raft", testRaftDump)
 
 	//FOR TESTING
 	if testing {
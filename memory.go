@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// What to do once the data on a node outgrows its memory limit
+const (
+	EvictNone = "none" // reject new writes until keys are deleted
+	EvictLRU  = "lru"  // evict the keys read or written longest ago
+	EvictLFU  = "lfu"  // evict the keys read or written the fewest times
+	EvictTTL  = "ttl"  // evict the keys closest to expiring, and only keys with a ttl
+)
+
+// Rough bytes every key costs beyond its key and value: the entry, the
+// engine's index and the bookkeeping in the kvs
+const keyOverhead = 64
+
+var ErrOutOfMemory = errors.New("memory limit reached")
+var ErrInvalidEvictionPolicy = errors.New("invalid eviction policy")
+
+// How recently and how often a key has been used, for eviction
+type keyAccess struct {
+	last  uint64 // value of the kvs access clock at the last use
+	count uint64
+}
+
+// Returns roughly how many bytes storing entry under key takes
+func entrySize(key string, entry KeyEntry) int64 {
+	size := int64(len(key) + keyOverhead)
+	switch {
+	case entry.IsRaw():
+		size += int64(len(entry.Data) + len(entry.ContentType))
+	case entry.CrdtType() != "":
+		jsonData, _ := json.Marshal(entry)
+		size += int64(len(jsonData))
+	default:
+		jsonData, _ := json.Marshal(entry.Value)
+		size += int64(len(jsonData))
+	}
+	return size
+}
+
+// Returns the bytes used by the stored data and the limit, 0 if there isn't one
+func (kvs *KeyValStoreDatabase) MemoryUsage() (used int64, limit int64) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	return kvs.memoryUsed, kvs.config.MemoryLimit
+}
+
+// Returns ErrOutOfMemory if the eviction policy is none and writing entry
+// to key would take the node over its limit. Other policies let writes in
+// and evict afterwards. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) checkQuota(key string, entry KeyEntry) error {
+	return kvs.checkQuotaGrowth(entrySize(key, entry) - kvs.sizes[key])
+}
+
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) checkQuotaGrowth(growth int64) error {
+	if kvs.config.MemoryLimit <= 0 || kvs.config.EvictionPolicy != EvictNone || growth <= 0 {
+		return nil
+	}
+	if kvs.memoryUsed+growth > kvs.config.MemoryLimit {
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// Returns how many bytes applying writes would add. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) writesGrowth(writes []TxnWrite) int64 {
+	var growth int64
+	for _, write := range writes {
+		growth -= kvs.sizes[write.Key]
+		if !write.Delete {
+			growth += entrySize(write.Key, KeyEntry{Value: write.Value})
+		}
+	}
+	return growth
+}
+
+// Keeps the size and access of a key up to date as it's stored or removed.
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) trackPut(key string, entry KeyEntry) {
+	size := entrySize(key, entry)
+	kvs.memoryUsed += size - kvs.sizes[key]
+	kvs.sizes[key] = size
+	kvs.touch(key)
+}
+
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) trackDelete(key string) {
+	kvs.memoryUsed -= kvs.sizes[key]
+	delete(kvs.sizes, key)
+	delete(kvs.access, key)
+}
+
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) trackClear() {
+	kvs.memoryUsed = 0
+	kvs.sizes = make(map[string]int64)
+	kvs.access = make(map[string]*keyAccess)
+}
+
+// Records a read or write of key. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) touch(key string) {
+	kvs.accessClock++
+	access, exists := kvs.access[key]
+	if !exists {
+		access = &keyAccess{}
+		kvs.access[key] = access
+	}
+	access.last = kvs.accessClock
+	access.count++
+}
+
+// Returns the keys to evict, in order, to bring the data back under the
+// memory limit. Locked keys are never picked
+func (kvs *KeyValStoreDatabase) EvictionCandidates() []string {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	limit := kvs.config.MemoryLimit
+	if limit <= 0 || kvs.memoryUsed <= limit || kvs.config.EvictionPolicy == EvictNone {
+		return nil
+	}
+
+	keys := make([]string, 0, len(kvs.sizes))
+	for key := range kvs.sizes {
+		if kvs.isLocked(key) {
+			continue
+		}
+		if _, hasTtl := kvs.expiries[key]; kvs.config.EvictionPolicy == EvictTTL && !hasTtl {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	// ties go to the key that sorts first, so the order is always the same
+	less := func(i, j int) bool { return keys[i] < keys[j] }
+	switch kvs.config.EvictionPolicy {
+	case EvictLRU:
+		less = func(i, j int) bool { return kvs.accessOf(keys[i]).last < kvs.accessOf(keys[j]).last }
+	case EvictLFU:
+		less = func(i, j int) bool {
+			a, b := kvs.accessOf(keys[i]), kvs.accessOf(keys[j])
+			if a.count != b.count {
+				return a.count < b.count
+			}
+			return a.last < b.last
+		}
+	case EvictTTL:
+		less = func(i, j int) bool { return kvs.expiries[keys[i]] < kvs.expiries[keys[j]] }
+	}
+	sort.Strings(keys)
+	sort.SliceStable(keys, less)
+
+	// take just enough keys to get under the limit
+	over := kvs.memoryUsed - limit
+	for i, key := range keys {
+		over -= kvs.sizes[key]
+		if over <= 0 {
+			return keys[:i+1]
+		}
+	}
+	return keys
+}
+
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) accessOf(key string) keyAccess {
+	if access, exists := kvs.access[key]; exists {
+		return *access
+	}
+	return keyAccess{}
+}
+
+// Deletes a key to free memory, the same way a client delete would, so it
+// can be replicated like one
+func (kvs *KeyValStoreDatabase) EvictData(key string, sender string) (currentMetadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	if !kvs.engine.Has(key) || kvs.isLocked(key) {
+		return nil, ErrKeyNotFound
+	}
+
+	err = kvs.propose(WalRecord{Op: WalOpDelete, Key: key, Version: kvs.nextVersion(), Sender: sender})
+	if err != nil {
+		return nil, err
+	}
+	return kvs.copyMetadata(), nil
+}
+
+// Evicts keys while the node is over its memory limit. Like the ttl reaper,
+// only the shard's primary picks keys, and it deletes each one the same way
+// a client delete would, so every replica drops the same keys in the same
+// causal order
+func evictKeys() {
+	ticker := time.NewTicker(EVICT_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// only evict if this node is the primary of its shard
+		if localShardId < 0 || localShardId >= len(ring.Shards) {
+			continue
+		}
+		if shardPrimary(localShardId) != localAddress {
+			continue
+		}
+
+		keys := kvsDb.EvictionCandidates()
+		if len(keys) > 0 {
+			used, limit := kvsDb.MemoryUsage()
+			log.Printf("memory use %d is over the %d byte limit, evicting %d keys", used, limit, len(keys))
+		}
+		for _, key := range keys {
+			currMetadata, err := kvsDb.EvictData(key, localAddress)
+			if err == ErrKeyNotFound {
+				// key was deleted or locked since we looked
+				continue
+			} else if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			go broadcastKvsDelete(key, currMetadata, localAddress)
+		}
+	}
+}
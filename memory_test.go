@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Each policy picks keys in its own order, just enough of them to get back
+// under the limit
+func TestEvictionCandidates(t *testing.T) {
+	// every key here takes the same 68 bytes, 204 in all
+	tests := []struct {
+		name   string
+		policy string
+		limit  int64
+		want   []string
+	}{
+		{"none never evicts", EvictNone, 100, nil},
+		{"under the limit", EvictLRU, 300, nil},
+		{"lru", EvictLRU, 150, []string{"c"}},
+		{"lru, two keys over", EvictLRU, 100, []string{"c", "a"}},
+		{"lfu", EvictLFU, 100, []string{"c", "b"}},
+		{"ttl", EvictTTL, 150, []string{"b"}},
+		{"no limit", EvictTTL, 0, nil},
+		{"ttl skips keys without one", EvictTTL, 10, []string{"b", "a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			txnTestShard(t)
+			kvsDb.config.EvictionPolicy = test.policy
+			kvsDb.config.MemoryLimit = test.limit
+
+			// written in order, then a is read twice and b once
+			later := time.Now().Add(time.Hour).UnixMilli()
+			for _, write := range []struct {
+				key       string
+				expiresAt int64
+			}{{"a", later + 2}, {"b", later + 1}, {"c", 0}} {
+				if err := kvsDb.PutDataNoChecks(write.key, KeyEntry{Value: "x", ExpiresAt: write.expiresAt}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, key := range []string{"a", "a", "b"} {
+				if _, _, err := kvsDb.GetData(key, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if used, _ := kvsDb.MemoryUsage(); used != 204 {
+				t.Fatalf("got %d bytes used, want 204", used)
+			}
+
+			if got := kvsDb.EvictionCandidates(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("with a limit of %d got %v, want %v", test.limit, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "sync"
+
+// Counts of what this node's repair processes found and fixed since it
+// started, shown by GET /metrics
+type Metrics struct {
+	sync.Mutex
+	AntiEntropy AntiEntropyMetrics `json:"anti-entropy"`
+	ReadRepair  ReadRepairMetrics  `json:"read-repair"`
+}
+
+type AntiEntropyMetrics struct {
+	Rounds          int64 `json:"rounds"`           // exchanges this node started and finished
+	FailedRounds    int64 `json:"failed-rounds"`    // exchanges cut short by an error
+	DivergentRanges int64 `json:"divergent-ranges"` // leaves of the tree whose digests differed
+	DivergentKeys   int64 `json:"divergent-keys"`   // keys that differed in those leaves
+	KeysRepaired    int64 `json:"keys-repaired"`    // keys changed here to match a replica
+	KeysPushed      int64 `json:"keys-pushed"`      // keys a replica changed to match this node
+	UnresolvedKeys  int64 `json:"unresolved-keys"`  // keys that couldn't be settled either way
+}
+
+type ReadRepairMetrics struct {
+	StaleReads    int64 `json:"stale-reads"`    // replicas that answered a read here with an older copy
+	RepairsSent   int64 `json:"repairs-sent"`   // of those, the ones brought up to date
+	FailedRepairs int64 `json:"failed-repairs"` // of those, the ones that couldn't be reached
+	KeysRepaired  int64 `json:"keys-repaired"`  // keys changed here by a read
+}
+
+var metrics Metrics
@@ -6,11 +6,43 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// Carries causal metadata, as JSON, for requests and responses whose body
+// is a raw value
+const CausalMetadataHeader = "X-Causal-Metadata"
+
+// Returns true if the request body is a raw value rather than JSON. A
+// request without a Content-Type is taken to be JSON, and so is a form,
+// since that's what curl -d sends JSON bodies as
+func isRawBody(c *gin.Context) bool {
+	contentType := c.ContentType()
+	return contentType != "" && contentType != gin.MIMEJSON && contentType != gin.MIMEPOSTForm
+}
+
+// Reads causal metadata from the X-Causal-Metadata header. exists is false
+// if the request has no such header
+func parseMetadataHeader(c *gin.Context) (metadata map[string]int, exists bool, err error) {
+	value := c.GetHeader(CausalMetadataHeader)
+	if value == "" {
+		return make(map[string]int), false, nil
+	}
+	err = json.Unmarshal([]byte(value), &metadata)
+	if err != nil || metadata == nil {
+		return nil, true, errors.New(CausalMetadataHeader + " must be a JSON object of clocks")
+	}
+	return metadata, true, nil
+}
+
 func parseKeysFromBody(c *gin.Context, keys ...string) (map[string]interface{}, error) {
+	return parseKeysFromBodyWithOptional(c, keys)
+}
+
+// Same as parseKeysFromBody, but the optional keys are only copied over if they're present
+func parseKeysFromBodyWithOptional(c *gin.Context, keys []string, optional ...string) (map[string]interface{}, error) {
 	// get the json data from the body
 	data, err := parseDataFromBody(c)
 	if err != nil {
@@ -27,6 +59,12 @@ func parseKeysFromBody(c *gin.Context, keys ...string) (map[string]interface{},
 		output[key] = val
 	}
 
+	for _, key := range optional {
+		if val, exists := data[key]; exists {
+			output[key] = val
+		}
+	}
+
 	return output, nil
 }
 
@@ -81,3 +119,458 @@ func parseEnvironmentVariables() (string, []string, int, bool) {
 
 	return localAddress, initialView, initialShardCount, shardCountExists
 }
+
+// Default storage settings, used when the matching environment variable isn't set
+const DefaultStorageEngine = EngineMemory
+const DefaultDataDir = "data"
+const DefaultWalSyncPolicy = SyncAlways
+const DefaultWalBatchSize = 64
+const DefaultWalSyncInterval = time.Millisecond * 100
+const DefaultSnapshotInterval = time.Minute * 5
+const DefaultSnapshotThreshold = 10000
+const DefaultHistoryVersions = 10
+const DefaultHistoryRetention = time.Hour * 24 * 7
+const DefaultEvictionPolicy = EvictNone
+const DefaultChangeLogRetention = 100000
+const DefaultReplication = ReplicationCausal
+
+func parseLimits() Limits {
+	l := Limits{
+		MaxKeyLength: DefaultMaxKeyLength,
+		MaxValueSize: DefaultMaxValueSize,
+		MaxBodySize:  DefaultMaxBodySize,
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("MAX_KEY_LENGTH")); err == nil && n > 0 {
+		l.MaxKeyLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_VALUE_SIZE")); err == nil && n > 0 {
+		l.MaxValueSize = n
+	}
+	if n, err := strconv.ParseInt(os.Getenv("MAX_BODY_SIZE"), 10, 64); err == nil && n > 0 {
+		l.MaxBodySize = n
+	}
+	return l
+}
+
+func parseStorageConfig() StorageConfig {
+	config := StorageConfig{
+		Engine:             DefaultStorageEngine,
+		Dir:                DefaultDataDir,
+		SyncPolicy:         DefaultWalSyncPolicy,
+		BatchSize:          DefaultWalBatchSize,
+		SyncInterval:       DefaultWalSyncInterval,
+		SnapshotInterval:   DefaultSnapshotInterval,
+		SnapshotThreshold:  DefaultSnapshotThreshold,
+		HistoryVersions:    DefaultHistoryVersions,
+		HistoryRetention:   DefaultHistoryRetention,
+		EvictionPolicy:     DefaultEvictionPolicy,
+		ChangeLogRetention: DefaultChangeLogRetention,
+		Replication:        DefaultReplication,
+	}
+
+	if engine, exists := os.LookupEnv("STORAGE_ENGINE"); exists {
+		config.Engine = engine
+	}
+	if dir, exists := os.LookupEnv("DATA_DIR"); exists {
+		config.Dir = dir
+	}
+	if policy, exists := os.LookupEnv("WAL_SYNC_POLICY"); exists {
+		config.SyncPolicy = policy
+	}
+	if n, err := strconv.Atoi(os.Getenv("WAL_BATCH_SIZE")); err == nil && n > 0 {
+		config.BatchSize = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("WAL_SYNC_INTERVAL")); err == nil && d > 0 {
+		config.SyncInterval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("SNAPSHOT_INTERVAL")); err == nil && d > 0 {
+		config.SnapshotInterval = d
+	}
+	if n, err := strconv.Atoi(os.Getenv("SNAPSHOT_THRESHOLD")); err == nil && n > 0 {
+		config.SnapshotThreshold = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("HISTORY_VERSIONS")); err == nil && n >= 0 {
+		config.HistoryVersions = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("HISTORY_RETENTION")); err == nil && d >= 0 {
+		config.HistoryRetention = d
+	}
+	if n, err := strconv.ParseInt(os.Getenv("MEMORY_LIMIT"), 10, 64); err == nil && n > 0 {
+		config.MemoryLimit = n
+	}
+	if policy, exists := os.LookupEnv("EVICTION_POLICY"); exists {
+		config.EvictionPolicy = policy
+	}
+	if n, err := strconv.Atoi(os.Getenv("CHANGELOG_RETENTION")); err == nil && n > 0 {
+		config.ChangeLogRetention = n
+	}
+	if mode, exists := os.LookupEnv("REPLICATION"); exists {
+		config.Replication = strings.ToLower(mode)
+	}
+
+	return config
+}
+
+// Reads the start, end, limit and values query parameters of a scan.
+// limit defaults to DefaultScanLimit
+func parseScanQuery(c *gin.Context) (ScanQuery, error) {
+	query := ScanQuery{
+		Start: c.Query("start"),
+		End:   c.Query("end"),
+		Limit: DefaultScanLimit,
+	}
+
+	if param := c.Query("limit"); param != "" {
+		limit, err := strconv.Atoi(param)
+		if err != nil || limit <= 0 || limit > MaxScanLimit {
+			return ScanQuery{}, errors.New("limit must be a number from 1 to " + strconv.Itoa(MaxScanLimit))
+		}
+		query.Limit = limit
+	}
+
+	if param := c.Query("values"); param != "" {
+		values, err := strconv.ParseBool(param)
+		if err != nil {
+			return ScanQuery{}, errors.New("values must be true or false")
+		}
+		query.Values = values
+	}
+
+	return query, nil
+}
+
+// Reads the offset and limit query parameters of a change log read.
+// hasOffset is false if there's no offset, and limit defaults to
+// DefaultChangesLimit
+func parseChangesQuery(c *gin.Context) (offset uint64, hasOffset bool, limit int, err error) {
+	limit = DefaultChangesLimit
+	if param := c.Query("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit <= 0 || limit > MaxChangesLimit {
+			return 0, false, 0, errors.New("limit must be a number from 1 to " + strconv.Itoa(MaxChangesLimit))
+		}
+	}
+
+	if param := c.Query("offset"); param != "" {
+		offset, err = strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			return 0, false, 0, errors.New("offset must be a whole number of 0 or more")
+		}
+		hasOffset = true
+	}
+	return offset, hasOffset, limit, nil
+}
+
+// Reads the consistency level from the query string, one if it isn't given
+func parseConsistency(c *gin.Context) (string, error) {
+	level := strings.ToLower(c.DefaultQuery("consistency", ConsistencyOne))
+	switch level {
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return level, nil
+	}
+	return "", ErrInvalidConsistency
+}
+
+// Same as parseConsistency, but reads can also ask to be linearizable
+func parseReadConsistency(c *gin.Context) (string, error) {
+	level := strings.ToLower(c.DefaultQuery("consistency", ConsistencyOne))
+	switch level {
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll, ConsistencyLinearizable:
+		return level, nil
+	}
+	return "", ErrInvalidReadConsistency
+}
+
+// Reads causal-metadata from the body if there is one. Requests with no
+// body have no causal dependencies
+func parseOptionalMetadata(c *gin.Context) (map[string]int, error) {
+	if c.Request.ContentLength == 0 {
+		return make(map[string]int), nil
+	}
+
+	data, err := parseKeysFromBodyWithOptional(c, nil, "causal-metadata")
+	if err != nil {
+		return nil, err
+	}
+	return getMetadataFromInterface(data["causal-metadata"]), nil
+}
+
+// Reads the optional delta (default 1), initial, min, max and conflict-free
+// fields of an increment
+func parseIncrOp(data map[string]interface{}) (IncrOp, error) {
+	op := IncrOp{Delta: 1}
+
+	numbers := map[string]*float64{"delta": &op.Delta, "initial": &op.Initial}
+	for field, dest := range numbers {
+		if val, exists := data[field]; exists {
+			number, ok := val.(float64)
+			if !ok {
+				return IncrOp{}, errors.New(field + " must be a number")
+			}
+			*dest = number
+		}
+	}
+
+	bounds := map[string]**float64{"min": &op.Min, "max": &op.Max}
+	for field, dest := range bounds {
+		if val, exists := data[field]; exists {
+			number, ok := val.(float64)
+			if !ok {
+				return IncrOp{}, errors.New(field + " must be a number")
+			}
+			*dest = &number
+		}
+	}
+	if op.Min != nil && op.Max != nil && *op.Min > *op.Max {
+		return IncrOp{}, errors.New("min can't be bigger than max")
+	}
+
+	if val, exists := data["conflict-free"]; exists {
+		conflictFree, ok := val.(bool)
+		if !ok {
+			return IncrOp{}, errors.New("conflict-free must be a boolean")
+		}
+		op.ConflictFree = conflictFree
+	}
+	if op.ConflictFree {
+		// every replica creating the counter would add the initial value again
+		if _, exists := data["initial"]; exists {
+			return IncrOp{}, errors.New("conflict-free counters always start at 0")
+		}
+		if op.Min != nil || op.Max != nil {
+			return IncrOp{}, ErrCounterBounds
+		}
+	}
+	return op, nil
+}
+
+// Reads the type and op of a crdt operation, and the fields that op needs:
+// a value to add, remove or set, a field of a map, or a delta (default 1)
+func parseCrdtOp(data map[string]interface{}) (CrdtOp, error) {
+	var op CrdtOp
+	op.Type, _ = data["type"].(string)
+	op.Op, _ = data["op"].(string)
+	op.Value = data["value"]
+	op.Field, _ = data["field"].(string)
+
+	ops := map[string][]string{
+		CrdtGCounter:  {"incr"},
+		CrdtPNCounter: {"incr"},
+		CrdtORSet:     {"add", "remove"},
+		CrdtRegister:  {"set"},
+		CrdtMap:       {"set", "remove"},
+	}
+	valid, exists := ops[op.Type]
+	if !exists {
+		return op, errors.New("type must be one of gcounter, pncounter, orset, register or map")
+	}
+	if !containsString(valid, op.Op) {
+		return op, errors.New("op for " + op.Type + " must be one of " + strings.Join(valid, ", "))
+	}
+
+	if op.Op == "incr" {
+		op.Delta = 1
+		if val, exists := data["delta"]; exists {
+			delta, ok := val.(float64)
+			if !ok {
+				return op, errors.New("delta must be a number")
+			}
+			op.Delta = delta
+		}
+		if op.Type == CrdtGCounter && op.Delta < 0 {
+			return op, errors.New("a gcounter can't be decremented")
+		}
+	}
+	if op.Type == CrdtMap && op.Field == "" {
+		return op, errors.New("field must be a non-empty string")
+	}
+	if op.Value == nil && (op.Op == "set" || op.Type == CrdtORSet) {
+		return op, errors.New("value not specified")
+	}
+	return op, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the list of keys of a batch request
+func parseBatchKeys(i interface{}) ([]string, error) {
+	list, ok := i.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, errors.New("keys must be a non-empty list")
+	}
+	if len(list) > MaxBatchSize {
+		return nil, errors.New("a batch can have at most " + strconv.Itoa(MaxBatchSize) + " keys")
+	}
+
+	keys := make([]string, 0, len(list))
+	seen := make(map[string]struct{}, len(list))
+	for _, item := range list {
+		key, ok := item.(string)
+		if !ok {
+			return nil, errors.New("keys must be strings")
+		}
+		if _, exists := seen[key]; !exists {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Reads the key value pairs of a batch put
+func parseBatchValues(i interface{}) ([]string, map[string]interface{}, error) {
+	values, ok := i.(map[string]interface{})
+	if !ok || len(values) == 0 {
+		return nil, nil, errors.New("values must be a non-empty object")
+	}
+	if len(values) > MaxBatchSize {
+		return nil, nil, errors.New("a batch can have at most " + strconv.Itoa(MaxBatchSize) + " keys")
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return keys, values, nil
+}
+
+// Reads the reads, conditions and writes of a transaction. Every write
+// needs a key and either a value or "delete": true, and no key can be
+// written twice
+func parseTxnRequest(data map[string]interface{}) (TxnRequest, error) {
+	var req TxnRequest
+	var err error
+
+	req.Reads, err = parseTxnReads(data["reads"])
+	if err != nil {
+		return req, err
+	}
+
+	// conditions are checked here, but sent on to the shards as they are
+	_, err = parseTxnConditions(data["conditions"])
+	if err != nil {
+		return req, err
+	}
+	req.Conditions = make(map[string]map[string]interface{})
+	if conds, ok := data["conditions"].(map[string]interface{}); ok {
+		for key, cond := range conds {
+			req.Conditions[key] = cond.(map[string]interface{})
+		}
+	}
+
+	if data["writes"] != nil {
+		writes, ok := data["writes"].([]interface{})
+		if !ok {
+			return req, errors.New("writes must be a list")
+		}
+		written := make(map[string]struct{}, len(writes))
+		for _, raw := range writes {
+			write, ok := raw.(map[string]interface{})
+			if !ok {
+				return req, errors.New("each write must be an object")
+			}
+			key, ok := write["key"].(string)
+			if !ok {
+				return req, errors.New("each write needs a key")
+			}
+			if limits.checkKey(key) != nil {
+				return req, errors.New("Key is too long")
+			}
+			if _, exists := written[key]; exists {
+				return req, errors.New("a key can only be written once")
+			}
+			written[key] = struct{}{}
+
+			isDelete, _ := write["delete"].(bool)
+			if !isDelete && write["value"] == nil {
+				return req, errors.New("each write needs a value or delete")
+			}
+			req.Writes = append(req.Writes, TxnWrite{Key: key, Value: write["value"], Delete: isDelete})
+		}
+	}
+
+	err = limits.checkWrites(req.Writes)
+	if err != nil {
+		return req, err
+	}
+
+	count := len(req.Reads) + len(req.Conditions) + len(req.Writes)
+	if count == 0 {
+		return req, errors.New("a transaction needs reads, conditions or writes")
+	}
+	if count > MaxBatchSize {
+		return req, errors.New("a transaction can have at most " + strconv.Itoa(MaxBatchSize) + " operations")
+	}
+	return req, nil
+}
+
+// Reads an optional list of keys to read
+func parseTxnReads(i interface{}) ([]string, error) {
+	if i == nil {
+		return nil, nil
+	}
+	list, ok := i.([]interface{})
+	if !ok {
+		return nil, errors.New("reads must be a list")
+	}
+
+	reads := make([]string, 0, len(list))
+	for _, item := range list {
+		key, ok := item.(string)
+		if !ok {
+			return nil, errors.New("reads must be strings")
+		}
+		reads = append(reads, key)
+	}
+	return reads, nil
+}
+
+// Reads an optional object of the if-* fields for each key
+func parseTxnConditions(i interface{}) (map[string]WriteCondition, error) {
+	conds := make(map[string]WriteCondition)
+	if i == nil {
+		return conds, nil
+	}
+	raw, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("conditions must be an object")
+	}
+
+	for key, fields := range raw {
+		fieldMap, ok := fields.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("the conditions of each key must be an object")
+		}
+		cond, err := parseWriteCondition(fieldMap)
+		if err != nil {
+			return nil, err
+		}
+		conds[key] = cond
+	}
+	return conds, nil
+}
+
+// Reads the body of an anti-entropy request, which must come from another
+// replica of this node's shard
+func parseAntiEntropyRequest(c *gin.Context) (AntiEntropyRequest, error) {
+	var req AntiEntropyRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		return AntiEntropyRequest{}, err
+	}
+	if kvsDb.Raft() != nil {
+		return AntiEntropyRequest{}, ErrAntiEntropyOff
+	}
+	if req.ShardId != localShardId {
+		return AntiEntropyRequest{}, ErrWrongShard
+	}
+	return req, nil
+}
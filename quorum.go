@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How many replicas of a key's shard a request waits for. This node counts
+// as one of them
+const (
+	ConsistencyOne    = "one"    // just this node; the rest are sent the write in the background
+	ConsistencyQuorum = "quorum" // a majority of the shard's replicas
+	ConsistencyAll    = "all"    // every replica of the shard
+
+	// reads only: the shard's raft leader, once it's sure nothing newer
+	// has been acknowledged
+	ConsistencyLinearizable = "linearizable"
+)
+
+var ErrInvalidConsistency = errors.New("consistency must be one, quorum or all")
+var ErrInvalidReadConsistency = errors.New("consistency must be one, quorum, all or linearizable")
+var ErrQuorumNotReached = errors.New("not enough replicas answered in time")
+
+// A key as one replica has it. Version is the key's version, or the
+// version of the delete that removed it (Deleted) if the key's history
+// still has it, so copies from different replicas can be compared
+type ReplicaRead struct {
+	Entry    KeyEntry       `json:"entry"`
+	Exists   bool           `json:"exists"`
+	Deleted  bool           `json:"deleted,omitempty"`
+	Version  int64          `json:"version"`
+	Metadata map[string]int `json:"causal-metadata"`
+
+	// the replica that answered, not sent
+	from string
+}
+
+// Returns the copy as anti-entropy would compare it. An expired copy has no
+// hash, so it loses a tie
+func (read ReplicaRead) syncItem(key string) SyncItem {
+	switch {
+	case read.Exists:
+		return newSyncItem(key, &read.Entry, read.Version)
+	case read.Deleted:
+		return newSyncItem(key, nil, read.Version)
+	}
+	return SyncItem{Version: read.Version}
+}
+
+// Returns the newest of reads, with ties broken the way anti-entropy breaks
+// them, so a read and a later anti-entropy round settle on the same copy
+func newestRead(key string, reads []ReplicaRead) ReplicaRead {
+	newest := reads[0]
+	for _, read := range reads[1:] {
+		if read.syncItem(key).newerThan(newest.syncItem(key)) {
+			newest = read
+		}
+	}
+	return newest
+}
+
+// Returns how many of a shard's replicas the consistency level needs
+func replicasNeeded(level string, replicas int) int {
+	switch level {
+	case ConsistencyQuorum:
+		return replicas/2 + 1
+	case ConsistencyAll:
+		return replicas
+	}
+	return 1
+}
+
+// Like GetData, but a key that's missing or expired isn't an error
+func (kvs *KeyValStoreDatabase) GetLatest(key string, metadata map[string]int) (ReplicaRead, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	// Check metadata
+	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
+	if !metadataValid {
+		return ReplicaRead{}, ErrInvalidMetadata
+	}
+
+	read := ReplicaRead{Metadata: kvs.copyMetadata()}
+	entry, existed, err := kvs.engine.Get(key)
+	if err != nil {
+		return ReplicaRead{}, err
+	}
+	if existed {
+		// served until the primary's delete gets here, like GetData
+		read.Version = entry.Version
+		read.Entry, read.Exists = entry, true
+		kvs.touch(key)
+	} else if history := kvs.history[key]; len(history) > 0 {
+		read.Version = history[len(history)-1].Version
+		read.Deleted = history[len(history)-1].Deleted
+	}
+	return read, nil
+}
+
+// Reads key from as many replicas of this node's shard as the consistency
+// level needs, this node included, and returns the newest copy. The
+// metadata returned covers every copy that was read. Once every replica
+// asked has answered, the ones with an older copy are sent the newest one in
+// the background
+func readKvsQuorum(key string, metadata map[string]int, level string) (entry KeyEntry, currentMetadata map[string]int, err error) {
+	local, err := kvsDb.GetLatest(key, metadata)
+	if err != nil {
+		return KeyEntry{}, nil, err
+	}
+	local.from = localAddress
+	reads := []ReplicaRead{local}
+	currentMetadata = local.Metadata
+
+	replicas := removeLocalAddressFromMap(ring.Shards[localShardId].Replicas)
+	needed := replicasNeeded(level, len(replicas)+1)
+
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"causal-metadata": metadata,
+	})
+
+	// ask every replica, and take the first answers to come back. The rest
+	// are waited for in the background up to the same deadline, to repair
+	ctx, cancel := context.WithTimeout(context.Background(), QUORUM_TIMEOUT)
+	answers := make(chan *ReplicaRead, len(replicas))
+	for node := range replicas {
+		go func(node string) {
+			// not retried, a replica that's behind just doesn't count
+			res, err := replicaCall(ctx, node, "/rep/kvs?key="+url.QueryEscape(key), http.MethodGet, jsonData, false)
+			if err != nil {
+				answers <- nil
+				return
+			}
+			defer res.Body.Close()
+
+			var read ReplicaRead
+			if res.StatusCode != http.StatusOK || json.NewDecoder(res.Body).Decode(&read) != nil {
+				answers <- nil
+				return
+			}
+			read.from = node
+			answers <- &read
+		}(node)
+	}
+
+	got := 1
+	waiting := len(replicas)
+	for ; waiting > 0 && got < needed; waiting-- {
+		select {
+		case read := <-answers:
+			if read == nil {
+				continue
+			}
+			got++
+			reads = append(reads, *read)
+			mergeMetadata(currentMetadata, read.Metadata)
+		case <-ctx.Done():
+			startRepair(key, reads, answers, waiting, cancel)
+			return KeyEntry{}, nil, ErrQuorumNotReached
+		}
+	}
+	newest := newestRead(key, reads)
+	startRepair(key, reads, answers, waiting, cancel)
+	if got < needed {
+		return KeyEntry{}, nil, ErrQuorumNotReached
+	}
+	if !newest.Exists {
+		return KeyEntry{}, nil, ErrKeyNotFound
+	}
+	return newest.Entry, currentMetadata, nil
+}
+
+// Sends a write this node has applied to the rest of the cluster, and
+// waits until as many replicas of its shard as the consistency level needs
+// have applied it too. Nodes outside the shard only update their metadata,
+// so they're never waited for. Returns how many replicas applied it, this
+// node included, how many were needed, and whether any replica heard from
+// refused it as too large
+func replicateToShard(level string, method string, jsonData []byte) (acks int, needed int, tooLarge bool) {
+	nodes := removeLocalAddressFromMap(view.Nodes)
+	replicas := removeLocalAddressFromMap(ring.Shards[localShardId].Replicas)
+	needed = replicasNeeded(level, len(replicas)+1)
+
+	// the replicas not waited for still need the write, so nothing is called
+	// off once the level is met; every request just ends at the deadline,
+	// and anti-entropy brings a replica that missed it up to date
+	ctx, cancel := context.WithTimeout(context.Background(), QUORUM_TIMEOUT)
+
+	// the status each replica answered with, 0 if it didn't
+	results := make(chan int, len(replicas))
+	for node := range nodes {
+		if _, isReplica := replicas[node]; !isReplica {
+			go sendSingleMsg(node, "/rep/kvs", method, "application/json", jsonData, true)
+			continue
+		}
+		go func(node string) {
+			res, err := replicaCall(ctx, node, "/rep/kvs", method, jsonData, true)
+			if err != nil {
+				results <- 0
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode == http.StatusRequestEntityTooLarge {
+				log.Printf("%s refused a write as too large; every node should run with the same size limits", node)
+			}
+			results <- res.StatusCode
+		}(node)
+	}
+
+	acks = 1
+	waiting := len(replicas)
+	for ; waiting > 0 && acks < needed; waiting-- {
+		select {
+		case status := <-results:
+			if status == http.StatusOK {
+				acks++
+			} else if status == http.StatusRequestEntityTooLarge {
+				tooLarge = true
+			}
+		case <-ctx.Done():
+			go awaitResults(results, waiting, cancel)
+			return acks, needed, tooLarge
+		}
+	}
+	go awaitResults(results, waiting, cancel)
+	return acks, needed, tooLarge
+}
+
+// Waits for the answers still to come from the replicas a write was sent
+// to, then lets go of the write's context
+func awaitResults(results <-chan int, waiting int, cancel context.CancelFunc) {
+	for ; waiting > 0; waiting-- {
+		<-results
+	}
+	cancel()
+}
+
+// Replicates a write the way the consistency level asks for. Returns
+// false, having already answered the client, if a replica refused it as
+// too large or too few replicas applied it. The write isn't undone; it
+// still reaches the others in the background
+func replicateWrite(c *gin.Context, level string, method string, jsonData []byte, metadata map[string]int) bool {
+	// in raft mode the write is already on a majority of the shard
+	if kvsDb.Raft() != nil {
+		return true
+	}
+
+	// level one doesn't wait for anyone
+	acks, needed, tooLarge := replicateToShard(level, method, jsonData)
+	if tooLarge {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":           "Write was applied here, but a replica of the shard refused it as over its size limits",
+			"acks":            acks,
+			"needed":          needed,
+			"causal-metadata": metadata,
+		})
+		return false
+	}
+	if acks < needed {
+		c.JSON(http.StatusGatewayTimeout, gin.H{
+			"error":           "Write was applied on fewer replicas than the consistency level needs",
+			"acks":            acks,
+			"needed":          needed,
+			"causal-metadata": metadata,
+		})
+		return false
+	}
+	return true
+}
+
+// Sends a /rep message to node, usually a replica of this node's shard, and
+// if retry is set, tries again with a growing pause while it answers 503,
+// until ctx is done. Unlike sendSingleMsg this never drops the node from
+// the view: a slow replica is still part of its shard
+func replicaCall(ctx context.Context, node string, endpoint string, method string, jsonData []byte, retry bool) (*http.Response, error) {
+	pause := 10 * time.Millisecond
+	for {
+		req, err := http.NewRequestWithContext(ctx, method, "http://"+node+endpoint, bytes.NewReader(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusServiceUnavailable || !retry {
+			return res, nil
+		}
+		res.Body.Close()
+
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if pause < time.Second {
+			pause *= 2
+		}
+	}
+}
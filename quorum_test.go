@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Points the globals at a single shard holding this node and a replica at
+// each of the given addresses
+func quorumTestShard(t *testing.T, replicas ...string) {
+	txnTestShard(t, replicas...)
+	// repairs in the background read the globals, so they have to finish
+	// before the next test replaces them
+	t.Cleanup(pendingRepairs.Wait)
+	view.PutView(localAddress)
+	for _, replica := range replicas {
+		view.PutView(replica)
+	}
+}
+
+func TestReplicateToShard(t *testing.T) {
+	tests := []struct {
+		name         string
+		level        string
+		statuses     []int
+		wantAcks     int
+		wantNeeded   int
+		wantTooLarge bool
+	}{
+		{"one doesn't wait", ConsistencyOne, []int{http.StatusOK, http.StatusOK}, 1, 1, false},
+		{"quorum", ConsistencyQuorum, []int{http.StatusOK, http.StatusOK}, 2, 2, false},
+		{"all", ConsistencyAll, []int{http.StatusOK, http.StatusOK}, 3, 3, false},
+		{"all with a failed replica", ConsistencyAll, []int{http.StatusOK, http.StatusInternalServerError}, 2, 3, false},
+		{"all with a replica over its limits", ConsistencyAll, []int{http.StatusOK, http.StatusRequestEntityTooLarge}, 2, 3, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var replicas []string
+			for _, status := range test.statuses {
+				replicas = append(replicas, txnTestServer(t, status, map[string]string{}))
+			}
+			quorumTestShard(t, replicas...)
+
+			acks, needed, tooLarge := replicateToShard(test.level, http.MethodPut, []byte("{}"))
+			if acks != test.wantAcks || needed != test.wantNeeded {
+				t.Errorf("got %d of %d acks, want %d of %d", acks, needed, test.wantAcks, test.wantNeeded)
+			}
+			if tooLarge != test.wantTooLarge {
+				t.Errorf("got too large %v, want %v", tooLarge, test.wantTooLarge)
+			}
+		})
+	}
+}
+
+// A replica that's down or keeps answering 503 isn't waited for past the
+// deadline, and stays in the view
+func TestReplicateToShardDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		replica func(t *testing.T, requests *int32) string
+	}{
+		{"replica down", func(t *testing.T, requests *int32) string { return "127.0.0.1:1" }},
+		{"replica behind", func(t *testing.T, requests *int32) string {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(requests, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			t.Cleanup(server.Close)
+			return strings.TrimPrefix(server.URL, "http://")
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeout := QUORUM_TIMEOUT
+			QUORUM_TIMEOUT = 200 * time.Millisecond
+			defer func() { QUORUM_TIMEOUT = timeout }()
+			var requests int32
+			replica := test.replica(t, &requests)
+			quorumTestShard(t, replica)
+
+			acks, needed, _ := replicateToShard(ConsistencyAll, http.MethodPut, []byte("{}"))
+			if acks != 1 || needed != 2 {
+				t.Errorf("got %d of %d acks, want 1 of 2", acks, needed)
+			}
+			if !view.Contains(replica) {
+				t.Errorf("%s was dropped from the view", replica)
+			}
+
+			// give a retry in flight time to land
+			time.Sleep(50 * time.Millisecond)
+			sent := atomic.LoadInt32(&requests)
+			time.Sleep(QUORUM_TIMEOUT)
+			if atomic.LoadInt32(&requests) != sent {
+				t.Errorf("replica still sent the write after the deadline")
+			}
+		})
+	}
+}
+
+// Replicas that are down or never answer don't hold a read up past its
+// deadline, and stay in the view
+func TestReadKvsQuorumDeadline(t *testing.T) {
+	current := ReplicaRead{Entry: KeyEntry{Value: "x", Version: 5}, Exists: true, Version: 5, Metadata: map[string]int{}}
+
+	tests := []struct {
+		name    string
+		level   string
+		wantErr error
+	}{
+		{"quorum without the missing replicas", ConsistencyQuorum, nil},
+		{"all", ConsistencyAll, ErrQuorumNotReached},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timeout := QUORUM_TIMEOUT
+			QUORUM_TIMEOUT = 200 * time.Millisecond
+			defer func() { QUORUM_TIMEOUT = timeout }()
+
+			up := []string{txnTestServer(t, http.StatusOK, current), txnTestServer(t, http.StatusOK, current)}
+			released := make(chan struct{})
+			hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.ReadAll(r.Body)
+				<-r.Context().Done()
+				close(released)
+			}))
+			defer hung.Close()
+			hungAddress := strings.TrimPrefix(hung.URL, "http://")
+			down := "127.0.0.1:1"
+			antiEntropyTestShard(t, up[0], up[1], hungAddress, down)
+			_, err := kvsDb.RepairKey("k", current.syncItem("k"), "n1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entry, _, err := readKvsQuorum("k", map[string]int{}, test.level)
+			if err != test.wantErr {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if err == nil && entry.Value != "x" {
+				t.Errorf("got %v, want x", entry.Value)
+			}
+
+			select {
+			case <-released:
+			case <-time.After(2 * QUORUM_TIMEOUT):
+				t.Errorf("request to the replica that never answers wasn't called off")
+			}
+			for _, replica := range []string{up[0], up[1], hungAddress, down} {
+				if !view.Contains(replica) {
+					t.Errorf("%s was dropped from the view", replica)
+				}
+			}
+		})
+	}
+}
+
+// Two copies of key "k" written at the same version, and the one anti-entropy
+// keeps
+func quorumTestTie() (a, b KeyEntry, winner string) {
+	a, b = KeyEntry{Value: "a", Version: 5}, KeyEntry{Value: "b", Version: 5}
+	winner = "a"
+	if newSyncItem("k", &b, 5).newerThan(newSyncItem("k", &a, 5)) {
+		winner = "b"
+	}
+	return a, b, winner
+}
+
+func TestNewestRead(t *testing.T) {
+	a, b, winner := quorumTestTie()
+	old := ReplicaRead{Entry: KeyEntry{Value: "old", Version: 4}, Exists: true, Version: 4, from: "old"}
+	readA := ReplicaRead{Entry: a, Exists: true, Version: 5, from: "a"}
+	readB := ReplicaRead{Entry: b, Exists: true, Version: 5, from: "b"}
+	deleted := ReplicaRead{Deleted: true, Version: 6, from: "deleted"}
+	expired := ReplicaRead{Version: 5, from: "expired"}
+
+	tests := []struct {
+		name  string
+		reads []ReplicaRead
+		want  string
+	}{
+		{"later version", []ReplicaRead{old, readA}, "a"},
+		{"later version first", []ReplicaRead{readA, old}, "a"},
+		{"same version", []ReplicaRead{readA, readB}, winner},
+		{"same version the other way round", []ReplicaRead{readB, readA}, winner},
+		{"later delete", []ReplicaRead{readA, deleted}, "deleted"},
+		{"live copy over an expired one", []ReplicaRead{expired, readA}, "a"},
+		{"expired copy after a live one", []ReplicaRead{readA, expired}, "a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := newestRead("k", test.reads); got.from != test.want {
+				t.Errorf("got the copy from %s, want %s", got.from, test.want)
+			}
+		})
+	}
+}
+
+func TestRepairStaleReplicas(t *testing.T) {
+	a, b, winner := quorumTestTie()
+	old := KeyEntry{Value: "old", Version: 4}
+
+	tests := []struct {
+		name      string
+		local     SyncItem
+		remote    ReplicaRead
+		wantPush  bool   // whether the replica is sent a repair
+		wantValue string // the local value afterwards, "" if deleted
+	}{
+		{"replica behind", SyncItem{Entry: &a, Version: 5}, ReplicaRead{Entry: old, Exists: true, Version: 4}, true, "a"},
+		{"this node behind", SyncItem{Entry: &old, Version: 4}, ReplicaRead{Entry: a, Exists: true, Version: 5}, false, "a"},
+		{"same copy", SyncItem{Entry: &a, Version: 5}, ReplicaRead{Entry: a, Exists: true, Version: 5}, false, "a"},
+		{"same version", SyncItem{Entry: &a, Version: 5}, ReplicaRead{Entry: b, Exists: true, Version: 5}, winner == "a", winner},
+		{"replica deleted it", SyncItem{Entry: &a, Version: 5}, ReplicaRead{Deleted: true, Version: 6}, false, ""},
+		{"replica has it expired", SyncItem{Entry: &a, Version: 5}, ReplicaRead{Version: 5}, false, "a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			var pushed []AntiEntropyRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req AntiEntropyRequest
+				json.NewDecoder(r.Body).Decode(&req)
+				lock.Lock()
+				pushed = append(pushed, req)
+				lock.Unlock()
+				json.NewEncoder(w).Encode(map[string]interface{}{"repaired": len(req.Items), "complete": true})
+			}))
+			defer server.Close()
+			replica := strings.TrimPrefix(server.URL, "http://")
+			antiEntropyTestShard(t, replica)
+
+			_, err := kvsDb.RepairKey("k", test.local, "n1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			local, err := kvsDb.GetLatest("k", map[string]int{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			local.from = localAddress
+			remote := test.remote
+			remote.from = replica
+
+			repairStaleReplicas("k", []ReplicaRead{local, remote})
+
+			lock.Lock()
+			defer lock.Unlock()
+			if (len(pushed) > 0) != test.wantPush {
+				t.Fatalf("got %d repairs sent to the replica, want any %v", len(pushed), test.wantPush)
+			}
+			if test.wantPush {
+				item := pushed[0].Items["k"]
+				if item.Entry == nil || item.Entry.Value != test.wantValue || !pushed[0].ReadRepair {
+					t.Errorf("replica was sent %+v", pushed[0])
+				}
+			}
+			entry, exists, _ := kvsDb.engine.Get("k")
+			if test.wantValue == "" {
+				if exists {
+					t.Errorf("got %v, want it deleted", entry.Value)
+				}
+			} else if !exists || entry.Value != test.wantValue {
+				t.Errorf("got %v, want %s", entry.Value, test.wantValue)
+			}
+		})
+	}
+}
+
+// A replica that answers after the read has returned is still repaired
+func TestRepairAfterAnswers(t *testing.T) {
+	var lock sync.Mutex
+	var pushed []AntiEntropyRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AntiEntropyRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		lock.Lock()
+		pushed = append(pushed, req)
+		lock.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"repaired": len(req.Items), "complete": true})
+	}))
+	defer server.Close()
+	late := strings.TrimPrefix(server.URL, "http://")
+	antiEntropyTestShard(t, "n1", late)
+
+	current := KeyEntry{Value: "new", Version: 5}
+	reads := []ReplicaRead{
+		{Entry: current, Exists: true, Version: 5, from: localAddress},
+		{Entry: current, Exists: true, Version: 5, from: "n1"},
+	}
+	answers := make(chan *ReplicaRead, 2)
+	answers <- &ReplicaRead{Entry: KeyEntry{Value: "old", Version: 4}, Exists: true, Version: 4, from: late}
+	answers <- nil
+	repairAfterAnswers("k", reads, answers, 2, func() {})
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(pushed) != 1 || pushed[0].Items["k"].Entry == nil || pushed[0].Items["k"].Entry.Value != "new" {
+		t.Errorf("late replica was sent %+v, want the new copy", pushed)
+	}
+}
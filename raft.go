@@ -0,0 +1,1366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How the replicas of a shard keep their copies in step
+const (
+	ReplicationCausal = "causal" // every node applies writes as they arrive, in causal order
+	ReplicationRaft   = "raft"   // the replicas of each shard run raft, and writes go through its leader
+)
+
+// Roles a node can have in its shard's raft group
+const (
+	RaftFollower  = "follower"
+	RaftCandidate = "candidate"
+	RaftLeader    = "leader"
+)
+
+// Set on a client request one node has already sent on to its leader
+const RaftForwardedHeader = "X-Raft-Forwarded"
+
+const raftStateFileName = "state.json"
+const raftLogFileName = "log"
+const raftSnapshotFileName = "snapshot.incoming"
+
+// Entries kept in the log behind the last snapshot, so followers that are
+// only a little behind can still catch up from the log
+const raftLogRetention = 1000
+
+var ErrInvalidReplication = errors.New("invalid replication mode")
+var ErrNotLeader = errors.New("not the leader of the shard")
+var ErrRaftNotReady = errors.New("leader hasn't applied the whole log yet")
+var ErrRaftTimeout = errors.New("write wasn't committed in time")
+
+// One entry of the replicated log. Record is nil for the entry a new
+// leader commits to find out how far the log is committed
+type RaftEntry struct {
+	Term   uint64     `json:"term"`
+	Index  uint64     `json:"index"`
+	Record *WalRecord `json:"record,omitempty"`
+}
+
+// The state a snapshot of the kvs was taken at, and the data in it
+type RaftSnapshot struct {
+	Index    uint64                      `json:"index"`
+	Term     uint64                      `json:"term"`
+	Data     map[string]KeyEntry         `json:"data"`
+	History  map[string][]HistoryVersion `json:"history"`
+	Metadata map[string]int              `json:"metadata"`
+	Prepared []PreparedTxn               `json:"prepared"`
+	Finished map[string]FinishedTxn      `json:"finished"`
+}
+
+type RaftVoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last-index"`
+	LastTerm  uint64 `json:"last-term"`
+}
+
+type RaftVoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type RaftAppendRequest struct {
+	Term         uint64      `json:"term"`
+	Leader       string      `json:"leader"`
+	PrevIndex    uint64      `json:"prev-index"`
+	PrevTerm     uint64      `json:"prev-term"`
+	Entries      []RaftEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leader-commit"`
+}
+
+// Also the answer to a piece of a snapshot, where MatchIndex is only set
+// once the follower has the whole of it. On failure ConflictIndex is where
+// the leader should try next
+type RaftAppendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	MatchIndex    uint64 `json:"match-index"`
+	ConflictIndex uint64 `json:"conflict-index"`
+}
+
+// One piece of a snapshot. A snapshot can be far bigger than a request is
+// allowed to be, so it's sent as its JSON encoding in pieces, Data being
+// the bytes from Offset on. Done is set on the last piece
+type RaftSnapshotRequest struct {
+	Term          uint64 `json:"term"`
+	Leader        string `json:"leader"`
+	SnapshotIndex uint64 `json:"snapshot-index"`
+	SnapshotTerm  uint64 `json:"snapshot-term"`
+	Offset        int64  `json:"offset"`
+	Data          []byte `json:"data"`
+	Done          bool   `json:"done"`
+}
+
+type RaftStatus struct {
+	Role        string   `json:"role"`
+	Term        uint64   `json:"term"`
+	Leader      string   `json:"leader"`
+	CommitIndex uint64   `json:"commit-index"`
+	LastApplied uint64   `json:"last-applied"`
+	LastIndex   uint64   `json:"last-index"`
+	Lease       bool     `json:"lease"` // whether the leader holds a read lease
+	Peers       []string `json:"peers"`
+}
+
+// This node's part in the raft group of its shard
+type RaftNode struct {
+	sync.Mutex
+	self  string
+	peers map[string]struct{} // the rest of the group
+	dir   string
+
+	// kept on disk. entries[0] stands in for the last entry compacted away
+	// (index and term 0 if there hasn't been one)
+	term     uint64
+	votedFor string
+	entries  []RaftEntry
+	logFile  *os.File
+
+	role        string
+	leader      string
+	commitIndex uint64
+	lastApplied uint64
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	lastAck     map[string]time.Time // when each peer last answered the leader
+	ackSent     map[string]time.Time // when the newest request each peer answered this term went out
+	kicks       map[string]chan struct{}
+
+	// when the election timer started, and how long it runs this time
+	heardAt         time.Time
+	electionTimeout time.Duration
+
+	// when a follower last heard from its leader
+	leaderContact time.Time
+
+	// when this node started. It may have heard from a leader just before
+	// it went down
+	started time.Time
+
+	// the snapshot the leader is part way through sending, written to a
+	// file as it comes in
+	incoming       *os.File
+	incomingIndex  uint64
+	incomingTerm   uint64
+	incomingOffset int64
+
+	// closed whenever commitIndex, lastApplied, the term or the role changes
+	changed chan struct{}
+
+	// returns a snapshot of the kvs at lastApplied, for followers whose
+	// next entry has been compacted away
+	snapshot func() (RaftSnapshot, error)
+}
+
+// Loads the group's state from dir, or starts a new empty log. applied is
+// the index of the last entry the kvs has applied
+func OpenRaftNode(dir string, self string, peers map[string]struct{}, applied uint64) (*RaftNode, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RaftNode{
+		self:       self,
+		peers:      make(map[string]struct{}),
+		dir:        dir,
+		entries:    []RaftEntry{{}},
+		role:       RaftFollower,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		lastAck:    make(map[string]time.Time),
+		ackSent:    make(map[string]time.Time),
+		kicks:      make(map[string]chan struct{}),
+		changed:    make(chan struct{}),
+		started:    time.Now(),
+	}
+	for peer := range peers {
+		if peer != self {
+			r.peers[peer] = struct{}{}
+		}
+	}
+
+	err = r.loadState()
+	if err != nil {
+		return nil, err
+	}
+	err = r.loadLog()
+	if err != nil {
+		return nil, err
+	}
+
+	// everything the kvs applied was committed
+	r.lastApplied = applied
+	if r.lastApplied < r.baseIndex() {
+		r.lastApplied = r.baseIndex()
+	}
+	r.commitIndex = r.lastApplied
+	r.resetElectionTimer()
+	return r, nil
+}
+
+/// --- log and state on disk ---
+
+func (r *RaftNode) loadState() error {
+	jsonData, err := os.ReadFile(filepath.Join(r.dir, raftStateFileName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state struct {
+		Term     uint64 `json:"term"`
+		VotedFor string `json:"voted-for"`
+	}
+	err = json.Unmarshal(jsonData, &state)
+	if err != nil {
+		return err
+	}
+	r.term, r.votedFor = state.Term, state.VotedFor
+	return nil
+}
+
+// Writes the term and vote to a temporary file, syncs it and moves it into
+// place. Has to be done before answering anyone with the new term or vote
+func (r *RaftNode) saveState() error {
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"term":      r.term,
+		"voted-for": r.votedFor,
+	})
+	return writeFileSynced(r.dir, raftStateFileName, jsonData)
+}
+
+// Reads the log, dropping a last entry that was cut off halfway through
+// being written
+func (r *RaftNode) loadLog() error {
+	name := filepath.Join(r.dir, raftLogFileName)
+	file, err := os.Open(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		decoder := json.NewDecoder(bufio.NewReader(file))
+		entries := make([]RaftEntry, 0)
+		for decoder.More() {
+			var entry RaftEntry
+			if decoder.Decode(&entry) != nil {
+				break
+			}
+			entries = append(entries, entry)
+		}
+		file.Close()
+		if len(entries) > 0 {
+			r.entries = entries
+		}
+	}
+
+	// write it back out, so a torn tail doesn't stay in the file
+	return r.rewriteLog()
+}
+
+// Replaces the log file with the entries in memory
+func (r *RaftNode) rewriteLog() error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range r.entries {
+		encoder.Encode(entry)
+	}
+	err := writeFileSynced(r.dir, raftLogFileName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if r.logFile != nil {
+		r.logFile.Close()
+	}
+	r.logFile, err = os.OpenFile(filepath.Join(r.dir, raftLogFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// Adds entries to the end of the log and syncs them
+func (r *RaftNode) appendLog(entries []RaftEntry) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		encoder.Encode(entry)
+	}
+	_, err := r.logFile.Write(buf.Bytes())
+	if err == nil {
+		err = r.logFile.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	r.entries = append(r.entries, entries...)
+	return nil
+}
+
+// Drops the entries from index on
+func (r *RaftNode) truncateLog(index uint64) error {
+	r.entries = r.entries[:index-r.baseIndex()]
+	return r.rewriteLog()
+}
+
+// Drops the entries up to and including index, which has been applied and
+// is in a snapshot of the kvs, keeping raftLogRetention of them around
+func (r *RaftNode) Compact(index uint64) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if index < raftLogRetention {
+		return nil
+	}
+	index -= raftLogRetention
+	if index <= r.baseIndex() || index > r.lastApplied {
+		return nil
+	}
+	r.entries = append([]RaftEntry{{Term: r.termAt(index), Index: index}}, r.entries[index-r.baseIndex()+1:]...)
+	return r.rewriteLog()
+}
+
+func (r *RaftNode) baseIndex() uint64 {
+	return r.entries[0].Index
+}
+
+func (r *RaftNode) lastIndex() uint64 {
+	return r.entries[len(r.entries)-1].Index
+}
+
+func (r *RaftNode) lastTerm() uint64 {
+	return r.entries[len(r.entries)-1].Term
+}
+
+// Returns the term of the entry at index, which must be in the log or be
+// the last entry compacted away
+func (r *RaftNode) termAt(index uint64) uint64 {
+	return r.entries[index-r.baseIndex()].Term
+}
+
+/// --- roles and elections ---
+
+// Runs elections whenever the leader goes quiet for an election timeout,
+// and steps down as leader when a majority hasn't answered for as long
+func (r *RaftNode) Run() {
+	ticker := time.NewTicker(RAFT_HEARTBEAT_INTERVAL / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.Lock()
+		if r.role == RaftLeader && !r.hasQuorum() {
+			log.Printf("lost touch with a majority, stepping down as leader of term %d", r.term)
+			r.becomeFollower(r.term)
+		}
+		timedOut := r.role != RaftLeader && time.Since(r.heardAt) >= r.electionTimeout
+		r.Unlock()
+		if timedOut {
+			r.startElection()
+		}
+	}
+}
+
+// Returns true if a majority, this node included, answered the leader
+// within the last election timeout. Caller must hold the lock
+func (r *RaftNode) hasQuorum() bool {
+	count := 1
+	for peer := range r.peers {
+		if time.Since(r.lastAck[peer]) < RAFT_ELECTION_TIMEOUT {
+			count++
+		}
+	}
+	return count >= r.majority()
+}
+
+// Election timeouts are picked at random between RAFT_ELECTION_TIMEOUT and
+// twice that, so nodes rarely time out together and split the vote
+func (r *RaftNode) resetElectionTimer() {
+	r.heardAt = time.Now()
+	r.electionTimeout = RAFT_ELECTION_TIMEOUT + time.Duration(rand.Int63n(int64(RAFT_ELECTION_TIMEOUT)))
+}
+
+// Closes the changed channel for anyone waiting on it. Caller must hold the lock
+func (r *RaftNode) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Steps down to follower, moving to term if it's newer. Caller must hold the lock
+func (r *RaftNode) becomeFollower(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.leader = ""
+		err := r.saveState()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if r.role != RaftFollower {
+		if r.role == RaftLeader {
+			r.leader = ""
+		}
+		r.role = RaftFollower
+		r.resetElectionTimer()
+	}
+	r.notify()
+}
+
+func (r *RaftNode) majority() int {
+	return (len(r.peers)+1)/2 + 1
+}
+
+// Asks every peer for its vote in a new term
+func (r *RaftNode) startElection() {
+	r.Lock()
+	r.term++
+	r.role = RaftCandidate
+	r.votedFor = r.self
+	r.leader = ""
+	r.resetElectionTimer()
+	err := r.saveState()
+	if err != nil {
+		log.Println(err)
+		r.Unlock()
+		return
+	}
+	r.notify()
+
+	term := r.term
+	req := RaftVoteRequest{Term: term, Candidate: r.self, LastIndex: r.lastIndex(), LastTerm: r.lastTerm()}
+	peers := make([]string, 0, len(r.peers))
+	for peer := range r.peers {
+		peers = append(peers, peer)
+	}
+	votes := 1
+	if votes >= r.majority() {
+		r.becomeLeader()
+		r.Unlock()
+		return
+	}
+	r.Unlock()
+
+	for _, peer := range peers {
+		go func(peer string) {
+			var resp RaftVoteResponse
+			err := raftCall(peer, "/rep/raft/vote", req, &resp, RAFT_ELECTION_TIMEOUT/2)
+			if err != nil {
+				return
+			}
+
+			r.Lock()
+			defer r.Unlock()
+			if resp.Term > r.term {
+				r.becomeFollower(resp.Term)
+				return
+			}
+			if r.role != RaftCandidate || r.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes >= r.majority() {
+				r.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// Takes over as leader of the current term and starts sending entries to
+// every peer. The first entry is an empty one of the new term: once it's
+// committed, so is everything before it. Caller must hold the lock
+func (r *RaftNode) becomeLeader() {
+	log.Printf("elected leader of term %d", r.term)
+	r.role = RaftLeader
+	r.leader = r.self
+	r.ackSent = make(map[string]time.Time)
+	for peer := range r.peers {
+		r.nextIndex[peer] = r.lastIndex() + 1
+		r.matchIndex[peer] = 0
+		r.lastAck[peer] = time.Now() // they just voted, or will hear from us shortly
+		r.kicks[peer] = make(chan struct{}, 1)
+		go r.replicate(peer, r.term)
+	}
+
+	err := r.appendLog([]RaftEntry{{Term: r.term, Index: r.lastIndex() + 1}})
+	if err != nil {
+		log.Println(err)
+	}
+	r.advanceCommit()
+	r.notify()
+}
+
+// Answers a candidate asking for this node's vote
+func (r *RaftNode) HandleVote(req RaftVoteRequest) RaftVoteResponse {
+	r.Lock()
+	defer r.Unlock()
+
+	// while a leader is in touch, nobody else is voted in, which is what
+	// makes its lease safe
+	if req.Term > r.term && r.inTouchWithLeader() {
+		return RaftVoteResponse{Term: r.term}
+	}
+	if req.Term > r.term {
+		r.becomeFollower(req.Term)
+	}
+	resp := RaftVoteResponse{Term: r.term}
+	if req.Term < r.term || (r.votedFor != "" && r.votedFor != req.Candidate) {
+		return resp
+	}
+
+	// only vote for candidates whose log has everything ours does
+	upToDate := req.LastTerm > r.lastTerm() || (req.LastTerm == r.lastTerm() && req.LastIndex >= r.lastIndex())
+	if !upToDate {
+		return resp
+	}
+
+	r.votedFor = req.Candidate
+	err := r.saveState()
+	if err != nil {
+		log.Println(err)
+		return resp
+	}
+	r.resetElectionTimer()
+	resp.Granted = true
+	return resp
+}
+
+// Returns true if this node is the leader, or heard from one less than an
+// election timeout ago. A node that started less than an election timeout
+// ago counts as in touch, since it can't know whether it heard from one
+// just before it went down. Caller must hold the lock
+func (r *RaftNode) inTouchWithLeader() bool {
+	if r.role == RaftLeader || time.Since(r.started) < RAFT_ELECTION_TIMEOUT {
+		return true
+	}
+	return r.leader != "" && time.Since(r.leaderContact) < RAFT_ELECTION_TIMEOUT
+}
+
+/// --- log replication ---
+
+// Sends entries, or heartbeats when there are none, to peer for as long as
+// this node is leader of term
+func (r *RaftNode) replicate(peer string, term uint64) {
+	ticker := time.NewTicker(RAFT_HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		r.Lock()
+		if r.role != RaftLeader || r.term != term {
+			r.Unlock()
+			return
+		}
+		kick := r.kicks[peer]
+		r.Unlock()
+
+		// keep going while the peer is behind and answering
+		if r.sendAppend(peer, term) {
+			continue
+		}
+		select {
+		case <-kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Wakes every peer's replicator up to send what's new. Caller must hold the lock
+func (r *RaftNode) kickAll() {
+	for _, kick := range r.kicks {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Sends peer the entries after the last one it's known to have (or a
+// snapshot, if they've been compacted away). Returns true if the peer
+// answered and has more to catch up on
+func (r *RaftNode) sendAppend(peer string, term uint64) bool {
+	r.Lock()
+	next := r.nextIndex[peer]
+	if next <= r.baseIndex() {
+		r.Unlock()
+		return r.sendSnapshot(peer, term)
+	}
+	req := RaftAppendRequest{
+		Term:         term,
+		Leader:       r.self,
+		PrevIndex:    next - 1,
+		PrevTerm:     r.termAt(next - 1),
+		LeaderCommit: r.commitIndex,
+	}
+
+	// send as many entries as fit in a request
+	size := 0
+	for _, entry := range r.entries[next-r.baseIndex():] {
+		jsonData, _ := json.Marshal(entry)
+		size += len(jsonData)
+		if len(req.Entries) > 0 && int64(size) > limits.MaxBodySize {
+			break
+		}
+		req.Entries = append(req.Entries, entry)
+	}
+	r.Unlock()
+
+	var resp RaftAppendResponse
+	sent := time.Now()
+	err := raftCall(peer, "/rep/raft/append", req, &resp, RAFT_ELECTION_TIMEOUT/2)
+	if err != nil {
+		return false
+	}
+	return r.handleAppendResponse(peer, term, next, sent, resp)
+}
+
+// Sends peer a snapshot of the kvs, for a peer whose next entry has been
+// compacted away. It goes in pieces of at most the client body limit, which
+// base64 leaves within the /rep limit
+func (r *RaftNode) sendSnapshot(peer string, term uint64) bool {
+	snapshot, err := r.snapshot()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	jsonData, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	for offset := int64(0); ; {
+		end := offset + limits.MaxBodySize
+		if end > int64(len(jsonData)) {
+			end = int64(len(jsonData))
+		}
+		req := RaftSnapshotRequest{
+			Term:          term,
+			Leader:        r.self,
+			SnapshotIndex: snapshot.Index,
+			SnapshotTerm:  snapshot.Term,
+			Offset:        offset,
+			Data:          jsonData[offset:end],
+			Done:          end == int64(len(jsonData)),
+		}
+		var resp RaftAppendResponse
+		sent := time.Now()
+		err = raftCall(peer, "/rep/raft/snapshot", req, &resp, DEFAULT_TIMEOUT)
+		if err != nil {
+			return false
+		}
+		// the peer has all of it, has moved on, or lost the pieces so far
+		if req.Done || !resp.Success || resp.MatchIndex > 0 || resp.Term > term {
+			return r.handleAppendResponse(peer, term, snapshot.Index+1, sent, resp)
+		}
+		if !r.snapshotProgress(peer, term, sent) {
+			return false
+		}
+		offset = end
+	}
+}
+
+// Takes note of peer answering a piece of a snapshot that went out at sent.
+// Returns false if this node is no longer leader of term
+func (r *RaftNode) snapshotProgress(peer string, term uint64, sent time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.role != RaftLeader || r.term != term {
+		return false
+	}
+	r.lastAck[peer] = time.Now()
+	r.recordAck(peer, sent)
+	return true
+}
+
+// Moves peer's next and match index on from its answer to a request that
+// started at next and went out at sent, and commits whatever a majority
+// now has
+func (r *RaftNode) handleAppendResponse(peer string, term uint64, next uint64, sent time.Time, resp RaftAppendResponse) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if resp.Term > r.term {
+		r.becomeFollower(resp.Term)
+		return false
+	}
+	if r.role != RaftLeader || r.term != term {
+		return false
+	}
+	r.lastAck[peer] = time.Now()
+	r.recordAck(peer, sent)
+
+	if !resp.Success {
+		// skip back past the entries the peer doesn't have
+		if resp.ConflictIndex > 0 && resp.ConflictIndex < next {
+			r.nextIndex[peer] = resp.ConflictIndex
+		} else if next > 1 {
+			r.nextIndex[peer] = next - 1
+		}
+		return true
+	}
+
+	if resp.MatchIndex > r.matchIndex[peer] {
+		r.matchIndex[peer] = resp.MatchIndex
+	}
+	r.nextIndex[peer] = r.matchIndex[peer] + 1
+	r.advanceCommit()
+	return r.nextIndex[peer] <= r.lastIndex()
+}
+
+// Commits the newest entry of the current term that a majority has. Entries
+// of earlier terms are only committed along with one of the current term.
+// Caller must hold the lock
+func (r *RaftNode) advanceCommit() {
+	for index := r.lastIndex(); index > r.commitIndex && index > r.baseIndex(); index-- {
+		if r.termAt(index) != r.term {
+			return
+		}
+		count := 1
+		for peer := range r.peers {
+			if r.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= r.majority() {
+			r.commitIndex = index
+			r.notify()
+			return
+		}
+	}
+}
+
+// Answers the leader sending entries or a heartbeat
+func (r *RaftNode) HandleAppend(req RaftAppendRequest) RaftAppendResponse {
+	r.Lock()
+	defer r.Unlock()
+
+	if req.Term < r.term {
+		return RaftAppendResponse{Term: r.term}
+	}
+	r.acceptLeader(req.Term, req.Leader)
+	resp := RaftAppendResponse{Term: r.term}
+
+	// entries up to the base are applied already, so they match
+	if req.PrevIndex < r.baseIndex() {
+		skip := r.baseIndex() - req.PrevIndex
+		if uint64(len(req.Entries)) <= skip {
+			resp.Success = true
+			resp.MatchIndex = req.PrevIndex + uint64(len(req.Entries))
+			return resp
+		}
+		req.Entries = req.Entries[skip:]
+		req.PrevIndex, req.PrevTerm = r.baseIndex(), r.entries[0].Term
+	}
+
+	// the log has to have the entry just before the new ones
+	if req.PrevIndex > r.lastIndex() {
+		resp.ConflictIndex = r.lastIndex() + 1
+		return resp
+	}
+	if prevTerm := r.termAt(req.PrevIndex); prevTerm != req.PrevTerm {
+		// the leader can skip back past every entry of the conflicting term
+		index := req.PrevIndex
+		for index > r.baseIndex()+1 && r.termAt(index-1) == prevTerm {
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp
+	}
+
+	// drop entries that conflict with the new ones, and add what's missing
+	for i, entry := range req.Entries {
+		if entry.Index <= r.lastIndex() {
+			if r.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			err := r.truncateLog(entry.Index)
+			if err != nil {
+				log.Println(err)
+				return resp
+			}
+		}
+		err := r.appendLog(req.Entries[i:])
+		if err != nil {
+			log.Println(err)
+			return resp
+		}
+		break
+	}
+
+	resp.Success = true
+	resp.MatchIndex = req.PrevIndex + uint64(len(req.Entries))
+
+	// only what this request showed the log has can be committed, and a
+	// late or repeated request never takes back what already was
+	newCommit := req.LeaderCommit
+	if resp.MatchIndex < newCommit {
+		newCommit = resp.MatchIndex
+	}
+	if newCommit > r.commitIndex {
+		r.commitIndex = newCommit
+		r.notify()
+	}
+	return resp
+}
+
+// Follows leader, the leader of term, and restarts the election timer.
+// Caller must hold the lock
+func (r *RaftNode) acceptLeader(term uint64, leader string) {
+	if term > r.term || r.role != RaftFollower {
+		r.becomeFollower(term)
+	}
+	if r.leader != leader {
+		r.leader = leader
+		r.notify()
+	}
+	r.leaderContact = time.Now()
+	r.resetElectionTimer()
+}
+
+// Takes a piece of a snapshot sent by the leader. Returns the snapshot once
+// the last piece is in, nil if there's more to come or it doesn't need to be
+// installed, along with the answer to send back
+func (r *RaftNode) acceptSnapshot(req RaftSnapshotRequest) (*RaftSnapshot, RaftAppendResponse, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if req.Term < r.term {
+		return nil, RaftAppendResponse{Term: r.term}, nil
+	}
+	r.acceptLeader(req.Term, req.Leader)
+
+	resp := RaftAppendResponse{Term: r.term}
+	if req.SnapshotIndex <= r.lastApplied {
+		r.dropIncoming()
+		resp.Success, resp.MatchIndex = true, req.SnapshotIndex
+		return nil, resp, nil
+	}
+
+	if req.Offset == 0 {
+		r.dropIncoming()
+		file, err := os.Create(filepath.Join(r.dir, raftSnapshotFileName))
+		if err != nil {
+			return nil, resp, err
+		}
+		r.incoming, r.incomingIndex, r.incomingTerm, r.incomingOffset = file, req.SnapshotIndex, req.SnapshotTerm, 0
+	}
+	// a piece of some other snapshot, or not the one that comes next: the
+	// leader starts over
+	if r.incoming == nil || req.SnapshotIndex != r.incomingIndex || req.SnapshotTerm != r.incomingTerm || req.Offset != r.incomingOffset {
+		return nil, resp, nil
+	}
+
+	_, err := r.incoming.Write(req.Data)
+	if err != nil {
+		r.dropIncoming()
+		return nil, resp, err
+	}
+	r.incomingOffset += int64(len(req.Data))
+	resp.Success = true
+	if !req.Done {
+		return nil, resp, nil
+	}
+
+	defer r.dropIncoming()
+	_, err = r.incoming.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, RaftAppendResponse{Term: r.term}, err
+	}
+	var snapshot RaftSnapshot
+	err = json.NewDecoder(bufio.NewReader(r.incoming)).Decode(&snapshot)
+	if err != nil {
+		return nil, RaftAppendResponse{Term: r.term}, err
+	}
+	resp.MatchIndex = snapshot.Index
+	return &snapshot, resp, nil
+}
+
+// Throws away whatever came in of a snapshot. Caller must hold the lock
+func (r *RaftNode) dropIncoming() {
+	if r.incoming == nil {
+		return
+	}
+	r.incoming.Close()
+	os.Remove(r.incoming.Name())
+	r.incoming = nil
+}
+
+// Moves the log past a snapshot the kvs has just installed. Entries after
+// it are kept if the log agrees with the snapshot about its last entry
+func (r *RaftNode) installedSnapshot(index uint64, term uint64) error {
+	r.Lock()
+	defer r.Unlock()
+
+	base := RaftEntry{Term: term, Index: index}
+	if index > r.baseIndex() && index <= r.lastIndex() && r.termAt(index) == term {
+		r.entries = append([]RaftEntry{base}, r.entries[index-r.baseIndex()+1:]...)
+	} else {
+		r.entries = []RaftEntry{base}
+	}
+	if index > r.commitIndex {
+		r.commitIndex = index
+	}
+	r.lastApplied = index
+	r.notify()
+	return r.rewriteLog()
+}
+
+/// --- proposals and reads ---
+
+// Adds a record to the log as leader. The record was worked out from the
+// kvs as it is, so everything already in the log has to have been applied.
+// Returns the record's index and term; the kvs applies it once it's
+// committed, like any other entry
+func (r *RaftNode) Replicate(rec WalRecord) (uint64, uint64, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.role != RaftLeader {
+		return 0, 0, ErrNotLeader
+	}
+	if r.lastApplied != r.lastIndex() {
+		return 0, 0, ErrRaftNotReady
+	}
+
+	index := r.lastIndex() + 1
+	err := r.appendLog([]RaftEntry{{Term: r.term, Index: index, Record: &rec}})
+	if err != nil {
+		return 0, 0, err
+	}
+	r.kickAll()
+	r.advanceCommit()
+	return index, r.term, nil
+}
+
+// Waits until the kvs has applied the entry this node proposed at index as
+// leader of term. Once it's in the log it might still be committed by a
+// later leader, so losing leadership leaves the outcome unknown, same as a
+// timeout
+func (r *RaftNode) waitProposal(index uint64, term uint64) error {
+	timeout := time.After(RAFT_COMMIT_TIMEOUT)
+	for {
+		r.Lock()
+		if r.lastApplied >= index {
+			// the entry applied there is ours unless a later leader replaced it
+			ours := index >= r.baseIndex() && r.termAt(index) == term
+			r.Unlock()
+			if !ours {
+				return ErrRaftTimeout
+			}
+			return nil
+		}
+		if r.term != term {
+			r.Unlock()
+			return ErrRaftTimeout
+		}
+		changed := r.changed
+		r.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return ErrRaftTimeout
+		}
+	}
+}
+
+// Makes sure a read served now sees every write committed before it
+// started: this node must still be the leader (checked with a round of
+// heartbeats a majority answers), and must have applied everything that
+// was committed when the read came in
+func (r *RaftNode) ReadIndex() error {
+	r.Lock()
+	if r.role != RaftLeader {
+		r.Unlock()
+		return ErrNotLeader
+	}
+	// until an entry of its own term is committed, a new leader doesn't
+	// know how far the log is committed
+	if r.termAt(r.commitIndex) != r.term {
+		r.Unlock()
+		return ErrRaftNotReady
+	}
+	term := r.term
+	readIndex := r.commitIndex
+	reqs := make(map[string]RaftAppendRequest, len(r.peers))
+	for peer := range r.peers {
+		// heartbeats that only confirm the term, and change nothing
+		prev := r.matchIndex[peer]
+		if prev < r.baseIndex() {
+			prev = r.baseIndex()
+		}
+		reqs[peer] = RaftAppendRequest{Term: term, Leader: r.self, PrevIndex: prev, PrevTerm: r.termAt(prev)}
+	}
+	majority := r.majority()
+	r.Unlock()
+
+	acks := make(chan bool, len(reqs))
+	for peer, req := range reqs {
+		go func(peer string, req RaftAppendRequest) {
+			var resp RaftAppendResponse
+			sent := time.Now()
+			err := raftCall(peer, "/rep/raft/append", req, &resp, RAFT_ELECTION_TIMEOUT/2)
+			if err == nil {
+				r.Lock()
+				if resp.Term > term {
+					r.becomeFollower(resp.Term)
+				} else if r.role == RaftLeader && r.term == term {
+					r.recordAck(peer, sent)
+				}
+				r.Unlock()
+			}
+			acks <- err == nil && resp.Term == term
+		}(peer, req)
+	}
+	confirmed := 1
+	for waiting := len(reqs); confirmed < majority && waiting > 0; waiting-- {
+		if <-acks {
+			confirmed++
+		}
+	}
+	if confirmed < majority {
+		return ErrNotLeader
+	}
+
+	return r.waitApplied(readIndex)
+}
+
+// Waits until the kvs has applied index
+func (r *RaftNode) waitApplied(index uint64) error {
+	timeout := time.After(RAFT_COMMIT_TIMEOUT)
+	for {
+		r.Lock()
+		if r.lastApplied >= index {
+			r.Unlock()
+			return nil
+		}
+		changed := r.changed
+		r.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return ErrRaftTimeout
+		}
+	}
+}
+
+// Returns the committed entries the kvs hasn't applied yet
+func (r *RaftNode) unapplied() []RaftEntry {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.commitIndex <= r.lastApplied {
+		return nil
+	}
+	entries := make([]RaftEntry, r.commitIndex-r.lastApplied)
+	copy(entries, r.entries[r.lastApplied+1-r.baseIndex():])
+	return entries
+}
+
+func (r *RaftNode) setApplied(index uint64) {
+	r.Lock()
+	defer r.Unlock()
+	if index > r.lastApplied {
+		r.lastApplied = index
+		r.notify()
+	}
+}
+
+// Returns the last applied entry's index and term
+func (r *RaftNode) appliedPosition() (uint64, uint64) {
+	r.Lock()
+	defer r.Unlock()
+	return r.lastApplied, r.termAt(r.lastApplied)
+}
+
+/// --- membership ---
+
+// Returns the leader this node knows of, "" if it doesn't know one
+func (r *RaftNode) Leader() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.leader
+}
+
+// Adds a node that joined the shard to the group. A leader starts sending
+// it the log straight away
+func (r *RaftNode) AddPeer(node string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, exists := r.peers[node]; exists || node == r.self {
+		return
+	}
+	r.peers[node] = struct{}{}
+	if r.role == RaftLeader {
+		r.nextIndex[node] = r.lastIndex() + 1
+		r.matchIndex[node] = 0
+		r.lastAck[node] = time.Now()
+		r.kicks[node] = make(chan struct{}, 1)
+		go r.replicate(node, r.term)
+	}
+}
+
+func (r *RaftNode) Status() RaftStatus {
+	r.Lock()
+	defer r.Unlock()
+
+	status := RaftStatus{
+		Role:        r.role,
+		Term:        r.term,
+		Leader:      r.leader,
+		CommitIndex: r.commitIndex,
+		LastApplied: r.lastApplied,
+		LastIndex:   r.lastIndex(),
+		Lease:       r.role == RaftLeader && time.Now().Before(r.leaseExpiry()),
+		Peers:       make([]string, 0, len(r.peers)),
+	}
+	for peer := range r.peers {
+		status.Peers = append(status.Peers, peer)
+	}
+	return status
+}
+
+/// --- kvs side ---
+
+// Returns this node's raft group, nil outside raft mode
+func (kvs *KeyValStoreDatabase) Raft() *RaftNode {
+	kvs.Lock()
+	defer kvs.Unlock()
+	return kvs.raft
+}
+
+// Starts this node's part in the raft group of its shard, made up of peers
+// and this node. Does nothing outside raft mode or if it's already running
+func (kvs *KeyValStoreDatabase) StartRaft(peers map[string]struct{}) error {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	if kvs.config.Replication != ReplicationRaft || kvs.raft != nil {
+		return nil
+	}
+
+	raft, err := OpenRaftNode(filepath.Join(kvs.config.Dir, "raft"), kvs.LocalAddress, peers, kvs.raftIndex)
+	if err != nil {
+		return err
+	}
+	raft.snapshot = kvs.raftSnapshot
+	kvs.raft = raft
+
+	go raft.Run()
+	go kvs.applyRaftEntries()
+	return nil
+}
+
+// Goes through raft before committing a record, when the kvs is in raft
+// mode, so it's only applied once a majority of the shard has it in their
+// log. Otherwise it's the same as commit. Caller must hold the lock, which
+// is let go while the record is replicated so reads don't wait on it
+func (kvs *KeyValStoreDatabase) propose(rec WalRecord) error {
+	if kvs.raft == nil {
+		return kvs.commit(rec)
+	}
+
+	index, term, err := kvs.raft.Replicate(rec)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	kvs.proposal = done
+	kvs.Unlock()
+	err = kvs.raft.waitProposal(index, term)
+	kvs.Lock()
+	kvs.proposal = nil
+	close(done)
+	return err
+}
+
+// Waits until the raft proposal in flight, if there is one, is done with,
+// so a write is worked out from a kvs that has every earlier write applied.
+// Caller must hold the lock, and holds it again on return
+func (kvs *KeyValStoreDatabase) awaitProposal() {
+	for kvs.proposal != nil {
+		done := kvs.proposal
+		kvs.Unlock()
+		<-done
+		kvs.Lock()
+	}
+}
+
+// Applies entries as they're committed, the leader's own proposals
+// included, in log order
+func (kvs *KeyValStoreDatabase) applyRaftEntries() {
+	for {
+		kvs.raft.Lock()
+		changed := kvs.raft.changed
+		kvs.raft.Unlock()
+
+		// the lock is taken first, so nothing else applies entries meanwhile
+		kvs.Lock()
+		for _, entry := range kvs.raft.unapplied() {
+			if entry.Record != nil {
+				rec := *entry.Record
+				rec.RaftIndex = entry.Index
+				err := kvs.commit(rec)
+				if err != nil {
+					log.Println(err)
+					break
+				}
+			}
+			kvs.raft.setApplied(entry.Index)
+		}
+		kvs.Unlock()
+
+		<-changed
+	}
+}
+
+// Returns a copy of the kvs at the last raft entry it applied
+func (kvs *KeyValStoreDatabase) raftSnapshot() (RaftSnapshot, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	snapshot := RaftSnapshot{
+		Data:     make(map[string]KeyEntry, kvs.engine.Len()),
+		Metadata: kvs.copyMetadata(),
+		Prepared: make([]PreparedTxn, 0, len(kvs.prepared)),
+		Finished: kvs.copyFinishedTxns(),
+	}
+	snapshot.Index, snapshot.Term = kvs.raft.appliedPosition()
+	err := kvs.rangeData(func(key string, entry KeyEntry) bool {
+		snapshot.Data[key] = entry
+		return true
+	})
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.History, err = kvs.historyWithValues()
+	if err != nil {
+		return snapshot, err
+	}
+	for _, txn := range kvs.prepared {
+		snapshot.Prepared = append(snapshot.Prepared, txn)
+	}
+	return snapshot, nil
+}
+
+// Takes a piece of a snapshot sent by the leader, and once it has all of
+// it, replaces everything in the kvs with it
+func (kvs *KeyValStoreDatabase) InstallRaftSnapshot(req RaftSnapshotRequest) (RaftAppendResponse, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	snapshot, resp, err := kvs.raft.acceptSnapshot(req)
+	if err != nil || snapshot == nil {
+		return resp, err
+	}
+
+	err = kvs.commit(WalRecord{Op: WalOpReset, Data: snapshot.Data, History: snapshot.History, Metadata: snapshot.Metadata, Finished: snapshot.Finished, RaftIndex: snapshot.Index})
+	if err != nil {
+		return resp, err
+	}
+
+	// the prepared transactions have to match the snapshot's too
+	prepared := make(map[string]bool, len(snapshot.Prepared))
+	for _, txn := range snapshot.Prepared {
+		prepared[txn.Id] = true
+		if _, exists := kvs.prepared[txn.Id]; !exists {
+			txn := txn
+			err = kvs.commit(WalRecord{Op: WalOpPrepare, Txn: &txn, RaftIndex: snapshot.Index})
+			if err != nil {
+				return resp, err
+			}
+		}
+	}
+	for id := range kvs.prepared {
+		if !prepared[id] {
+			err = kvs.commit(WalRecord{Op: WalOpAbort, TxnId: id, RaftIndex: snapshot.Index})
+			if err != nil {
+				return resp, err
+			}
+		}
+	}
+
+	return resp, kvs.raft.installedSnapshot(snapshot.Index, snapshot.Term)
+}
+
+/// --- helpers ---
+
+// Sends a raft message to node and decodes its answer into resp. Unlike
+// sendSingleMsg this never drops the node from the view: a node that
+// doesn't answer is still part of its raft group
+func raftCall(node string, endpoint string, req interface{}, resp interface{}, timeout time.Duration) error {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+node+endpoint, bytes.NewReader(jsonData))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s with %d", node, endpoint, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Writes data to a temporary file in dir, syncs it and moves it into place
+func writeFileSynced(dir string, name string, data []byte) error {
+	tmpName := filepath.Join(dir, name+".tmp")
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpName, filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How a test follower answers appends
+const (
+	raftTestSilent  int32 = iota // fails them
+	raftTestAck                  // acknowledges them
+	raftTestNewTerm              // has moved on to a newer term
+)
+
+// Starts a follower that answers appends as answer says. Returns its address
+func raftTestFollower(t *testing.T, answer *int32) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req RaftAppendRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch atomic.LoadInt32(answer) {
+		case raftTestSilent:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case raftTestAck:
+			json.NewEncoder(w).Encode(RaftAppendResponse{Term: req.Term, Success: true, MatchIndex: req.PrevIndex + uint64(len(req.Entries))})
+		case raftTestNewTerm:
+			json.NewEncoder(w).Encode(RaftAppendResponse{Term: req.Term + 1})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Returns a kvs whose node is the leader of term 1 in a group with peers,
+// once the leader's first entry is applied
+func raftTestLeader(t *testing.T, peers ...string) *KeyValStoreDatabase {
+	kvs := NewKeyValStoreDatabase("n0")
+	kvs.config.Replication = ReplicationRaft
+	peerSet := make(map[string]struct{})
+	for _, peer := range peers {
+		peerSet[peer] = struct{}{}
+	}
+	raft, err := OpenRaftNode(t.TempDir(), "n0", peerSet, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raft.snapshot = kvs.raftSnapshot
+	kvs.raft = raft
+	go kvs.applyRaftEntries()
+
+	raft.Lock()
+	raft.term = 1
+	raft.becomeLeader()
+	raft.Unlock()
+	err = raft.waitApplied(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kvs
+}
+
+// Sets the commit timeout short for a test. The election timeout is left
+// alone as the leader's replicators go on reading it after the test
+func raftTestTimeouts(t *testing.T) {
+	commit := RAFT_COMMIT_TIMEOUT
+	RAFT_COMMIT_TIMEOUT = 500 * time.Millisecond
+	t.Cleanup(func() {
+		RAFT_COMMIT_TIMEOUT = commit
+	})
+}
+
+func TestProposeLetsReadsThrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  int32 // how the follower answers after the leader's first entry
+		wantErr error
+	}{
+		{"committed", raftTestAck, nil},
+		{"never committed", raftTestSilent, ErrRaftTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raftTestTimeouts(t)
+			answer := raftTestAck
+			kvs := raftTestLeader(t, raftTestFollower(t, &answer))
+			atomic.StoreInt32(&answer, test.answer)
+
+			written := make(chan error, 1)
+			go func() {
+				_, _, _, err := kvs.PutData("a", KeyEntry{Value: "x"}, WriteCondition{}, map[string]int{}, "n0")
+				written <- err
+			}()
+
+			// the kvs isn't held while the write waits on the follower
+			read := make(chan int, 1)
+			go func() {
+				read <- kvs.KeyCount()
+			}()
+			select {
+			case <-read:
+			case <-time.After(RAFT_COMMIT_TIMEOUT / 2):
+				t.Fatal("read waited on the write")
+			}
+
+			err := <-written
+			if err != test.wantErr {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			_, exists, _ := kvs.engine.Get("a")
+			if exists != (test.wantErr == nil) {
+				t.Errorf("got key stored %v after error %v", exists, err)
+			}
+		})
+	}
+}
+
+func TestProposalsApplyInOrder(t *testing.T) {
+	raftTestTimeouts(t)
+	answer := raftTestAck
+	kvs := raftTestLeader(t, raftTestFollower(t, &answer))
+
+	// every write waits for the one before, so each one's version is worked
+	// out from a kvs that has the last one applied
+	done := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, _, _, err := kvs.IncrData("n", IncrOp{Delta: 1}, map[string]int{})
+			done <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entry, _, _ := kvs.engine.Get("n")
+	if entry.Value != 10.0 {
+		t.Errorf("got %v, want 10", entry.Value)
+	}
+}
+
+func TestForwardToNodeKeepsView(t *testing.T) {
+	tests := []struct {
+		name       string
+		leaderUp   bool
+		wantStatus int
+	}{
+		{"leader answers", true, http.StatusTeapot},
+		{"leader down", false, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			leader := txnTestServer(t, http.StatusTeapot, map[string]string{})
+			if !test.leaderUp {
+				leader = "127.0.0.1:1"
+			}
+			quorumTestShard(t, leader)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/kvs/a", nil)
+			err := forwardToNode(c, leader, time.Second)
+			if err != nil {
+				sendNoLeader(c)
+			}
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+			if !view.Contains(leader) {
+				t.Errorf("%s was dropped from the view", leader)
+			}
+		})
+	}
+}
+
+// A read must not be served by a leader that may have been replaced
+func TestReadDuringLeaderChange(t *testing.T) {
+	tests := []struct {
+		name       string
+		lease      time.Duration
+		answer     int32 // how the follower answers once the read comes in
+		wantErr    error
+		wantStatus int // for the same key read with /kvs/_mget
+	}{
+		{"within the lease", time.Hour, raftTestSilent, nil, http.StatusOK},
+		{"leadership confirmed", 0, raftTestAck, nil, http.StatusOK},
+		{"follower gone quiet", 0, raftTestSilent, ErrNotLeader, http.StatusServiceUnavailable},
+		{"new leader elected", 0, raftTestNewTerm, ErrNotLeader, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raftTestTimeouts(t)
+			lease := RAFT_LEASE_TIMEOUT
+			RAFT_LEASE_TIMEOUT = test.lease
+			defer func() { RAFT_LEASE_TIMEOUT = lease }()
+
+			answer := raftTestAck
+			kvs := raftTestLeader(t, raftTestFollower(t, &answer))
+			_, _, _, err := kvs.PutData("a", KeyEntry{Value: "x"}, WriteCondition{}, map[string]int{}, "n0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			atomic.StoreInt32(&answer, test.answer)
+
+			entry, _, err := kvs.GetData("a", map[string]int{})
+			if err != test.wantErr {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if err == nil && entry.Value != "x" {
+				t.Errorf("got %v, want x", entry.Value)
+			}
+
+			kvsDb = kvs
+			results, _ := localMget([]string{"a"}, nil, map[string]int{})
+			if results["a"].Status != test.wantStatus {
+				t.Errorf("got mget status %d, want %d", results["a"].Status, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestVoteAfterStartup(t *testing.T) {
+	tests := []struct {
+		name      string
+		upFor     time.Duration
+		wantGrant bool
+	}{
+		{"just started", 0, false},
+		{"up for an election timeout", RAFT_ELECTION_TIMEOUT, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raft, err := OpenRaftNode(t.TempDir(), "n0", map[string]struct{}{"n1": {}}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raft.started = raft.started.Add(-test.upFor)
+
+			resp := raft.HandleVote(RaftVoteRequest{Term: 1, Candidate: "n1"})
+			if resp.Granted != test.wantGrant {
+				t.Errorf("got granted %v, want %v", resp.Granted, test.wantGrant)
+			}
+		})
+	}
+}
+
+func TestAppendKeepsCommit(t *testing.T) {
+	entries := []RaftEntry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}}
+
+	tests := []struct {
+		name       string
+		req        RaftAppendRequest
+		wantCommit uint64
+	}{
+		{"late append of the first entry", RaftAppendRequest{Term: 1, Leader: "n1", Entries: entries[:1], LeaderCommit: 3}, 2},
+		{"heartbeat from the start of the log", RaftAppendRequest{Term: 1, Leader: "n1", LeaderCommit: 3}, 2},
+		{"commit moving on", RaftAppendRequest{Term: 1, Leader: "n1", PrevIndex: 3, PrevTerm: 1, Entries: []RaftEntry{{Term: 1, Index: 4}}, LeaderCommit: 4}, 4},
+		{"commit past what the request showed", RaftAppendRequest{Term: 1, Leader: "n1", PrevIndex: 3, PrevTerm: 1, Entries: []RaftEntry{{Term: 1, Index: 4}}, LeaderCommit: 9}, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raft, err := OpenRaftNode(t.TempDir(), "n0", map[string]struct{}{"n1": {}}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := raft.HandleAppend(RaftAppendRequest{Term: 1, Leader: "n1", Entries: entries, LeaderCommit: 2})
+			if !resp.Success || raft.commitIndex != 2 {
+				t.Fatalf("first append got %+v, commit index %d", resp, raft.commitIndex)
+			}
+
+			resp = raft.HandleAppend(test.req)
+			if !resp.Success {
+				t.Fatalf("got %+v", resp)
+			}
+			if raft.commitIndex != test.wantCommit {
+				t.Errorf("got commit index %d, want %d", raft.commitIndex, test.wantCommit)
+			}
+		})
+	}
+}
+
+// A snapshot bigger than a request may be still gets to a follower
+func TestSendSnapshotInPieces(t *testing.T) {
+	raftTestTimeouts(t)
+	defaults := limits
+	limits.MaxBodySize = 1024
+	defer func() { limits = defaults }()
+
+	leader := raftTestLeader(t)
+	for i := 0; i < 50; i++ {
+		_, _, _, err := leader.PutData("key"+strconv.Itoa(i), KeyEntry{Value: strings.Repeat("x", 100)}, WriteCondition{}, map[string]int{}, "n0")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	follower := NewKeyValStoreDatabase("n1")
+	follower.config.Replication = ReplicationRaft
+	raft, err := OpenRaftNode(t.TempDir(), "n1", map[string]struct{}{"n0": {}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower.raft = raft
+	kvsDb = follower
+
+	var pieces int32
+	router := gin.New()
+	router.Use(limitRequestBody)
+	router.POST("/rep/raft/snapshot", func(c *gin.Context) {
+		atomic.AddInt32(&pieces, 1)
+		repRaftSnapshot(c)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	leader.raft.sendSnapshot(strings.TrimPrefix(server.URL, "http://"), 1)
+
+	if pieces < 2 {
+		t.Errorf("sent in %d pieces", pieces)
+	}
+	if follower.KeyCount() != 50 {
+		t.Errorf("follower has %d keys, want 50", follower.KeyCount())
+	}
+	want, _ := leader.raft.appliedPosition()
+	if applied, _ := raft.appliedPosition(); applied != want {
+		t.Errorf("follower applied up to %d, want %d", applied, want)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// read repairs still running in the background
+var pendingRepairs sync.WaitGroup
+
+// Runs repairAfterAnswers in the background, counted in pendingRepairs
+func startRepair(key string, reads []ReplicaRead, answers <-chan *ReplicaRead, waiting int, cancel context.CancelFunc) {
+	pendingRepairs.Add(1)
+	go func() {
+		defer pendingRepairs.Done()
+		repairAfterAnswers(key, reads, answers, waiting, cancel)
+	}()
+}
+
+// Waits for the replicas a read hasn't heard from yet, up to the read's
+// deadline, then lets go of the read's context and repairs every stale copy
+// among all the answers, so a replica that answered late isn't left behind
+func repairAfterAnswers(key string, reads []ReplicaRead, answers <-chan *ReplicaRead, waiting int, cancel context.CancelFunc) {
+	for ; waiting > 0; waiting-- {
+		if read := <-answers; read != nil {
+			reads = append(reads, *read)
+		}
+	}
+	cancel()
+	repairStaleReplicas(key, reads)
+}
+
+// Sends the newest copy of key a read found to every replica that answered
+// it with an older one, this node included, so a hot key doesn't wait for
+// anti-entropy to come around. The copy goes the way anti-entropy sends it,
+// so each replica only takes it if it's still newer than its own by the
+// time it gets there
+func repairStaleReplicas(key string, reads []ReplicaRead) {
+	newest := newestRead(key, reads)
+	if !newest.Exists && !newest.Deleted {
+		// expired, or no replica has it
+		return
+	}
+	item := newest.syncItem(key)
+	req := AntiEntropyRequest{ShardId: localShardId, Items: map[string]SyncItem{key: item}, From: newest.from, ReadRepair: true}
+
+	stale, sent, failed := 0, 0, 0
+	for _, read := range reads {
+		if !item.newerThan(read.syncItem(key)) {
+			continue
+		}
+		// an expired copy of the same write is left to the reaper
+		if !read.Exists && !read.Deleted && read.Version == item.Version {
+			continue
+		}
+		// a replica without any version of the key may have deleted it and
+		// dropped the tombstone since
+		if read.Version == 0 && !kvsDb.KeepsTombstones() {
+			continue
+		}
+		stale++
+
+		var repaired int
+		var err error
+		if read.from == localAddress {
+			repaired, _, err = applyRepairs(req)
+		} else {
+			repaired, err = pushRepairs(read.from, req)
+		}
+		if err != nil {
+			log.Printf("read repair of %s on %s failed: %v", key, read.from, err)
+			failed++
+		} else if repaired > 0 {
+			sent++
+		}
+	}
+
+	metrics.Lock()
+	metrics.ReadRepair.StaleReads += int64(stale)
+	metrics.ReadRepair.RepairsSent += int64(sent)
+	metrics.ReadRepair.FailedRepairs += int64(failed)
+	metrics.Unlock()
+}
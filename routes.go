@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -79,6 +85,152 @@ func getKey(c *gin.Context) {
 		return
 	}
 
+	level, err := parseReadConsistency(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// clients reading raw values send their metadata in a header
+	metadata, hasHeader, err := parseMetadataHeader(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !hasHeader {
+		// get the json data from the body
+		data, err := parseKeysFromBody(c, "causal-metadata")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no causal-metadata specified"})
+			return
+		}
+		metadata = getMetadataFromInterface(data["causal-metadata"])
+	}
+
+	// an older version was asked for
+	if c.Query("version") != "" {
+		getKeyVersion(c, key, metadata)
+		return
+	}
+
+	// read this node's copy, or the newest copy of as many replicas as the
+	// consistency level needs. In raft mode the leader's copy is the newest
+	var entry KeyEntry
+	var currMetadata map[string]int
+	if level == ConsistencyLinearizable {
+		entry, currMetadata, err = kvsDb.GetLinearizable(key, metadata)
+	} else if level == ConsistencyOne || kvsDb.Raft() != nil {
+		entry, currMetadata, err = kvsDb.GetData(key, metadata)
+	} else {
+		entry, currMetadata, err = readKvsQuorum(key, metadata, level)
+	}
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrKeyNotFound {
+		if !proxyToOldPlacement(c, key, metadata) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist"})
+		}
+		return
+	} else if err == ErrQuorumNotReached {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Fewer replicas answered than the consistency level needs"})
+		return
+	} else if err == ErrLinearizableUnsupported {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Linearizable reads need REPLICATION=raft"})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady || err == ErrRaftTimeout {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Couldn't make sure the read is up to date; try again later"})
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	sendKeyEntry(c, entry, currMetadata)
+}
+
+// Sends a key that was read to the client, unless a precondition on its
+// version says not to
+func sendKeyEntry(c *gin.Context, entry KeyEntry, currMetadata map[string]int) {
+	// check If-Match and If-None-Match against the key's version
+	c.Header("ETag", formatEtag(entry.Version))
+	status := checkReadPreconditions(c.Request.Header, entry)
+	if status == http.StatusPreconditionFailed {
+		sendPreconditionFailed(c, currMetadata)
+		return
+	} else if status == http.StatusNotModified {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	// raw values go back byte for byte, with their metadata in a header
+	if entry.IsRaw() {
+		setMetadataHeader(c, currMetadata)
+		c.Data(http.StatusOK, entry.ContentType, entry.Data)
+		return
+	}
+
+	// send success to client, with the time left to live if the key has one
+	response := gin.H{"result": "found", "value": entry.Value, "version": entry.Version, "causal-metadata": currMetadata}
+	if entry.ExpiresAt != 0 {
+		// an expired key is served until the primary's delete arrives
+		left := entry.ExpiresAt - time.Now().UnixMilli()
+		if left < 0 {
+			left = 0
+		}
+		response["ttl"] = float64(left) / 1000
+	}
+	if crdtType := entry.CrdtType(); crdtType != "" {
+		response["type"] = crdtType
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Retrieves a single retained version of the key
+func getKeyVersion(c *gin.Context, key string, metadata map[string]int) {
+	version, err := strconv.ParseInt(c.Query("version"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a number"})
+		return
+	}
+
+	// get version from local kvs database and check for errors
+	v, currMetadata, err := kvsDb.GetVersion(key, version, metadata)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrKeyNotFound || err == ErrVersionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version does not exist"})
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	if v.Deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key was deleted at this version", "version": v.Version, "writer": v.Writer, "causal-metadata": currMetadata})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "found", "value": v.Value, "version": v.Version, "writer": v.Writer, "causal-metadata": currMetadata})
+}
+
+// Returns every retained version of the key, oldest first
+func getKeyHistory(c *gin.Context) {
+	// get key from URL
+	key := c.Param(("key"))
+
+	shardId := ring.GetShardId(key)
+	if shardId != localShardId {
+		proxyToShard(c, "/kvs/"+key+"/history", shardId)
+		return
+	}
+
 	// get the json data from the body
 	data, err := parseKeysFromBody(c, "causal-metadata")
 	if err != nil {
@@ -87,21 +239,135 @@ func getKey(c *gin.Context) {
 	}
 	metadata := getMetadataFromInterface(data["causal-metadata"])
 
-	// Make change in local kvs database and check for errors
-	val, currMetadata, err := kvsDb.GetData(key, metadata)
+	// get history from local kvs database and check for errors
+	history, currMetadata, err := kvsDb.GetHistory(key, metadata)
 	if err == ErrInvalidMetadata {
 		sendServiceUnavailable(c)
 		return
 	} else if err == ErrKeyNotFound {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key has no history"})
 		return
 	} else if err != nil {
 		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
 
-	// send success to client
-	c.JSON(http.StatusOK, gin.H{"result": "found", "value": val, "causal-metadata": currMetadata})
+	c.JSON(http.StatusOK, gin.H{"history": history, "causal-metadata": currMetadata})
+}
+
+// Lists the keys in [start, end), or the keys starting with prefix, across
+// every shard in order, a page at a time. With values=true their values
+// are listed too
+func getKeys(c *gin.Context) {
+	query, err := parseScanQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	prefix := c.Query("prefix")
+	if prefix != "" {
+		query.Start, query.End = prefixRange(prefix, query.Start, query.End)
+	}
+
+	// the cursor picks up after the last key of the previous page
+	if cursor := c.Query("cursor"); cursor != "" {
+		query.After, err = decodeScanCursor(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	metadata, err := parseOptionalMetadata(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// a prefix with a hash tag only has keys on one shard
+	var page ScanPage
+	if shardId := ring.GetShardIdFromPrefix(prefix); shardId >= 0 {
+		page, err = scanShard(shardId, query, metadata)
+	} else {
+		page, err = scanAllShards(query, metadata)
+	}
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// only hand out a cursor if there's another page
+	response := gin.H{"keys": page.Keys, "causal-metadata": page.Metadata}
+	if query.Values {
+		response["values"] = page.Values
+	}
+	if page.More {
+		response["cursor"] = encodeScanCursor(page.Keys[len(page.Keys)-1])
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Streams every put and delete of a key, or of every key starting with a
+// prefix, as server-sent events. Each event's id is a cursor that resumes
+// the stream right after it, given as ?cursor= or the Last-Event-ID header
+func watchKeys(c *gin.Context) {
+	key, prefix := c.Query("key"), c.Query("prefix")
+	if key != "" && prefix != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Watch a key or a prefix, not both"})
+		return
+	}
+	if limits.checkKey(key) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key is too long"})
+		return
+	}
+
+	encoded := c.Query("cursor")
+	if encoded == "" {
+		encoded = c.GetHeader("Last-Event-ID")
+	}
+	var cursor map[string]int
+	if encoded != "" {
+		var err error
+		cursor, err = decodeWatchCursor(encoded)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// a key, or a prefix with a hash tag, only lives on one shard
+	var shardIds []int
+	if key != "" {
+		shardIds = []int{ring.GetShardId(key)}
+	} else if shardId := ring.GetShardIdFromPrefix(prefix); shardId >= 0 {
+		shardIds = []int{shardId}
+	} else {
+		for shardId := range ring.Shards {
+			shardIds = append(shardIds, shardId)
+		}
+	}
+
+	// every shard is watched until the stream ends
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	sources := make([]<-chan Change, 0, len(shardIds))
+	for _, shardId := range shardIds {
+		changes, err := watchShard(ctx, shardId, key, prefix, cursor)
+		if err == ErrCursorTooOld {
+			c.JSON(http.StatusGone, gin.H{"error": "Cursor is too old to resume from, watch again without one"})
+			return
+		} else if err != nil {
+			c.JSON(123, gin.H{"error": err.Error()})
+			return
+		}
+		sources = append(sources, changes)
+	}
+
+	streamChanges(ctx, c, sources, cursor)
 }
 
 // Tries to add the kv pair to the kvs
@@ -115,8 +381,25 @@ func putKey(c *gin.Context) {
 		return
 	}
 
+	level, err := parseConsistency(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// anything but JSON is stored as a raw value
+	if isRawBody(c) {
+		putRawKey(c, key, level)
+		return
+	}
+
 	// get the json data from the body
-	data, err := parseKeysFromBody(c, "value", "causal-metadata")
+	data, err := parseKeysFromBodyWithOptional(c, []string{"value", "causal-metadata"}, append([]string{"ttl"}, writeConditionKeys...)...)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata or value not specified"})
 		return
@@ -124,8 +407,15 @@ func putKey(c *gin.Context) {
 	value := data["value"]
 	metadata := getMetadataFromInterface(data["causal-metadata"])
 
+	cond, err := parseWriteCondition(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	parseEtagConditions(c.Request.Header, &cond)
+
 	// check if key is under char limit
-	if len(key) > 50 {
+	if limits.checkKey(key) != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Key is too long"})
 		return
 	}
@@ -135,338 +425,1733 @@ func putKey(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "PUT request does not specify a value"})
 		return
 	}
+	if limits.checkValue(value) != nil {
+		sendValueTooLarge(c)
+		return
+	}
+
+	entry := KeyEntry{Value: value}
+
+	// check if ttl (in seconds) is valid and turn it into an expiry time
+	if ttl, exists := data["ttl"]; exists {
+		seconds, ok := ttl.(float64)
+		if !ok || seconds <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive number of seconds"})
+			return
+		}
+		entry.ExpiresAt = time.Now().UnixMilli() + int64(seconds*1000)
+	}
 
 	// put key and check for errors
-	wasCreated, currMetadata, err := kvsDb.PutData(key, value, metadata, localAddress)
+	wasCreated, entry, currMetadata, err := kvsDb.PutData(key, entry, cond, metadata, localAddress)
 	if err == ErrInvalidMetadata {
 		sendServiceUnavailable(c)
 		return
+	} else if err == ErrPreconditionFailed {
+		sendPreconditionFailed(c, currMetadata)
+		return
+	} else if err == ErrOutOfMemory {
+		sendInsufficientStorage(c, currMetadata)
+		return
+	} else if err == ErrKeyLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key is locked by a transaction", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
 	} else if err != nil {
 		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
 
+	// wait for as many replicas as the consistency level needs
+	if !replicateWrite(c, level, http.MethodPut, kvsPutMessage(key, entry, currMetadata), currMetadata) {
+		return
+	}
+
 	// check if updated of created
+	c.Header("ETag", formatEtag(entry.Version))
 	if wasCreated {
-		c.JSON(http.StatusCreated, gin.H{"result": "created", "causal-metadata": currMetadata})
+		c.JSON(http.StatusCreated, gin.H{"result": "created", "version": entry.Version, "causal-metadata": currMetadata})
 	} else {
-		c.JSON(http.StatusOK, gin.H{"result": "updated", "causal-metadata": currMetadata})
+		c.JSON(http.StatusOK, gin.H{"result": "updated", "version": entry.Version, "causal-metadata": currMetadata})
+	}
+}
+
+// Stores the request body byte for byte, along with its Content-Type. Causal
+// metadata comes in the X-Causal-Metadata header, and conditions in the
+// If-Match and If-None-Match headers
+func putRawKey(c *gin.Context, key string, level string) {
+	metadata, _, err := parseMetadataHeader(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var cond WriteCondition
+	parseEtagConditions(c.Request.Header, &cond)
+
+	// check if key is under char limit
+	if limits.checkKey(key) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key is too long"})
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(body) > limits.MaxValueSize {
+		sendValueTooLarge(c)
+		return
+	}
+	entry := KeyEntry{Data: body, ContentType: c.GetHeader("Content-Type")}
+
+	// the ttl (in seconds) goes in the query string
+	if ttl := c.Query("ttl"); ttl != "" {
+		seconds, err := strconv.ParseFloat(ttl, 64)
+		if err != nil || seconds <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be a positive number of seconds"})
+			return
+		}
+		entry.ExpiresAt = time.Now().UnixMilli() + int64(seconds*1000)
+	}
+
+	// put key and check for errors
+	wasCreated, entry, currMetadata, err := kvsDb.PutData(key, entry, cond, metadata, localAddress)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrPreconditionFailed {
+		sendPreconditionFailed(c, currMetadata)
+		return
+	} else if err == ErrOutOfMemory {
+		sendInsufficientStorage(c, currMetadata)
+		return
+	} else if err == ErrKeyLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key is locked by a transaction", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// wait for as many replicas as the consistency level needs
+	if !replicateWrite(c, level, http.MethodPut, kvsPutMessage(key, entry, currMetadata), currMetadata) {
+		return
 	}
 
-	// broadcast
-	go broadcastKvsPut(key, value, currMetadata, localAddress)
+	// check if updated of created
+	c.Header("ETag", formatEtag(entry.Version))
+	setMetadataHeader(c, currMetadata)
+	if wasCreated {
+		c.JSON(http.StatusCreated, gin.H{"result": "created", "version": entry.Version, "causal-metadata": currMetadata})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"result": "updated", "version": entry.Version, "causal-metadata": currMetadata})
+	}
 }
 
-func deleteKey(c *gin.Context) {
+// Adds delta to the number stored at key and returns the new value
+func incrKey(c *gin.Context) {
+	// get key from URL
+	key := c.Param(("key"))
+
+	shardId := ring.GetShardId(key)
+	if shardId != localShardId {
+		proxyToShard(c, "/kvs/"+key+"/incr", shardId)
+		return
+	}
+
+	level, err := parseConsistency(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// get the json data from the body
+	data, err := parseKeysFromBodyWithOptional(c, []string{"causal-metadata"}, "delta", "initial", "min", "max", "conflict-free")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no causal-metadata specified"})
+		return
+	}
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	op, err := parseIncrOp(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// check if key is under char limit
+	if limits.checkKey(key) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key is too long"})
+		return
+	}
+
+	// increment and check for errors
+	wasCreated, entry, currMetadata, err := kvsDb.IncrData(key, op, metadata)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrCounterBounds {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err == ErrInvalidCrdtOp {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A grow-only counter can't be decremented"})
+		return
+	} else if err == ErrNotANumber || err == ErrNotACounter {
+		c.JSON(http.StatusConflict, gin.H{"error": "Value is not a number that can be incremented this way", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrCounterOutOfBounds {
+		c.JSON(http.StatusConflict, gin.H{"error": "Increment would go out of bounds", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrOutOfMemory {
+		sendInsufficientStorage(c, currMetadata)
+		return
+	} else if err == ErrKeyLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key is locked by a transaction", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// wait for as many replicas as the consistency level needs
+	if !replicateWrite(c, level, http.MethodPut, kvsPutMessage(key, entry, currMetadata), currMetadata) {
+		return
+	}
+
+	c.Header("ETag", formatEtag(entry.Version))
+	response := gin.H{"result": "updated", "value": entry.Value, "version": entry.Version, "causal-metadata": currMetadata}
+	if wasCreated {
+		response["result"] = "created"
+		c.JSON(http.StatusCreated, response)
+	} else {
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// Applies an operation to the crdt stored at key, creating it if needed
+func updateCrdt(c *gin.Context) {
 	// get key from URL
 	key := c.Param(("key"))
 
-	shardId := ring.GetShardId(key)
-	if shardId != localShardId {
-		proxyToShard(c, "/kvs/"+key, shardId)
+	shardId := ring.GetShardId(key)
+	if shardId != localShardId {
+		proxyToShard(c, "/kvs/"+key+"/crdt", shardId)
+		return
+	}
+
+	level, err := parseConsistency(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// get the json data from the body
+	data, err := parseKeysFromBodyWithOptional(c, []string{"type", "op", "causal-metadata"}, "value", "field", "delta")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata, type or op not specified"})
+		return
+	}
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	op, err := parseCrdtOp(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if limits.checkValue(op.Value) != nil {
+		sendValueTooLarge(c)
+		return
+	}
+
+	// check if key is under char limit
+	if limits.checkKey(key) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key is too long"})
+		return
+	}
+
+	// apply and check for errors
+	wasCreated, entry, currMetadata, err := kvsDb.UpdateCrdt(key, op, metadata)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrCrdtTypeMismatch {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key holds a different type", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrOutOfMemory {
+		sendInsufficientStorage(c, currMetadata)
+		return
+	} else if err == ErrKeyLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key is locked by a transaction", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the whole crdt is sent, and replicas merge it into theirs. Wait for as
+	// many of them as the consistency level needs
+	if !replicateWrite(c, level, http.MethodPut, kvsPutMessage(key, entry, currMetadata), currMetadata) {
+		return
+	}
+
+	c.Header("ETag", formatEtag(entry.Version))
+	response := gin.H{"result": "updated", "type": op.Type, "value": entry.Value, "version": entry.Version, "causal-metadata": currMetadata}
+	if wasCreated {
+		response["result"] = "created"
+		c.JSON(http.StatusCreated, response)
+	} else {
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func deleteKey(c *gin.Context) {
+	// get key from URL
+	key := c.Param(("key"))
+
+	shardId := ring.GetShardId(key)
+	if shardId != localShardId {
+		proxyToShard(c, "/kvs/"+key, shardId)
+		return
+	}
+
+	level, err := parseConsistency(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// clients of raw values can send their metadata in a header, with no body
+	metadata, hasHeader, err := parseMetadataHeader(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var cond WriteCondition
+	if !hasHeader {
+		// get the json data from the body
+		data, err := parseKeysFromBodyWithOptional(c, []string{"causal-metadata"}, writeConditionKeys...)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata not specified"})
+			return
+		}
+		metadata = getMetadataFromInterface(data["causal-metadata"])
+
+		cond, err = parseWriteCondition(data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	parseEtagConditions(c.Request.Header, &cond)
+
+	// put key and check for errors
+	currMetadata, err := kvsDb.DeleteData(key, cond, 0, metadata, localAddress)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrPreconditionFailed {
+		sendPreconditionFailed(c, currMetadata)
+		return
+	} else if err == ErrKeyNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist"})
+		return
+	} else if err == ErrKeyLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key is locked by a transaction", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// replicas are sent the metadata the client sent, plus this node's tick
+	// for the delete so they take it in order after this node's earlier writes
+	metadata[localAddress] = currMetadata[localAddress]
+	version := versionFromMetadata(currMetadata, localAddress)
+
+	// wait for as many replicas as the consistency level needs
+	if !replicateWrite(c, level, http.MethodDelete, kvsDeleteMessage(key, version, metadata), currMetadata) {
+		return
+	}
+
+	// send success to client
+	c.JSON(http.StatusOK, gin.H{"result": "deleted", "causal-metadata": currMetadata})
+}
+
+// Gets many keys at once, from every shard they're on
+func mgetKeys(c *gin.Context) {
+	// get the json data from the body
+	data, err := parseKeysFromBody(c, "keys", "causal-metadata")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata or keys not specified"})
+		return
+	}
+	keys, err := parseBatchKeys(data["keys"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	results, currMetadata := runBatch("/kvs/_mget", keys, nil, metadata, localMget)
+	c.JSON(http.StatusOK, gin.H{"results": results, "causal-metadata": currMetadata})
+}
+
+// Puts many key value pairs at once, on every shard they're on
+func mputKeys(c *gin.Context) {
+	// get the json data from the body
+	data, err := parseKeysFromBody(c, "values", "causal-metadata")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata or values not specified"})
+		return
+	}
+	keys, values, err := parseBatchValues(data["values"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	results, currMetadata := runBatch("/kvs/_mput", keys, values, metadata, localMput)
+	c.JSON(http.StatusOK, gin.H{"results": results, "causal-metadata": currMetadata})
+}
+
+// Deletes many keys at once, on every shard they're on
+func mdeleteKeys(c *gin.Context) {
+	// get the json data from the body
+	data, err := parseKeysFromBody(c, "keys", "causal-metadata")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata or keys not specified"})
+		return
+	}
+	keys, err := parseBatchKeys(data["keys"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	results, currMetadata := runBatch("/kvs/_mdelete", keys, nil, metadata, localMdelete)
+	c.JSON(http.StatusOK, gin.H{"results": results, "causal-metadata": currMetadata})
+}
+
+// Applies puts, deletes and conditions on keys of a single shard as one
+// unit, so no replica ever sees part of it
+func putBatch(c *gin.Context) {
+	// keep the body around so the request can still be proxied once we
+	// know which shard it's for
+	rawData, _ := c.GetRawData()
+	c.Request.Body = io.NopCloser(bytes.NewReader(rawData))
+
+	// get the json data from the body
+	data, err := parseKeysFromBodyWithOptional(c, []string{"writes", "causal-metadata"}, "conditions")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata or writes not specified"})
+		return
+	}
+	req, err := parseTxnRequest(data)
+	if err == ErrValueTooLarge {
+		sendValueTooLarge(c)
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	conds, err := parseTxnConditions(data["conditions"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Writes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a batch needs at least one write"})
+		return
+	}
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	// every key has to be on the same shard
+	keys := make([]string, 0, len(req.Writes)+len(conds))
+	for _, write := range req.Writes {
+		keys = append(keys, write.Key)
+	}
+	for key := range conds {
+		keys = append(keys, key)
+	}
+	shardId := ring.GetShardId(keys[0])
+	for _, key := range keys[1:] {
+		if ring.GetShardId(key) != shardId {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Keys are on more than one shard; use /kvs/_txn"})
+			return
+		}
+	}
+
+	if shardId != localShardId {
+		c.Request.Body = io.NopCloser(bytes.NewReader(rawData))
+		proxyToShard(c, "/kvs/_batch", shardId)
+		return
+	}
+
+	level, err := parseConsistency(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// in raft mode only the shard's leader serves it
+	c.Request.Body = io.NopCloser(bytes.NewReader(rawData))
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// apply the batch and check for errors
+	writes, currMetadata, err := kvsDb.PutBatch(req.Writes, conds, metadata)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrPreconditionFailed {
+		sendPreconditionFailed(c, currMetadata)
+		return
+	} else if err == ErrOutOfMemory {
+		sendInsufficientStorage(c, currMetadata)
+		return
+	} else if err == ErrKeyLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key is locked by a transaction", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// wait for as many replicas as the consistency level needs
+	if !replicateWrite(c, level, http.MethodPut, kvsBatchMessage(writes, "", currMetadata), currMetadata) {
+		return
+	}
+
+	// every write in the batch has the same version
+	c.JSON(http.StatusOK, gin.H{"result": "applied", "version": versionFromMetadata(currMetadata, localAddress), "causal-metadata": currMetadata})
+}
+
+// Runs reads, conditions and writes on any number of shards as a single
+// atomic transaction
+func runTxn(c *gin.Context) {
+	// get the json data from the body
+	data, err := parseKeysFromBodyWithOptional(c, []string{"causal-metadata"}, "reads", "conditions", "writes")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata not specified"})
+		return
+	}
+	req, err := parseTxnRequest(data)
+	if err == ErrValueTooLarge {
+		sendValueTooLarge(c)
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	// run the transaction and check for errors
+	reads, currMetadata, err := runTransaction(req, metadata)
+	if errors.Is(err, ErrShardUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"result": "aborted", "error": err.Error(), "causal-metadata": currMetadata})
+		return
+	} else if err == ErrPreconditionFailed {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"result": "aborted", "error": "Precondition failed", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrOutOfMemory {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"result": "aborted", "error": "Node is over its memory limit", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrKeyLocked {
+		c.JSON(http.StatusConflict, gin.H{"result": "aborted", "error": "Key is locked by another transaction", "causal-metadata": currMetadata})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"result": "aborted", "error": err.Error(), "causal-metadata": currMetadata})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "committed", "reads": reads, "causal-metadata": currMetadata})
+}
+
+/// --- shard routes ---
+
+// Client to Node Endpoints
+func getNodeShardId(c *gin.Context) {
+	if localShardId != -1 {
+		c.JSON(http.StatusOK, gin.H{"node-shard-id": localShardId})
+	} else {
+		c.JSON(123, gin.H{"error": "Node not assigned to a Shard"})
+	}
+}
+
+func getShardIds(c *gin.Context) {
+	// Since the Shard IDs are just their index in the ring.Shards slice
+	// we must create a slice of numbers from 0 to number of shards
+	idArr := make([]int, len(ring.Shards))
+	for i := 0; i < len(idArr); i++ {
+		idArr[i] = i
+	}
+
+	// Respond with 200 OK and the idArr
+	c.JSON(http.StatusOK, gin.H{"shard-ids": idArr})
+}
+
+func getShardMembers(c *gin.Context) {
+	// get ID from URL
+	id, err := parseShardIdFromURL(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		return
+	}
+
+	// turn the map of replicas (aka shard members) into a slice so the JSON formatts correctly
+	members := make([]string, len(ring.Shards[id].Replicas))
+
+	i := 0
+	for key := range ring.Shards[id].Replicas {
+		members[i] = key
+		i++
+	}
+
+	// respond with members
+	c.JSON(http.StatusOK, gin.H{"shard-members": members})
+}
+
+// Returns the counters of this node's repair processes
+func getMetrics(c *gin.Context) {
+	metrics.Lock()
+	antiEntropy, readRepair := metrics.AntiEntropy, metrics.ReadRepair
+	metrics.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"anti-entropy": antiEntropy,
+		"read-repair":  readRepair,
+	})
+}
+
+func getShardKeyCount(c *gin.Context) {
+	// get ID from URL
+	id, err := parseShardIdFromURL(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		return
+	}
+
+	if id != localShardId {
+		proxyToShard(c, "/shard/key-count/"+strconv.Itoa(id), id)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shard-key-count": kvsDb.KeyCount()})
+}
+
+func addNodeToShard(c *gin.Context) {
+	/// ----Parsing Data----
+	// get shard ID from URL
+	shardId, err := parseShardIdFromURL(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		return
+	}
+
+	// get the json data from the body
+	data, err := parseKeysFromBody(c, "socket-address")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no address specified"})
+		return
+	}
+	nodeAddress := data["socket-address"].(string)
+
+	// check if nodeAddress is in the view
+	if !view.Contains(nodeAddress) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "socket-address not found"})
+		return
+	}
+
+	/// ----Adding Node Local----
+	// add the node the the local shard
+	ring.AddNodeToShard(shardId, nodeAddress)
+
+	// if the nodeAddress is this node start cloning data
+	if nodeAddress == localAddress {
+		localShardId = shardId
+		// in raft mode the shard's leader sends it the data instead
+		if kvsDb.config.Replication == ReplicationRaft {
+			startShardRaft()
+		} else {
+			go getShardData(shardId)
+		}
+	} else if raft := kvsDb.Raft(); raft != nil && shardId == localShardId {
+		raft.AddPeer(nodeAddress)
+	}
+	// Respond to client
+	c.JSON(http.StatusOK, gin.H{"result": "node added to shard"})
+
+	go broadcastAddNodeToShard(nodeAddress, shardId)
+}
+
+func putReshard(c *gin.Context) {
+	/// ----Parsing Data----
+	// get the json data from the body
+	data, err := parseKeysFromBody(c, "shard-count")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no shard count specified"})
+		return
+	}
+	shardCount := int(data["shard-count"].(float64))
+
+	// raft groups can't change their members through the log yet
+	if kvsDb.config.Replication == ReplicationRaft {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Resharding isn't supported in raft mode"})
+		return
+	}
+
+	/// ----Resharding Local----
+	// reshard local ring and check for insufficient node count
+	ring, err = ring.Reshard(shardCount, view.Nodes)
+	if err == ErrNotEnoughNodes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Not enough nodes to provide fault tolerance with requested shard count"})
+		return
+	}
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	localShardId = ring.GetShardIdFromNode(localAddress)
+
+	// Respond to client
+	c.JSON(http.StatusOK, gin.H{"result": "resharded"})
+
+	// recheck data with new shards
+	go shuffleKvsData()
+
+	/// Broadcast
+	go broadcastReshard(ring)
+}
+
+/// --- change log routes ---
+
+// Reads a shard's change log from its primary, from ?offset= or where
+// ?consumer= left off. Offsets are from the primary's log
+func getChanges(c *gin.Context) {
+	shardId, err := parseShardIdFromURL(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		return
+	}
+	if proxyToShardPrimary(c, shardId) {
+		return
+	}
+
+	offset, hasOffset, limit, err := parseChangesQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	consumer := c.Query("consumer")
+	if consumer != "" && hasOffset {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Read from an offset or a consumer, not both"})
+		return
+	}
+	if consumer != "" && !consumerNamePattern.MatchString(consumer) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidConsumerName.Error()})
+		return
+	}
+
+	var page ChangePage
+	if consumer != "" {
+		page, err = kvsDb.ConsumerChanges(consumer, limit, shardSenders(shardId))
+	} else {
+		if !hasOffset {
+			offset, _ = kvsDb.changes.Bounds()
+		}
+		page, err = kvsDb.ReadChanges(offset, limit, nil)
+	}
+	if err == ErrOffsetTooOld {
+		c.JSON(http.StatusGone, gin.H{"error": "Offset is older than the retained changes"})
+		return
+	} else if err == ErrInvalidOffset {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+func getConsumer(c *gin.Context) {
+	shardId, err := parseShardIdFromURL(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		return
+	}
+	if proxyToShardPrimary(c, shardId) {
+		return
+	}
+
+	name := c.Param("name")
+	if !consumerNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidConsumerName.Error()})
+		return
+	}
+
+	consumer, err := kvsDb.changes.LoadConsumer(name)
+	if err == ErrConsumerNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Consumer does not exist"})
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, consumer)
+}
+
+// Commits a consumer's progress: the offset of the next change it wants,
+// usually the next-offset of the last page it read
+func commitConsumer(c *gin.Context) {
+	shardId, err := parseShardIdFromURL(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		return
+	}
+	if proxyToShardPrimary(c, shardId) {
+		return
+	}
+
+	name := c.Param("name")
+	if !consumerNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidConsumerName.Error()})
+		return
+	}
+
+	data, err := parseKeysFromBody(c, "offset")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no offset specified"})
+		return
+	}
+	offset, ok := data["offset"].(float64)
+	if !ok || offset < 0 || offset != float64(uint64(offset)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a whole number of 0 or more"})
+		return
+	}
+
+	consumer, err := kvsDb.CommitConsumer(name, uint64(offset))
+	if err == ErrOffsetTooOld {
+		c.JSON(http.StatusGone, gin.H{"error": "Offset is older than the retained changes"})
+		return
+	} else if err == ErrInvalidOffset {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, consumer)
+
+	// the rest of the shard keeps it in case one of them becomes primary
+	go broadcastConsumer(consumer, shardId)
+}
+
+func deleteConsumer(c *gin.Context) {
+	shardId, err := parseShardIdFromURL(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		return
+	}
+	if proxyToShardPrimary(c, shardId) {
+		return
+	}
+
+	name := c.Param("name")
+	if !consumerNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidConsumerName.Error()})
+		return
+	}
+
+	err = kvsDb.changes.RemoveConsumer(name)
+	if err == ErrConsumerNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Consumer does not exist"})
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "deleted"})
+
+	go broadcastDeleteConsumer(name, shardId)
+}
+
+// ------------ Node to Node endpoints -----------------
+
+// Returns this node's copy of a key, for a coordinator reading from more
+// than one replica
+func repGetKey(c *gin.Context) {
+	metadata, err := parseOptionalMetadata(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	read, err := kvsDb.GetLatest(c.Query("key"), metadata)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, read)
+}
+
+// adds keys to kvsDb but with less error checking and does not broadcast
+func repPutKey(c *gin.Context) {
+	// get data from request body
+	data, err := parseKeysFromBodyWithOptional(c, []string{"causal-metadata", "sender"}, "key", "entry", "value", "writes", "txn-id")
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// batches are applied as one unit
+	if _, isBatch := data["writes"]; isBatch {
+		repPutBatch(c, data)
+		return
+	}
+	if data["key"] == nil || (data["entry"] == nil && data["value"] == nil) {
+		c.JSON(123, gin.H{"error": "not all keys present"})
+		return
+	}
+	key := data["key"].(string)
+	entry := getEntryOrValueFromInterface(data)
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	sender := data["sender"].(string)
+
+	// Check if correct shard
+	// if incorrect just update causal metaData, but don't actually store the data
+	shardId := ring.GetShardId(key)
+	if shardId != localShardId {
+		//just update the meta data and check error
+		err = kvsDb.putJustMetadata(metadata, sender)
+		if err == ErrInvalidMetadata {
+			sendServiceUnavailable(c)
+		} else if err != nil {
+			c.JSON(123, gin.H{"error": err.Error()})
+		}
+		c.JSON(http.StatusOK, gin.H{"result": "complete"})
+		return
+	}
+
+	// only the replicas that store the key hold it to the size limits
+	if limits.checkKey(key) != nil || limits.checkEntry(entry) != nil {
+		refuseTooLarge(c, metadata, sender)
+		return
+	}
+
+	// add data to kvs database
+	_, _, _, err = kvsDb.PutData(key, entry, WriteCondition{}, metadata, sender)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// respond with success
+	c.JSON(http.StatusOK, gin.H{"result": "added"})
+}
+
+// Applies a batch of writes from another replica. Nodes on other shards
+// only take the batch's metadata, since none of its keys are theirs
+func repPutBatch(c *gin.Context, data map[string]interface{}) {
+	writes := getBatchWritesFromInterface(data["writes"])
+	txnId, _ := data["txn-id"].(string)
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+	sender := data["sender"].(string)
+
+	// only the writes this node stores are held to the size limits
+	localWrites := make([]BatchWrite, 0, len(writes))
+	for _, write := range writes {
+		if ring.GetShardId(write.Key) != localShardId {
+			continue
+		}
+		if limits.checkKey(write.Key) != nil || (write.Entry != nil && limits.checkEntry(*write.Entry) != nil) {
+			refuseTooLarge(c, metadata, sender)
+			return
+		}
+		localWrites = append(localWrites, write)
+	}
+
+	// add data to kvs database
+	err := kvsDb.ApplyBatch(localWrites, txnId, metadata, sender)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// respond with success
+	c.JSON(http.StatusOK, gin.H{"result": "added"})
+}
+
+// Refuses a replicated write over this node's size limits. The write's
+// metadata is still taken, so the sender's later writes aren't held up
+// waiting for one that will never be applied here
+func refuseTooLarge(c *gin.Context, metadata map[string]int, sender string) {
+	err := kvsDb.putJustMetadata(metadata, sender)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Key or value is over the size limits"})
+}
+
+func repDeleteKey(c *gin.Context) {
+	// get data from request body
+	data, err := parseKeysFromBodyWithOptional(c, []string{"key", "causal-metadata", "sender"}, "version")
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	key := data["key"].(string)
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+
+	sender := data["sender"].(string)
+
+	// older nodes don't send the version, and it's worked out from metadata
+	var version int64
+	if val, ok := data["version"].(float64); ok {
+		version = int64(val)
+	}
+
+	// Check if correct shard
+	// if incorrect just update causal metaData, but don't actually stor the data
+	shardId := ring.GetShardId(key)
+	if shardId != localShardId {
+		//just update the meta data and check error
+		err = kvsDb.putJustMetadata(metadata, sender)
+		if err == ErrInvalidMetadata {
+			sendServiceUnavailable(c)
+		} else if err != nil {
+			c.JSON(123, gin.H{"error": err.Error()})
+		}
+		c.JSON(http.StatusOK, gin.H{"result": "complete"})
+		return
+	}
+
+	// add data to kvs database
+	_, err = kvsDb.DeleteData(key, WriteCondition{}, version, metadata, sender)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrKeyNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist"})
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// respond with success
+	c.JSON(http.StatusOK, gin.H{"result": "deleted"})
+}
+
+func repAddNodeToShard(c *gin.Context) {
+	// get shard-id and socket-address of the node from the json data
+	data, err := parseKeysFromBody(c, "shard-id", "socket-address")
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+	}
+	shardId := int(data["shard-id"].(float64))
+	nodeAddress, _ := data["socket-address"].(string)
+
+	// add the node to the local ring
+	ring.AddNodeToShard(shardId, nodeAddress)
+
+	if nodeAddress == localAddress {
+		localShardId = shardId
+		// in raft mode the shard's leader sends it the data instead
+		if kvsDb.config.Replication == ReplicationRaft {
+			startShardRaft()
+		} else {
+			go getShardData(shardId)
+		}
+	} else if raft := kvsDb.Raft(); raft != nil && shardId == localShardId {
+		raft.AddPeer(nodeAddress)
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "added"})
+}
+
+func repReshard(c *gin.Context) {
+	oldRing := ring
+	oldRing.Lock()
+	defer oldRing.Unlock()
+
+	type TempSt struct {
+		Ring Ring `json:"ring"`
+	}
+	var newRing TempSt
+	reqBody, _ := io.ReadAll(c.Request.Body)
+	json.Unmarshal(reqBody, &newRing)
+
+	ring = &newRing.Ring
+
+	localShardId = ring.GetShardIdFromNode(localAddress)
+
+	go shuffleKvsData()
+	c.JSON(http.StatusOK, gin.H{"result": "resharded"})
+}
+
+func repPutKeyNoChecks(c *gin.Context) {
+	// get data from request body
+	data, err := parseKeysFromBodyWithOptional(c, []string{"key"}, "entry", "value")
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	if data["entry"] == nil && data["value"] == nil {
+		c.JSON(123, gin.H{"error": "not all keys present"})
+		return
+	}
+	key := data["key"].(string)
+	entry := getEntryOrValueFromInterface(data)
+
+	if limits.checkKey(key) != nil || limits.checkEntry(entry) != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Key or value is over the size limits"})
+		return
+	}
+
+	// add data to kvs database
+	err = kvsDb.PutDataNoChecks(key, entry)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// respond with success
+	c.JSON(http.StatusOK, gin.H{"result": "added"})
+}
+
+// Sends another shard this node's copy of a key the current shard hash
+// doesn't put here, while this node still has keys left to move. Once
+// it's moved them all it answers that it has
+func repGetUnmigratedKey(c *gin.Context) {
+	if shardMigration.isFinished() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist", "migrated": true})
+		return
+	}
+
+	entry, _, err := kvsDb.GetData(c.Param("key"), nil)
+	if err == ErrKeyNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entry": entry})
+}
+
+// Prepares this shard's part of a transaction for its coordinator, and
+// copies it to the rest of the shard before voting to commit
+func repPrepareTxn(c *gin.Context) {
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// get data from request body
+	data, err := parseKeysFromBodyWithOptional(c, []string{"txn", "causal-metadata"}, "reads", "conditions")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	txn := getTxnFromInterface(data["txn"])
+	metadata := getMetadataFromInterface(data["causal-metadata"])
+	if limits.checkWrites(txn.Writes) != nil {
+		sendValueTooLarge(c)
+		return
+	}
+
+	reads, err := parseTxnReads(data["reads"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	conds, err := parseTxnConditions(data["conditions"])
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// prepare and check for errors
+	values, currMetadata, err := kvsDb.PrepareTxn(txn, reads, conds, metadata)
+	if err == ErrInvalidMetadata {
+		sendServiceUnavailable(c)
+		return
+	} else if err == ErrPreconditionFailed {
+		sendPreconditionFailed(c, currMetadata)
+		return
+	} else if err == ErrOutOfMemory {
+		sendInsufficientStorage(c, currMetadata)
+		return
+	} else if err == ErrKeyLocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key is locked by another transaction", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrTxnCommitted || err == ErrTxnAborted {
+		c.JSON(http.StatusGone, gin.H{"error": "Transaction has already finished", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	// the shard only votes yes once every replica holds the transaction
+	err = broadcastPreparedTxn(txn)
+	if err != nil {
+		abortErr := abortPreparedTxn(txn.Id)
+		if abortErr != nil {
+			log.Println(abortErr)
+		}
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Transaction couldn't be prepared on every replica of the shard; try again later", "causal-metadata": currMetadata})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reads": values, "causal-metadata": currMetadata})
+}
+
+func repCommitTxn(c *gin.Context) {
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// get data from request body
+	data, err := parseKeysFromBody(c, "txn-id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	txnId, _ := data["txn-id"].(string)
+
+	currMetadata, err := commitPreparedTxn(txnId)
+	if err == ErrTxnNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not prepared", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrTxnAborted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Transaction was aborted", "causal-metadata": currMetadata})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "committed", "causal-metadata": currMetadata})
+}
+
+func repAbortTxn(c *gin.Context) {
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
+		return
+	}
+
+	// get data from request body
+	data, err := parseKeysFromBody(c, "txn-id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	txnId, _ := data["txn-id"].(string)
+
+	err = abortPreparedTxn(txnId)
+	if err == ErrTxnCommitted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Transaction was committed"})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "aborted"})
+}
+
+// Returns the coordinator's record of a transaction, or this node's copy of
+// it, for a shard that's been holding it prepared for too long
+func repGetTxn(c *gin.Context) {
+	txnId := c.Param("id")
+	if !isValidTxnId(txnId) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction does not exist"})
+		return
+	}
+
+	record, err := readTxnRecord(txnDir(), txnId)
+	if err == ErrTxnNotFound {
+		record, err = readTxnRecord(txnCopyDir(), txnId)
+	}
+	if err == ErrTxnNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction does not exist"})
+		return
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, record)
+}
+
+// Stores a copy of the decided record of a coordinator on this node's shard
+func repPutTxnRecord(c *gin.Context) {
+	var body struct {
+		Record TxnRecord `json:"record"`
+	}
+	err := c.ShouldBindJSON(&body)
+	if err != nil || !isValidTxnId(body.Record.Id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request"})
+		return
+	}
+
+	err = storeTxnRecordCopy(body.Record)
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "stored"})
+}
+
+// Drops the copy of a record once its coordinator has told every shard
+func repDropTxnRecord(c *gin.Context) {
+	// get data from request body
+	data, err := parseKeysFromBody(c, "txn-id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	txnId, _ := data["txn-id"].(string)
+	if !isValidTxnId(txnId) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction does not exist"})
+		return
+	}
+
+	err = removeTxnRecord(txnCopyDir(), txnId)
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "removed"})
+}
+
+// Answers another shard that can't reach a transaction's coordinator with
+// how the transaction stands on this shard, aborting it if it isn't prepared
+func repTerminateTxn(c *gin.Context) {
+	// in raft mode only the shard's leader serves it
+	if proxyToRaftLeader(c) {
 		return
 	}
 
-	// get the json data from the body
-	data, err := parseKeysFromBody(c, "causal-metadata")
+	// get data from request body
+	data, err := parseKeysFromBody(c, "txn-id")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "causal-metadata not specified"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	metadata := getMetadataFromInterface(data["causal-metadata"])
+	txnId, _ := data["txn-id"].(string)
 
-	// put key and check for errors
-	currMetadata, err := kvsDb.DeleteData(key, metadata, localAddress)
-	if err == ErrInvalidMetadata {
-		sendServiceUnavailable(c)
+	state, err := terminateTxn(txnId)
+	if err == ErrAbortNotReplicated {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Transaction couldn't be aborted on every replica of the shard; try again later"})
 		return
-	} else if err == ErrKeyNotFound {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist"})
+	} else if err == ErrNotLeader || err == ErrRaftNotReady {
+		sendNoLeader(c)
+		return
+	} else if err == ErrRaftTimeout {
+		sendRaftTimeout(c)
 		return
 	} else if err != nil {
 		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
 
-	// send success to client
-	c.JSON(http.StatusOK, gin.H{"result": "deleted", "causal-metadata": currMetadata})
-
-	// broadcast
-	go broadcastKvsDelete(key, metadata, localAddress)
-}
-
-/// --- shard routes ---
-
-// Client to Node Endpoints
-func getNodeShardId(c *gin.Context) {
-	if localShardId != -1 {
-		c.JSON(http.StatusOK, gin.H{"node-shard-id": localShardId})
-	} else {
-		c.JSON(123, gin.H{"error": "Node not assigned to a Shard"})
-	}
+	c.JSON(http.StatusOK, gin.H{"state": state})
 }
 
-func getShardIds(c *gin.Context) {
-	// Since the Shard IDs are just their index in the ring.Shards slice
-	// we must create a slice of numbers from 0 to number of shards
-	idArr := make([]int, len(ring.Shards))
-	for i := 0; i < len(idArr); i++ {
-		idArr[i] = i
+// Returns how a transaction ended on this replica, for the shard's primary
+// when it's been holding it prepared for too long
+func repGetFinishedTxn(c *gin.Context) {
+	finished, exists := kvsDb.FinishedTxn(c.Param("id"))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction hasn't finished here"})
+		return
 	}
-
-	// Respond with 200 OK and the idArr
-	c.JSON(http.StatusOK, gin.H{"shard-ids": idArr})
+	c.JSON(http.StatusOK, finished)
 }
 
-func getShardMembers(c *gin.Context) {
-	// get ID from URL
-	id, err := parseShardIdFromURL(c)
+// Stores a copy of a transaction prepared by this shard's primary
+func repAcceptTxn(c *gin.Context) {
+	// get data from request body
+	data, err := parseKeysFromBody(c, "txn")
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
 
-	// turn the map of replicas (aka shard members) into a slice so the JSON formatts correctly
-	members := make([]string, len(ring.Shards[id].Replicas))
+	txn := getTxnFromInterface(data["txn"])
+	if limits.checkWrites(txn.Writes) != nil {
+		sendValueTooLarge(c)
+		return
+	}
 
-	i := 0
-	for key := range ring.Shards[id].Replicas {
-		members[i] = key
-		i++
+	err = kvsDb.AcceptPreparedTxn(txn)
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
 	}
 
-	// respond with members
-	c.JSON(http.StatusOK, gin.H{"shard-members": members})
+	c.JSON(http.StatusOK, gin.H{"result": "prepared"})
 }
 
-func getShardKeyCount(c *gin.Context) {
-	// get ID from URL
-	id, err := parseShardIdFromURL(c)
+// Drops a transaction aborted by this shard's primary
+func repDropTxn(c *gin.Context) {
+	// get data from request body
+	data, err := parseKeysFromBody(c, "txn-id")
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
+	txnId, _ := data["txn-id"].(string)
 
-	if id != localShardId {
-		proxyToShard(c, "/shard/key-count/"+strconv.Itoa(id), id)
+	err = kvsDb.AbortTxn(txnId)
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"shard-key-count": len(kvsDb.Data)})
+	c.JSON(http.StatusOK, gin.H{"result": "aborted"})
 }
 
-func addNodeToShard(c *gin.Context) {
-	/// ----Parsing Data----
-	// get shard ID from URL
-	shardId, err := parseShardIdFromURL(c)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "ID not found"})
+// Answers a candidate in this node's raft group asking for its vote
+func repRaftVote(c *gin.Context) {
+	raft := kvsDb.Raft()
+	if raft == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node isn't in a raft group"})
 		return
 	}
 
-	// get the json data from the body
-	data, err := parseKeysFromBody(c, "socket-address")
+	var req RaftVoteRequest
+	err := c.ShouldBindJSON(&req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no address specified"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	nodeAddress := data["socket-address"].(string)
 
-	// check if nodeAddress is in the view
-	if !view.Contains(nodeAddress) {
-		c.JSON(http.StatusNotFound, gin.H{"error": "socket-address not found"})
+	c.JSON(http.StatusOK, raft.HandleVote(req))
+}
+
+// Appends entries sent by the leader of this node's raft group, or just
+// takes note of the leader if there are none
+func repRaftAppend(c *gin.Context) {
+	raft := kvsDb.Raft()
+	if raft == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node isn't in a raft group"})
 		return
 	}
 
-	/// ----Adding Node Local----
-	// add the node the the local shard
-	ring.AddNodeToShard(shardId, nodeAddress)
-
-	// if the nodeAddress is this node start cloning data
-	if nodeAddress == localAddress {
-		localShardId = shardId
-		go getShardData(shardId)
+	var req RaftAppendRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	// Respond to client
-	c.JSON(http.StatusOK, gin.H{"result": "node added to shard"})
 
-	go broadcastAddNodeToShard(nodeAddress, shardId)
+	c.JSON(http.StatusOK, raft.HandleAppend(req))
 }
 
-func putReshard(c *gin.Context) {
-	/// ----Parsing Data----
-	// get the json data from the body
-	data, err := parseKeysFromBody(c, "shard-count")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "no shard count specified"})
+// Replaces the kvs with a snapshot sent by the leader of this node's raft
+// group, for a node too far behind to catch up from the log
+func repRaftSnapshot(c *gin.Context) {
+	if kvsDb.Raft() == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node isn't in a raft group"})
 		return
 	}
-	shardCount := int(data["shard-count"].(float64))
 
-	/// ----Resharding Local----
-	// reshard local ring and check for insufficient node count
-	ring, err = ring.Reshard(shardCount, view.Nodes)
-	if err == ErrNotEnoughNodes {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Not enough nodes to provide fault tolerance with requested shard count"})
+	var req RaftSnapshotRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+
+	resp, err := kvsDb.InstallRaftSnapshot(req)
 	if err != nil {
 		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	localShardId = ring.GetShardIdFromNode(localAddress)
-
-	// Respond to client
-	c.JSON(http.StatusOK, gin.H{"result": "resharded"})
+// Sends the children digests of the asked for nodes of this node's Merkle
+// tree, along with the clock the tree was built at
+func repAntiEntropyTree(c *gin.Context) {
+	req, err := parseAntiEntropyRequest(c)
+	if err == ErrWrongShard {
+		c.JSON(http.StatusConflict, gin.H{"error": "Node is on a different shard"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	// recheck data with new shards
-	go shuffleKvsData()
+	tree, metadata, err := kvsDb.MerkleHashes()
+	if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	hashes, err := childHashes(tree, req.Prefixes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	/// Broadcast
-	go broadcastReshard(ring)
+	c.JSON(http.StatusOK, gin.H{
+		"hashes":          hashes,
+		"causal-metadata": metadata,
+	})
 }
 
-// ------------ Node to Node endpoints -----------------
+// Sends this node's copy of every key in the asked for leaves of its
+// Merkle tree
+func repAntiEntropyKeys(c *gin.Context) {
+	req, err := parseAntiEntropyRequest(c)
+	if err == ErrWrongShard {
+		c.JSON(http.StatusConflict, gin.H{"error": "Node is on a different shard"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-// adds keys to kvsDb but with less error checking and does not broadcast
-func repPutKey(c *gin.Context) {
-	// get data from request body
-	data, err := parseKeysFromBody(c, "key", "value", "causal-metadata", "sender")
+	items, err := kvsDb.LeafItems(req.Prefixes)
 	if err != nil {
 		c.JSON(123, gin.H{"error": err.Error()})
+		return
 	}
-	key := data["key"].(string)
-	value := data["value"]
-	metadata := getMetadataFromInterface(data["causal-metadata"])
 
-	sender := data["sender"].(string)
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
 
-	// Check if correct shard
-	// if incorrect just update causal metaData, but don't actually store the data
-	shardId := ring.GetShardId(key)
-	if shardId != localShardId {
-		//just update the meta data and check error
-		err = kvsDb.putJustMetadata(metadata, sender)
-		if err == ErrInvalidMetadata {
-			sendServiceUnavailable(c)
-		} else if err != nil {
-			c.JSON(123, gin.H{"error": err.Error()})
-		}
-		c.JSON(http.StatusOK, gin.H{"result": "complete"})
+// Takes the newer copies of keys a replica found during anti-entropy
+func repAntiEntropyRepair(c *gin.Context) {
+	req, err := parseAntiEntropyRequest(c)
+	if err == ErrWrongShard {
+		c.JSON(http.StatusConflict, gin.H{"error": "Node is on a different shard"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// add data to kvs database
-	_, _, err = kvsDb.PutData(key, value, metadata, sender)
-	if err == ErrInvalidMetadata {
-		sendServiceUnavailable(c)
-		return
-	} else if err != nil {
+	repaired, complete, err := applyRepairs(req)
+	if err != nil {
 		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
 
-	// respond with success
-	c.JSON(http.StatusOK, gin.H{"result": "added"})
+	c.JSON(http.StatusOK, gin.H{
+		"repaired": repaired,
+		"complete": complete,
+	})
 }
 
-func repDeleteKey(c *gin.Context) {
-	// get data from request body
-	data, err := parseKeysFromBody(c, "key", "causal-metadata", "sender")
+// Scans this node's shard for another node's getKeys
+func repScanKeys(c *gin.Context) {
+	query, err := parseScanQuery(c)
 	if err != nil {
-		c.JSON(123, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	key := data["key"].(string)
-	metadata := getMetadataFromInterface(data["causal-metadata"])
-
-	sender := data["sender"].(string)
+	query.After = c.Query("after")
 
-	// Check if correct shard
-	// if incorrect just update causal metaData, but don't actually stor the data
-	shardId := ring.GetShardId(key)
-	if shardId != localShardId {
-		//just update the meta data and check error
-		err = kvsDb.putJustMetadata(metadata, sender)
-		if err == ErrInvalidMetadata {
-			sendServiceUnavailable(c)
-		} else if err != nil {
-			c.JSON(123, gin.H{"error": err.Error()})
-		}
-		c.JSON(http.StatusOK, gin.H{"result": "complete"})
+	metadata, err := parseOptionalMetadata(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// add data to kvs database
-	_, err = kvsDb.DeleteData(key, metadata, sender)
+	page, err := kvsDb.ScanKeys(query, metadata)
 	if err == ErrInvalidMetadata {
 		sendServiceUnavailable(c)
 		return
-	} else if err == ErrKeyNotFound {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist"})
-		return
 	} else if err != nil {
 		c.JSON(123, gin.H{"error": err.Error()})
 		return
 	}
 
-	// respond with success
-	c.JSON(http.StatusOK, gin.H{"result": "deleted"})
+	c.JSON(http.StatusOK, page)
 }
 
-func repAddNodeToShard(c *gin.Context) {
-	// get shard-id and socket-address of the node from the json data
-	data, err := parseKeysFromBody(c, "shard-id", "socket-address")
-	if err != nil {
-		c.JSON(123, gin.H{"error": err.Error()})
+// Streams this node's changes for another node's watchKeys. Each change is
+// one event, so a batch arrives whole
+func repWatchKeys(c *gin.Context) {
+	var cursor map[string]int
+	if encoded := c.Query("cursor"); encoded != "" {
+		var err error
+		cursor, err = decodeWatchCursor(encoded)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 	}
-	shardId := int(data["shard-id"].(float64))
-	nodeAddress, _ := data["socket-address"].(string)
 
-	// add the node to the local ring
-	ring.AddNodeToShard(shardId, nodeAddress)
+	if localShardId < 0 || localShardId >= len(ring.Shards) {
+		c.JSON(123, gin.H{"error": "node is not in a shard"})
+		return
+	}
 
-	if nodeAddress == localAddress {
-		localShardId = shardId
-		go getShardData(shardId)
+	w, err := kvsDb.Watch(cursor, watchMatcher(c.Query("key"), c.Query("prefix")), shardSenders(localShardId))
+	if err == ErrCursorTooOld {
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	defer kvsDb.Unwatch(w)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Status(http.StatusOK)
+
+	heartbeat := time.NewTicker(WATCH_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change, ok := <-w.ch:
+			if !ok {
+				return
+			}
+			writeEvent(c, "", "change", change)
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
 	}
-	c.JSON(http.StatusOK, gin.H{"result": "added"})
 }
 
-func repReshard(c *gin.Context) {
-	oldRing := ring
-	oldRing.Lock()
-	defer oldRing.Unlock()
-
-	type TempSt struct {
-		Ring Ring `json:"ring"`
+// Saves a consumer committed on the shard's primary
+func repSaveConsumer(c *gin.Context) {
+	var consumer ChangeConsumer
+	err := c.ShouldBindJSON(&consumer)
+	if err != nil || !consumerNamePattern.MatchString(consumer.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid consumer"})
+		return
 	}
-	var newRing TempSt
-	reqBody, _ := io.ReadAll(c.Request.Body)
-	json.Unmarshal(reqBody, &newRing)
-
-	ring = &newRing.Ring
-
-	localShardId = ring.GetShardIdFromNode(localAddress)
 
-	go shuffleKvsData()
-	c.JSON(http.StatusOK, gin.H{"result": "resharded"})
-}
-
-func repPutKeyNoChecks(c *gin.Context) {
-	// get data from request body
-	data, err := parseKeysFromBody(c, "key", "value")
+	err = kvsDb.changes.SaveConsumer(consumer)
 	if err != nil {
 		c.JSON(123, gin.H{"error": err.Error()})
+		return
 	}
-	key := data["key"].(string)
-	value := data["value"]
+	c.JSON(http.StatusOK, gin.H{"result": "saved"})
+}
 
-	// add data to kvs database
-	kvsDb.PutDataNoChecks(key, value)
+func repDeleteConsumer(c *gin.Context) {
+	name := c.Param("name")
+	if !consumerNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidConsumerName.Error()})
+		return
+	}
 
-	// respond with success
-	c.JSON(http.StatusOK, gin.H{"result": "added"})
+	err := kvsDb.changes.RemoveConsumer(name)
+	if err != nil && err != ErrConsumerNotFound {
+		c.JSON(123, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "deleted"})
 }
 
 func repCloneRing(c *gin.Context) {
@@ -500,3 +2185,13 @@ func testRingDump(c *gin.Context) {
 		"ring": ring,
 	})
 }
+func testRaftDump(c *gin.Context) {
+	raft := kvsDb.Raft()
+	if raft == nil {
+		c.JSON(http.StatusOK, gin.H{"raft": nil})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"raft": raft.Status(),
+	})
+}
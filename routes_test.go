@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Raw values go back byte for byte with their content type, and show up
+// base64 encoded in JSON responses
+func TestRawValueRoundTrip(t *testing.T) {
+	txnTestShard(t)
+	defaults := limits
+	limits = parseLimits()
+	defer func() { limits = defaults }()
+
+	router := gin.New()
+	router.PUT("/kvs/:key", putKey)
+	router.GET("/kvs/:key", getKey)
+	router.GET("/kvs", getKeys)
+	body := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, '\n'}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/kvs/img", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "image/png")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("put got status %d: %s", w.Code, w.Body)
+	}
+	metadata := w.Header().Get(CausalMetadataHeader)
+	if metadata == "" {
+		t.Fatal("put didn't send its metadata back in a header")
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/kvs/img", nil)
+	req.Header.Set(CausalMetadataHeader, metadata)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), body) {
+		t.Errorf("get got status %d and body %q, want %q", w.Code, w.Body.Bytes(), body)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("get got content type %q", contentType)
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/kvs?values=true", bytes.NewReader([]byte(`{"causal-metadata": `+metadata+`}`)))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	var page ScanPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("scan got status %d: %s", w.Code, w.Body)
+	}
+	want := map[string]interface{}{"content-type": "image/png", "base64": base64.StdEncoding.EncodeToString(body)}
+	if !reflect.DeepEqual(page.Values["img"], want) {
+		t.Errorf("scan got value %v, want %v", page.Values["img"], want)
+	}
+}
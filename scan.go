@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Page sizes for key scans
+const (
+	DefaultScanLimit = 100
+	MaxScanLimit     = 1000
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// What to scan: the keys in [Start, End) that sort after After. An empty
+// End means no upper bound
+type ScanQuery struct {
+	Start  string
+	End    string
+	After  string
+	Limit  int
+	Values bool // include each key's value
+}
+
+// One page of scan results, in key order
+type ScanPage struct {
+	Keys     []string               `json:"keys"`
+	Values   map[string]interface{} `json:"values,omitempty"`
+	More     bool                   `json:"more"` // keys are left past the last one
+	Metadata map[string]int         `json:"causal-metadata"`
+}
+
+// Returns up to query.Limit live keys from the kvs, once the causal
+// dependencies in metadata are satisfied
+func (kvs *KeyValStoreDatabase) ScanKeys(query ScanQuery, metadata map[string]int) (ScanPage, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	// Check metadata
+	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
+	if !metadataValid {
+		return ScanPage{}, ErrInvalidMetadata
+	}
+
+	// resume past the cursor rather than from the start of the range
+	start := query.Start
+	if query.After >= start {
+		start = query.After
+	}
+
+	page := ScanPage{Keys: make([]string, 0)}
+	if query.Values {
+		page.Values = make(map[string]interface{})
+	}
+
+	// expired keys are listed until the primary's delete of them gets here,
+	// like GetData serves them
+	err := kvs.engine.Scan(start, query.End, func(key string, entry KeyEntry) bool {
+		if key == query.After {
+			return true
+		}
+		if len(page.Keys) == query.Limit {
+			page.More = true
+			return false
+		}
+		page.Keys = append(page.Keys, key)
+		if query.Values {
+			page.Values[key] = entry.ClientValue()
+		}
+		return true
+	})
+	if err != nil {
+		return ScanPage{}, err
+	}
+
+	page.Metadata = kvs.copyMetadata()
+	return page, nil
+}
+
+// Scans every shard at once and merges the results into a single ordered
+// page. Each shard is asked for a full page, since any one of them might
+// hold every key on it. The returned metadata covers every shard
+func scanAllShards(query ScanQuery, metadata map[string]int) (ScanPage, error) {
+	pages := make([]ScanPage, len(ring.Shards))
+	errs := make([]error, len(ring.Shards))
+
+	var wg sync.WaitGroup
+	for i := range ring.Shards {
+		wg.Add(1)
+		go func(shardId int) {
+			defer wg.Done()
+			pages[shardId], errs[shardId] = scanShard(shardId, query, metadata)
+		}(i)
+	}
+	wg.Wait()
+
+	merged := ScanPage{Keys: make([]string, 0), Metadata: make(map[string]int)}
+	if query.Values {
+		merged.Values = make(map[string]interface{})
+	}
+	for i, page := range pages {
+		if errs[i] != nil {
+			return ScanPage{}, errs[i]
+		}
+		merged.Keys = append(merged.Keys, page.Keys...)
+		merged.More = merged.More || page.More
+		for key, value := range page.Values {
+			merged.Values[key] = value
+		}
+		mergeMetadata(merged.Metadata, page.Metadata)
+	}
+
+	// keys only live on one shard, except briefly while a reshard moves them
+	sort.Strings(merged.Keys)
+	merged.Keys = dedupeSortedKeys(merged.Keys)
+
+	if len(merged.Keys) > query.Limit {
+		for _, key := range merged.Keys[query.Limit:] {
+			delete(merged.Values, key)
+		}
+		merged.Keys = merged.Keys[:query.Limit]
+		merged.More = true
+	}
+	return merged, nil
+}
+
+// Scans a single shard, locally if it's ours or on one of its replicas if not
+func scanShard(shardId int, query ScanQuery, metadata map[string]int) (ScanPage, error) {
+	if shardId == localShardId {
+		return kvsDb.ScanKeys(query, metadata)
+	}
+
+	params := url.Values{}
+	params.Set("start", query.Start)
+	params.Set("end", query.End)
+	params.Set("after", query.After)
+	params.Set("limit", strconv.Itoa(query.Limit))
+	params.Set("values", strconv.FormatBool(query.Values))
+
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"causal-metadata": metadata,
+	})
+
+	// not retried, so the client hears about unmet dependencies right away
+	res, err := sendMsgToGroup(
+		removeLocalAddressFromMap(ring.Shards[shardId].Replicas),
+		"/rep/scan?"+params.Encode(),
+		"GET",
+		"application/json",
+		jsonData,
+		false)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusServiceUnavailable {
+		return ScanPage{}, ErrInvalidMetadata
+	}
+
+	var page struct {
+		ScanPage
+		Error string `json:"error"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&page)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return ScanPage{}, errors.New(page.Error)
+	}
+	return page.ScanPage, nil
+}
+
+func dedupeSortedKeys(keys []string) []string {
+	if len(keys) == 0 {
+		return keys
+	}
+	out := keys[:1]
+	for _, key := range keys[1:] {
+		if key != out[len(out)-1] {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// Returns the range of keys starting with prefix, narrowed to [start, end)
+func prefixRange(prefix, start, end string) (string, string) {
+	if prefix > start {
+		start = prefix
+	}
+
+	// the smallest key past every key with the prefix: bump the last byte
+	// that can be bumped and cut off the rest. Prefixes of only 0xff bytes
+	// have no upper bound
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			prefixEnd := string(b[:i+1])
+			if end == "" || prefixEnd < end {
+				end = prefixEnd
+			}
+			break
+		}
+	}
+	return start, end
+}
+
+// Cursors are the last key of the previous page, opaque to the client
+func encodeScanCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeScanCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	return string(key), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func scanTestKvs(t *testing.T, keys ...string) {
+	txnTestShard(t)
+	for _, key := range keys {
+		if err := kvsDb.PutDataNoChecks(key, KeyEntry{Value: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Paging through a range with each page's cursor lists every key in it
+// once, in order
+func TestScanKeysPagination(t *testing.T) {
+	scanTestKvs(t, "e", "a", "c", "b", "d", "f")
+
+	tests := []struct {
+		name       string
+		start, end string
+		limit      int
+		want       [][]string
+	}{
+		{"whole range", "", "", 4, [][]string{{"a", "b", "c", "d"}, {"e", "f"}}},
+		{"pages that end on the last key", "", "", 3, [][]string{{"a", "b", "c"}, {"d", "e", "f"}}},
+		{"bounded range", "b", "e", 2, [][]string{{"b", "c"}, {"d"}}},
+		{"empty range", "x", "", 2, [][]string{{}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := ScanQuery{Start: test.start, End: test.end, Limit: test.limit}
+			for i, want := range test.want {
+				page, err := kvsDb.ScanKeys(query, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(page.Keys, want) {
+					t.Errorf("page %d got keys %v, want %v", i, page.Keys, want)
+				}
+				if wantMore := i < len(test.want)-1; page.More != wantMore {
+					t.Errorf("page %d got more %v, want %v", i, page.More, wantMore)
+				}
+				if !page.More {
+					break
+				}
+
+				// clients only see the cursor
+				query.After, err = decodeScanCursor(encodeScanCursor(page.Keys[len(page.Keys)-1]))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Keys written behind the cursor aren't listed again, and ones ahead of it are
+func TestScanKeysCursorAcrossWrites(t *testing.T) {
+	scanTestKvs(t, "a", "c", "e")
+
+	page, err := kvsDb.ScanKeys(ScanQuery{Limit: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "d"} {
+		if err := kvsDb.PutDataNoChecks(key, KeyEntry{Value: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err = kvsDb.ScanKeys(ScanQuery{After: page.Keys[len(page.Keys)-1], Limit: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"d", "e"}; !reflect.DeepEqual(page.Keys, want) {
+		t.Errorf("got keys %v, want %v", page.Keys, want)
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	tests := []struct {
+		name               string
+		prefix, start, end string
+		wantStart, wantEnd string
+	}{
+		{"prefix alone", "user:", "", "", "user:", "user;"},
+		{"start past the prefix", "user:", "user:5", "", "user:5", "user;"},
+		{"end inside the prefix", "user:", "", "user:5", "user:", "user:5"},
+		{"trailing 0xff bytes", "a\xff\xff", "", "", "a\xff\xff", "b"},
+		{"only 0xff bytes", "\xff", "", "", "\xff", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start, end := prefixRange(test.prefix, test.start, test.end)
+			if start != test.wantStart || end != test.wantEnd {
+				t.Errorf("got [%q, %q), want [%q, %q)", start, end, test.wantStart, test.wantEnd)
+			}
+		})
+	}
+}
+
+// A prefix listing merges every shard's keys and values into one page,
+// cut to the limit
+func TestScanAllShardsByPrefix(t *testing.T) {
+	scanTestKvs(t, "user:1", "user:4", "other")
+	remote := txnTestServer(t, http.StatusOK, ScanPage{
+		Keys:     []string{"user:2", "user:3", "user:4"},
+		Values:   map[string]interface{}{"user:2": "user:2", "user:3": "user:3", "user:4": "user:4"},
+		Metadata: map[string]int{"n1": 3},
+	})
+	ring = NewRing(2, map[string]struct{}{"n0": {}})
+	ring.Shards[1].Replicas[remote] = struct{}{}
+
+	query := ScanQuery{Limit: 3, Values: true}
+	query.Start, query.End = prefixRange("user:", "", "")
+	page, err := scanAllShards(query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"user:1", "user:2", "user:3"}; !reflect.DeepEqual(page.Keys, want) {
+		t.Errorf("got keys %v, want %v", page.Keys, want)
+	}
+	if want := map[string]interface{}{"user:1": "user:1", "user:2": "user:2", "user:3": "user:3"}; !reflect.DeepEqual(page.Values, want) {
+		t.Errorf("got values %v, want %v", page.Values, want)
+	}
+	if !page.More {
+		t.Error("got no more keys with user:4 left")
+	}
+	if page.Metadata["n1"] != 3 {
+		t.Errorf("got metadata %v, want the other shard's clock in it", page.Metadata)
+	}
+}
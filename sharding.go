@@ -5,6 +5,7 @@ import (
 	"hash/crc32"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -79,7 +80,17 @@ func NewRing(numShards int, nodes map[string]struct{}) *Ring {
 
 // Given a piece of data, this function returns the id of the shard it should go to
 func (r *Ring) GetShardId(key string) int {
-	i := r.search(key)
+	return r.shardIdByHash(key, ShardHashVersion)
+}
+
+// Returns the id of the shard the given version of the shard hash puts
+// key on (see ShardHashVersion)
+func (r *Ring) shardIdByHash(key string, hashVersion int) int {
+	id := hashTag(key)
+	if hashVersion < 2 {
+		id = key
+	}
+	i := r.search(id)
 	if i >= len(r.VirtShards) {
 		i = 0
 	}
@@ -96,6 +107,51 @@ func (r *Ring) search(id string) int {
 	return sort.Search(len(r.VirtShards), searchfn)
 }
 
+// Bump this whenever the way keys are placed on shards changes. Each node
+// saves the version its keys were placed with next to them, and moves them
+// on startup if it's older
+//
+//	1: the whole key is hashed
+//	2: only a key's hash tag is hashed, if it has one
+const ShardHashVersion = 2
+
+const shardHashFileName = "shard-hash"
+
+// Returns the part of key that picks its shard. If the key holds a hash tag,
+// a non empty substring between the first '{' and the first '}' after it,
+// only the tag is hashed, so "user:{42}:cart" and "user:{42}:profile" are
+// always on the same shard. Otherwise the whole key is hashed
+func hashTag(key string) string {
+	tag, ok := findHashTag(key)
+	if !ok {
+		return key
+	}
+	return tag
+}
+
+func findHashTag(key string) (string, bool) {
+	open := strings.IndexByte(key, '{')
+	if open < 0 {
+		return "", false
+	}
+	end := strings.IndexByte(key[open+1:], '}')
+	if end <= 0 {
+		return "", false
+	}
+	return key[open+1 : open+1+end], true
+}
+
+// Returns the shard every key starting with prefix is on, or -1 if they
+// could be on any of them. Only a prefix that holds a whole hash tag pins
+// its keys to one shard
+func (r *Ring) GetShardIdFromPrefix(prefix string) int {
+	_, ok := findHashTag(prefix)
+	if !ok {
+		return -1
+	}
+	return r.GetShardId(prefix)
+}
+
 // Finds the id of the shard a node belongs to, If node not found return -1
 func (r *Ring) GetShardIdFromNode(node string) int {
 	for i := 0; i < len(r.Shards); i++ {
@@ -121,6 +177,19 @@ func (r *Ring) Reshard(numShards int, nodes map[string]struct{}) (*Ring, error)
 	return newRing, nil
 }
 
+// Returns the replica with the lowest address, or "" if the shard is empty.
+// Every node agrees on it without talking to each other, so it's used to
+// pick which replica does shard wide background work
+func (s Shard) Primary() string {
+	primary := ""
+	for node := range s.Replicas {
+		if primary == "" || node < primary {
+			primary = node
+		}
+	}
+	return primary
+}
+
 func (r *Ring) AddNodeToShard(shardId int, node string) {
 	r.Lock()
 	defer r.Unlock()
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHashTag(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"user:42", "user:42"},
+		{"user:{42}:cart", "42"},
+		{"{42}", "42"},
+		{"user:{}:cart", "user:{}:cart"},
+		{"user:{42", "user:{42"},
+		{"user:}42{", "user:}42{"},
+		{"{a}{b}", "a"},
+	}
+
+	for _, test := range tests {
+		if got := hashTag(test.key); got != test.want {
+			t.Errorf("hashTag(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestReadShardHashVersion(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string // "" for no file
+		empty bool
+		want  int
+	}{
+		{"new data directory", "", true, ShardHashVersion},
+		{"keys from before hash tags", "", false, 1},
+		{"saved version", "2", false, 2},
+		{"saved version with newline", "1\n", false, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if test.file != "" {
+				err := os.WriteFile(filepath.Join(dir, shardHashFileName), []byte(test.file), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := readShardHashVersion(dir, test.empty)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got version %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// Sets this node up as the only replica of shard 0 of a 2 shard ring, with
+// the given replicas on shard 1, and returns a hash tagged key the old
+// shard hash put on shard oldShard and the current one on the other shard
+func migrationTestShard(t *testing.T, oldShard int, replicas ...string) string {
+	txnTestShard(t)
+	ring = NewRing(2, map[string]struct{}{"n0": {}})
+	for _, replica := range replicas {
+		ring.Shards[1].Replicas[replica] = struct{}{}
+	}
+	shardMigration = &ShardMigration{moved: make(map[int]bool)}
+
+	for i := 0; ; i++ {
+		key := "user:{" + strconv.Itoa(i) + "}:cart"
+		if ring.shardIdByHash(key, 1) == oldShard && ring.GetShardId(key) != oldShard {
+			return key
+		}
+	}
+}
+
+func TestMoveMisplacedKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantLeft int
+	}{
+		{"every replica took the key", []int{http.StatusOK, http.StatusOK}, 0},
+		{"a replica turned it down", []int{http.StatusOK, http.StatusInternalServerError}, 1},
+		{"a replica is down", []int{http.StatusOK, 0}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replicas := make([]string, 0)
+			for _, status := range test.statuses {
+				if status == 0 {
+					replicas = append(replicas, "127.0.0.1:1")
+				} else {
+					replicas = append(replicas, txnTestServer(t, status, map[string]string{}))
+				}
+			}
+			key := migrationTestShard(t, 0, replicas...)
+			if err := kvsDb.PutDataNoChecks(key, KeyEntry{Value: "x"}); err != nil {
+				t.Fatal(err)
+			}
+
+			left, err := moveMisplacedKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if left != test.wantLeft {
+				t.Errorf("got %d keys left, want %d", left, test.wantLeft)
+			}
+			if kvsDb.KeyCount() != test.wantLeft {
+				t.Errorf("%d keys are still here, want %d", kvsDb.KeyCount(), test.wantLeft)
+			}
+			for _, replica := range replicas {
+				if _, ok := ring.Shards[1].Replicas[replica]; !ok {
+					t.Errorf("%s was dropped from its shard", replica)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitForViewGivesUp(t *testing.T) {
+	txnTestShard(t)
+	view.PutView("127.0.0.1:1")
+	if err := waitForView(0); err == nil {
+		t.Error("waited for a node that's down without giving up")
+	}
+}
+
+// Reads of keys the old shard hash placed elsewhere fall back to that
+// shard until it says it's moved them
+func TestProxyToOldPlacement(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       interface{}
+		wantStatus int
+		wantMoved  bool
+	}{
+		{"old shard still has the key", http.StatusOK, map[string]interface{}{"entry": KeyEntry{Value: "x", Version: 1}}, http.StatusOK, false},
+		{"old shard doesn't have it", http.StatusNotFound, map[string]interface{}{"error": "Key does not exist"}, http.StatusNotFound, false},
+		{"old shard moved its keys", http.StatusNotFound, map[string]interface{}{"migrated": true}, http.StatusNotFound, true},
+		{"old shard is down", 0, nil, http.StatusNotFound, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := "127.0.0.1:1"
+			if test.status != 0 {
+				node = txnTestServer(t, test.status, test.body)
+			}
+			key := migrationTestShard(t, 1, node)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/kvs/"+key, nil)
+			if !proxyToOldPlacement(c, key, map[string]int{}) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Key does not exist"})
+			}
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+			if shardMigration.hasMoved(1) != test.wantMoved {
+				t.Errorf("got shard 1 moved %v, want %v", shardMigration.hasMoved(1), test.wantMoved)
+			}
+		})
+	}
+}
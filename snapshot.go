@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Bump this whenever the layout of a snapshot changes, and keep
+// readSnapshot able to load every older version
+//
+//	1: entries hold just the value
+//	2: entries hold the whole KeyEntry
+//	3: entries also hold the key's history, and deleted keys with history
+//	   have an entry with no KeyEntry
+//	4: the header also holds the prepared transactions
+//	5: the header also holds the index of the last raft entry applied
+//	6: the header also holds the recently finished transactions
+const SnapshotVersion = 6
+
+const snapshotFileName = "kvs.snapshot"
+
+var ErrUnknownSnapshotVersion = errors.New("unknown snapshot version")
+
+// Snapshots are stored as JSON lines: a header followed by one line per key,
+// so they can be written and read without holding everything in one buffer
+type SnapshotHeader struct {
+	Version   int                    `json:"version"`
+	LSN       uint64                 `json:"lsn"`
+	Metadata  map[string]int         `json:"metadata"`
+	Prepared  []PreparedTxn          `json:"prepared,omitempty"`
+	Finished  map[string]FinishedTxn `json:"finished,omitempty"`
+	RaftIndex uint64                 `json:"raft-index,omitempty"`
+}
+
+type SnapshotEntry struct {
+	Key     string           `json:"key"`
+	Entry   *KeyEntry        `json:"entry,omitempty"`
+	History []HistoryVersion `json:"history,omitempty"`
+	Value   interface{}      `json:"value,omitempty"` // version 1 only
+}
+
+// Writes a snapshot to a temporary file and atomically moves it into place
+func writeSnapshot(dir string, header SnapshotHeader, data EngineSnapshot, history map[string][]HistoryVersion) error {
+	tmpName := filepath.Join(dir, snapshotFileName+".tmp")
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	// header first, then every key
+	err = encoder.Encode(header)
+	if err == nil {
+		err = data.Range(func(key string, entry KeyEntry) bool {
+			var versions []HistoryVersion
+			versions, err = withValues(key, history[key], data.GetVersion)
+			if err == nil {
+				err = encoder.Encode(SnapshotEntry{Key: key, Entry: &entry, History: versions})
+			}
+			return err == nil
+		})
+	}
+
+	// then the history of keys that have been deleted
+	for key, versions := range history {
+		if err != nil {
+			break
+		}
+		if len(versions) > 0 && versions[len(versions)-1].Deleted {
+			versions, err = withValues(key, versions, data.GetVersion)
+			if err == nil {
+				err = encoder.Encode(SnapshotEntry{Key: key, History: versions})
+			}
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpName, filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		return err
+	}
+
+	// make sure the rename itself is durable
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
+
+// Reads the snapshot in dir, calling start with its header and then apply
+// on every key. If no snapshot has been taken yet, start gets an empty
+// header (lsn 0) and that's returned
+func readSnapshot(dir string, start func(SnapshotHeader) error, apply func(SnapshotEntry) error) (SnapshotHeader, error) {
+	var header SnapshotHeader
+
+	file, err := os.Open(filepath.Join(dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return header, start(header)
+	} else if err != nil {
+		return header, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	err = decoder.Decode(&header)
+	if err != nil {
+		return header, err
+	}
+	if header.Version < 1 || header.Version > SnapshotVersion {
+		return header, ErrUnknownSnapshotVersion
+	}
+	err = start(header)
+	if err != nil {
+		return header, err
+	}
+
+	for decoder.More() {
+		var entry SnapshotEntry
+		err = decoder.Decode(&entry)
+		if err != nil {
+			return header, err
+		}
+		if header.Version == 1 {
+			entry.Entry = &KeyEntry{Value: entry.Value}
+		}
+		err = apply(entry)
+		if err != nil {
+			return header, err
+		}
+	}
+
+	return header, nil
+}
+
+// Writes a point in time snapshot of the kvs and removes the log behind it.
+// The lock is only held long enough to take a view of the engine and roll the log over;
+// encoding and syncing the snapshot happens without it.
+func (kvs *KeyValStoreDatabase) Snapshot() error {
+	kvs.snapshotLock.Lock()
+	defer kvs.snapshotLock.Unlock()
+
+	// Take a view of the engine at the current end of the log
+	kvs.Lock()
+	data := kvs.engine.Snapshot()
+	defer data.Close()
+	history := make(map[string][]HistoryVersion, len(kvs.history))
+	for key, versions := range kvs.history {
+		history[key] = versions
+	}
+	header := SnapshotHeader{
+		Version:   SnapshotVersion,
+		LSN:       kvs.wal.LastLSN(),
+		Metadata:  kvs.copyMetadata(),
+		Prepared:  make([]PreparedTxn, 0, len(kvs.prepared)),
+		Finished:  kvs.copyFinishedTxns(),
+		RaftIndex: kvs.raftIndex,
+	}
+	for _, txn := range kvs.prepared {
+		header.Prepared = append(header.Prepared, txn)
+	}
+	err := kvs.wal.Rotate()
+	kvs.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Startup only replays the log after the snapshot, so the change log
+	// can't be regenerated for anything the snapshot covers
+	err = kvs.changes.Sync()
+	if err != nil {
+		return err
+	}
+
+	// Write the snapshot, then drop the log segments it covers
+	err = writeSnapshot(kvs.config.Dir, header, data, history)
+	if err != nil {
+		return err
+	}
+	kvs.lastSnapshotLSN = header.LSN
+	kvs.lastSnapshotTime = time.Now()
+
+	// the snapshot is there either way, the engine just can't reopen as of it
+	err = data.Checkpoint(header.LSN)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = kvs.wal.Compact(header.LSN)
+	if err != nil {
+		return err
+	}
+
+	// nor can the raft log entries the snapshot covers be needed again,
+	// except by followers that are behind
+	if raft := kvs.Raft(); raft != nil {
+		return raft.Compact(header.RaftIndex)
+	}
+	return nil
+}
+
+// Takes a snapshot whenever SnapshotThreshold records have been logged
+// or SnapshotInterval has passed with anything new in the log
+func (kvs *KeyValStoreDatabase) snapshotLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		kvs.snapshotLock.Lock()
+		pending := kvs.wal.LastLSN() - kvs.lastSnapshotLSN
+		due := time.Since(kvs.lastSnapshotTime) >= kvs.config.SnapshotInterval
+		kvs.snapshotLock.Unlock()
+
+		if pending >= uint64(kvs.config.SnapshotThreshold) || (due && pending > 0) {
+			err := kvs.Snapshot()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Writes on both sides of a snapshot survive a restart, and the log
+// segments the snapshot covers are removed
+func TestSnapshotRecovery(t *testing.T) {
+	for _, engine := range []string{EngineMemory, EngineDisk} {
+		t.Run(engine, func(t *testing.T) {
+			config := walTestConfig(t)
+			config.Engine = engine
+			kvs := NewKeyValStoreDatabase("n0")
+			err := kvs.OpenStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			put := func(key string, value interface{}) {
+				_, _, _, err := kvs.PutData(key, KeyEntry{Value: value}, WriteCondition{}, nil, "n0")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			put("a", "1")
+			put("b", "2")
+			err = kvs.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			snapshotLSN := kvs.lastSnapshotLSN
+
+			// only in the log
+			put("c", "3")
+			put("b", "4")
+			_, err = kvs.DeleteData("a", WriteCondition{}, 0, nil, "n0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			segments, err := listWalSegments(config.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, segment := range segments {
+				if walSegmentStart(segment) <= snapshotLSN {
+					t.Errorf("segment %s is covered by the snapshot at lsn %d but wasn't removed", segment, snapshotLSN)
+				}
+			}
+
+			kvs.wal.file.Close()
+			reopened := NewKeyValStoreDatabase("n0")
+			err = reopened.OpenStorage(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.wal.file.Close()
+
+			got := make(map[string]interface{})
+			reopened.rangeData(func(key string, entry KeyEntry) bool {
+				got[key] = entry.Value
+				return true
+			})
+			want := map[string]interface{}{"b": "4", "c": "3"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got data %v, want %v", got, want)
+			}
+			if !reflect.DeepEqual(reopened.CurrentMetadata(), kvs.CurrentMetadata()) {
+				t.Errorf("got metadata %v, want %v", reopened.CurrentMetadata(), kvs.CurrentMetadata())
+			}
+			if reopened.wal.LastLSN() != kvs.wal.LastLSN() {
+				t.Errorf("reopened log ends at lsn %d, want %d", reopened.wal.LastLSN(), kvs.wal.LastLSN())
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Deletes keys whose ttl has run out. Only the shard's primary reaps, and
+// it deletes each key the same way a client delete would (bumping its own
+// clock and broadcasting it), so every replica removes the key at the same
+// causal point no matter what its own wall clock says.
+func reapExpiredKeys() {
+	ticker := time.NewTicker(REAP_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// only reap if this node is the primary of its shard
+		if localShardId < 0 || localShardId >= len(ring.Shards) {
+			continue
+		}
+		if shardPrimary(localShardId) != localAddress {
+			continue
+		}
+
+		for _, key := range kvsDb.ExpiredKeys(time.Now().UnixMilli()) {
+			currMetadata, err := kvsDb.ExpireData(key, localAddress)
+			if err == ErrKeyNotFound {
+				// key was rewritten or deleted since we looked
+				continue
+			} else if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			go broadcastKvsDelete(key, currMetadata, localAddress)
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrKeyLocked = errors.New("key is locked by a transaction")
+var ErrTxnNotFound = errors.New("transaction not prepared")
+var ErrTxnNotReplicated = errors.New("transaction wasn't prepared on every replica of the shard")
+var ErrAbortNotReplicated = errors.New("transaction wasn't aborted on every replica of the shard")
+var ErrTxnCommitted = errors.New("transaction already committed")
+var ErrTxnAborted = errors.New("transaction already aborted")
+
+// One write of a transaction, as the client sent it
+type TxnWrite struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value,omitempty"`
+	Delete bool        `json:"delete,omitempty"`
+}
+
+// The part of a transaction that falls on one shard, once that shard has
+// voted to commit it. Every key it reads, checks or writes stays locked
+// until it commits or aborts
+type PreparedTxn struct {
+	Id               string     `json:"id"`
+	Coordinator      string     `json:"coordinator"`
+	CoordinatorShard int        `json:"coordinator-shard"`
+	Shards           []int      `json:"shards,omitempty"` // every shard in the transaction
+	Keys             []string   `json:"keys"`
+	Writes           []TxnWrite `json:"writes"`
+	Time             int64      `json:"time"` // unix milliseconds it was prepared
+}
+
+// How a transaction ended on this replica. It's kept for TXN_FINISHED_RETENTION
+// after, so a commit or abort that arrives again, from the coordinator
+// retrying or from another replica of the shard, isn't applied twice, and a
+// prepare that arrives after the abort is refused
+type FinishedTxn struct {
+	State   string `json:"state"`             // TxnCommitted or TxnAborted
+	Version int64  `json:"version,omitempty"` // of the writes, if it committed
+	Time    int64  `json:"time"`              // unix milliseconds
+}
+
+// One write of a batch applied as a single unit, exactly as it was stored
+type BatchWrite struct {
+	Key     string    `json:"key"`
+	Entry   *KeyEntry `json:"entry,omitempty"`   // nil for a delete
+	Version int64     `json:"version,omitempty"` // of a delete
+}
+
+// Checks the transaction's conditions on this shard and locks its keys
+// against every other write and transaction. Returns the value of each key
+// in reads (nil if it doesn't exist). Preparing the same transaction twice
+// just reads again
+func (kvs *KeyValStoreDatabase) PrepareTxn(txn PreparedTxn, reads []string, conds map[string]WriteCondition, metadata map[string]int) (values map[string]interface{}, currentMetadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	// Check metadata
+	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
+	if !metadataValid {
+		return nil, kvs.copyMetadata(), ErrInvalidMetadata
+	}
+
+	err = kvs.finishedErr(txn.Id)
+	if err != nil {
+		return nil, kvs.copyMetadata(), err
+	}
+	if _, exists := kvs.prepared[txn.Id]; !exists {
+		// every key must be free
+		for _, key := range txn.Keys {
+			if kvs.isLocked(key) {
+				return nil, kvs.copyMetadata(), ErrKeyLocked
+			}
+		}
+		for key, cond := range conds {
+			_, err = kvs.checkCondition(key, cond)
+			if err != nil {
+				return nil, kvs.copyMetadata(), err
+			}
+		}
+		err = kvs.checkQuotaGrowth(kvs.writesGrowth(txn.Writes))
+		if err != nil {
+			return nil, kvs.copyMetadata(), err
+		}
+
+		txn.Time = time.Now().UnixMilli()
+		err = kvs.propose(WalRecord{Op: WalOpPrepare, Txn: &txn})
+		if err != nil {
+			return nil, kvs.copyMetadata(), err
+		}
+	}
+
+	values = make(map[string]interface{}, len(reads))
+	for _, key := range reads {
+		values[key] = nil
+		if kvs.hasLiveKey(key) {
+			entry, _, err := kvs.engine.Get(key)
+			if err != nil {
+				return nil, kvs.copyMetadata(), err
+			}
+			values[key] = entry.ClientValue()
+		}
+	}
+
+	return values, kvs.copyMetadata(), nil
+}
+
+// Stores a copy of a transaction prepared by the shard's primary, so the
+// keys are locked here too and the transaction outlives the primary
+func (kvs *KeyValStoreDatabase) AcceptPreparedTxn(txn PreparedTxn) error {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	if _, exists := kvs.prepared[txn.Id]; exists {
+		return nil
+	}
+	err := kvs.finishedErr(txn.Id)
+	if err != nil {
+		return err
+	}
+	txn.Time = time.Now().UnixMilli()
+	return kvs.commit(WalRecord{Op: WalOpPrepare, Txn: &txn})
+}
+
+// Applies every write of a prepared transaction as one batch, with a single
+// version and a single tick of this node's clock, and unlocks its keys.
+// Returns the writes as they were stored, to be sent to the replicas, or
+// ErrTxnCommitted if it's already been committed here
+func (kvs *KeyValStoreDatabase) CommitTxn(id string) (writes []BatchWrite, currentMetadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	txn, exists := kvs.prepared[id]
+	if !exists {
+		err = kvs.finishedErr(id)
+		if err == nil {
+			err = ErrTxnNotFound
+		}
+		return nil, kvs.copyMetadata(), err
+	}
+
+	writes = kvs.batchWrites(txn.Writes)
+	err = kvs.propose(WalRecord{Op: WalOpBatch, Writes: writes, TxnId: id, Sender: kvs.LocalAddress})
+	if err != nil {
+		return nil, kvs.copyMetadata(), err
+	}
+	return writes, kvs.copyMetadata(), nil
+}
+
+// Applies writes to keys on this shard as one unit if none of them are
+// locked and every condition holds: one version, one tick of this node's
+// clock and one record for the replicas. Returns the writes as they were
+// stored, to be sent to the replicas
+func (kvs *KeyValStoreDatabase) PutBatch(txnWrites []TxnWrite, conds map[string]WriteCondition, metadata map[string]int) (writes []BatchWrite, currentMetadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	// Check metadata
+	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
+	if !metadataValid {
+		return nil, kvs.copyMetadata(), ErrInvalidMetadata
+	}
+
+	for _, write := range txnWrites {
+		if kvs.isLocked(write.Key) {
+			return nil, kvs.copyMetadata(), ErrKeyLocked
+		}
+	}
+	for key, cond := range conds {
+		_, err = kvs.checkCondition(key, cond)
+		if err != nil {
+			return nil, kvs.copyMetadata(), err
+		}
+	}
+	err = kvs.checkQuotaGrowth(kvs.writesGrowth(txnWrites))
+	if err != nil {
+		return nil, kvs.copyMetadata(), err
+	}
+
+	writes = kvs.batchWrites(txnWrites)
+	err = kvs.propose(WalRecord{Op: WalOpBatch, Writes: writes, Sender: kvs.LocalAddress})
+	if err != nil {
+		return nil, kvs.copyMetadata(), err
+	}
+	return writes, kvs.copyMetadata(), nil
+}
+
+// Applies the writes of a multi-put or multi-delete as one batch: one
+// version, one tick of this node's clock and one record for the replicas.
+// Unlike PutBatch, a key that can't be written doesn't stop the others; its
+// error is returned in failed. created has the keys a put created. Returns
+// no writes, and doesn't tick the clock, if none of the keys went through
+func (kvs *KeyValStoreDatabase) PutMulti(txnWrites []TxnWrite, metadata map[string]int) (writes []BatchWrite, created map[string]bool, failed map[string]error, currentMetadata map[string]int, err error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	// Check metadata
+	metadataValid := kvs.IsMetadataValid(metadata, kvs.LocalAddress)
+	if !metadataValid {
+		return nil, nil, nil, kvs.copyMetadata(), ErrInvalidMetadata
+	}
+
+	created = make(map[string]bool)
+	failed = make(map[string]error)
+	allowed := make([]TxnWrite, 0, len(txnWrites))
+	for _, write := range txnWrites {
+		exists := kvs.hasLiveKey(write.Key)
+		if kvs.isLocked(write.Key) {
+			failed[write.Key] = ErrKeyLocked
+		} else if write.Delete && !exists {
+			failed[write.Key] = ErrKeyNotFound
+		} else {
+			created[write.Key] = !write.Delete && !exists
+			allowed = append(allowed, write)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, created, failed, kvs.copyMetadata(), nil
+	}
+	err = kvs.checkQuotaGrowth(kvs.writesGrowth(allowed))
+	if err != nil {
+		return nil, nil, nil, kvs.copyMetadata(), err
+	}
+
+	writes = kvs.batchWrites(allowed)
+	err = kvs.propose(WalRecord{Op: WalOpBatch, Writes: writes, Sender: kvs.LocalAddress})
+	if err != nil {
+		return nil, nil, nil, kvs.copyMetadata(), err
+	}
+	return writes, created, failed, kvs.copyMetadata(), nil
+}
+
+// Drops a prepared transaction and unlocks its keys. Nothing it would have
+// written was ever applied, so there's nothing to undo. A transaction that
+// was never prepared here is recorded as aborted all the same, so it can't
+// be prepared later. Returns ErrTxnCommitted if it's already been committed
+func (kvs *KeyValStoreDatabase) AbortTxn(id string) error {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	if _, exists := kvs.prepared[id]; !exists {
+		err := kvs.finishedErr(id)
+		if err == ErrTxnAborted {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return kvs.propose(WalRecord{Op: WalOpAbort, TxnId: id})
+}
+
+// Answers for this shard when another can't reach a transaction's
+// coordinator: TxnPreparing if it's prepared here, how it ended if it has,
+// and otherwise TxnAborted, once it's aborted here so it can't be prepared
+func (kvs *KeyValStoreDatabase) RefuseTxn(id string) (string, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	if _, exists := kvs.prepared[id]; exists {
+		return TxnPreparing, nil
+	}
+	if finished, exists := kvs.finished[id]; exists {
+		return finished.State, nil
+	}
+	return TxnAborted, kvs.propose(WalRecord{Op: WalOpAbort, TxnId: id})
+}
+
+// Commits a transaction prepared here with the version another replica of
+// the shard already committed it with, so every replica stores the same
+// writes. Unlike CommitTxn it doesn't tick this node's clock: the batch
+// from the replica that committed it does that once it arrives
+func (kvs *KeyValStoreDatabase) SettleTxn(id string, version int64) error {
+	kvs.Lock()
+	defer kvs.Unlock()
+	kvs.awaitProposal()
+
+	txn, exists := kvs.prepared[id]
+	if !exists {
+		err := kvs.finishedErr(id)
+		if err == ErrTxnCommitted {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return ErrTxnNotFound
+	}
+
+	if version == 0 {
+		version = kvs.nextVersion()
+	}
+	return kvs.propose(WalRecord{Op: WalOpBatch, Writes: kvs.batchWritesAt(txn.Writes, version), TxnId: id})
+}
+
+// Applies a batch sent by sender as one unit, unlocking the keys of
+// transaction txnId if it came from one. The batch moves sender's clock
+// forward even with no writes, for nodes on other shards. The writes of a
+// transaction that's already committed here are left out, so it's never
+// applied twice
+func (kvs *KeyValStoreDatabase) ApplyBatch(writes []BatchWrite, txnId string, metadata map[string]int, sender string) error {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	if kvs.alreadyApplied(metadata, sender) {
+		return nil
+	}
+	metadataValid := kvs.IsMetadataValid(metadata, sender)
+	if !metadataValid {
+		return ErrInvalidMetadata
+	}
+
+	if txnId != "" && kvs.finished[txnId].State == TxnCommitted {
+		writes = nil
+	}
+	return kvs.commit(WalRecord{Op: WalOpBatch, Writes: writes, TxnId: txnId, Sender: sender})
+}
+
+// Returns how a transaction ended on this replica, and whether it has
+func (kvs *KeyValStoreDatabase) FinishedTxn(id string) (FinishedTxn, bool) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	finished, exists := kvs.finished[id]
+	return finished, exists
+}
+
+// Forgets the transactions that finished before cutoff (unix milliseconds)
+func (kvs *KeyValStoreDatabase) PruneFinishedTxns(cutoff int64) {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	for id, finished := range kvs.finished {
+		if finished.Time < cutoff {
+			delete(kvs.finished, id)
+		}
+	}
+}
+
+// Returns every transaction prepared on this node
+func (kvs *KeyValStoreDatabase) PreparedTxns() []PreparedTxn {
+	kvs.Lock()
+	defer kvs.Unlock()
+
+	txns := make([]PreparedTxn, 0, len(kvs.prepared))
+	for _, txn := range kvs.prepared {
+		txns = append(txns, txn)
+	}
+	return txns
+}
+
+// Turns a client's writes into the writes of one batch, all with the next
+// version. Deleting a key that isn't there is a no-op. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) batchWrites(txnWrites []TxnWrite) []BatchWrite {
+	return kvs.batchWritesAt(txnWrites, kvs.nextVersion())
+}
+
+// batchWrites with the given version. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) batchWritesAt(txnWrites []TxnWrite, version int64) []BatchWrite {
+	writes := make([]BatchWrite, 0, len(txnWrites))
+	for _, write := range txnWrites {
+		if write.Delete {
+			if kvs.engine.Has(write.Key) {
+				writes = append(writes, BatchWrite{Key: write.Key, Version: version})
+			}
+		} else {
+			writes = append(writes, BatchWrite{Key: write.Key, Entry: &KeyEntry{Value: write.Value, Version: version}})
+		}
+	}
+	return writes
+}
+
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) lockTxn(txn PreparedTxn) {
+	kvs.prepared[txn.Id] = txn
+	for _, key := range txn.Keys {
+		kvs.locks[key] = txn.Id
+	}
+}
+
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) releaseTxn(id string) {
+	txn, exists := kvs.prepared[id]
+	if !exists {
+		return
+	}
+	for _, key := range txn.Keys {
+		if kvs.locks[key] == id {
+			delete(kvs.locks, key)
+		}
+	}
+	delete(kvs.prepared, id)
+}
+
+// Caller must hold the lock
+func (kvs *KeyValStoreDatabase) copyFinishedTxns() map[string]FinishedTxn {
+	finished := make(map[string]FinishedTxn, len(kvs.finished))
+	for id, txn := range kvs.finished {
+		finished[id] = txn
+	}
+	return finished
+}
+
+// Records how a transaction ended. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) recordFinishedTxn(id string, state string, writes []BatchWrite, at int64) {
+	finished := FinishedTxn{State: state, Time: at}
+	if len(writes) > 0 {
+		finished.Version = writes[0].Version
+		if writes[0].Entry != nil {
+			finished.Version = writes[0].Entry.Version
+		}
+	}
+	// the first outcome recorded stands. A batch with no writes, sent by
+	// the replica that committed a transaction settled here, doesn't change
+	// the version it settled with
+	if previous, exists := kvs.finished[id]; exists {
+		if previous.State != state {
+			return
+		}
+		if finished.Version == 0 {
+			finished.Version = previous.Version
+		}
+	}
+	kvs.finished[id] = finished
+}
+
+// Returns ErrTxnCommitted or ErrTxnAborted if the transaction has finished
+// on this replica. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) finishedErr(id string) error {
+	switch kvs.finished[id].State {
+	case TxnCommitted:
+		return ErrTxnCommitted
+	case TxnAborted:
+		return ErrTxnAborted
+	}
+	return nil
+}
+
+// Returns true if a prepared transaction holds key. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) isLocked(key string) bool {
+	_, locked := kvs.locks[key]
+	return locked
+}
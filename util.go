@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -12,16 +21,21 @@ import (
 // util functions
 func initPrimaryNode(initailView []string, shardCount int) {
 	kvsDb = NewKeyValStoreDatabase(localAddress)
+	openKvsStorage()
 	view = NewView()
 	for _, v := range initailView {
 		view.PutView(v)
 	}
 	ring = NewRing(shardCount, view.Nodes)
 	localShardId = ring.GetShardIdFromNode(localAddress)
+	if kvsDb.config.Replication == ReplicationRaft && localShardId >= 0 {
+		startShardRaft()
+	}
 }
 
 func initTertiaryNode(initailView []string) {
 	kvsDb = NewKeyValStoreDatabase(localAddress)
+	openKvsStorage()
 	view = NewView()
 	for _, v := range initailView {
 		view.PutView(v)
@@ -32,6 +46,23 @@ func initTertiaryNode(initailView []string) {
 	broadcastPutView(localAddress)
 }
 
+// replays anything saved on disk into the kvs before the node starts serving
+func openKvsStorage() {
+	err := kvsDb.OpenStorage(parseStorageConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Starts this node's part in the raft group of its shard, with the rest
+// of the shard's replicas as the other members
+func startShardRaft() {
+	err := kvsDb.StartRaft(removeLocalAddressFromMap(ring.Shards[localShardId].Replicas))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func deleteNode(node string) {
 	view.DeleteView(node)
 	ring.RemoveNode(node)
@@ -77,15 +108,29 @@ func getShardData(shardId int) {
 		log.Fatal(err)
 	}
 
+	// replicas that haven't been upgraded yet send bare values
 	type TempKvs struct {
-		Kvs KeyValStoreDatabase `json:"data"`
+		Kvs struct {
+			Format   int                         `json:"format"`
+			Data     map[string]json.RawMessage  `json:"data"`
+			History  map[string][]HistoryVersion `json:"history"`
+			Metadata map[string]int              `json:"metadata"`
+		} `json:"data"`
 	}
 
 	var newKvsDb TempKvs
 
 	resBody, _ := io.ReadAll(res.Body)
 	json.Unmarshal(resBody, &newKvsDb)
-	kvsDb = &newKvsDb.Kvs
+
+	data, err := decodeEntries(newKvsDb.Kvs.Data, newKvsDb.Kvs.Format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = kvsDb.ResetData(data, newKvsDb.Kvs.History, newKvsDb.Kvs.Metadata)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 // This function runs through every key in the database
@@ -95,22 +140,226 @@ func shuffleKvsData() {
 	kvsDb.Lock()
 	defer kvsDb.Unlock()
 
-	toDelete := make(map[string]interface{})
+	// the shards being watched just changed under every watcher
+	kvsDb.feed.reset(kvsDb.Metadata)
 
-	for key, val := range kvsDb.Data {
+	toDelete := make(map[string]KeyEntry)
+
+	err := kvsDb.rangeData(func(key string, entry KeyEntry) bool {
 		// if key no longer belongs, add to the delete list
 		keyShardId := ring.GetShardId(key)
 		if keyShardId != localShardId {
-			toDelete[key] = val
+			toDelete[key] = entry
 		}
 		// Broadcast to new shard
-		go broadcastKeyValNoChecks(key, val, removeLocalAddressFromMap(ring.Shards[keyShardId].Replicas))
+		go broadcastKeyValNoChecks(key, entry, removeLocalAddressFromMap(ring.Shards[keyShardId].Replicas))
+		return true
+	})
+	if err != nil {
+		log.Println(err)
 	}
 
 	// Delete all shards the don't belong to new shard
 	for key := range toDelete {
-		delete(kvsDb.Data, key)
+		err := kvsDb.dropData(key)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Run once on startup. Keys stored while an older shard hash was in use may
+// belong on another shard now, so once the rest of the view is up they're
+// sent there. Keys the new shard doesn't have yet are dropped only once
+// every replica of it took them, and the rest are tried again until none
+// are left. Until then reads fall back to this shard (see proxyToOldPlacement)
+func migrateShardHash() {
+	version, err := readShardHashVersion(kvsDb.config.Dir, kvsDb.KeyCount() == 0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// a node that isn't on a shard yet gets its keys cloned when it joins one
+	if version < ShardHashVersion && localShardId >= 0 {
+		log.Printf("moving keys placed with shard hash %d to where shard hash %d puts them", version, ShardHashVersion)
+		for {
+			err = waitForView(MIGRATE_WAIT_TIMEOUT)
+			if err != nil {
+				log.Println(err)
+			}
+			left, err := moveMisplacedKeys()
+			if err == nil && left == 0 {
+				break
+			} else if err != nil {
+				log.Println(err)
+			} else {
+				log.Printf("%d keys couldn't be moved yet, trying again", left)
+			}
+			time.Sleep(MIGRATE_RETRY_INTERVAL)
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(kvsDb.config.Dir, shardHashFileName), []byte(strconv.Itoa(ShardHashVersion)), 0644)
+	if err != nil {
+		log.Println(err)
+	}
+	shardMigration.finish()
+}
+
+// Where moving keys placed by an older shard hash stands
+type ShardMigration struct {
+	sync.Mutex
+	finished bool         // this node has none left to move
+	moved    map[int]bool // shards that said they have none left either
+}
+
+var shardMigration = &ShardMigration{moved: make(map[int]bool)}
+
+func (m *ShardMigration) finish() {
+	m.Lock()
+	defer m.Unlock()
+	m.finished = true
+}
+
+func (m *ShardMigration) isFinished() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.finished
+}
+
+func (m *ShardMigration) markMoved(shardId int) {
+	m.Lock()
+	defer m.Unlock()
+	m.moved[shardId] = true
+}
+
+func (m *ShardMigration) hasMoved(shardId int) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.moved[shardId]
+}
+
+// Sends every key this node holds that belongs on another shard to each
+// replica of that shard, without evicting any that don't answer. A key is
+// dropped here once all of them took it. Returns how many keys are left
+func moveMisplacedKeys() (int, error) {
+	misplaced := make(map[string]KeyEntry)
+	kvsDb.Lock()
+	err := kvsDb.rangeData(func(key string, entry KeyEntry) bool {
+		if ring.GetShardId(key) != localShardId {
+			misplaced[key] = entry
+		}
+		return true
+	})
+	kvsDb.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	left := 0
+	for key, entry := range misplaced {
+		jsonData, _ := json.Marshal(map[string]interface{}{"key": key, "entry": entry})
+		moved := true
+		for node := range removeLocalAddressFromMap(ring.Shards[ring.GetShardId(key)].Replicas) {
+			res, err := txnCall(node, "/rep/shard/kvs", http.MethodPut, jsonData)
+			if err != nil || res.StatusCode != http.StatusOK {
+				moved = false
+				break
+			}
+		}
+		if !moved {
+			left++
+			continue
+		}
+
+		kvsDb.Lock()
+		err = kvsDb.dropData(key)
+		kvsDb.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return left, nil
+}
+
+// Returns the shard hash version the keys in dir were placed with. Data
+// from before it was saved is version 1, unless there's nothing there yet
+func readShardHashVersion(dir string, empty bool) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, shardHashFileName))
+	if os.IsNotExist(err) {
+		if empty {
+			return ShardHashVersion, nil
+		}
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Blocks until every other node in the view answers, so keys aren't sent
+// to nodes that are still starting up. Gives up after timeout
+func waitForView(timeout time.Duration) error {
+	netClient := &http.Client{
+		Timeout: DEFAULT_TIMEOUT,
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		down := 0
+		for node := range removeLocalAddressFromMap(view.Nodes) {
+			res, err := netClient.Get("http://" + node + "/view")
+			if err != nil {
+				down++
+				continue
+			}
+			res.Body.Close()
+		}
+		if down == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d nodes in the view still aren't answering", down)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Keys placed by the older shard hash may still be on the shard it put
+// them on, if that shard hasn't moved them yet (see migrateShardHash).
+// Asks that shard for key and sends its copy on, returning true if it had
+// it. Once one of its replicas says it's done, the shard isn't asked again
+func proxyToOldPlacement(c *gin.Context, key string, metadata map[string]int) bool {
+	oldShardId := ring.shardIdByHash(key, 1)
+	if oldShardId == localShardId || shardMigration.hasMoved(oldShardId) {
+		return false
+	}
+
+	for node := range removeLocalAddressFromMap(ring.Shards[oldShardId].Replicas) {
+		res, err := txnCall(node, "/rep/shard/unmigrated/"+url.PathEscape(key), http.MethodGet, nil)
+		if err != nil {
+			continue
+		}
+		var answer struct {
+			Entry    *KeyEntry `json:"entry"`
+			Migrated bool      `json:"migrated"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&answer)
+		res.Body.Close()
+		if err != nil {
+			continue
+		}
+		if answer.Migrated {
+			shardMigration.markMoved(oldShardId)
+			return false
+		}
+		if res.StatusCode == http.StatusOK && answer.Entry != nil {
+			// the copy there doesn't depend on anything on this shard
+			sendKeyEntry(c, *answer.Entry, metadata)
+			return true
+		}
 	}
+	return false
 }
 
 func removeLocalAddressFromMap(mp map[string]struct{}) map[string]struct{} {
@@ -124,6 +373,101 @@ func removeLocalAddressFromMap(mp map[string]struct{}) map[string]struct{} {
 }
 
 func proxyToShard(c *gin.Context, endpoint string, shardId int) {
+	proxyToNodes(c, endpoint, removeLocalAddressFromMap(ring.Shards[shardId].Replicas))
+}
+
+// Returns the node that does a shard's background work: the leader of this
+// node's shard in raft mode, otherwise the ring's primary. "" if the
+// shard has no leader right now
+func shardPrimary(shardId int) string {
+	if raft := kvsDb.Raft(); raft != nil && shardId == localShardId {
+		return raft.Leader()
+	}
+	return ring.Shards[shardId].Primary()
+}
+
+// Sends the request to the shard's primary if that isn't this node, and
+// returns true if it did
+func proxyToShardPrimary(c *gin.Context, shardId int) bool {
+	primary := shardPrimary(shardId)
+	if primary == localAddress {
+		return false
+	}
+	if primary == "" {
+		sendNoLeader(c)
+		return true
+	}
+	proxyToNodes(c, c.Request.URL.Path, map[string]struct{}{primary: {}})
+	return true
+}
+
+// In raft mode, sends the request on to the leader of this node's shard if
+// that isn't this node, and returns true if it did. A request is only
+// forwarded once, so nodes that disagree about the leader can't bounce it
+// between them
+func proxyToRaftLeader(c *gin.Context) bool {
+	raft := kvsDb.Raft()
+	if raft == nil {
+		return false
+	}
+	leader := raft.Leader()
+	if leader == localAddress {
+		return false
+	}
+	if leader == "" || c.GetHeader(RaftForwardedHeader) != "" {
+		sendNoLeader(c)
+		return true
+	}
+	c.Request.Header.Set(RaftForwardedHeader, localAddress)
+
+	// a leader that doesn't answer may be on its way out, but it's still
+	// in the shard, so it's never dropped from the view for it
+	err := forwardToNode(c, leader, RAFT_COMMIT_TIMEOUT+DEFAULT_TIMEOUT)
+	if err != nil {
+		log.Println(err)
+		sendNoLeader(c)
+	}
+	return true
+}
+
+// Sends the client's request to node as it is, and sends its response
+// back. Unlike proxyToNodes this never drops node from the view. Returns
+// an error, having answered nothing, if node didn't answer within timeout
+func forwardToNode(c *gin.Context, node string, timeout time.Duration) error {
+	endpoint := c.Request.URL.Path
+	if c.Request.URL.RawQuery != "" {
+		endpoint += "?" + c.Request.URL.RawQuery
+	}
+	reqData, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(c.Request.Method, "http://"+node+endpoint, bytes.NewReader(reqData))
+	if err != nil {
+		return err
+	}
+	req.Header = c.Request.Header.Clone()
+	netClient := &http.Client{
+		Timeout: timeout,
+	}
+	res, err := netClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	sendProxiedResponse(c, res)
+	return nil
+}
+
+// Sends the client's request to the first of nodes that answers and sends
+// its response back
+func proxyToNodes(c *gin.Context, endpoint string, nodes map[string]struct{}) {
+	// keep the query string
+	if c.Request.URL.RawQuery != "" {
+		endpoint += "?" + c.Request.URL.RawQuery
+	}
 
 	// Get body data from context
 	reqData, err := io.ReadAll(c.Request.Body)
@@ -132,12 +476,12 @@ func proxyToShard(c *gin.Context, endpoint string, shardId int) {
 		return
 	}
 
-	// send client request to shard and get response
-	res, err := sendMsgToGroup(
-		removeLocalAddressFromMap(ring.Shards[shardId].Replicas),
+	// send client request (with its headers) to shard and get response
+	res, err := sendMsgToGroupWithHeaders(
+		nodes,
 		endpoint,
 		c.Request.Method,
-		c.ContentType(),
+		c.Request.Header,
 		reqData,
 		false)
 	if err != nil {
@@ -145,11 +489,35 @@ func proxyToShard(c *gin.Context, endpoint string, shardId int) {
 		return
 	}
 
-	// send the response from the shard back to the OG client
+	sendProxiedResponse(c, res)
+}
+
+// send the response (and its headers) from the shard back to the OG client
+func sendProxiedResponse(c *gin.Context, res *http.Response) {
+	for name, values := range res.Header {
+		if name != "Content-Length" {
+			c.Writer.Header()[name] = values
+		}
+	}
 	resData, _ := io.ReadAll(res.Body)
 	c.Data(res.StatusCode, res.Header.Get("Content-Type"), resData)
 }
 
+// Sends metadata back in the X-Causal-Metadata header
+func setMetadataHeader(c *gin.Context, metadata map[string]int) {
+	jsonData, _ := json.Marshal(metadata)
+	c.Header(CausalMetadataHeader, string(jsonData))
+}
+
+// Raises every clock in into to at least its value in from
+func mergeMetadata(into map[string]int, from map[string]int) {
+	for replica, time := range from {
+		if time > into[replica] {
+			into[replica] = time
+		}
+	}
+}
+
 func getMetadataFromInterface(i interface{}) map[string]int {
 	metadata := make(map[string]int)
 	if i == nil {
@@ -162,3 +530,35 @@ func getMetadataFromInterface(i interface{}) map[string]int {
 	}
 	return metadata
 }
+
+func getEntryFromInterface(i interface{}) KeyEntry {
+	var entry KeyEntry
+	// round trip through JSON so every field of KeyEntry gets filled in
+	jsonData, _ := json.Marshal(i)
+	json.Unmarshal(jsonData, &entry)
+	return entry
+}
+
+// Reads the entry of a replicated put, or builds one from its value if it
+// came from a replica that hasn't been upgraded to send entries yet
+func getEntryOrValueFromInterface(data map[string]interface{}) KeyEntry {
+	if data["entry"] == nil {
+		return KeyEntry{Value: data["value"]}
+	}
+	return getEntryFromInterface(data["entry"])
+}
+
+func getTxnFromInterface(i interface{}) PreparedTxn {
+	var txn PreparedTxn
+	// round trip through JSON so every field gets filled in
+	jsonData, _ := json.Marshal(i)
+	json.Unmarshal(jsonData, &txn)
+	return txn
+}
+
+func getBatchWritesFromInterface(i interface{}) []BatchWrite {
+	var writes []BatchWrite
+	jsonData, _ := json.Marshal(i)
+	json.Unmarshal(jsonData, &writes)
+	return writes
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sync policies for the write-ahead log
+const (
+	SyncAlways   = "always"   // fsync after every record
+	SyncBatch    = "batch"    // fsync after every BatchSize records (and on every interval tick)
+	SyncInterval = "interval" // fsync on every interval tick
+)
+
+// Record operations
+const (
+	WalOpPut      = "put"
+	WalOpDelete   = "delete"
+	WalOpMetadata = "metadata"
+	WalOpReset    = "reset"
+	WalOpBatch    = "batch"    // several puts and deletes applied as one
+	WalOpPrepare  = "prepare"  // a transaction locking its keys
+	WalOpAbort    = "abort"    // a prepared transaction being dropped
+	WalOpCatchUp  = "catch-up" // a replica's clock, once anti-entropy copied its writes here
+)
+
+// Bump this whenever the layout of a record changes, and keep
+// WalRecord.UnmarshalJSON able to read every older format
+//
+//	1: puts hold just the value, and resets a map of values
+//	2: puts and resets hold whole KeyEntries
+const WalFormat = 2
+
+// Log segments are named after the lsn of their first record so they sort in order
+const walSegmentPattern = "wal-*.log"
+const walSegmentFormat = "wal-%020d.log"
+
+var ErrInvalidSyncPolicy = errors.New("invalid wal sync policy")
+var ErrWalCorrupt = errors.New("wal is corrupt")
+
+type StorageConfig struct {
+	Engine             string
+	Dir                string
+	SyncPolicy         string
+	BatchSize          int
+	SyncInterval       time.Duration
+	SnapshotInterval   time.Duration
+	SnapshotThreshold  int
+	HistoryVersions    int
+	HistoryRetention   time.Duration
+	MemoryLimit        int64 // bytes, 0 means no limit
+	EvictionPolicy     string
+	ChangeLogRetention int // changes kept in the change log
+	Replication        string
+}
+
+// A single mutation of the kvs. Records are replayed in order on startup,
+// so every record must describe the change exactly as it was applied.
+type WalRecord struct {
+	Format   int                         `json:"format,omitempty"` // always WalFormat when written
+	LSN      uint64                      `json:"lsn"`
+	Op       string                      `json:"op"`
+	Key      string                      `json:"key,omitempty"`
+	Time     int64                       `json:"time"` // unix milliseconds
+	Entry    *KeyEntry                   `json:"entry,omitempty"`
+	Version  int64                       `json:"version,omitempty"` // of a delete
+	Sender   string                      `json:"sender,omitempty"`
+	From     string                      `json:"from,omitempty"` // the replica a repair or catch-up came from
+	Data     map[string]KeyEntry         `json:"data,omitempty"`
+	History  map[string][]HistoryVersion `json:"history,omitempty"`
+	Metadata map[string]int              `json:"metadata,omitempty"`
+	Writes   []BatchWrite                `json:"writes,omitempty"`
+	Txn      *PreparedTxn                `json:"txn,omitempty"`
+	TxnId    string                      `json:"txn-id,omitempty"`
+	Finished map[string]FinishedTxn      `json:"finished,omitempty"` // of a reset
+
+	// the raft entry the record came from, in raft mode
+	RaftIndex uint64 `json:"raft-index,omitempty"`
+
+	Value interface{} `json:"value,omitempty"` // format 1 only
+}
+
+// WalRecord without its JSON methods
+type walRecordJSON WalRecord
+
+func (rec WalRecord) MarshalJSON() ([]byte, error) {
+	rec.Format = WalFormat
+	return json.Marshal(walRecordJSON(rec))
+}
+
+// Reads a record of any format, turning older ones into the current layout.
+// Records without a format were written before it was added, in format 1
+func (rec *WalRecord) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		walRecordJSON
+		Data map[string]json.RawMessage `json:"data,omitempty"`
+	}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*rec = WalRecord(raw.walRecordJSON)
+	if rec.Format == 0 {
+		rec.Format = 1
+	}
+
+	if rec.Op == WalOpPut && rec.Entry == nil {
+		rec.Entry = &KeyEntry{Value: rec.Value}
+	}
+	if raw.Data != nil {
+		rec.Data, err = decodeEntries(raw.Data, rec.Format)
+	}
+	return err
+}
+
+// Decodes a map of entries written in the given record format, where
+// format 1 holds bare values
+func decodeEntries(raw map[string]json.RawMessage, format int) (map[string]KeyEntry, error) {
+	entries := make(map[string]KeyEntry, len(raw))
+	for key, data := range raw {
+		var entry KeyEntry
+		var err error
+		if format < 2 {
+			err = json.Unmarshal(data, &entry.Value)
+		} else {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries[key] = entry
+	}
+	return entries, nil
+}
+
+type WriteAheadLog struct {
+	sync.Mutex
+	file     *os.File
+	config   StorageConfig
+	lastLSN  uint64
+	unsynced int
+	size     int64 // where the last complete record in file ends
+	torn     bool  // a failed write left part of a record past size
+}
+
+// Opens the log in the configured directory and calls apply on every
+// record in it with an lsn greater than afterLSN (records at or below it
+// are already covered by a snapshot). A partially written record at the
+// end of the newest segment (from a crash mid-write) is truncated away; a
+// bad record anywhere else is an error, since the records after it would
+// be lost.
+func OpenWriteAheadLog(config StorageConfig, afterLSN uint64, apply func(WalRecord) error) (*WriteAheadLog, error) {
+	switch config.SyncPolicy {
+	case SyncAlways, SyncBatch, SyncInterval:
+	default:
+		return nil, ErrInvalidSyncPolicy
+	}
+
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := listWalSegments(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	wal := &WriteAheadLog{
+		config:  config,
+		lastLSN: afterLSN,
+	}
+
+	// Replay every complete record in every segment
+	var validLen int64
+	for i, segment := range segments {
+		file, err := os.Open(segment)
+		if err != nil {
+			return nil, err
+		}
+		var torn bool
+		validLen, torn, err = replayRecords(file, func(rec WalRecord) error {
+			if rec.LSN <= afterLSN {
+				return nil
+			}
+			wal.lastLSN = rec.LSN
+			return apply(rec)
+		})
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", segment, err)
+		}
+		if torn {
+			// only the segment being written when the node went down can
+			// end in a torn write
+			if i < len(segments)-1 {
+				return nil, fmt.Errorf("%s: %w: bad record at byte %d", segment, ErrWalCorrupt, validLen)
+			}
+			log.Printf("dropping the torn record at byte %d of %s", validLen, segment)
+		}
+	}
+
+	// Keep appending to the newest segment, or start the first one
+	if len(segments) == 0 {
+		err = wal.openSegment()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		newest := segments[len(segments)-1]
+		wal.file, err = os.OpenFile(newest, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		// Drop anything after the last complete record and move to the end
+		wal.size = validLen
+		err = wal.dropTornRecord()
+		if err != nil {
+			wal.file.Close()
+			return nil, err
+		}
+	}
+
+	if config.SyncPolicy != SyncAlways {
+		go wal.syncLoop()
+	}
+
+	return wal, nil
+}
+
+// Reads records from r until the end of the file, and returns the number of
+// bytes that were valid. A record that can't be decoded is only taken as a
+// torn write (torn is true) if nothing but whitespace follows it; otherwise
+// it's ErrWalCorrupt
+func replayRecords(r io.Reader, apply func(WalRecord) error) (validLen int64, torn bool, err error) {
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// anything left over is a torn write
+			return validLen, len(bytes.TrimSpace(line)) > 0, nil
+		} else if err != nil {
+			return validLen, false, err
+		}
+
+		var rec WalRecord
+		if json.Unmarshal(line, &rec) != nil {
+			rest, err := io.ReadAll(reader)
+			if err != nil {
+				return validLen, false, err
+			}
+			if len(bytes.TrimSpace(rest)) > 0 {
+				return validLen, false, fmt.Errorf("%w: bad record at byte %d is followed by more records", ErrWalCorrupt, validLen)
+			}
+			return validLen, true, nil
+		}
+
+		err = apply(rec)
+		if err != nil {
+			return validLen, false, err
+		}
+		validLen += int64(len(line))
+	}
+}
+
+// Returns the paths of all log segments in dir, oldest first
+func listWalSegments(dir string) ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(dir, walSegmentPattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// Returns the lsn of the first record in a segment from its name
+func walSegmentStart(segment string) uint64 {
+	var start uint64
+	fmt.Sscanf(filepath.Base(segment), walSegmentFormat, &start)
+	return start
+}
+
+// Creates a new segment starting after the last record. Caller must hold the lock
+func (wal *WriteAheadLog) openSegment() error {
+	name := filepath.Join(wal.config.Dir, fmt.Sprintf(walSegmentFormat, wal.lastLSN+1))
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	wal.file = file
+	wal.size = 0
+	return nil
+}
+
+// Cuts the current segment back to the end of its last complete record,
+// so a write that failed partway can't leave a bad record in the middle of
+// the log once more are appended. Caller must hold the lock
+func (wal *WriteAheadLog) dropTornRecord() error {
+	err := wal.file.Truncate(wal.size)
+	if err == nil {
+		_, err = wal.file.Seek(wal.size, io.SeekStart)
+	}
+	wal.torn = err != nil
+	return err
+}
+
+// Writes a record to the end of the log, syncing according to the sync
+// policy. If the write (or with SyncAlways, the sync) fails, the record is
+// cut back out of the log
+func (wal *WriteAheadLog) Append(rec WalRecord) error {
+	wal.Lock()
+	defer wal.Unlock()
+
+	// an earlier failed write couldn't be cut back out yet
+	if wal.torn {
+		err := wal.dropTornRecord()
+		if err != nil {
+			return err
+		}
+	}
+
+	rec.LSN = wal.lastLSN + 1
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	_, err = wal.file.Write(line)
+	if err == nil && wal.config.SyncPolicy == SyncAlways {
+		err = wal.file.Sync()
+	}
+	if err != nil {
+		dropErr := wal.dropTornRecord()
+		if dropErr != nil {
+			return fmt.Errorf("%w (and cutting the record back out failed: %v)", err, dropErr)
+		}
+		return err
+	}
+	wal.lastLSN = rec.LSN
+	wal.size += int64(len(line))
+
+	if wal.config.SyncPolicy == SyncBatch {
+		wal.unsynced++
+		if wal.unsynced >= wal.config.BatchSize {
+			return wal.sync()
+		}
+	} else if wal.config.SyncPolicy == SyncInterval {
+		wal.unsynced++
+	}
+	return nil
+}
+
+// Returns the lsn of the last record written to the log
+func (wal *WriteAheadLog) LastLSN() uint64 {
+	wal.Lock()
+	defer wal.Unlock()
+	return wal.lastLSN
+}
+
+// Closes the current segment and starts a new one, so everything up to
+// LastLSN() can later be removed with Compact. The new segment is opened
+// before the old one is closed, so if it can't be the log keeps appending
+// to the old one
+func (wal *WriteAheadLog) Rotate() error {
+	wal.Lock()
+	defer wal.Unlock()
+
+	// the old segment mustn't end in part of a record either
+	if wal.torn {
+		err := wal.dropTornRecord()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := wal.file.Sync()
+	if err != nil {
+		return err
+	}
+	wal.unsynced = 0
+
+	old := wal.file
+	err = wal.openSegment()
+	if err != nil {
+		return err
+	}
+	err = old.Close()
+	if err != nil {
+		return fmt.Errorf("closing the old log segment: %w", err)
+	}
+	return nil
+}
+
+// Removes every segment that only holds records at or below lsn
+func (wal *WriteAheadLog) Compact(lsn uint64) error {
+	segments, err := listWalSegments(wal.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	// a segment is covered when the one after it starts at or before lsn+1
+	for i := 0; i < len(segments)-1; i++ {
+		if walSegmentStart(segments[i+1]) > lsn+1 {
+			break
+		}
+		err = os.Remove(segments[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flushes the log to disk. Caller must hold the lock
+func (wal *WriteAheadLog) sync() error {
+	if wal.unsynced == 0 {
+		return nil
+	}
+	err := wal.file.Sync()
+	if err == nil {
+		wal.unsynced = 0
+	}
+	return err
+}
+
+// Background loop for the batch and interval policies
+func (wal *WriteAheadLog) syncLoop() {
+	ticker := time.NewTicker(wal.config.SyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		wal.Lock()
+		wal.sync()
+		wal.Unlock()
+	}
+}
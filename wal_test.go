@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func walTestConfig(t *testing.T) StorageConfig {
+	config := parseStorageConfig()
+	config.Dir = t.TempDir()
+	config.SyncPolicy = SyncAlways
+	return config
+}
+
+// Writes each segment's contents, named after its first lsn
+func writeWalSegments(t *testing.T, dir string, segments map[uint64]string) {
+	for start, contents := range segments {
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf(walSegmentFormat, start)), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplayRecords(t *testing.T) {
+	put := func(lsn string, key string) string {
+		return `{"lsn":` + lsn + `,"op":"put","key":"` + key + `","entry":{"value":1,"version":1}}` + "\n"
+	}
+
+	tests := []struct {
+		name     string
+		log      string
+		keys     []string
+		torn     bool
+		validLen int
+		err      error
+	}{
+		{"empty", "", nil, false, 0, nil},
+		{"complete", put("1", "a") + put("2", "b"), []string{"a", "b"}, false, len(put("1", "a") + put("2", "b")), nil},
+		{"torn without newline", put("1", "a") + `{"lsn":2,"op":"pu`, []string{"a"}, true, len(put("1", "a")), nil},
+		{"torn with newline", put("1", "a") + "{\"lsn\":2,\"op\n", []string{"a"}, true, len(put("1", "a")), nil},
+		{"zero filled tail", put("1", "a") + "\x00\x00\x00\x00", []string{"a"}, true, len(put("1", "a")), nil},
+		{"trailing whitespace", put("1", "a") + "garbage\n\n  \n", []string{"a"}, true, len(put("1", "a")), nil},
+		{"bad record in the middle", put("1", "a") + "garbage\n" + put("3", "c"), []string{"a"}, false, len(put("1", "a")), ErrWalCorrupt},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var keys []string
+			validLen, torn, err := replayRecords(strings.NewReader(test.log), func(rec WalRecord) error {
+				keys = append(keys, rec.Key)
+				return nil
+			})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if torn != test.torn {
+				t.Errorf("got torn %v, want %v", torn, test.torn)
+			}
+			if int(validLen) != test.validLen {
+				t.Errorf("got %d valid bytes, want %d", validLen, test.validLen)
+			}
+			if strings.Join(keys, ",") != strings.Join(test.keys, ",") {
+				t.Errorf("replayed %v, want %v", keys, test.keys)
+			}
+		})
+	}
+}
+
+func TestOpenWriteAheadLog(t *testing.T) {
+	put := func(lsn string) string {
+		return `{"lsn":` + lsn + `,"op":"put","key":"k` + lsn + `","entry":{"value":1,"version":1}}` + "\n"
+	}
+
+	tests := []struct {
+		name     string
+		segments map[uint64]string
+		lastLSN  uint64
+		err      error
+	}{
+		{"one segment", map[uint64]string{1: put("1") + put("2")}, 2, nil},
+		{"torn end of newest segment", map[uint64]string{1: put("1"), 2: put("2") + `{"ls`}, 2, nil},
+		{"torn end of older segment", map[uint64]string{1: put("1") + `{"ls`, 2: put("2")}, 0, ErrWalCorrupt},
+		{"bad record before good ones", map[uint64]string{1: put("1") + "garbage\n" + put("3")}, 0, ErrWalCorrupt},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := walTestConfig(t)
+			writeWalSegments(t, config.Dir, test.segments)
+
+			wal, err := OpenWriteAheadLog(config, 0, func(rec WalRecord) error { return nil })
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			defer wal.file.Close()
+			if wal.LastLSN() != test.lastLSN {
+				t.Errorf("got last lsn %d, want %d", wal.LastLSN(), test.lastLSN)
+			}
+
+			// the torn record is gone, so the next one is appended cleanly
+			err = wal.Append(WalRecord{Op: WalOpPut, Key: "next", Entry: &KeyEntry{Value: 2}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var replayed uint64
+			reopened, err := OpenWriteAheadLog(config, 0, func(rec WalRecord) error {
+				replayed = rec.LSN
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reopened.file.Close()
+			if replayed != test.lastLSN+1 {
+				t.Errorf("reopened log ends at lsn %d, want %d", replayed, test.lastLSN+1)
+			}
+		})
+	}
+}
+
+// A write that fails partway is cut back out, so the records appended
+// after it still replay
+func TestAppendDropsFailedWrite(t *testing.T) {
+	config := walTestConfig(t)
+	wal, err := OpenWriteAheadLog(config, 0, func(rec WalRecord) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { wal.file.Close() }()
+	if err = wal.Append(WalRecord{Op: WalOpPut, Key: "a", Entry: &KeyEntry{Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// what a short write leaves behind, before it could be cut back out
+	if _, err = wal.file.Write([]byte(`{"lsn":2,"op":"pu`)); err != nil {
+		t.Fatal(err)
+	}
+	wal.torn = true
+
+	if err = wal.Append(WalRecord{Op: WalOpPut, Key: "b", Entry: &KeyEntry{Value: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	reopened, err := OpenWriteAheadLog(config, 0, func(rec WalRecord) error {
+		keys = append(keys, rec.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.file.Close()
+	if strings.Join(keys, ",") != "a,b" {
+		t.Errorf("replayed keys %v, want [a b]", keys)
+	}
+}
+
+// If the new segment can't be opened, the log keeps using the old one
+func TestRotateKeepsOldSegmentOnFailure(t *testing.T) {
+	config := walTestConfig(t)
+	wal, err := OpenWriteAheadLog(config, 0, func(rec WalRecord) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { wal.file.Close() }()
+
+	wal.config.Dir = filepath.Join(config.Dir, "missing")
+	if err = wal.Rotate(); err == nil {
+		t.Fatal("rotated into a directory that doesn't exist")
+	}
+	if err = wal.Append(WalRecord{Op: WalOpPut, Key: "a", Entry: &KeyEntry{Value: 1}}); err != nil {
+		t.Errorf("got %v appending after the failed rotate", err)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most recent changes each node keeps for watchers to resume from
+const WatchBufferSize = 10000
+
+// Changes a watcher can fall behind by before it's cut off
+const watcherQueueSize = 1024
+
+var ErrCursorTooOld = errors.New("cursor is older than the retained changes")
+var ErrInvalidWatchCursor = errors.New("invalid watch cursor")
+
+// A put or delete applied to the kvs, with the clock of the node once it
+// was. Every replica of a shard applies the same writes in causal order,
+// each counted in its sender's clock, so an event looks the same on
+// whichever replica it's read from
+type WatchEvent struct {
+	Type     string         `json:"type"` // put, delete, catch-up, or open to start a stream
+	Key      string         `json:"key,omitempty"`
+	Value    interface{}    `json:"value,omitempty"`
+	Version  int64          `json:"version,omitempty"`
+	Metadata map[string]int `json:"causal-metadata"`
+	Sender   string         `json:"sender,omitempty"`
+
+	// a put or delete copied from Sender by anti-entropy or a read, which
+	// no clock counts. The catch-up that follows, if any, counts it
+	Repair bool `json:"repair,omitempty"`
+}
+
+// The events of one write, or of every write in a batch, which all share
+// a tick of the sender's clock. A repair or catch-up is a change of its
+// own, from the replica it was copied from
+type Change []WatchEvent
+
+func (change Change) sender() string {
+	return change[0].Sender
+}
+
+func (change Change) tick() int {
+	return change[0].Metadata[change[0].Sender]
+}
+
+// Returns true if the change is a write counted in its sender's clock
+func (change Change) counted() bool {
+	return !change[0].Repair && change[0].Type != "catch-up"
+}
+
+// Returns true if a reader whose position is clock hasn't had change yet.
+// A repair doesn't move the clock, so a reader at exactly the clock it was
+// made at may or may not have had it, and gets it again
+func (change Change) after(clock map[string]int) bool {
+	switch {
+	case change.counted():
+		return change.tick() > clock[change.sender()]
+	case change[0].Type == "catch-up":
+		return metadataBehind(clock, change[0].Metadata)
+	}
+	for replica, time := range change[0].Metadata {
+		if clock[replica] > time {
+			return false
+		}
+	}
+	return true
+}
+
+// Moves clock on past change
+func (change Change) advance(clock map[string]int) {
+	if change.counted() {
+		if change.tick() > clock[change.sender()] {
+			clock[change.sender()] = change.tick()
+		}
+	} else if change[0].Type == "catch-up" {
+		mergeMetadata(clock, change[0].Metadata)
+	}
+}
+
+// Returns the events of change on the keys match accepts
+func (change Change) filter(match func(key string) bool) Change {
+	var matched Change
+	for _, event := range change {
+		if match(event.Key) {
+			matched = append(matched, event)
+		}
+	}
+	return matched
+}
+
+// Keeps the most recent changes applied to this node and hands them to
+// watchers as they happen
+type ChangeFeed struct {
+	sync.Mutex
+	changes []Change
+
+	// the newest tick of each sender that's no longer in changes. A cursor
+	// behind it might have missed some
+	floor map[string]int
+
+	watchers map[*watcher]struct{}
+}
+
+type watcher struct {
+	match func(key string) bool
+	ch    chan Change
+}
+
+func NewChangeFeed() *ChangeFeed {
+	return &ChangeFeed{
+		floor:    make(map[string]int),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// Records a change and sends it to every watcher it matches. A watcher
+// that has fallen too far behind is closed, and can resume from its cursor
+func (feed *ChangeFeed) publish(change Change) {
+	if len(change) == 0 {
+		return
+	}
+	feed.Lock()
+	defer feed.Unlock()
+
+	if len(feed.changes) == WatchBufferSize {
+		feed.changes[0].advance(feed.floor)
+		feed.changes = feed.changes[1:]
+	}
+	feed.changes = append(feed.changes, change)
+
+	for w := range feed.watchers {
+		matched := change.filter(w.match)
+		if len(matched) == 0 {
+			continue
+		}
+		select {
+		case w.ch <- matched:
+		default:
+			close(w.ch)
+			delete(feed.watchers, w)
+		}
+	}
+}
+
+// Forgets every change, as if the node started over at metadata. Every
+// watcher is closed, since nothing from before can be resumed from
+func (feed *ChangeFeed) reset(metadata map[string]int) {
+	feed.Lock()
+	defer feed.Unlock()
+
+	feed.changes = nil
+	feed.floor = make(map[string]int, len(metadata))
+	for replica, time := range metadata {
+		feed.floor[replica] = time
+	}
+	for w := range feed.watchers {
+		close(w.ch)
+	}
+	feed.watchers = make(map[*watcher]struct{})
+}
+
+// Starts watching the keys match accepts. The channel opens with an open
+// event holding the clocks of senders the stream starts from: the cursor
+// if there is one, followed by every retained change past it, or the
+// current clock if not
+func (feed *ChangeFeed) subscribe(cursor map[string]int, match func(key string) bool, senders map[string]struct{}, clock map[string]int) (*watcher, error) {
+	feed.Lock()
+	defer feed.Unlock()
+
+	open := WatchEvent{Type: "open", Metadata: make(map[string]int)}
+	for sender := range senders {
+		open.Metadata[sender] = clock[sender]
+	}
+
+	var backlog []Change
+	if cursor != nil {
+		for sender := range senders {
+			if feed.floor[sender] > cursor[sender] {
+				return nil, ErrCursorTooOld
+			}
+			open.Metadata[sender] = cursor[sender]
+		}
+		for _, change := range feed.changes {
+			if !change.after(cursor) {
+				continue
+			}
+			if matched := change.filter(match); len(matched) > 0 {
+				backlog = append(backlog, matched)
+			}
+		}
+	}
+
+	// room for the whole backlog, so catching up never cuts the watcher off
+	w := &watcher{match: match, ch: make(chan Change, 1+len(backlog)+watcherQueueSize)}
+	w.ch <- Change{open}
+	for _, change := range backlog {
+		w.ch <- change
+	}
+
+	feed.watchers[w] = struct{}{}
+	return w, nil
+}
+
+func (feed *ChangeFeed) unsubscribe(w *watcher) {
+	feed.Lock()
+	defer feed.Unlock()
+
+	if _, exists := feed.watchers[w]; exists {
+		close(w.ch)
+		delete(feed.watchers, w)
+	}
+}
+
+// Watches keys on this node. Takes the kvs lock so the open event's clock
+// lines up exactly with the first change after it
+func (kvs *KeyValStoreDatabase) Watch(cursor map[string]int, match func(key string) bool, senders map[string]struct{}) (*watcher, error) {
+	kvs.Lock()
+	defer kvs.Unlock()
+	return kvs.feed.subscribe(cursor, match, senders, kvs.Metadata)
+}
+
+func (kvs *KeyValStoreDatabase) Unwatch(w *watcher) {
+	kvs.feed.unsubscribe(w)
+}
+
+// Returns the change an applied record made. Records with neither a
+// sender nor a replica they came from (keys moved by a reshard, clones,
+// metadata) don't make one. Caller must hold the lock
+func (kvs *KeyValStoreDatabase) recordChange(rec WalRecord) Change {
+	if rec.Sender == "" && rec.From == "" {
+		return nil
+	}
+
+	var change Change
+	switch rec.Op {
+	case WalOpPut:
+		change = append(change, WatchEvent{Type: "put", Key: rec.Key, Value: rec.Entry.ClientValue(), Version: rec.Entry.Version})
+	case WalOpDelete:
+		change = append(change, WatchEvent{Type: "delete", Key: rec.Key, Version: rec.Version})
+	case WalOpBatch:
+		for _, write := range rec.Writes {
+			if write.Entry != nil {
+				change = append(change, WatchEvent{Type: "put", Key: write.Key, Value: write.Entry.ClientValue(), Version: write.Entry.Version})
+			} else {
+				change = append(change, WatchEvent{Type: "delete", Key: write.Key, Version: write.Version})
+			}
+		}
+	case WalOpCatchUp:
+		change = append(change, WatchEvent{Type: "catch-up"})
+	}
+
+	metadata := kvs.copyMetadata()
+	for i := range change {
+		change[i].Metadata = metadata
+		change[i].Sender = rec.Sender
+		if rec.Sender == "" {
+			change[i].Sender = rec.From
+			change[i].Repair = rec.Op != WalOpCatchUp
+		}
+	}
+	return change
+}
+
+/// --- streams ---
+
+// Returns a function matching key exactly if it isn't empty, or every key
+// starting with prefix otherwise
+func watchMatcher(key, prefix string) func(string) bool {
+	if key != "" {
+		return func(k string) bool { return k == key }
+	}
+	return func(k string) bool { return strings.HasPrefix(k, prefix) }
+}
+
+// Returns the nodes of a shard, whose clocks count the changes made on it
+func shardSenders(shardId int) map[string]struct{} {
+	senders := make(map[string]struct{})
+	for node := range ring.Shards[shardId].Replicas {
+		senders[node] = struct{}{}
+	}
+	return senders
+}
+
+// Watches a shard: locally if it's ours, or by streaming /rep/watch from
+// one of its replicas if not. The channel closes when the stream ends
+func watchShard(ctx context.Context, shardId int, key, prefix string, cursor map[string]int) (<-chan Change, error) {
+	if shardId == localShardId {
+		w, err := kvsDb.Watch(cursor, watchMatcher(key, prefix), shardSenders(shardId))
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			kvsDb.Unwatch(w)
+		}()
+		return w.ch, nil
+	}
+
+	params := url.Values{}
+	params.Set("key", key)
+	params.Set("prefix", prefix)
+	if cursor != nil {
+		params.Set("cursor", encodeWatchCursor(cursor))
+	}
+
+	// streams stay open, so no timeout, and a replica that can't be reached
+	// isn't taken out of the view either. A replica that restarted no longer
+	// has the changes a cursor needs, but another one might
+	var res *http.Response
+	err := errors.New("no replica of shard " + strconv.Itoa(shardId) + " can be watched")
+	for node := range removeLocalAddressFromMap(ring.Shards[shardId].Replicas) {
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+node+"/rep/watch?"+params.Encode(), nil)
+		if reqErr != nil {
+			return nil, reqErr
+		}
+		nodeRes, nodeErr := http.DefaultClient.Do(req)
+		if nodeErr != nil {
+			continue
+		}
+		if nodeRes.StatusCode == http.StatusOK {
+			res = nodeRes
+			break
+		}
+		if nodeRes.StatusCode == http.StatusGone {
+			err = ErrCursorTooOld
+		}
+		nodeRes.Body.Close()
+	}
+	if res == nil {
+		return nil, err
+	}
+
+	changes := make(chan Change)
+	go func() {
+		defer close(changes)
+		defer res.Body.Close()
+
+		// every data line is one change
+		scanner := bufio.NewScanner(res.Body)
+		scanner.Buffer(make([]byte, 64*1024), int(2*limits.MaxBodySize))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var change Change
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &change) != nil || len(change) == 0 {
+				return
+			}
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// Writes the changes of every source to the client as one stream of
+// server-sent events, starting with an open event once every source has
+// opened. Each event's id is the cursor just past it; the events of a batch
+// share one, on the last of them, so a batch is never resumed from halfway.
+// The stream ends when the client leaves or any source ends, since the
+// changes it would be missing can only be replayed from the cursor
+func streamChanges(ctx context.Context, c *gin.Context, sources []<-chan Change, cursor map[string]int) {
+	position := make(map[string]int)
+	mergeMetadata(position, cursor)
+	for _, source := range sources {
+		select {
+		case change, ok := <-source:
+			if !ok {
+				return
+			}
+			mergeMetadata(position, change[0].Metadata)
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	merged := make(chan Change)
+	ended := make(chan struct{}, len(sources))
+	for _, source := range sources {
+		go func(source <-chan Change) {
+			defer func() { ended <- struct{}{} }()
+			for change := range source {
+				select {
+				case merged <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(source)
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	writeEvent(c, encodeWatchCursor(position), "open", WatchEvent{Type: "open", Metadata: position})
+
+	heartbeat := time.NewTicker(WATCH_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change := <-merged:
+			// a replica resumed from an older cursor can repeat changes
+			if !change.after(position) {
+				continue
+			}
+			change.advance(position)
+			for i, event := range change {
+				id := ""
+				if i == len(change)-1 {
+					id = encodeWatchCursor(position)
+				}
+				writeEvent(c, id, event.Type, event)
+			}
+		case <-heartbeat.C:
+			// keeps idle connections from being closed along the way
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		case <-ended:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Writes one server-sent event
+func writeEvent(c *gin.Context, id string, eventType string, data interface{}) {
+	jsonData, _ := json.Marshal(data)
+	if id != "" {
+		fmt.Fprintf(c.Writer, "id: %s\n", id)
+	}
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", eventType, jsonData)
+	c.Writer.Flush()
+}
+
+// Cursors are the clock of every sender up to its last change, opaque to the client
+func encodeWatchCursor(cursor map[string]int) string {
+	jsonData, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(jsonData)
+}
+
+func decodeWatchCursor(encoded string) (map[string]int, error) {
+	jsonData, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidWatchCursor
+	}
+	cursor := make(map[string]int)
+	if json.Unmarshal(jsonData, &cursor) != nil {
+		return nil, ErrInvalidWatchCursor
+	}
+	return cursor, nil
+}
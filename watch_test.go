@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Returns the key of every event in the changes waiting on w
+func drainWatcher(w *watcher) []string {
+	keys := make([]string, 0)
+	for {
+		select {
+		case change, ok := <-w.ch:
+			if !ok {
+				return keys
+			}
+			for _, event := range change {
+				keys = append(keys, event.Type+" "+event.Key)
+			}
+		default:
+			return keys
+		}
+	}
+}
+
+// A watcher that resumes from its cursor gets every matching change it
+// missed, and none it already had
+func TestWatchResumesFromCursor(t *testing.T) {
+	txnTestShard(t)
+	senders := map[string]struct{}{"n0": {}}
+	match := watchMatcher("", "user:")
+	put := func(key string) {
+		if _, _, _, err := kvsDb.PutData(key, KeyEntry{Value: key}, WriteCondition{}, nil, "n0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := kvsDb.Watch(nil, match, senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := <-w.ch
+	cursor := opened[0].Metadata
+	put("user:1")
+	put("other")
+	first := <-w.ch
+	if first[0].Key != "user:1" {
+		t.Fatalf("got %v, want the put of user:1", first)
+	}
+	first.advance(cursor)
+	kvsDb.Unwatch(w)
+
+	// missed while disconnected
+	put("user:2")
+	_, err = kvsDb.DeleteData("user:1", WriteCondition{}, 0, nil, "n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("other")
+
+	// clients only see the encoded cursor
+	decoded, err := decodeWatchCursor(encodeWatchCursor(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := kvsDb.Watch(decoded, match, senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kvsDb.Unwatch(resumed)
+	put("user:3")
+
+	want := []string{"open ", "put user:2", "delete user:1", "put user:3"}
+	if got := drainWatcher(resumed); !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed watcher got %v, want %v", got, want)
+	}
+}
+
+// A cursor from before the changes the node still holds can't be resumed
+// from, since some in between are gone
+func TestWatchCursorTooOld(t *testing.T) {
+	txnTestShard(t)
+	senders := map[string]struct{}{"n0": {}}
+	cursor := kvsDb.CurrentMetadata()
+	for _, key := range []string{"a", "b"} {
+		if _, _, _, err := kvsDb.PutData(key, KeyEntry{Value: key}, WriteCondition{}, nil, "n0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// what a restart does to the changes kept in memory
+	kvsDb.feed.reset(kvsDb.CurrentMetadata())
+	if _, err := kvsDb.Watch(cursor, watchMatcher("", ""), senders); err != ErrCursorTooOld {
+		t.Errorf("got %v resuming from before the restart, want %v", err, ErrCursorTooOld)
+	}
+	current := kvsDb.CurrentMetadata()
+	w, err := kvsDb.Watch(current, watchMatcher("", ""), senders)
+	if err != nil {
+		t.Fatalf("got %v resuming from the current clock", err)
+	}
+	kvsDb.Unwatch(w)
+}